@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+const (
+	// DRAIN stops jobd starting new runs
+	DRAIN = "drain"
+
+	// UNDRAIN lets jobd start new runs again
+	UNDRAIN = "undrain"
+
+	// RELOAD reloads the notification routes and Slack template
+	RELOAD = "reload"
+
+	// CHOWN gives a job to another user
+	CHOWN = "chown"
+)
+
+// admins are the users, besides jobd's own, allowed to manage every job and
+// jobd itself
+var admins = namesFlag{}
+
+// namesFlag is a set of names given with a flag as a comma separated list.
+type namesFlag map[string]bool
+
+func (a namesFlag) String() string {
+	names := []string{}
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (a namesFlag) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			a[name] = true
+		}
+	}
+	return nil
+}
+
+// adminctl is the ctl file at the root of the jobd name space through which
+// admins manage jobd and any job.
+type adminctl struct {
+	srv.File
+	user p.User
+}
+
+// mkAdminCtlFile creates the root ctl file. Anyone may read it but only admins
+// may write to it.
+func mkAdminCtlFile(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkAdminCtlFile(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkAdminCtlFile(%v, %v)", dir, user)
+
+	ac := &adminctl{user: user}
+	if err := ac.Add(dir, "ctl", user, nil, 0666, ac); err != nil {
+		glog.Errorln("Can't create ctl file: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// isAdmin reports whether user is jobd's user or one of the admins.
+func (ac *adminctl) isAdmin(user p.User) bool {
+	return user != nil && (user.Name() == ac.user.Name() || admins[user.Name()])
+}
+
+// Read returns the admins, whether jobd is draining, the protected jobs, what
+// the last garbage collection and check of the store found and the reader's
+// pending confirmation token.
+func (ac *adminctl) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	cont := []byte(fmt.Sprintf("admins: %s\ndraining: %v\nprotected: %s\ngc: %s\nfsck: %s\nconfirm: %s\n", admins, isDraining(), strings.Join(protectedJobs(), ","), lastGC(), lastCheck(), pendingConfirmation(fid.Fid.User.Name(), time.Now())))
+	if offset > uint64(len(cont)) {
+		return 0, nil
+	}
+	return copy(buf, cont[offset:]), nil
+}
+
+// Write carries out an admin command: drain, undrain, reload, gc, fsck, compact,
+// stop <job>, start <job>, protect <job>, unprotect <job>, undelete <job>,
+// chown <job> <user> or maintenance from=<time> to=<time> reason=<reason>. Destructive commands are carried out only when written a
+// second time followed by the confirmation token the first write issued.
+func (ac *adminctl) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	glog.V(4).Infof("Entering adminctl.Write(%v, %v, %v)", fid, data, offset)
+	defer glog.V(4).Infof("Exiting adminctl.Write(%v, %v, %v)", fid, data, offset)
+
+	ac.Lock()
+	defer ac.Unlock()
+
+	user := fid.Fid.User
+	if !ac.isAdmin(user) {
+		return 0, srv.Eperm
+	}
+
+	cmd, args, err := parseCtl(string(data))
+	if err != nil {
+		return 0, err
+	}
+	if destructive[cmd] {
+		if args, err = confirmed(user.Name(), cmd, args, time.Now()); err != nil {
+			return 0, err
+		}
+	}
+	line := strings.Join(append([]string{cmd}, args...), " ")
+
+	glog.Infof("%s: %s", user.Name(), line)
+
+	switch cmd {
+	case DRAIN, UNDRAIN:
+		if err := configurable["drain"].set(fmt.Sprint(cmd == DRAIN)); err != nil {
+			return 0, err
+		}
+	case RELOAD:
+		if err := reload(); err != nil {
+			return 0, err
+		}
+	case FSCK:
+		if err := checkStore(); err != nil {
+			return 0, err
+		}
+	case COMPACT:
+		if _, err := compact(); err != nil {
+			return 0, err
+		}
+	case GC:
+		if _, _, err := gc(time.Now()); err != nil {
+			return 0, err
+		}
+	case STOP, START:
+		if len(args) != 1 {
+			return 0, invalid("command", "expected %s <job>", cmd)
+		}
+		j, ok := jobsroot.lookup(args[0])
+		if !ok {
+			return 0, invalid("job", "no such job: %s", args[0])
+		}
+		j.slk.Lock()
+		if cmd == STOP {
+			if j.defn.state != STOPPED {
+				j.stop()
+				notify(j.event(JOBSTOPPED, "stopped by %s", user.Name()))
+			}
+			j.interrupt()
+			j.reap()
+		} else if j.defn.state != STARTED {
+			j.start()
+			notify(j.event(JOBSTARTED, "started by %s", user.Name()))
+		}
+		j.slk.Unlock()
+	case PROTECT, UNPROTECT:
+		if len(args) != 1 {
+			return 0, invalid("command", "expected %s <job>", cmd)
+		}
+		j, ok := jobsroot.lookup(args[0])
+		if !ok {
+			return 0, invalid("job", "no such job: %s", args[0])
+		}
+		if err := j.protect(cmd == PROTECT); err != nil {
+			return 0, err
+		}
+		j.record(fmt.Sprintf("%sed by %s\n", cmd, user.Name()))
+	case MAINTENANCE:
+		w, err := maintenanceArgs(args, user.Name())
+		if err != nil {
+			return 0, err
+		}
+		if err := w.plan(time.Now()); err != nil {
+			return 0, err
+		}
+	case TRASH:
+		if len(args) != 1 {
+			return 0, invalid("command", "expected delete <job>")
+		}
+		if err := deleteJob(args[0], user.Name()); err != nil {
+			return 0, err
+		}
+	case UNDELETE:
+		if len(args) != 1 {
+			return 0, invalid("command", "expected undelete <job>")
+		}
+		if err := undelete(args[0], user.Name()); err != nil {
+			return 0, err
+		}
+	case EMPTY:
+		if len(args) != 0 {
+			return 0, invalid("command", "expected empty")
+		}
+		if err := emptyTrash(time.Now()); err != nil {
+			return 0, err
+		}
+	case CHOWN:
+		if len(args) != 2 {
+			return 0, invalid("command", "expected chown <job> <user>")
+		}
+		j, ok := jobsroot.lookup(args[0])
+		if !ok {
+			return 0, invalid("job", "no such job: %s", args[0])
+		}
+		owner := p.OsUsers.Uname2User(args[1])
+		if owner == nil {
+			return 0, invalid("user", "no such user: %s", args[1])
+		}
+		if err := saveOwner(j.defn.name, owner); err != nil {
+			return 0, err
+		}
+		j.chown(owner)
+	default:
+		return 0, invalid("command", "unknown: %s", cmd)
+	}
+
+	audit(auditentry{Author: user.Name(), Action: line})
+	return len(data), nil
+}
+
+// chown gives the job and all its files to user.
+func (j *job) chown(user p.User) {
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	j.user = user
+	own(&j.File, user)
+	for _, name := range []string{"ctl", "schedule", "cmd", "log", "stats", "errors", "settings", "history", "records", "offsets", "runs", "test", "simulate", "diff", "origin", "id"} {
+		own(j.Find(name), user)
+	}
+	for name := range tunables {
+		own(j.Find(name), user)
+	}
+	if attach := j.Find("attach"); attach != nil {
+		own(attach, user)
+		own(attach.Find("in"), user)
+		own(attach.Find("out"), user)
+	}
+	for _, r := range j.runs {
+		if r.dir == nil {
+			continue
+		}
+		own(r.dir, user)
+		for _, name := range []string{"status", "cmd", "stdout", "sums", "ps", "steps", "items"} {
+			own(r.dir.Find(name), user)
+		}
+		for _, name := range []string{"steps", "items"} {
+			if dir := r.dir.Find(name); dir != nil {
+				for _, res := range r.steps {
+					own(dir.Find(strconv.Itoa(res.n)), user)
+				}
+			}
+		}
+	}
+}
+
+// own makes user the owner of f, if there is such a file.
+func own(f *srv.File, user p.User) {
+	if f == nil {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+
+	f.Uid, f.Uidnum = user.Name(), uint32(user.Id())
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// confirm writes a destructive command to the root ctl file and, once that's
+// refused with a confirmation token, writes it again with the token, returning
+// the error the confirmed command fails with.
+func (h *harness) confirm(cmd string) error {
+	h.tb.Helper()
+
+	err := h.try("/ctl", cmd)
+	if err == nil || !strings.Contains(err.Error(), CONFIRM) {
+		h.tb.Fatalf("%s: got %v, want a confirmation token", cmd, err)
+	}
+	msg := err.Error()
+	return h.try("/ctl", cmd+" "+msg[strings.LastIndex(msg, CONFIRM):])
+}
+
+// TestAdminConfirm checks that a destructive root ctl command runs only once
+// written again with the token it was refused with, which then can't be used
+// again.
+func TestAdminConfirm(t *testing.T) {
+	h := mkharness(t)
+
+	err := h.try("/ctl", GC)
+	if err == nil || !strings.Contains(err.Error(), CONFIRM) {
+		t.Fatalf("got %v, want a confirmation token", err)
+	}
+	msg := err.Error()
+	token := msg[strings.LastIndex(msg, CONFIRM):]
+	if !strings.Contains(h.read("/ctl"), token) {
+		t.Errorf("the root ctl file doesn't show the pending token %s", token)
+	}
+
+	if err := h.try("/ctl", GC+" "+CONFIRM+"bogus"); err == nil {
+		t.Error("gc ran with a bogus token")
+	}
+	if err := h.confirm(GC); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.try("/ctl", GC+" "+token); err == nil {
+		t.Error("gc ran with a token that was already replaced")
+	}
+}
+
+// TestAdminDelete checks that an admin deletes a job through the root ctl file
+// once the deletion is confirmed, unless the job is protected.
+func TestAdminDelete(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "doomed:0 0 0 1 1 ? *:true")
+
+	h.write("/ctl", PROTECT+" doomed")
+	if err := h.confirm(TRASH + " doomed"); err == nil || !strings.Contains(err.Error(), "protected") {
+		t.Fatalf("deleting a protected job: got %v, want it refused", err)
+	}
+
+	if err := h.confirm(UNPROTECT + " doomed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.confirm(TRASH + " doomed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := jobsroot.lookup("doomed"); ok {
+		t.Error("the job is still there once its deletion was confirmed")
+	}
+}
+
+// TestAdminEmpty checks that emptying the trash through the root ctl file
+// removes the jobs deleted moments ago.
+func TestAdminEmpty(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "doomed:0 0 0 1 1 ? *:true")
+	if err := h.confirm(TRASH + " doomed"); err != nil {
+		t.Fatal(err)
+	}
+	if h.read("/trash/doomed") == "" {
+		t.Fatal("the deleted job isn't in the trash")
+	}
+
+	if err := h.confirm(EMPTY); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.c.FOpen("/trash/doomed", 0); err == nil {
+		t.Error("the deleted job is still in the trash once it was emptied")
+	}
+}
+
+// TestAdminStop checks that an admin stops a job through the root ctl file
+// without confirming it, as its owner does through the job's ctl file.
+func TestAdminStop(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "running:0 0 0 1 1 ? *:true")
+	h.write("/jobs/running/ctl", START)
+
+	if err := h.try("/ctl", STOP+" running"); err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := jobsroot.lookup("running"); j.defn.state != STOPPED {
+		t.Errorf("got state %s, want %s", j.defn.state, STOPPED)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+const (
+	// PAGERDUTY the channel that opens and resolves PagerDuty incidents
+	PAGERDUTY = "pagerduty"
+
+	// OPSGENIE the channel that opens and closes Opsgenie alerts
+	OPSGENIE = "opsgenie"
+
+	// ALERTOPENED the kind of event emitted when a job's alert is opened
+	ALERTOPENED = "alert.opened"
+
+	// ALERTRESOLVED the kind of event emitted when a job's alert is resolved
+	ALERTRESOLVED = "alert.resolved"
+
+	// WATCHINTERVAL is how often the scheduler ticks, checking jobs for
+	// staleness
+	WATCHINTERVAL = 10 * time.Second
+)
+
+// pagerdutyURL is the PagerDuty Events API v2 endpoint
+var pagerdutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// opsgenieURL is the Opsgenie Alert API endpoint
+var opsgenieURL = "https://api.opsgenie.com/v2/alerts"
+
+// alert tracks whether a job is in trouble: too many consecutive failures or
+// no successful run for too long.
+type alert struct {
+	sync.Mutex
+	failures int
+	failing  time.Time
+	open     bool
+	reason   string
+	since    time.Time
+	lastok   time.Time
+}
+
+// observe accounts for a finished run of the job, opening its alert once it has
+// failed alertafter times in a row and resolving it when a run succeeds. Runs
+// failing during maintenance aren't counted.
+func (j *job) observe(ok bool) {
+	a := &j.alert
+	a.Lock()
+	defer a.Unlock()
+
+	if !ok && underMaintenance(time.Now()) {
+		return
+	}
+	if ok {
+		a.failures = 0
+		a.lastok = time.Now()
+		if a.open {
+			j.resolve(a)
+		}
+		return
+	}
+
+	a.failures++
+	if a.failures == 1 {
+		a.failing = time.Now()
+	}
+	if threshold := j.count("alertafter", 0); threshold > 0 && a.failures >= threshold && !a.open {
+		j.open(a, fmt.Sprintf("%d consecutive failures", a.failures))
+	}
+}
+
+// rearm restarts the job's stale window, so time spent stopped doesn't count.
+func (j *job) rearm() {
+	j.alert.Lock()
+	j.alert.lastok = time.Time{}
+	j.alert.Unlock()
+}
+
+// checkStale opens the job's alert if it's started and hasn't run successfully
+// for longer than its stale window. Maintenance restarts the window.
+func (j *job) checkStale(now time.Time) {
+	window := j.duration("stale")
+	if window == 0 || j.defn.state != STARTED {
+		return
+	}
+
+	a := &j.alert
+	a.Lock()
+	defer a.Unlock()
+
+	if a.lastok.IsZero() || underMaintenance(now) {
+		a.lastok = now
+	}
+	if !a.open && now.Sub(a.lastok) > window {
+		j.open(a, fmt.Sprintf("no successful run for %v", now.Sub(a.lastok).Truncate(time.Second)))
+	}
+}
+
+// open opens the job's alert. The caller must hold the alert's lock.
+func (j *job) open(a *alert, reason string) {
+	glog.Warningf("Opening alert for %s: %s", j.defn.name, reason)
+	a.open, a.reason, a.since = true, reason, time.Now()
+	notify(j.event(ALERTOPENED, "%s", reason))
+}
+
+// resolve resolves the job's alert. The caller must hold the alert's lock.
+func (j *job) resolve(a *alert) {
+	glog.Infof("Resolving alert for %s", j.defn.name)
+	a.open, a.reason, a.since = false, "", time.Now()
+	notify(j.event(ALERTRESOLVED, "resolved"))
+}
+
+// watch is the scheduler's tick. It periodically checks every job for
+// staleness and forgets its orphans that exited, releases the notifications held
+// back by quiet hours that have ended and produces digests when they're due,
+// then records a heartbeat.
+func watch() {
+	beat(time.Now())
+	for now := range time.Tick(WATCHINTERVAL) {
+		for _, j := range jobsroot.list() {
+			j.checkStale(now)
+			j.tidy()
+		}
+		release(now)
+		shedQueued(now)
+		digestDue(now)
+		beat(time.Now())
+	}
+}
+
+// mkProblemsFile creates the read only file at the root of the jobd name space
+// that lists the jobs whose last run failed or whose alert is open.
+func mkProblemsFile(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkProblemsFile(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkProblemsFile(%v, %v)", dir, user)
+
+	pf := &jobfile{
+		// problems reader returns a line for each job in trouble.
+		reader: cached(func() []byte {
+			var out bytes.Buffer
+			for _, j := range jobsroot.list() {
+				out.WriteString(j.problems())
+			}
+			return out.Bytes()
+		}),
+		// problems is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := pf.Add(dir, "problems", user, nil, 0444, pf); err != nil {
+		glog.Errorln("Can't create problems file: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// problems describes, one per line, whether the job is failing and whether its
+// alert is open, along with when that started and why.
+func (j *job) problems() string {
+	a := &j.alert
+	a.Lock()
+	defer a.Unlock()
+
+	result := ""
+	if a.failures > 0 {
+		result += fmt.Sprintf("%s failing since %s: %d consecutive failures\n", j.defn.name, j.stamp(a.failing), a.failures)
+	}
+	if a.open {
+		result += fmt.Sprintf("%s alerting since %s: %s\n", j.defn.name, j.stamp(a.since), a.reason)
+	}
+	return result
+}
+
+// alerting reports whether an event opens or resolves an alert.
+func alerting(ev event) bool {
+	return ev.Kind == ALERTOPENED || ev.Kind == ALERTRESOLVED
+}
+
+// pagerduty triggers or resolves the job's PagerDuty incident, deduplicated by
+// the job's name, using the given integration routing key.
+func pagerduty(key string, ev event) error {
+	if !alerting(ev) {
+		return nil
+	}
+
+	action := "trigger"
+	if ev.Kind == ALERTRESOLVED {
+		action = "resolve"
+	}
+
+	// PagerDuty's severities include jobd's.
+	severity := ev.Severity
+	if severity == "" {
+		severity = "error"
+	}
+
+	return postJSON(pagerdutyURL, map[string]interface{}{
+		"routing_key":  key,
+		"event_action": action,
+		"dedup_key":    "jobd-" + ev.Job,
+		"payload": map[string]interface{}{
+			"summary":        fmt.Sprintf("jobd job %s: %s", ev.Job, ev.Message),
+			"source":         "jobd",
+			"severity":       severity,
+			"custom_details": ev.Labels,
+		},
+	})
+}
+
+// opsgenie creates or closes the job's Opsgenie alert, identified by an alias
+// derived from the job's name, using the given API key.
+func opsgenie(key string, ev event) error {
+	if !alerting(ev) {
+		return nil
+	}
+
+	alias := "jobd-" + ev.Job
+	url, body := opsgenieURL, map[string]interface{}{
+		"message":     fmt.Sprintf("jobd job %s: %s", ev.Job, ev.Message),
+		"alias":       alias,
+		"source":      "jobd",
+		"priority":    map[string]string{"critical": "P1", "warning": "P3", "info": "P5"}[ev.Severity],
+		"details":     ev.Labels,
+		"description": ev.Message,
+	}
+	if ev.Kind == ALERTRESOLVED {
+		url = fmt.Sprintf("%s/%s/close?identifierType=alias", opsgenieURL, alias)
+		body = map[string]interface{}{"source": "jobd", "note": ev.Message}
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "GenieKey "+key)
+
+	resp, err := notifier.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
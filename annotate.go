@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// ANNOTATE the ctl file command string to add a note to one of the job's
+	// kept runs
+	ANNOTATE = "annotate"
+
+	// MAXANNOTATION is the longest note a run may be annotated with, in bytes
+	MAXANNOTATION = 512
+)
+
+// annotate adds the note given by the arguments of an annotate command, the
+// number of one of the job's kept runs followed by the note, to that run. The
+// note is kept in the run's record and goes with the run into the job's daily
+// summaries.
+func (j *job) annotate(args []string) error {
+	if len(args) < 2 {
+		return invalid("command", "expected annotate <run> <note>")
+	}
+	r, err := j.lookupRun(args[0])
+	if err != nil {
+		return err
+	}
+	note := strings.TrimSpace(strings.Join(args[1:], " "))
+	if note == "" {
+		return invalid("note", "empty")
+	}
+	if len(note) > MAXANNOTATION {
+		return invalid("note", "%d bytes, longer than the limit of %d", len(note), MAXANNOTATION)
+	}
+
+	stamp := j.stamp(time.Now())
+	r.Lock()
+	r.annotations = append(r.annotations, fmt.Sprintf("%s %s", stamp, note))
+	annotations := append([]string{}, r.annotations...)
+	r.Unlock()
+
+	// A run still in progress is recorded with its annotations once it
+	// finishes, the record of one that's finished is rewritten with them.
+	err = j.records.amend(j.recordsPath(), r.id, func(rec *runrecord) { rec.Annotations = annotations })
+	if err != nil {
+		glog.Errorf("Can't record the annotations of %s run %d [%v]", j.defn.name, r.id, err)
+	}
+
+	j.record(fmt.Sprintf("run %d annotated: %s\n", r.id, note))
+	return nil
+}
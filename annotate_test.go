@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestAnnotate checks that a note written for a run shows in its status file
+// and the job's log, and that runs that aren't kept can't be annotated.
+func TestAnnotate(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "noted:0 0 0 1 1 ? *:true")
+	h.write("/jobs/noted/ctl", RUN)
+	h.eventually("the run to be logged", func() bool { return strings.Contains(h.read("/jobs/noted/log"), "fake run of true") })
+
+	h.write("/jobs/noted/ctl", ANNOTATE+` 1 "reran after a network blip"`)
+	if status := h.read("/jobs/noted/runs/1/status"); !strings.Contains(status, "annotation: ") || !strings.Contains(status, "reran after a network blip") {
+		t.Errorf("the run's status doesn't hold the note:\n%s", status)
+	}
+	if log := h.read("/jobs/noted/log"); !strings.Contains(log, "run 1 annotated: reran after a network blip") {
+		t.Errorf("the job's log doesn't hold the note:\n%s", log)
+	}
+
+	if err := h.try("/jobs/noted/ctl", ANNOTATE+" 2 note"); err == nil {
+		t.Error("a run that isn't kept was annotated")
+	}
+}
+
+// TestAnnotationsRecorded checks that annotating a finished run rewrites its
+// record with the note, leaving the records after it where the offsets file
+// says they are.
+func TestAnnotationsRecorded(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "noted:0 0 0 1 1 ? *:true")
+	for i := 1; i <= 2; i++ {
+		h.write("/jobs/noted/ctl", RUN)
+		h.eventually(fmt.Sprintf("run %d to be recorded", i), func() bool {
+			return strings.Count(h.read("/jobs/noted/records"), "\n") == i
+		})
+	}
+
+	h.write("/jobs/noted/ctl", ANNOTATE+` 1 "reran after a network blip"`)
+
+	records := h.read("/jobs/noted/records")
+	for _, line := range strings.Split(strings.TrimSpace(h.read("/jobs/noted/offsets")), "\n") {
+		var id, off, n int
+		if _, err := fmt.Sscan(line, &id, &off, &n); err != nil {
+			t.Fatal(err)
+		}
+		var rec runrecord
+		if err := json.Unmarshal([]byte(records[off:off+n]), &rec); err != nil {
+			t.Fatalf("run %d isn't where the offsets say: %v", id, err)
+		}
+		switch {
+		case rec.ID != id:
+			t.Errorf("got run %d where run %d should be", rec.ID, id)
+		case id == 1 && (len(rec.Annotations) != 1 || !strings.HasSuffix(rec.Annotations[0], "reran after a network blip")):
+			t.Errorf("got annotations %q for run 1, want the note", rec.Annotations)
+		case id == 2 && len(rec.Annotations) != 0:
+			t.Errorf("got annotations %q for run 2, want none", rec.Annotations)
+		}
+	}
+}
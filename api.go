@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+)
+
+const (
+	// CREATED the outcome of applying a job there was none of
+	CREATED = "created"
+
+	// CHANGED the outcome of applying a job that differed
+	CHANGED = "changed"
+
+	// UNCHANGED the outcome of applying a job that already matched
+	UNCHANGED = "unchanged"
+)
+
+// jobresource is a job as the HTTP API reads and writes it: its definition and
+// settings, its state, its owner and the version of all of these, which changes
+// whenever any of them does.
+type jobresource struct {
+	jobspec
+	State   string `json:"state,omitempty"`
+	Owner   string `json:"owner,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// apilk serializes the changes made through the HTTP API, so that each checks
+// the version it's given against the job it changes.
+var apilk sync.Mutex
+
+// jobsAPI routes the requests under /jobs/, running, reading, creating,
+// updating and deleting jobs, to their handlers behind the scope each needs.
+func jobsAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 3:
+		authorize(SCOPETRIGGER, trigger)(w, r)
+	case len(parts) > 3:
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		authorize(SCOPEREAD, readJobs)(w, r)
+	case len(parts) == 2 && r.Method == http.MethodPut:
+		authorize(SCOPEFULL, putJob)(w, r)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		authorize(SCOPEFULL, deleteJobAPI)(w, r)
+	default:
+		http.Error(w, "GET, PUT or DELETE a job", http.StatusMethodNotAllowed)
+	}
+}
+
+// resource returns the job as the HTTP API shows it.
+func (j *job) resource() jobresource {
+	j.slk.Lock()
+	state := j.defn.state
+	j.slk.Unlock()
+
+	settingslk.RLock()
+	res := jobresource{jobspec: jobspec{ID: j.defn.id, Name: j.defn.name, Schedule: j.defn.schedule, Cmd: j.defn.cmd}, State: state, Owner: j.user.Name()}
+	if len(j.defn.settings) > 0 {
+		res.Settings = make(map[string]string)
+		for name, value := range j.defn.settings {
+			res.Settings[name] = value
+		}
+	}
+	settingslk.RUnlock()
+
+	sum := sha256.Sum256([]byte(strings.Join(append(j.spec(), "state: "+state, "owner: "+res.Owner), "\n")))
+	res.Version = hex.EncodeToString(sum[:8])
+	return res
+}
+
+// readJobs returns every job, for /jobs/, or the one named, for /jobs/<job>,
+// along with its version as its ETag.
+func readJobs(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.Trim(r.URL.Path, "/"), "jobs")
+	if name = strings.TrimPrefix(name, "/"); name == "" {
+		all := []jobresource{}
+		for _, j := range jobsroot.list() {
+			all = append(all, j.resource())
+		}
+		reply(w, http.StatusOK, all)
+		return
+	}
+
+	j, ok := jobsroot.lookup(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	reply(w, http.StatusOK, j.resource())
+}
+
+// readJobByID returns the job whose ID is named in the request's path,
+// /ids/<id>, along with its version as its ETag.
+func readJobByID(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobsroot.lookupID(strings.TrimPrefix(r.URL.Path, "/ids/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	reply(w, http.StatusOK, j.resource())
+}
+
+// applied is the outcome of applying a job: created, changed, unchanged or
+// failed, with the reason, and the job's version after.
+type applied struct {
+	Name    string `json:"name"`
+	Outcome string `json:"outcome"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+	status  int
+}
+
+// putJob makes the job named in the request's path, /jobs/<job>, match the one
+// in its body, creating it if there's none, and returns it. Its schedule,
+// command and settings are replaced, and it's started or stopped if the body
+// gives a state. Nothing is done if it already matches. An If-Match header, if
+// given, must hold the job's current version, and an If-None-Match header of *
+// that there's no such job yet.
+func putJob(w http.ResponseWriter, r *http.Request) {
+	var want jobresource
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAXIMPORT)).Decode(&want); err != nil {
+		http.Error(w, invalid("job", "%v", err).Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if want.Name != "" && want.Name != name {
+		http.Error(w, invalid("name", "%s doesn't match the path's %s", want.Name, name).Error(), http.StatusBadRequest)
+		return
+	}
+	want.Name = name
+
+	apilk.Lock()
+	defer apilk.Unlock()
+
+	a := applyJob(want, requester(r), keyOwner(r), false, func(version string) error {
+		return preconditions(r, version)
+	})
+	if a.Outcome == FAILED {
+		http.Error(w, a.Error, a.status)
+		return
+	}
+	j, _ := jobsroot.lookup(a.Name)
+	reply(w, a.status, j.resource())
+}
+
+// applyJob makes the job named in want match it, creating it if there's none,
+// owned by owner, as putJob does. When check is set nothing is done, only the
+// outcome is worked out. guard, if not nil, is first given the job's version, empty if there's no
+// such job, and the job is left alone if it fails. The caller holds apilk.
+func applyJob(want jobresource, author string, owner p.User, check bool, guard func(version string) error) applied {
+	a := applied{Name: want.Name, Outcome: FAILED}
+	fail := func(status int, err error) applied {
+		a.Error, a.status = err.Error(), status
+		return a
+	}
+
+	if want.State != "" && want.State != STARTED && want.State != STOPPED {
+		return fail(http.StatusBadRequest, invalid("state", "expected %s or %s: %s", STARTED, STOPPED, want.State))
+	}
+	jd, warnings, err := validateDef(want.Name, want.Schedule, want.Cmd)
+	if err != nil {
+		return fail(http.StatusBadRequest, err)
+	}
+	a.Name = jd.name
+	for setting, value := range want.Settings {
+		if _, _, err := parseSetting(setting + "=" + value); err != nil {
+			return fail(http.StatusBadRequest, err)
+		}
+		jd.settings[setting] = value
+	}
+
+	j, ok := jobsroot.lookup(jd.name)
+	if !ok {
+		if guard != nil {
+			if err := guard(""); err != nil {
+				return fail(http.StatusPreconditionFailed, err)
+			}
+		}
+		if status, err := createJob(jd, want, warnings, author, owner, check); err != nil {
+			return fail(status, err)
+		}
+		a.Outcome, a.status = CREATED, http.StatusCreated
+		if !check {
+			j, _ = jobsroot.lookup(jd.name)
+			a.Version = j.resource().Version
+		}
+		return a
+	}
+
+	current := j.resource()
+	if guard != nil {
+		if err := guard(current.Version); err != nil {
+			return fail(http.StatusPreconditionFailed, err)
+		}
+	}
+	if want.ID != "" && want.ID != current.ID {
+		return fail(http.StatusConflict, fmt.Errorf("%s has ID %s, not %s", jd.name, current.ID, want.ID))
+	}
+
+	redefined := current.Schedule != jd.schedule || current.Cmd != jd.cmd
+	if redefined && j.isProtected() {
+		return fail(http.StatusConflict, fmt.Errorf("%s is protected, unprotect it first", jd.name))
+	}
+	respecified := redefined || !reflect.DeepEqual(current.Settings, nonEmpty(jd.settings))
+	restated := want.State != "" && want.State != current.State
+
+	a.Outcome, a.Version, a.status = UNCHANGED, current.Version, http.StatusOK
+	if !respecified && !restated {
+		return a
+	}
+	a.Outcome = CHANGED
+	if check {
+		return a
+	}
+
+	if respecified {
+		before := j.spec()
+		j.redefine(jd.schedule, jd.cmd, jd.settings)
+		j.changed(author, before)
+	}
+	if restated {
+		j.setState(want.State)
+	}
+	glog.V(3).Infof("Updated job over HTTP: %v (%s)", jd.name, author)
+	if err := saveJobs(); err != nil {
+		return fail(http.StatusInternalServerError, err)
+	}
+	if err := jobsroot.saveSettings(); err != nil {
+		return fail(http.StatusInternalServerError, err)
+	}
+	a.Version = j.resource().Version
+	return a
+}
+
+// createJob creates the job for applyJob, owned by owner, or jobd's user if
+// nil, with the ID asked for, if any, and the state, stopped unless started is
+// asked for. Jobs created count against the -clonerate of their owner, or of
+// the author when jobd's user owns them. When check is set it only checks that
+// it could. It returns the status to reply
+// with when it fails.
+func createJob(jd *jobdef, want jobresource, warnings []string, author string, owner p.User, check bool) (int, error) {
+	if n := len(jobsroot.list()); maxjobs > 0 && n >= maxjobs {
+		return http.StatusConflict, fmt.Errorf("jobd holds %d jobs, the limit is %d", n, maxjobs)
+	}
+	definer := author
+	if owner != nil {
+		definer = owner.Name()
+	}
+	if !mayDefine(definer, time.Now()) {
+		return http.StatusTooManyRequests, fmt.Errorf("%s defined %d jobs in the last minute, the limit is %d", definer, clonerate, clonerate)
+	}
+	if want.ID != "" {
+		if !uuid.MatchString(want.ID) {
+			return http.StatusBadRequest, invalid("id", "not a UUID: %s", want.ID)
+		}
+		if other, ok := jobsroot.lookupID(want.ID); ok {
+			return http.StatusConflict, fmt.Errorf("ID %s is already used by %s", want.ID, other.defn.name)
+		}
+		jd.id = want.ID
+	}
+	if check {
+		return http.StatusCreated, nil
+	}
+
+	glog.V(3).Infof("Creating job over HTTP: %v (%s)", jd.name, author)
+	if err := jobsroot.addJob(*jd, owner); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defined(definer, time.Now())
+	j, _ := jobsroot.lookup(jd.name)
+	for _, w := range warnings {
+		j.record(fmt.Sprintf("warning: %s\n", w))
+	}
+	j.record(fmt.Sprintf("created by %s\n", author))
+	if want.State == STARTED {
+		j.setState(STARTED)
+	}
+
+	if err := saveJobs(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := jobsroot.saveSettings(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusCreated, nil
+}
+
+// applyJobs makes each of the jobs in the request's body, a JSON array, match
+// it as putJob does, and returns the outcome for each, along with whether any
+// changed. Each job is applied on its own, one failing doesn't hold up the
+// others, and jobs that already match are left alone. Given check=true, nothing
+// is done and the outcomes are those applying the jobs would have.
+func applyJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST the jobs to apply", http.StatusMethodNotAllowed)
+		return
+	}
+	var wants []jobresource
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAXIMPORT)).Decode(&wants); err != nil {
+		http.Error(w, invalid("jobs", "%v", err).Error(), http.StatusBadRequest)
+		return
+	}
+	check := r.URL.Query().Get("check") == "true"
+
+	apilk.Lock()
+	defer apilk.Unlock()
+
+	result := struct {
+		Changed bool      `json:"changed"`
+		Failed  bool      `json:"failed"`
+		Jobs    []applied `json:"jobs"`
+	}{Jobs: []applied{}}
+	author, owner := requester(r), keyOwner(r)
+	seen := make(map[string]bool)
+	for _, want := range wants {
+		a := applied{Name: want.Name, Outcome: FAILED, Error: fmt.Sprintf("%s is given more than once", want.Name)}
+		if !seen[want.Name] {
+			a = applyJob(want, author, owner, check, nil)
+		}
+		seen[want.Name] = true
+		result.Changed = result.Changed || a.Outcome == CREATED || a.Outcome == CHANGED
+		result.Failed = result.Failed || a.Outcome == FAILED
+		result.Jobs = append(result.Jobs, a)
+	}
+	reply(w, http.StatusOK, result)
+}
+
+// deleteJobAPI deletes the job named in the request's path, /jobs/<job>,
+// moving it to the trash. Deleting a job that doesn't exist succeeds, so that
+// the request may be repeated. An If-Match header, if given, must hold the
+// job's current version.
+func deleteJobAPI(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/jobs/")
+
+	apilk.Lock()
+	defer apilk.Unlock()
+
+	j, ok := jobsroot.lookup(name)
+	if !ok {
+		if err := preconditions(r, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := preconditions(r, j.resource().Version); err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if j.isProtected() {
+		http.Error(w, fmt.Sprintf("%s is protected, unprotect it first", name), http.StatusConflict)
+		return
+	}
+
+	glog.V(3).Infof("Deleting job over HTTP: %v", name)
+	if err := deleteJob(name, requester(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setState starts or stops the job as writing to its ctl file does.
+func (j *job) setState(state string) {
+	j.slk.Lock()
+	defer j.slk.Unlock()
+
+	switch {
+	case state == STARTED && j.defn.state != STARTED:
+		j.start()
+		notify(j.event(JOBSTARTED, "started"))
+	case state == STOPPED && j.defn.state != STOPPED:
+		j.stop()
+		notify(j.event(JOBSTOPPED, "stopped"))
+		j.interrupt()
+		j.reap()
+	}
+}
+
+// preconditions checks the request's If-Match and If-None-Match headers against
+// the version of the job it names, empty if there's no such job.
+func preconditions(r *http.Request, version string) error {
+	if match := r.Header.Get("If-Match"); match != "" && (version == "" || !etagMatches(match, version)) {
+		if version == "" {
+			return fmt.Errorf("no such job")
+		}
+		return fmt.Errorf("version is %s", version)
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && version != "" && etagMatches(match, version) {
+		return fmt.Errorf("already exists at version %s", version)
+	}
+	return nil
+}
+
+// etagMatches reports whether the list of entity tags in an If-Match or
+// If-None-Match header holds the version, or is *.
+func etagMatches(header, version string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+		if tag == "*" || tag == version {
+			return true
+		}
+	}
+	return false
+}
+
+// nonEmpty returns the settings, or nil if there are none, as a job's resource
+// holds them.
+func nonEmpty(settings map[string]string) map[string]string {
+	if len(settings) == 0 {
+		return nil
+	}
+	return settings
+}
+
+// keyOwner returns the user the request's key is named after, who owns the
+// jobs it creates, or nil if there's no such user, leaving them to jobd's user.
+func keyOwner(r *http.Request) p.User {
+	if k := lookupKey(r); k != nil {
+		return p.OsUsers.Uname2User(k.name)
+	}
+	return nil
+}
+
+// requester names the author of a change made through the HTTP API after the
+// key that made it.
+func requester(r *http.Request) string {
+	if k := lookupKey(r); k != nil {
+		return "http:" + k.name
+	}
+	return "http"
+}
+
+// reply writes v as JSON with the given status and, for a single job, its
+// version as the ETag.
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	if res, ok := v.(jobresource); ok {
+		w.Header().Set("ETag", `"`+res.Version+`"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
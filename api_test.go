@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestPutJob checks that a job created over the HTTP API belongs to the user
+// its key is named after and counts against their -clonerate, and that If-Match
+// is checked only when given.
+func TestPutJob(t *testing.T) {
+	mkharness(t)
+	defer func(keys []*apikey, rate int) { apikeys, clonerate = keys, rate }(apikeys, clonerate)
+	apikeys, clonerate = []*apikey{{name: "deployer", scope: SCOPEFULL, secret: "d3ploy"}}, 1
+
+	put := func(name, body string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/jobs/"+name, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer d3ploy")
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		putJob(w, r)
+		return w
+	}
+
+	w := put("deployed", `{"schedule": "0 0 0 1 1 ? *", "cmd": "true"}`, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d creating a job: %s", w.Code, w.Body)
+	}
+	j, _ := jobsroot.lookup("deployed")
+	if owner := j.user.Name(); owner != "deployer" {
+		t.Errorf("got owner %s, want the key's deployer", owner)
+	}
+
+	if w := put("deployed", `{"schedule": "0 0 0 1 1 ? *", "cmd": "false"}`, nil); w.Code != http.StatusOK {
+		t.Errorf("got %d changing a job without If-Match, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if w := put("deployed", `{"schedule": "0 0 0 1 1 ? *", "cmd": "true"}`, http.Header{"If-Match": {`"stale"`}}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("got %d changing a job with a stale If-Match, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+
+	if w := put("another", `{"schedule": "0 0 0 1 1 ? *", "cmd": "true"}`, nil); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got %d creating a job beyond -clonerate, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if _, ok := jobsroot.lookup("another"); ok {
+		t.Error("a job was created beyond -clonerate")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// SCOPEREAD lets a key read jobd's state
+	SCOPEREAD = "read"
+
+	// SCOPETRIGGER lets a key run jobs, and read jobd's state
+	SCOPETRIGGER = "trigger"
+
+	// SCOPEFULL lets a key do anything the HTTP API allows
+	SCOPEFULL = "full"
+)
+
+// scopes ranks the scopes, each allowing everything those below it do
+var scopes = map[string]int{SCOPEREAD: 1, SCOPETRIGGER: 2, SCOPEFULL: 3}
+
+// apikey is a key that grants its holder a scope on the HTTP API, at no more
+// than its rate of requests.
+type apikey struct {
+	sync.Mutex
+	name   string
+	scope  string
+	secret string
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// apikeys are the keys loaded from the -apikeys file, the HTTP API is closed
+// when there are none
+var apikeys []*apikey
+
+// openreads opens the HTTP API to reads when there are no keys
+var openreads bool
+
+// loadAPIKeys reads API keys from the named file. Each line holds a key of the
+// form <name> <scope> <secret> [<requests per minute>]. Blank lines and lines
+// starting with # are ignored.
+func loadAPIKeys(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 && len(fields) != 4 {
+			return fmt.Errorf("%s line %d: expected <name> <scope> <secret> [<requests per minute>]", name, n)
+		}
+		if _, ok := scopes[fields[1]]; !ok {
+			return fmt.Errorf("%s line %d: scope not one of read, trigger or full: %s", name, n, fields[1])
+		}
+
+		k := &apikey{name: fields[0], scope: fields[1], secret: fields[2]}
+		if len(fields) == 4 {
+			rpm, err := strconv.Atoi(fields[3])
+			if err != nil || rpm <= 0 {
+				return fmt.Errorf("%s line %d: not a positive number of requests per minute: %s", name, n, fields[3])
+			}
+			k.rate, k.tokens = float64(rpm)/60, float64(rpm)
+		}
+		apikeys = append(apikeys, k)
+	}
+
+	return scanner.Err()
+}
+
+// lookupKey returns the key whose secret is given as the request's bearer
+// token, or, for WebSocket upgrades, which browsers can't add headers to, as its
+// access_token parameter, or nil if there's none.
+func lookupKey(r *http.Request) *apikey {
+	secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if secret == "" && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		secret = r.URL.Query().Get("access_token")
+	}
+	if secret == "" {
+		return nil
+	}
+	for _, k := range apikeys {
+		if subtle.ConstantTimeCompare([]byte(k.secret), []byte(secret)) == 1 {
+			return k
+		}
+	}
+	return nil
+}
+
+// allow reports whether the key may make another request now. Keys without a
+// rate may make as many as they like, the others may make up to a minute's
+// worth at once.
+func (k *apikey) allow(now time.Time) bool {
+	if k.rate == 0 {
+		return true
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	if !k.last.IsZero() {
+		k.tokens += now.Sub(k.last).Seconds() * k.rate
+		if k.tokens > k.rate*60 {
+			k.tokens = k.rate * 60
+		}
+	}
+	k.last = now
+
+	if k.tokens < 1 {
+		return false
+	}
+	k.tokens--
+	return true
+}
+
+// authorize wraps a handler so it's only called for requests bearing a key
+// with at least the given scope, within the key's rate. Without keys only read
+// requests are allowed, and only given -openreads.
+func authorize(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(apikeys) == 0 {
+			if scope != SCOPEREAD || !openreads {
+				http.Error(w, "no API keys, see -apikeys and -openreads", http.StatusForbidden)
+				return
+			}
+			h(w, r)
+			return
+		}
+
+		k := lookupKey(r)
+		if k == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or unknown API key", http.StatusUnauthorized)
+			return
+		}
+		if scopes[k.scope] < scopes[scope] {
+			http.Error(w, fmt.Sprintf("key %s lacks the %s scope", k.name, scope), http.StatusForbidden)
+			return
+		}
+		if !k.allow(time.Now()) {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, fmt.Sprintf("key %s is over its rate", k.name), http.StatusTooManyRequests)
+			return
+		}
+
+		glog.V(3).Infof("HTTP %s %s by key %s", r.Method, r.URL.Path, k.name)
+		h(w, r)
+	}
+}
+
+// trigger runs the job named in the request's path, /jobs/<name>/run, now.
+func trigger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST to run a job", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[2] != "run" {
+		http.NotFound(w, r)
+		return
+	}
+	j, ok := jobsroot.lookup(parts[1])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if isDraining() {
+		http.Error(w, "draining, no new runs", http.StatusServiceUnavailable)
+		return
+	}
+
+	inv, err := j.runArgs(nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inv.note = "manual run over HTTP"
+
+	glog.V(3).Infof("Running job: %v (%s)", j.defn.name, inv.note)
+	go j.exec(inv)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestAuthorize checks that a request goes through only with a key that has
+// the scope it needs, within the key's rate, that without keys only reads do
+// and only with -openreads, and that keys are taken from the access_token
+// parameter only when opening a WebSocket.
+func TestAuthorize(t *testing.T) {
+	defer func(keys []*apikey, open bool) { apikeys, openreads = keys, open }(apikeys, openreads)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	keys := []*apikey{
+		{name: "reader", scope: SCOPEREAD, secret: "r3ader"},
+		{name: "ci", scope: SCOPETRIGGER, secret: "c1", rate: 1.0 / 60, tokens: 1},
+	}
+	bearer := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+
+	tests := []struct {
+		name   string
+		keys   []*apikey
+		open   bool
+		scope  string
+		target string
+		header http.Header
+		want   int
+	}{
+		{"no keys, reading", nil, false, SCOPEREAD, "/runs", nil, http.StatusForbidden},
+		{"no keys, open reads", nil, true, SCOPEREAD, "/runs", nil, http.StatusOK},
+		{"no keys, triggering", nil, true, SCOPETRIGGER, "/runs", nil, http.StatusForbidden},
+		{"no key given", keys, true, SCOPEREAD, "/runs", nil, http.StatusUnauthorized},
+		{"unknown key", keys, false, SCOPEREAD, "/runs", bearer("wrong"), http.StatusUnauthorized},
+		{"key lacking the scope", keys, false, SCOPETRIGGER, "/runs", bearer("r3ader"), http.StatusForbidden},
+		{"key with the scope", keys, false, SCOPETRIGGER, "/runs", bearer("c1"), http.StatusOK},
+		{"key over its rate", keys, false, SCOPEREAD, "/runs", bearer("c1"), http.StatusTooManyRequests},
+		{"access_token", keys, false, SCOPEREAD, "/runs?access_token=r3ader", nil, http.StatusUnauthorized},
+		{"access_token upgrading", keys, false, SCOPEREAD, "/events/ws?access_token=r3ader", http.Header{"Upgrade": {"websocket"}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		apikeys, openreads = tt.keys, tt.open
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		for name, values := range tt.header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		authorize(tt.scope, ok)(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
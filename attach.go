@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// attachment connects the stdin and stdout of an interactive run to the files
+// in the job's attach directory.
+type attachment struct {
+	sync.Mutex
+	active bool
+	in     io.WriteCloser
+	out    bytes.Buffer
+}
+
+// mkAttachDir creates a job's attach directory containing the in file, whose
+// writes go to the attached run's stdin, and the out file, which returns
+// everything the attached run has written to stdout and stderr.
+func mkAttachDir(job *job, user p.User) error {
+	glog.V(4).Infof("Entering mkAttachDir(%v, %v)", job.defn.name, user)
+	defer glog.V(4).Infof("Exiting mkAttachDir(%v, %v)", job.defn.name, user)
+
+	dir := new(srv.File)
+	if err := dir.Add(&job.File, "attach", user, nil, p.DMDIR|0555, nil); err != nil {
+		glog.Errorf("Can't create %s/attach [%v]", job.defn.name, err)
+		return err
+	}
+
+	in := &jobfile{
+		// in is write only.
+		reader: func() []byte {
+			return []byte{}
+		},
+		// in writer passes its data to the attached run's stdin.
+		writer: func(data []byte) (int, error) {
+			return job.attached.write(data)
+		}}
+	if err := in.Add(dir, "in", user, nil, 0200, in); err != nil {
+		glog.Errorf("Can't create %s/attach/in [%v]", job.defn.name, err)
+		return err
+	}
+
+	out := &jobfile{
+		// out reader returns the output of the most recent attached run.
+		reader: func() []byte {
+			return job.attached.output()
+		},
+		// out is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := out.Add(dir, "out", user, nil, 0444, out); err != nil {
+		glog.Errorf("Can't create %s/attach/out [%v]", job.defn.name, err)
+		return err
+	}
+
+	return nil
+}
+
+// attach readies the attachment for a new run, discarding the output of the
+// previous one, and fails if a run is already attached.
+func (a *attachment) attach() error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.active {
+		return fmt.Errorf("a run is already attached")
+	}
+
+	a.active = true
+	a.in = nil
+	a.out.Reset()
+
+	return nil
+}
+
+// connect gives the attachment the stdin of the run that has been attached.
+func (a *attachment) connect(in io.WriteCloser) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.in = in
+}
+
+// detach closes the attached run's stdin.
+func (a *attachment) detach() error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.in == nil {
+		return fmt.Errorf("no run attached")
+	}
+
+	err := a.in.Close()
+	a.in = nil
+	return err
+}
+
+// done marks the attached run as finished.
+func (a *attachment) done() {
+	a.Lock()
+	defer a.Unlock()
+
+	a.active = false
+	a.in = nil
+}
+
+// write passes data to the attached run's stdin, outside the attachment's lock
+// so that a run that's slow to read doesn't hold up its output.
+func (a *attachment) write(data []byte) (int, error) {
+	a.Lock()
+	in := a.in
+	a.Unlock()
+
+	if in == nil {
+		return 0, fmt.Errorf("no run attached")
+	}
+	return in.Write(data)
+}
+
+// Write collects the output of the attached run.
+func (a *attachment) Write(data []byte) (int, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.out.Write(data)
+}
+
+// output returns the output of the attached run so far.
+func (a *attachment) output() []byte {
+	a.Lock()
+	defer a.Unlock()
+
+	return append([]byte{}, a.out.Bytes()...)
+}
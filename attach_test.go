@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestAttachment checks that a single run at a time is attached, that writes
+// reach its stdin and that its output is collected until the next run is.
+func TestAttachment(t *testing.T) {
+	a := new(attachment)
+	if err := a.attach(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.attach(); err == nil {
+		t.Error("a second run was attached while the first still is")
+	}
+
+	r, w := io.Pipe()
+	a.connect(w)
+	input := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		input <- line
+	}()
+	if _, err := a.write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-input; got != "hello\n" {
+		t.Errorf("got input %q, want %q", got, "hello\n")
+	}
+
+	a.Write([]byte("world\n"))
+	if err := a.detach(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.write([]byte("too late\n")); err == nil {
+		t.Error("a write went through once the run's stdin was closed")
+	}
+	a.done()
+	if got := string(a.output()); got != "world\n" {
+		t.Errorf("got output %q, want %q", got, "world\n")
+	}
+
+	if err := a.attach(); err != nil {
+		t.Fatalf("can't attach a run once the last one is done: %v", err)
+	}
+	if got := a.output(); len(got) != 0 {
+		t.Errorf("got output %q of the last run once another was attached", got)
+	}
+}
+
+// TestAttachmentWriteDoesNotBlockOutput checks that a write to an attached run
+// whose stdin isn't being read doesn't hold up its output.
+func TestAttachmentWriteDoesNotBlockOutput(t *testing.T) {
+	a := new(attachment)
+	if err := a.attach(); err != nil {
+		t.Fatal(err)
+	}
+	r, w := io.Pipe()
+	defer r.Close()
+	a.connect(w)
+
+	go a.write([]byte("input nobody reads\n"))
+	time.Sleep(10 * time.Millisecond)
+
+	written := make(chan struct{})
+	go func() {
+		a.Write([]byte("output\n"))
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("the run's output is held up by a blocked write to its stdin")
+	}
+	if got := string(a.output()); got != "output\n" {
+		t.Errorf("got output %q, want %q", got, "output\n")
+	}
+}
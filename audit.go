@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// AUDITSHOWN is the number of the most recent audit entries the audit file
+// returns
+const AUDITSHOWN = 256
+
+// JOBCHANGED the kind of event emitted when a job's definition or settings
+// change
+const JOBCHANGED = "job.changed"
+
+// auditlog is the path to the audit log
+var auditlog string
+
+// auditlk serializes appends to the audit log
+var auditlk sync.Mutex
+
+// auditentry records who changed what, a JSON object per line of the audit
+// log.
+type auditentry struct {
+	Time   time.Time `json:"time"`
+	Author string    `json:"author"`
+	Job    string    `json:"job,omitempty"`
+	Action string    `json:"action"`
+	Diff   string    `json:"diff,omitempty"`
+}
+
+// audit appends an entry to the audit log.
+func audit(entry auditentry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		glog.Errorf("Can't audit %v [%v]", entry, err)
+		return
+	}
+	line, err := sealLine(string(data))
+	if err != nil {
+		glog.Errorf("Can't audit %v [%v]", entry, err)
+		return
+	}
+
+	auditlk.Lock()
+	defer auditlk.Unlock()
+
+	f, err := os.OpenFile(auditlog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		glog.Errorf("Can't open audit log [%v]", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		glog.Errorf("Can't write audit log [%v]", err)
+	}
+}
+
+// mkAuditFile creates the read only file at the root of the jobd name space
+// that returns the most recent entries of the audit log.
+func mkAuditFile(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkAuditFile(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkAuditFile(%v, %v)", dir, user)
+
+	af := &jobfile{
+		// audit reader returns the most recent audit entries, oldest first.
+		reader: cached(func() []byte {
+			return recentAudit(AUDITSHOWN)
+		}),
+		// audit is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := af.Add(dir, "audit", user, nil, 0444, af); err != nil {
+		glog.Errorln("Can't create audit file: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// recentAudit renders up to the last n entries of the audit log, a line for each
+// followed by its diff, if it has one, indented.
+func recentAudit(n int) []byte {
+	auditlk.Lock()
+	lines := []string{}
+	err := scan(auditlog, func(_ int, text string) {
+		lines = append(lines, text)
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	})
+	auditlk.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return []byte(fmt.Sprintf("can't read audit log: %v\n", err))
+	}
+
+	var out bytes.Buffer
+	for _, line := range lines {
+		var entry auditentry
+		data, err := unsealLine(line)
+		if err == nil {
+			err = json.Unmarshal([]byte(data), &entry)
+		}
+		if err != nil {
+			fmt.Fprintf(&out, "invalid entry: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(&out, "%s %s %s", formatTime(entry.Time, timefmt), entry.Author, entry.Action)
+		if entry.Job != "" {
+			fmt.Fprintf(&out, " %s", entry.Job)
+		}
+		out.WriteString("\n")
+		for _, d := range strings.Split(strings.TrimSuffix(entry.Diff, "\n"), "\n") {
+			if d != "" {
+				fmt.Fprintf(&out, "    %s\n", d)
+			}
+		}
+	}
+	return out.Bytes()
+}
+
+// spec describes the job's schedule, command and settings a line each, for
+// comparing before and after a change.
+func (j *job) spec() []string {
+	settingslk.RLock()
+	defer settingslk.RUnlock()
+
+	lines := []string{"schedule: " + j.defn.schedule, "cmd: " + j.defn.cmd}
+	names := []string{}
+	for name := range j.defn.settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s=%s", name, j.defn.settings[name]))
+	}
+	return lines
+}
+
+// changed emits an event and an audit entry, by author, with the difference
+// between the job's spec before a change and after it, if there is one.
+func (j *job) changed(author string, before []string) {
+	diff := unified(before, j.spec(), "before", "after")
+	if diff == "" {
+		return
+	}
+
+	glog.Infof("%s changed %s:\n%s", author, j.defn.name, diff)
+	ev := j.event(JOBCHANGED, "changed by %s", author)
+	ev.Author, ev.Diff = author, diff
+	emit(ev)
+	audit(auditentry{Author: author, Job: j.defn.name, Action: JOBCHANGED, Diff: diff})
+}
+
+// author returns the name of the user whose write to one of the job's files is
+// being handled.
+func (j *job) author() string {
+	if j.writer == "" {
+		return "jobd"
+	}
+	return j.writer
+}
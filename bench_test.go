@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// BenchmarkCreateJob defines jobs through the clone file, as a client would.
+func BenchmarkCreateJob(b *testing.B) {
+	root, user := testStore(b)
+	k := root.Find("clone").Ops.(*clonefile)
+	fid := testFid(&k.File, user)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		def := fmt.Sprintf("bench%d:0 0 0 1 1 ? *:true", i)
+		if _, err := k.Write(fid, []byte(def), 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDispatch measures how long a job's scheduler takes to wake for its
+// slot, dispatch it and record its fake run, the test clock moved a minute at a
+// time, while jobd holds 1000 or 10000 started jobs.
+func BenchmarkDispatch(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("jobs=%d", n), func(b *testing.B) {
+			testStore(b)
+			clock := &testclock{now: time.Date(2026, time.January, 1, 0, 0, 30, 0, time.UTC)}
+			sched = clock
+			b.Cleanup(func() { sched = wallclock{} })
+			testJobs(b, "bench", n-1, true)
+			j := testJobs(b, "dispatched", 1, false)[0]
+			j.slk.Lock()
+			j.reschedule("0 * * * * ? *")
+			j.start()
+			j.slk.Unlock()
+			for clock.waiters() < n {
+				time.Sleep(time.Millisecond)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				clock.advance(time.Minute)
+				for clock.waiters() < n {
+					runtime.Gosched()
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadLog reads a job's 4MB log from start to end in the chunks an 8K
+// msize allows.
+func BenchmarkReadLog(b *testing.B) {
+	_, user := testStore(b)
+	j := testJobs(b, "bench", 1, false)[0]
+	entry := strings.Repeat("x", 128*1024-1) + "\n"
+	for i := 0; i < j.history.Len(); i++ {
+		j.record(entry)
+	}
+	log := j.Find("log").Ops.(*jobfile)
+	fid := testFid(&log.File, user)
+	buf := make([]byte, 8192)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var total int64
+		for {
+			n, err := log.Read(fid, buf, uint64(total))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if n == 0 {
+				break
+			}
+			total += int64(n)
+		}
+		b.SetBytes(total)
+	}
+}
+
+// BenchmarkReadRecord reads single run records, located through the offsets
+// file, out of a job's 10000.
+func BenchmarkReadRecord(b *testing.B) {
+	_, user := testStore(b)
+	j := testJobs(b, "bench", 1, false)[0]
+	start := time.Now()
+	for i := 1; i <= 10000; i++ {
+		r := &run{id: i, start: start, end: start.Add(time.Second), status: SUCCEEDED}
+		j.keep(r)
+	}
+	rf := j.Find("records").Ops.(*recordsfile)
+	fid := testFid(&rf.File, user)
+	j.records.Lock()
+	offsets := append([]offset{}, j.records.offsets...)
+	j.records.Unlock()
+	buf := make([]byte, 8192)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		o := offsets[i%len(offsets)]
+		if _, err := rf.Read(fid, buf[:o.n], uint64(o.off)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCtlWrite stops and starts a job through its ctl file from as many
+// writers at once as there are CPUs.
+func BenchmarkCtlWrite(b *testing.B) {
+	_, user := testStore(b)
+	j := testJobs(b, "bench", 1, true)[0]
+	ctl := j.Find("ctl").Ops.(*jobfile)
+	fid := testFid(&ctl.File, user)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		cmds := [][]byte{[]byte(STOP), []byte(START)}
+		for i := 0; pb.Next(); i++ {
+			if _, err := ctl.Write(fid, cmds[i%2], 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/clnt"
+)
+
+// BROWSEUSER is the user the HTTP listener reads the name space as, so that it
+// shows only what anyone may read
+const BROWSEUSER = "nobody"
+
+// nsaddr and nsmsize are the address of jobd's 9P listener and its largest
+// message size, for jobd's own 9P clients
+var (
+	nsaddr  string
+	nsmsize uint32
+)
+
+// browser is the 9P connection the HTTP listener reads the name space through
+var browser struct {
+	sync.Mutex
+	c *clnt.Clnt
+}
+
+// listing renders the entries of a directory of the name space.
+var listing = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>jobd {{.Path}}</title></head>
+<body><h1>{{.Path}}</h1>
+<table>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Link}}">{{.Link}}</a></td><td>{{.Mode}}</td><td>{{.Length}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+// entry is a directory entry as listed.
+type entry struct {
+	Link   string
+	Mode   string
+	Length uint64
+}
+
+// browseClient returns the connection the HTTP listener reads the name space
+// through, making it on first use.
+func browseClient() (*clnt.Clnt, error) {
+	browser.Lock()
+	defer browser.Unlock()
+
+	if browser.c != nil {
+		return browser.c, nil
+	}
+	user := p.OsUsers.Uname2User(BROWSEUSER)
+	if user == nil {
+		return nil, invalid("user", "no such user: %s", BROWSEUSER)
+	}
+	c, err := clnt.Mount("tcp", nsaddr, "", nsmsize, user)
+	if err != nil {
+		return nil, err
+	}
+	browser.c = c
+	return c, nil
+}
+
+// browse serves the name space read only, as it appears to a 9P client
+// attached as BROWSEUSER: directories as HTML listings, linking to their
+// entries, and files as their contents.
+func browse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "the name space is read only", http.StatusMethodNotAllowed)
+		return
+	}
+	c, err := browseClient()
+	if err != nil {
+		glog.Errorf("Can't browse the name space [%v]", err)
+		http.Error(w, "name space unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/fs"))
+	d, err := c.FStat(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if d.Mode&p.DMDIR != 0 && !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	f, err := c.FOpen(name, p.OREAD)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	defer f.Close()
+
+	if d.Mode&p.DMDIR != 0 {
+		browseDir(w, name, f)
+	} else {
+		browseFile(w, f)
+	}
+}
+
+// browseDir writes the listing of an open directory.
+func browseDir(w http.ResponseWriter, name string, f *clnt.File) {
+	entries := []entry{}
+	for {
+		dirs, err := f.Readdir(0)
+		if err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(dirs) == 0 {
+			break
+		}
+		for _, d := range dirs {
+			e := entry{Link: d.Name, Mode: modeString(d.Mode), Length: d.Length}
+			if d.Mode&p.DMDIR != 0 {
+				e.Link += "/"
+			}
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Link < entries[j].Link })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := listing.Execute(w, struct {
+		Path    string
+		Entries []entry
+	}{name, entries}); err != nil {
+		glog.Errorf("Can't render the listing of %s [%v]", name, err)
+	}
+}
+
+// browseFile writes the contents of an open file, typed by what they look
+// like.
+func browseFile(w http.ResponseWriter, f *clnt.File) {
+	var data []byte
+	buf := make([]byte, nsmsize)
+	for {
+		n, err := f.ReadAt(buf, int64(len(data)))
+		data = append(data, buf[:n]...)
+		if err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	kind := http.DetectContentType(data)
+	if strings.HasPrefix(kind, "text/html") {
+		kind = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", kind)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(data)
+}
+
+// modeString returns the permissions of a 9P mode as ls shows them.
+func modeString(mode uint32) string {
+	s := []byte("d---------")
+	if mode&p.DMDIR == 0 {
+		s[0] = '-'
+	}
+	for i, c := range "rwxrwxrwx" {
+		if mode&(1<<uint(8-i)) != 0 {
+			s[i+1] = byte(c)
+		}
+	}
+	return string(s)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// MAXIMPORT is the largest import the import file accepts, in bytes
+const MAXIMPORT = 1 << 20
+
+// jobspec is a job as it's exported and imported.
+type jobspec struct {
+	ID       string            `json:"id,omitempty"`
+	Name     string            `json:"name"`
+	Schedule string            `json:"schedule"`
+	Cmd      string            `json:"cmd"`
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// importfile is the file at the root of the jobd name space that creates the
+// jobs in a JSON array written to it, all of them or none.
+type importfile struct {
+	srv.File
+	pending map[*srv.FFid][]byte
+}
+
+// mkExportFile creates the read only export file at the root of the jobd name
+// space.
+func mkExportFile(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkExportFile(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkExportFile(%v, %v)", dir, user)
+
+	ef := &jobfile{
+		// export reader returns every job as a JSON array the import file
+		// accepts.
+		reader: cached(func() []byte {
+			data, err := json.MarshalIndent(exportJobs(), "", "  ")
+			if err != nil {
+				glog.Errorf("Can't export jobs [%v]", err)
+				return nil
+			}
+			return append(data, '\n')
+		}),
+		// export is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := ef.Add(dir, "export", user, nil, 0444, ef); err != nil {
+		glog.Errorln("Can't create export file: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// exportJobs returns the definitions and settings of every job.
+func exportJobs() []jobspec {
+	settingslk.RLock()
+	defer settingslk.RUnlock()
+
+	specs := []jobspec{}
+	for _, j := range jobsroot.list() {
+		spec := jobspec{ID: j.defn.id, Name: j.defn.name, Schedule: j.defn.schedule, Cmd: j.defn.cmd}
+		if len(j.defn.settings) > 0 {
+			spec.Settings = make(map[string]string)
+			for name, value := range j.defn.settings {
+				spec.Settings[name] = value
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// mkImportFile creates the import file, which shares the mode of the clone
+// file.
+func mkImportFile(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkImportFile(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkImportFile(%v, %v)", dir, user)
+
+	group, mode := definers()
+	imp := &importfile{pending: make(map[*srv.FFid][]byte)}
+	if err := imp.Add(dir, "import", user, group, mode&0666, imp); err != nil {
+		glog.Errorln("Can't create import file: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// Write collects the JSON array written to the import file, which may take more
+// than one write, and once it's complete imports the jobs it holds.
+func (imp *importfile) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	glog.V(4).Infof("Entering importfile.Write(%v, %v, %v)", fid, data, offset)
+	defer glog.V(4).Infof("Exiting importfile.Write(%v, %v, %v)", fid, data, offset)
+
+	imp.Lock()
+	defer imp.Unlock()
+
+	if !jobsroot.CheckPerm(fid.Fid.User, p.DMWRITE) {
+		return 0, srv.Eperm
+	}
+
+	buf := append(imp.pending[fid], data...)
+	if len(buf) > MAXIMPORT {
+		delete(imp.pending, fid)
+		return 0, invalid("import", "longer than the limit of %d bytes", MAXIMPORT)
+	}
+
+	var specs []jobspec
+	if err := json.Unmarshal(buf, &specs); err != nil {
+		if strings.HasPrefix(err.Error(), "unexpected end of JSON input") {
+			imp.pending[fid] = buf
+			return len(data), nil
+		}
+		delete(imp.pending, fid)
+		return 0, invalid("import", "%v", err)
+	}
+	delete(imp.pending, fid)
+
+	if err := importJobs(specs, fid.Fid.User); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Clunk discards whatever was written through the fid but never completed an
+// import.
+func (imp *importfile) Clunk(fid *srv.FFid) error {
+	imp.Lock()
+	defer imp.Unlock()
+
+	delete(imp.pending, fid)
+	return nil
+}
+
+// Wstat doesn't do anything but support for the operation is required to make
+// the OS file system calls happy.
+func (imp *importfile) Wstat(fid *srv.FFid, dir *p.Dir) error {
+	return nil
+}
+
+// importing serializes imports
+var importing sync.Mutex
+
+// importJobs creates the jobs, owned by owner, after checking all of them as
+// the clone file would, along with their settings. It creates none of them if
+// any is invalid or already exists.
+func importJobs(specs []jobspec, owner p.User) error {
+	importing.Lock()
+	defer importing.Unlock()
+
+	if n := len(jobsroot.list()); maxjobs > 0 && n+len(specs) > maxjobs {
+		return fmt.Errorf("jobd holds %d jobs, importing %d would exceed the limit of %d", n, len(specs), maxjobs)
+	}
+
+	defs := []*jobdef{}
+	warned := make(map[string][]string)
+	seen := make(map[string]bool)
+	for i, spec := range specs {
+		jd, warnings, err := validateDef(spec.Name, spec.Schedule, spec.Cmd)
+		if err != nil {
+			return fmt.Errorf("job %d (%s): %v", i+1, spec.Name, err)
+		}
+		if _, ok := jobsroot.lookup(jd.name); ok || seen[jd.name] {
+			return fmt.Errorf("job %d (%s): already exists", i+1, jd.name)
+		}
+		jd.id = spec.ID
+		if jd.id == "" {
+			jd.id = newID()
+		} else if !uuid.MatchString(jd.id) {
+			return fmt.Errorf("job %d (%s): not a UUID: %s", i+1, jd.name, jd.id)
+		} else if _, ok := jobsroot.lookupID(jd.id); ok || seen[jd.id] {
+			return fmt.Errorf("job %d (%s): ID %s is already used", i+1, jd.name, jd.id)
+		}
+		seen[jd.id] = true
+		for name, value := range spec.Settings {
+			if _, _, err := parseSetting(name + "=" + value); err != nil {
+				return fmt.Errorf("job %d (%s): %v", i+1, jd.name, err)
+			}
+			jd.settings[name] = value
+		}
+		seen[jd.name] = true
+		warned[jd.name] = warnings
+		defs = append(defs, jd)
+	}
+
+	lines := []string{}
+	for _, jd := range defs {
+		line, err := encodeJob(jd)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line+"\n")
+	}
+
+	for i, jd := range defs {
+		if err := jobsroot.addJob(*jd, owner); err != nil {
+			for _, added := range defs[:i] {
+				jobsroot.removeJob(added.name)
+			}
+			return fmt.Errorf("job %d (%s): %v", i+1, jd.name, err)
+		}
+	}
+
+	storelk.Lock()
+	db, err := os.OpenFile(jobsdb, os.O_WRONLY|os.O_APPEND, 0755)
+	if err != nil {
+		storelk.Unlock()
+		for _, jd := range defs {
+			jobsroot.removeJob(jd.name)
+		}
+		return err
+	}
+	_, err = db.WriteString(strings.Join(lines, ""))
+	db.Close()
+	storelk.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, jd := range defs {
+		if err := saveOwner(jd.name, owner); err != nil {
+			return err
+		}
+		if j, ok := jobsroot.lookup(jd.name); ok {
+			for _, w := range warned[jd.name] {
+				j.record(fmt.Sprintf("warning: %s\n", w))
+			}
+		}
+	}
+
+	glog.Infof("%s imported %d jobs", owner.Name(), len(defs))
+	return jobsroot.saveSettings()
+}
@@ -0,0 +1,432 @@
+// Package client is a Go client of jobd's HTTP API, as described by the
+// OpenAPI document jobd serves at /openapi.json.
+//
+//	c := client.New("http://jobd:8080", "6f1c0b9e2d7a")
+//	if err := c.Run(ctx, "backup"); err != nil {
+//		...
+//	}
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client makes requests to a jobd HTTP listener.
+type Client struct {
+	// BaseURL is the address of the listener, e.g. http://jobd:8080
+	BaseURL string
+
+	// Key is the API key sent as a bearer token, none if empty
+	Key string
+
+	// HTTP is the client requests are made with, http.DefaultClient if nil
+	HTTP *http.Client
+}
+
+// Error is the reply to a request jobd didn't fulfil.
+type Error struct {
+	// StatusCode is the HTTP status of the reply
+	StatusCode int
+
+	// Message is the reason jobd gave
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("jobd: %d %s", e.StatusCode, e.Message)
+}
+
+// Job is a job as /dashboard/state lists it.
+type Job struct {
+	Name   string            `json:"name"`
+	State  string            `json:"state"`
+	Next   string            `json:"next,omitempty"`
+	Last   string            `json:"last,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Definition is a job as the jobs API reads and writes it.
+type Definition struct {
+	ID       string            `json:"id,omitempty"`
+	Name     string            `json:"name"`
+	Schedule string            `json:"schedule"`
+	Cmd      string            `json:"cmd"`
+	Settings map[string]string `json:"settings,omitempty"`
+	State    string            `json:"state,omitempty"`
+	Owner    string            `json:"owner,omitempty"`
+	Version  string            `json:"version,omitempty"`
+}
+
+// Applied is the reply of /apply: the outcome for each job applied, created,
+// changed, unchanged or failed, and whether any changed or failed.
+type Applied struct {
+	Changed bool `json:"changed"`
+	Failed  bool `json:"failed"`
+	Jobs    []struct {
+		Name    string `json:"name"`
+		Outcome string `json:"outcome"`
+		Version string `json:"version,omitempty"`
+		Error   string `json:"error,omitempty"`
+	} `json:"jobs"`
+}
+
+// Run is the record of a finished run found by Runs.
+type Run struct {
+	Job         string        `json:"job"`
+	ID          int           `json:"id"`
+	Status      string        `json:"status"`
+	Slot        time.Time     `json:"slot"`
+	Start       time.Time     `json:"start"`
+	End         time.Time     `json:"end"`
+	Duration    time.Duration `json:"duration"`
+	Exit        *int          `json:"exit,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Note        string        `json:"note,omitempty"`
+	Annotations []string      `json:"annotations,omitempty"`
+}
+
+// Search selects the runs Runs returns, those of every job if empty.
+type Search struct {
+	// Jobs are the jobs whose runs are wanted
+	Jobs []string
+
+	// Statuses are the statuses of the runs wanted, e.g. failed
+	Statuses []string
+
+	// Since is how recently the runs wanted started
+	Since time.Duration
+
+	// Longer is how long the runs wanted took at least
+	Longer time.Duration
+
+	// Output is text the saved output of the runs wanted holds
+	Output string
+
+	// Limit is the most runs wanted, 100 if zero
+	Limit int
+}
+
+// State is the reply of /dashboard/state: the jobs and the most recent failed
+// runs.
+type State struct {
+	Jobs     []Job   `json:"jobs"`
+	Failures []Event `json:"failures"`
+}
+
+// Event is something that happened to a job, or to jobd.
+type Event struct {
+	Time       time.Time         `json:"time"`
+	Kind       string            `json:"kind"`
+	Job        string            `json:"job,omitempty"`
+	JobID      string            `json:"job_id,omitempty"`
+	Run        int               `json:"run,omitempty"`
+	Status     string            `json:"status,omitempty"`
+	Severity   string            `json:"severity,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Message    string            `json:"message"`
+	Exit       string            `json:"exit,omitempty"`
+	Duration   time.Duration     `json:"duration,omitempty"`
+	Output     string            `json:"output,omitempty"`
+	Path       string            `json:"path,omitempty"`
+	Suppressed bool              `json:"suppressed,omitempty"`
+	Author     string            `json:"author,omitempty"`
+	Diff       string            `json:"diff,omitempty"`
+}
+
+// Filter selects the events streamed, every one if empty.
+type Filter struct {
+	// Jobs are the jobs whose events are wanted
+	Jobs []string
+
+	// Kinds are the kinds of events wanted, e.g. run.finished
+	Kinds []string
+
+	// Labels are the labels, or severity, the event's job must have
+	Labels map[string]string
+}
+
+// New returns a client of the listener at baseURL using the given key.
+func New(baseURL, key string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), Key: key}
+}
+
+// Run runs the job now, outside its schedule. It needs a key with the trigger
+// scope.
+func (c *Client) Run(ctx context.Context, job string) error {
+	resp, err := c.request(ctx, http.MethodPost, "/jobs/"+url.PathEscape(job)+"/run", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Jobs returns every job.
+func (c *Client) Jobs(ctx context.Context) ([]Definition, error) {
+	defs := []Definition{}
+	if err := c.decode(ctx, http.MethodGet, "/jobs/", nil, nil, &defs); err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// Job returns the named job.
+func (c *Client) Job(ctx context.Context, name string) (*Definition, error) {
+	def := &Definition{}
+	if err := c.decode(ctx, http.MethodGet, "/jobs/"+url.PathEscape(name), nil, nil, def); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// JobByID returns the job with the given ID.
+func (c *Client) JobByID(ctx context.Context, id string) (*Definition, error) {
+	def := &Definition{}
+	if err := c.decode(ctx, http.MethodGet, "/ids/"+url.PathEscape(id), nil, nil, def); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// PutJob creates the job, or makes it match def, and returns it. If version
+// isn't empty the job must be at that version, and if it's "*" it must not exist
+// yet. It needs a key with the full scope.
+func (c *Client) PutJob(ctx context.Context, def Definition, version string) (*Definition, error) {
+	body, err := json.Marshal(def)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	switch version {
+	case "":
+	case "*":
+		header.Set("If-None-Match", "*")
+	default:
+		header.Set("If-Match", `"`+version+`"`)
+	}
+
+	put := &Definition{}
+	if err := c.decode(ctx, http.MethodPut, "/jobs/"+url.PathEscape(def.Name), header, body, put); err != nil {
+		return nil, err
+	}
+	return put, nil
+}
+
+// DeleteJob deletes the named job, moving it to the trash. Deleting a job that
+// doesn't exist succeeds. If version isn't empty the job must be at that
+// version. It needs a key with the full scope.
+func (c *Client) DeleteJob(ctx context.Context, name, version string) error {
+	header := http.Header{}
+	if version != "" {
+		header.Set("If-Match", `"`+version+`"`)
+	}
+	resp, err := c.request(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(name), header, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Apply makes each of the jobs match its definition, as PutJob does, and
+// returns the outcome for each. When check is set nothing is changed and the
+// outcomes are those applying the jobs would have. It needs a key with the
+// full scope.
+func (c *Client) Apply(ctx context.Context, defs []Definition, check bool) (*Applied, error) {
+	body, err := json.Marshal(defs)
+	if err != nil {
+		return nil, err
+	}
+	path := "/apply"
+	if check {
+		path += "?check=true"
+	}
+
+	applied := &Applied{}
+	if err := c.decode(ctx, http.MethodPost, path, nil, body, applied); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// Runs returns the finished runs of every job matching the search, the most
+// recently started first.
+func (c *Client) Runs(ctx context.Context, search Search) ([]Run, error) {
+	q := url.Values{}
+	if len(search.Jobs) > 0 {
+		q.Set("job", strings.Join(search.Jobs, ","))
+	}
+	if len(search.Statuses) > 0 {
+		q.Set("status", strings.Join(search.Statuses, ","))
+	}
+	if search.Since > 0 {
+		q.Set("since", search.Since.String())
+	}
+	if search.Longer > 0 {
+		q.Set("longer", search.Longer.String())
+	}
+	if search.Output != "" {
+		q.Set("output", search.Output)
+	}
+	if search.Limit > 0 {
+		q.Set("limit", strconv.Itoa(search.Limit))
+	}
+
+	runs := []Run{}
+	if err := c.decode(ctx, http.MethodGet, "/runs?"+q.Encode(), nil, nil, &runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// State returns the jobs, with their states, next runs and the status of their
+// last runs, and the most recent failed runs.
+func (c *Client) State(ctx context.Context) (*State, error) {
+	state := &State{}
+	if err := c.decode(ctx, http.MethodGet, "/dashboard/state", nil, nil, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// File returns the contents of a file of the name space, e.g. jobs/backup/log.
+func (c *Client) File(ctx context.Context, path string) ([]byte, error) {
+	u := url.URL{Path: "/fs/" + strings.TrimLeft(path, "/")}
+	resp, err := c.request(ctx, http.MethodGet, u.EscapedPath(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Metrics returns the statistics of every job in the Prometheus text format.
+func (c *Client) Metrics(ctx context.Context) (string, error) {
+	return c.text(ctx, "/metrics")
+}
+
+// Healthy returns nil if jobd is alive, or the checks that failed.
+func (c *Client) Healthy(ctx context.Context) error {
+	_, err := c.text(ctx, "/healthz")
+	return err
+}
+
+// Ready returns nil if jobd is ready to serve, or the checks that failed.
+func (c *Client) Ready(ctx context.Context) error {
+	_, err := c.text(ctx, "/readyz")
+	return err
+}
+
+// Events calls fn with each event matching the filter emitted from now on,
+// until ctx is done, fn returns an error or the stream ends.
+func (c *Client) Events(ctx context.Context, filter Filter, fn func(Event) error) error {
+	q := url.Values{}
+	if len(filter.Jobs) > 0 {
+		q.Set("job", strings.Join(filter.Jobs, ","))
+	}
+	if len(filter.Kinds) > 0 {
+		q.Set("kind", strings.Join(filter.Kinds, ","))
+	}
+	if len(filter.Labels) > 0 {
+		labels := []string{}
+		for label, value := range filter.Labels {
+			labels = append(labels, label+"="+value)
+		}
+		q.Set("labels", strings.Join(labels, ","))
+	}
+
+	resp, err := c.request(ctx, http.MethodGet, "/events?"+q.Encode(), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+			return err
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+// text makes a GET request and returns its reply as a string.
+func (c *Client) text(ctx context.Context, path string) (string, error) {
+	resp, err := c.request(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return string(data), err
+}
+
+// decode makes a request and decodes its JSON reply into v.
+func (c *Client) decode(ctx context.Context, method, path string, header http.Header, body []byte, v interface{}) error {
+	resp, err := c.request(ctx, method, path, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// request makes a request, returning an *Error for replies other than 2xx.
+func (c *Client) request(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.BaseURL+path, rd)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Key)
+	}
+
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+	return resp, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// clock tells the scheduler the time and wakes it when its next slot is due
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// wallclock is the clock of the running jobd, the real one.
+type wallclock struct{}
+
+func (wallclock) Now() time.Time                         { return time.Now() }
+func (wallclock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// simclock is a clock that only moves when it's told to, for simulations.
+type simclock struct {
+	now time.Time
+}
+
+func (c *simclock) Now() time.Time { return c.now }
+
+// After moves the clock forward by d and returns a channel that's already
+// ready.
+func (c *simclock) After(d time.Duration) <-chan time.Time {
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// sched is the scheduler's clock
+var sched clock = wallclock{}
@@ -3,13 +3,30 @@ package main
 import (
 	"fmt"
 	"os"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	p "github.com/vergult/go9p"
 	"github.com/vergult/go9p/srv"
 )
 
+// MAXDEFINITION is the longest job definition the clone file accepts, in bytes
+const MAXDEFINITION = 4096
+
+// maxjobs is the most jobs jobd will hold, unlimited if zero
+var maxjobs = 1000
+
+// clonerate is the most jobs a user may define per minute, unlimited if zero
+var clonerate = 60
+
+// cloned holds when each user defined the jobs they defined in the last
+// minute, through the clone file or the HTTP API
+var cloned = struct {
+	sync.Mutex
+	made map[string][]time.Time
+}{made: make(map[string][]time.Time)}
+
 type clonefile struct {
 	srv.File
 }
@@ -21,8 +38,10 @@ func mkCloneFile(dir *srv.File, user p.User) error {
 
 	glog.V(3).Infoln("Create the clone file")
 
+	// Those who can write the jobs directory can write the clone file.
+	group, mode := definers()
 	k := new(clonefile)
-	if err := k.Add(dir, "clone", user, nil, 0666, k); err != nil {
+	if err := k.Add(dir, "clone", user, group, mode&0666, k); err != nil {
 		glog.Errorln("Can't create clone file: ", err)
 		return err
 	}
@@ -32,7 +51,8 @@ func mkCloneFile(dir *srv.File, user p.User) error {
 
 // Write handles writes to the clone file by attempting to parse the data being
 // written into a job definition and if successful adding the corresponding job
-// to the jobs directory.
+// to the jobs directory. Only users who may write the jobs directory may define
+// jobs.
 func (k *clonefile) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
 	glog.V(4).Infof("Entering clonefile.Write(%v, %v, %v)", fid, data, offset)
 	defer glog.V(4).Infof("Exiting clonefile.Write(%v, %v, %v)", fid, data, offset)
@@ -40,33 +60,99 @@ func (k *clonefile) Write(fid *srv.FFid, data []byte, offset uint64) (int, error
 	k.Lock()
 	defer k.Unlock()
 
-	glog.V(3).Infof("Create a new job from: %s", string(data))
+	if !jobsroot.CheckPerm(fid.Fid.User, p.DMWRITE) {
+		return 0, srv.Eperm
+	}
+
+	if len(data) > MAXDEFINITION {
+		return 0, invalid("definition", "%d bytes, longer than the limit of %d", len(data), MAXDEFINITION)
+	}
 
-	jdparts := strings.Split(string(data), ":")
-	if len(jdparts) != 3 {
-		return 0, fmt.Errorf("invalid job definition: %s", string(data))
+	if n := len(jobsroot.list()); maxjobs > 0 && n >= maxjobs {
+		return 0, fmt.Errorf("jobd holds %d jobs, the limit is %d", n, maxjobs)
 	}
 
-	jd, err := mkJobDefinition(jdparts[0], jdparts[1], jdparts[2])
+	user := fid.Fid.User.Name()
+	if !mayDefine(user, time.Now()) {
+		return 0, fmt.Errorf("%s defined %d jobs in the last minute, the limit is %d", user, clonerate, clonerate)
+	}
+
+	glog.V(3).Infof("Create a new job from: %s", string(data))
+
+	jd, warnings, err := validate(string(data))
 	if err != nil {
 		return 0, err
 	}
 
-	if err := jobsroot.addJob(*jd); err != nil {
+	jd.id = newID()
+	if err := jobsroot.addJob(*jd, fid.Fid.User); err != nil {
 		return len(data), err
 	}
+	defined(user, time.Now())
 
+	if j, ok := jobsroot.lookup(jd.name); ok {
+		for _, w := range warnings {
+			j.record(fmt.Sprintf("warning: %s\n", w))
+		}
+	}
+
+	line, err := encodeJob(jd)
+	if err != nil {
+		return len(data), err
+	}
+	storelk.Lock()
 	db, err := os.OpenFile(jobsdb, os.O_WRONLY|os.O_APPEND, 0755)
 	if err != nil {
+		storelk.Unlock()
 		return len(data), err
 	}
 
-	fmt.Fprintf(db, "%s\n", string(data))
+	fmt.Fprintln(db, line)
 	db.Close()
+	storelk.Unlock()
+
+	if err := saveOwner(jd.name, fid.Fid.User); err != nil {
+		return len(data), err
+	}
+
+	if len(jd.settings) > 0 {
+		if err := jobsroot.saveSettings(); err != nil {
+			return len(data), err
+		}
+	}
 
 	return len(data), nil
 }
 
+// mayDefine reports whether user may define another job at now, given the jobs
+// they defined in the last minute. It forgets older definitions.
+func mayDefine(user string, now time.Time) bool {
+	cloned.Lock()
+	defer cloned.Unlock()
+
+	recent := cloned.made[user][:0]
+	for _, t := range cloned.made[user] {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(cloned.made, user)
+	} else {
+		cloned.made[user] = recent
+	}
+
+	return clonerate == 0 || len(recent) < clonerate
+}
+
+// defined counts a job user defined at now against their -clonerate.
+func defined(user string, now time.Time) {
+	cloned.Lock()
+	defer cloned.Unlock()
+
+	cloned.made[user] = append(cloned.made[user], now)
+}
+
 // Wstat doesn't do anything but support for the operation is required to make
 // the OS file system calls happy.
 // TODO: verify it's still necessary.
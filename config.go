@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// draining is set while jobd starts no new runs
+var draining int32
+
+// tunable is a server setting that can be changed at runtime.
+type tunable struct {
+	get func() string
+	set func(string) error
+}
+
+// configurable are the server settings writable through the config directory
+var configurable = map[string]tunable{
+	"drain": {
+		get: func() string { return strconv.FormatBool(isDraining()) },
+		set: func(value string) error {
+			on, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("not a boolean: %s", value)
+			}
+			if on {
+				atomic.StoreInt32(&draining, 1)
+			} else {
+				atomic.StoreInt32(&draining, 0)
+			}
+			glog.Infof("Draining set to %v", on)
+			return nil
+		},
+	},
+	"clonerate": {
+		get: func() string { return strconv.Itoa(clonerate) },
+		set: func(value string) error { return setLimit(&clonerate, value) },
+	},
+	"trashfor": {
+		get: func() string { return trashfor.String() },
+		set: func(value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fmt.Errorf("not a duration: %s", value)
+			}
+			trashfor = d
+			return nil
+		},
+	},
+	"maxage": {
+		get: func() string { return maxage.String() },
+		set: func(value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fmt.Errorf("not a duration: %s", value)
+			}
+			maxage = d
+			return nil
+		},
+	},
+	"workers": {
+		get: func() string { return strconv.Itoa(workers) },
+		set: func(value string) error {
+			if err := setLimit(&workers, value); err != nil {
+				return err
+			}
+			pool.Lock()
+			defer pool.Unlock()
+			assign()
+			return nil
+		},
+	},
+	"queuesize": {
+		get: func() string { return strconv.Itoa(queuesize) },
+		set: func(value string) error {
+			pool.Lock()
+			defer pool.Unlock()
+			defer pool.room.Broadcast()
+			return setLimit(&queuesize, value)
+		},
+	},
+	"queuefull": {
+		get: func() string { return queuefull },
+		set: func(value string) error {
+			if err := validQueuefull(value); err != nil {
+				return err
+			}
+			pool.Lock()
+			defer pool.Unlock()
+			defer pool.room.Broadcast()
+			queuefull = value
+			return nil
+		},
+	},
+	"maxjobs": {
+		get: func() string { return strconv.Itoa(maxjobs) },
+		set: func(value string) error { return setLimit(&maxjobs, value) },
+	},
+	"maxstore": {
+		get: func() string { return strconv.FormatInt(maxstore, 10) },
+		set: func(value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("not a size: %s", value)
+			}
+			maxstore = n
+			return nil
+		},
+	},
+	"timefmt": {
+		get: func() string { return timefmt },
+		set: func(value string) error {
+			if err := validTimefmt(value); err != nil {
+				return err
+			}
+			timefmt = value
+			return nil
+		},
+	},
+	"v": {
+		get: func() string { return flag.Lookup("v").Value.String() },
+		set: func(value string) error { return flag.Set("v", value) },
+	},
+	"vmodule": {
+		get: func() string { return flag.Lookup("vmodule").Value.String() },
+		set: func(value string) error { return flag.Set("vmodule", value) },
+	},
+}
+
+// setLimit sets a limit to value, a count where zero means unlimited.
+func setLimit(limit *int, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("not a count: %s", value)
+	}
+	*limit = n
+	return nil
+}
+
+// isDraining reports whether jobd is draining, starting no new runs.
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// mkConfigDir creates the config directory at the root of the jobd name space,
+// holding a file for each of jobd's flags that reports its value. The files of
+// the configurable settings can be written to change them.
+func mkConfigDir(root *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkConfigDir(%v, %v)", root, user)
+	defer glog.V(4).Infof("Exiting mkConfigDir(%v, %v)", root, user)
+
+	dir := new(srv.File)
+	if err := dir.Add(root, "config", user, nil, p.DMDIR|0555, nil); err != nil {
+		glog.Errorln("Can't create config directory: ", err)
+		return err
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := configurable[f.Name]; ok || err != nil {
+			return
+		}
+		err = mkConfigFile(dir, user, f.Name, tunable{get: f.Value.String})
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, t := range configurable {
+		if err := mkConfigFile(dir, user, name, t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mkConfigFile creates the file reporting, and if it's settable changing, one
+// of jobd's settings.
+func mkConfigFile(dir *srv.File, user p.User, name string, t tunable) error {
+	mode := uint32(0444)
+	if t.set != nil {
+		mode = 0644
+	}
+
+	cf := &jobfile{
+		// config reader returns the setting's current value.
+		reader: func() []byte {
+			return []byte(t.get() + "\n")
+		},
+		// config writer changes the setting, if it can be.
+		writer: func(data []byte) (int, error) {
+			if t.set == nil {
+				return 0, srv.Eperm
+			}
+			if err := t.set(strings.TrimSpace(string(data))); err != nil {
+				return 0, invalid(name, "%v", err)
+			}
+			return len(data), nil
+		}}
+	if err := cf.Add(dir, name, user, nil, mode, cf); err != nil {
+		glog.Errorf("Can't create config/%s [%v]", name, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CONFIRMTTL is how long a confirmation token stays valid
+const CONFIRMTTL = time.Minute
+
+// CONFIRM prefixes the argument that confirms a destructive root ctl command
+const CONFIRM = "confirm="
+
+// destructive are the root ctl commands that must be confirmed
+var destructive = map[string]bool{GC: true, CHOWN: true, UNPROTECT: true, TRASH: true, EMPTY: true}
+
+// confirmation is a token issued to an admin to confirm a destructive command.
+type confirmation struct {
+	token   string
+	line    string
+	expires time.Time
+}
+
+// confirmations holds the confirmation token last issued to each admin
+var confirmations = struct {
+	sync.Mutex
+	issued map[string]confirmation
+}{issued: make(map[string]confirmation)}
+
+// confirmed splits the confirmation token off the arguments of a destructive
+// command and reports whether it's the one issued to user for the command, which
+// is then used up. Without one, or with another, it issues user a new token and
+// returns an error asking for the command to be written again with it.
+func confirmed(user, cmd string, args []string, now time.Time) ([]string, error) {
+	token := ""
+	if n := len(args); n > 0 && strings.HasPrefix(args[n-1], CONFIRM) {
+		token, args = strings.TrimPrefix(args[n-1], CONFIRM), args[:n-1]
+	}
+	line := strings.Join(append([]string{cmd}, args...), " ")
+
+	confirmations.Lock()
+	defer confirmations.Unlock()
+
+	c, ok := confirmations.issued[user]
+	delete(confirmations.issued, user)
+	if ok && token != "" && token == c.token && line == c.line && now.Before(c.expires) {
+		return args, nil
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	c = confirmation{token: hex.EncodeToString(b), line: line, expires: now.Add(CONFIRMTTL)}
+	confirmations.issued[user] = c
+	return nil, invalid("command", "%s is destructive, write it again within %v followed by %s%s", line, CONFIRMTTL, CONFIRM, c.token)
+}
+
+// pendingConfirmation describes the token issued to user that hasn't expired or
+// been used, if any.
+func pendingConfirmation(user string, now time.Time) string {
+	confirmations.Lock()
+	defer confirmations.Unlock()
+
+	c, ok := confirmations.issued[user]
+	if !ok || !now.Before(c.expires) {
+		return "none"
+	}
+	return fmt.Sprintf("%s%s for %s until %s", CONFIRM, c.token, c.line, formatTime(c.expires, timefmt))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// session counts what a 9P connection has done since it was opened.
+type session struct {
+	id      int
+	addr    string
+	user    string
+	opened  time.Time
+	last    time.Time
+	ops     int
+	read    uint64
+	written uint64
+	fids    map[*srv.Fid]bool
+	file    *jobfile
+}
+
+// sessions holds a session for each open 9P connection
+var sessions = struct {
+	sync.Mutex
+	dir   *srv.File
+	user  p.User
+	byref map[*srv.Conn]*session
+	last  int
+}{byref: make(map[*srv.Conn]*session)}
+
+// connsrv is jobd's file server, it keeps a session for each connection.
+type connsrv struct {
+	*srv.Fsrv
+}
+
+// mkConnectionsDir creates the connections directory at the root of the jobd
+// name space, it holds a file for each open 9P connection.
+func mkConnectionsDir(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkConnectionsDir(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkConnectionsDir(%v, %v)", dir, user)
+
+	sessions.dir, sessions.user = new(srv.File), user
+	if err := sessions.dir.Add(dir, "connections", user, nil, p.DMDIR|0555, nil); err != nil {
+		glog.Errorln("Can't create connections directory: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// ConnOpened adds a file for the connection to the connections directory.
+func (s *connsrv) ConnOpened(conn *srv.Conn) {
+	s.Fsrv.ConnOpened(conn)
+
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	sessions.last++
+	ss := &session{id: sessions.last, opened: time.Now(), fids: make(map[*srv.Fid]bool)}
+	if addr := conn.RemoteAddr(); addr != nil {
+		ss.addr = addr.String()
+	}
+	ss.last = ss.opened
+	ss.file = &jobfile{
+		// connection reader describes the session.
+		reader: func() []byte {
+			return ss.describe()
+		},
+		// connections are read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := ss.file.Add(sessions.dir, strconv.Itoa(ss.id), sessions.user, nil, 0444, ss.file); err != nil {
+		glog.Errorf("Can't create connections/%d [%v]", ss.id, err)
+	}
+	sessions.byref[conn] = ss
+}
+
+// ConnClosed removes the connection's file from the connections directory.
+func (s *connsrv) ConnClosed(conn *srv.Conn) {
+	s.Fsrv.ConnClosed(conn)
+
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if ss, ok := sessions.byref[conn]; ok {
+		ss.file.Remove()
+		delete(sessions.byref, conn)
+	}
+}
+
+// FidDestroy forgets a fid the connection clunked or removed.
+func (s *connsrv) FidDestroy(fid *srv.Fid) {
+	s.Fsrv.FidDestroy(fid)
+
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if ss, ok := sessions.byref[fid.Fconn]; ok {
+		delete(ss.fids, fid)
+	}
+}
+
+// Attach records the user the connection attached as.
+func (s *connsrv) Attach(req *srv.Req) {
+	s.Fsrv.Attach(req)
+
+	count(req.Conn, func(ss *session) {
+		if succeeded(req) {
+			ss.user = req.Tc.Uname
+			ss.fids[req.Fid] = true
+		}
+	})
+}
+
+// Walk counts the fids a walk adds.
+func (s *connsrv) Walk(req *srv.Req) {
+	s.Fsrv.Walk(req)
+
+	count(req.Conn, func(ss *session) {
+		if succeeded(req) && req.Newfid != nil {
+			ss.fids[req.Newfid] = true
+		}
+	})
+}
+
+// Read counts the bytes read.
+func (s *connsrv) Read(req *srv.Req) {
+	s.Fsrv.Read(req)
+
+	count(req.Conn, func(ss *session) {
+		if req.Rc != nil && req.Rc.Type == p.Rread {
+			ss.read += uint64(req.Rc.Count)
+		}
+	})
+}
+
+// Write counts the bytes written.
+func (s *connsrv) Write(req *srv.Req) {
+	s.Fsrv.Write(req)
+
+	count(req.Conn, func(ss *session) {
+		if req.Rc != nil && req.Rc.Type == p.Rwrite {
+			ss.written += uint64(req.Rc.Count)
+		}
+	})
+}
+
+// Open counts the operation.
+func (s *connsrv) Open(req *srv.Req) {
+	s.Fsrv.Open(req)
+	count(req.Conn, nil)
+}
+
+// Create counts the operation.
+func (s *connsrv) Create(req *srv.Req) {
+	s.Fsrv.Create(req)
+	count(req.Conn, nil)
+}
+
+// Clunk counts the operation.
+func (s *connsrv) Clunk(req *srv.Req) {
+	s.Fsrv.Clunk(req)
+	count(req.Conn, nil)
+}
+
+// Remove counts the operation. Removing a job's directory deletes the job.
+func (s *connsrv) Remove(req *srv.Req) {
+	if fid, ok := req.Fid.Aux.(*srv.FFid); ok {
+		if j, ok := fid.F.Ops.(*job); ok {
+			removeJobDir(req, j)
+			count(req.Conn, nil)
+			return
+		}
+	}
+	s.Fsrv.Remove(req)
+	count(req.Conn, nil)
+}
+
+// Stat counts the operation.
+func (s *connsrv) Stat(req *srv.Req) {
+	s.Fsrv.Stat(req)
+	count(req.Conn, nil)
+}
+
+// Wstat counts the operation.
+func (s *connsrv) Wstat(req *srv.Req) {
+	s.Fsrv.Wstat(req)
+	count(req.Conn, nil)
+}
+
+// count counts an operation of the connection, updating its session with the
+// given function, if any.
+func count(conn *srv.Conn, update func(*session)) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	ss, ok := sessions.byref[conn]
+	if !ok {
+		return
+	}
+	if update != nil {
+		update(ss)
+	}
+	ss.ops++
+	ss.last = time.Now()
+}
+
+// succeeded reports whether the request was answered with anything but an
+// error.
+func succeeded(req *srv.Req) bool {
+	return req.Rc != nil && req.Rc.Type != p.Rerror
+}
+
+// describe renders the session's address, user, operations, bytes read and
+// written and open fids a line each.
+func (ss *session) describe() []byte {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "address: %s\n", ss.addr)
+	fmt.Fprintf(&out, "user: %s\n", ss.user)
+	fmt.Fprintf(&out, "opened: %s\n", formatTime(ss.opened, timefmt))
+	fmt.Fprintf(&out, "last: %s\n", formatTime(ss.last, timefmt))
+	fmt.Fprintf(&out, "ops: %d\n", ss.ops)
+	if elapsed := ss.last.Sub(ss.opened).Seconds(); elapsed >= 1 {
+		fmt.Fprintf(&out, "rate: %.1f ops/s\n", float64(ss.ops)/elapsed)
+	}
+	fmt.Fprintf(&out, "read: %d\n", ss.read)
+	fmt.Fprintf(&out, "written: %d\n", ss.written)
+	fmt.Fprintf(&out, "fids: %d\n", len(ss.fids))
+	return out.Bytes()
+}
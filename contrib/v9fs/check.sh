@@ -0,0 +1,74 @@
+#!/bin/sh
+# check.sh exercises jobd through the Linux kernel's 9P client: it starts the
+# jobd given, or the one in $PATH, on a scratch database, mounts it with v9fs
+# and checks that directory reads, stats and writes behave as they do through
+# plan9port's 9p. It needs root, to mount, and the 9p and 9pnet_fd modules.
+#
+#	sudo contrib/v9fs/check.sh ./jobd
+set -eu
+
+jobd=${1:-jobd}
+port=${PORT:-5641}
+jobs=150
+tmp=$(mktemp -d)
+mnt=$tmp/mnt
+mkdir "$mnt"
+
+cleanup() {
+	umount "$mnt" 2>/dev/null || true
+	[ -n "${pid:-}" ] && kill "$pid" 2>/dev/null || true
+	rm -rf "$tmp"
+}
+trap cleanup EXIT
+
+fail() {
+	echo "FAIL: $*" >&2
+	exit 1
+}
+
+"$jobd" -logtostderr -dbdir="$tmp/db" -fsaddr="127.0.0.1:$port" -clonerate=0 2>"$tmp/jobd.log" &
+pid=$!
+sleep 1
+kill -0 "$pid" 2>/dev/null || fail "jobd didn't start: $(cat "$tmp/jobd.log")"
+
+# A small msize makes listing the jobs directory take several reads.
+mount -t 9p -o trans=tcp,port="$port",version=9p2000.u,msize=4096,uname="$(id -un)" 127.0.0.1 "$mnt"
+
+[ -f "$mnt/clone" ] || fail "no clone file"
+[ -d "$mnt/jobs" ] || fail "no jobs directory"
+
+i=1
+while [ $i -le $jobs ]; do
+	printf 'v9fs%d:0 0 3 * * ? *:echo %d' $i $i >"$mnt/clone"
+	i=$((i + 1))
+done
+
+# Directory reads resume from the offset the previous read ended at.
+n=$(ls "$mnt/jobs" | wc -l)
+[ "$n" -eq $jobs ] || fail "listed $n of $jobs jobs"
+n=$(ls "$mnt/jobs" | sort -u | wc -l)
+[ "$n" -eq $jobs ] || fail "listed $n distinct jobs"
+
+# A file's stat gives the length reading it returns.
+cmd=$mnt/jobs/v9fs7/cmd
+[ "$(cat "$cmd")" = "echo 7" ] || fail "cmd reads $(cat "$cmd")"
+size=$(stat -c %s "$cmd")
+read=$(cat "$cmd" | wc -c)
+[ "$size" -eq "$read" ] || fail "cmd stats $size bytes, reads $read"
+
+# Writes through the shell open with O_TRUNC, and bump the mtime.
+ctl=$mnt/jobs/v9fs7/ctl
+before=$(stat -c %Y "$ctl")
+sleep 1
+echo start >"$ctl" || fail "can't write ctl"
+[ "$(cat "$ctl")" = "started" ] || fail "ctl reads $(cat "$ctl")"
+after=$(stat -c %Y "$ctl")
+[ "$after" -gt "$before" ] || fail "ctl mtime unchanged after a write"
+echo stop >"$ctl"
+
+# Read only files refuse writes.
+if echo x 2>/dev/null >"$mnt/jobs/v9fs7/log"; then
+	fail "log accepted a write"
+fi
+
+echo PASS
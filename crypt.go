@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// MAXFRAME is the largest frame of a sealed stream that will be read, in bytes
+const MAXFRAME = 1 << 24
+
+// sealer encrypts the jobs database, the jobs' history and the files saved for
+// their runs when jobd is given -encryptkey, it's nil otherwise.
+var sealer cipher.AEAD
+
+// loadKey reads the AES-256 key held, raw or hex encoded, in the named file and
+// makes it the key everything jobd stores is encrypted with.
+func loadKey(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	key := data
+	if len(key) != 32 {
+		key, err = hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("%s doesn't hold a 32 byte key, raw or hex encoded", name)
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	sealer, err = cipher.NewGCM(block)
+	return err
+}
+
+// seal encrypts data with a fresh nonce, which prefixes the result, binding it
+// to ad so it only decrypts along with the same additional data.
+func seal(data, ad []byte) ([]byte, error) {
+	if sealer == nil {
+		return data, nil
+	}
+
+	nonce := make([]byte, sealer.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("can't encrypt: %v", err)
+	}
+	return sealer.Seal(nonce, nonce, data, ad), nil
+}
+
+// unseal decrypts data sealed by seal with the same additional data.
+func unseal(data, ad []byte) ([]byte, error) {
+	if sealer == nil {
+		return data, nil
+	}
+
+	n := sealer.NonceSize()
+	if len(data) < n {
+		return nil, fmt.Errorf("can't decrypt: too short")
+	}
+	out, err := sealer.Open(nil, data[:n], data[n:], ad)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt: %v", err)
+	}
+	return out, nil
+}
+
+// sealLine encrypts a line of a line oriented database, the result is base64
+// encoded so it remains a line.
+func sealLine(line string) (string, error) {
+	if sealer == nil {
+		return line, nil
+	}
+	data, err := seal([]byte(line), nil)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// unsealLine decrypts a line sealed by sealLine.
+func unsealLine(line string) (string, error) {
+	if sealer == nil {
+		return line, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return "", fmt.Errorf("can't decrypt: %v", err)
+	}
+	out, err := unseal(data, nil)
+	return string(out), err
+}
+
+// identity returns what the frames of the named file are bound to: its base
+// name, which stays the same when the job is renamed or its runs go to the
+// trash, without the suffix of the temporary file it's written to before being
+// renamed in place.
+func identity(name string) string {
+	return strings.TrimSuffix(path.Base(name), ".tmp")
+}
+
+// frameData returns the additional data the frame at index in the file with
+// the given identity is sealed with, so frames can't be reordered or moved to
+// another file.
+func frameData(id string, index uint64) []byte {
+	ad := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(ad, index)
+	return append(ad, id...)
+}
+
+// readSealed returns the contents of the named file, written whole by
+// writeSealed or as a stream by a sealedWriter, decrypted.
+func readSealed(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil || sealer == nil {
+		return data, err
+	}
+	return unframe(data, identity(name), false)
+}
+
+// readGrowing is readSealed for a file still being written, whose last frame
+// may not be whole yet.
+func readGrowing(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil || sealer == nil {
+		return data, err
+	}
+	return unframe(data, identity(name), true)
+}
+
+// writeSealed writes data, encrypted, to the named file.
+func writeSealed(name string, data []byte, perm os.FileMode) error {
+	if sealer == nil {
+		return ioutil.WriteFile(name, data, perm)
+	}
+
+	var out bytes.Buffer
+	if err := frame(&out, data, frameData(identity(name), 0)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, out.Bytes(), perm)
+}
+
+// frame writes data sealed with ad and prefixed with its length to w.
+func frame(w io.Writer, data, ad []byte) error {
+	sealed, err := seal(data, ad)
+	if err != nil {
+		return err
+	}
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// unframe decrypts the frames in data, those of the file with the given
+// identity. A last frame cut short is an error unless the file is growing, when
+// it's still being written and left out.
+func unframe(data []byte, id string, growing bool) ([]byte, error) {
+	var out bytes.Buffer
+	for index := uint64(0); len(data) > 0; index++ {
+		if len(data) < 4 {
+			if growing {
+				break
+			}
+			return nil, fmt.Errorf("can't decrypt: frame %d cut short", index)
+		}
+		size := binary.BigEndian.Uint32(data)
+		if size > MAXFRAME {
+			return nil, fmt.Errorf("can't decrypt: frame of %d bytes", size)
+		}
+		if uint32(len(data)-4) < size {
+			if growing {
+				break
+			}
+			return nil, fmt.Errorf("can't decrypt: frame %d cut short", index)
+		}
+		plain, err := unseal(data[4:4+size], frameData(id, index))
+		if err != nil {
+			return nil, err
+		}
+		out.Write(plain)
+		data = data[4+size:]
+	}
+	return out.Bytes(), nil
+}
+
+// sealedWriter encrypts each write to a file as a frame of its own, so the file
+// can be read while it's being written.
+type sealedWriter struct {
+	f      *os.File
+	id     string
+	frames uint64
+}
+
+// sealWriter returns a writer to f that encrypts what it's given when jobd
+// encrypts what it stores, f itself otherwise.
+func sealWriter(f *os.File) io.WriteCloser {
+	if sealer == nil {
+		return f
+	}
+	return &sealedWriter{f: f, id: identity(f.Name())}
+}
+
+func (sw *sealedWriter) Write(data []byte) (int, error) {
+	written := len(data)
+	for len(data) > 0 {
+		n := len(data)
+		if n > MAXFRAME/2 {
+			n = MAXFRAME / 2
+		}
+		if err := frame(sw.f, data[:n], frameData(sw.id, sw.frames)); err != nil {
+			return written - len(data), err
+		}
+		sw.frames++
+		data = data[n:]
+	}
+	return written, nil
+}
+
+func (sw *sealedWriter) Close() error {
+	return sw.f.Close()
+}
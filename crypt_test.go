@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// withKey makes jobd encrypt what it stores for the rest of the test.
+func withKey(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := sealer
+	t.Cleanup(func() { sealer = old })
+	sealer = aead
+}
+
+// frames returns the frames of a sealed stream.
+func frames(data []byte) [][]byte {
+	var out [][]byte
+	for len(data) >= 4 {
+		size := 4 + int(binary.BigEndian.Uint32(data))
+		out = append(out, data[:size])
+		data = data[size:]
+	}
+	return out
+}
+
+// TestSealedStream checks that a sealed stream reads back as written, and that
+// one whose frames were reordered, moved to another file or cut short doesn't,
+// unless it's still being written and its last frame is left out.
+func TestSealedStream(t *testing.T) {
+	withKey(t)
+	dir := t.TempDir()
+	name := path.Join(dir, "1.out")
+
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw := sealWriter(f)
+	for _, s := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := sw.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sw.Close()
+
+	if data, err := readSealed(name); err != nil || string(data) != "first\nsecond\nthird\n" {
+		t.Fatalf("got %q (%v), want what was written", data, err)
+	}
+
+	data, _ := ioutil.ReadFile(name)
+	fs := frames(data)
+	join := func(fs ...[]byte) []byte {
+		var out []byte
+		for _, f := range fs {
+			out = append(out, f...)
+		}
+		return out
+	}
+	tests := []struct {
+		name    string
+		file    string
+		data    []byte
+		growing bool
+		want    string
+		fails   bool
+	}{
+		{"reordered", "1.out", join(fs[1], fs[0], fs[2]), false, "", true},
+		{"dropped", "1.out", join(fs[0], fs[2]), false, "", true},
+		{"moved", "2.out", data, false, "", true},
+		{"cut short", "1.out", data[:len(data)-3], false, "", true},
+		{"cut short while written", "1.out", data[:len(data)-3], true, "first\nsecond\n", false},
+	}
+	for _, tt := range tests {
+		name := path.Join(dir, tt.file)
+		if err := ioutil.WriteFile(name, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		read := readSealed
+		if tt.growing {
+			read = readGrowing
+		}
+		got, err := read(name)
+		switch {
+		case tt.fails && err == nil:
+			t.Errorf("%s: got %q, want an error", tt.name, got)
+		case !tt.fails && (err != nil || string(got) != tt.want):
+			t.Errorf("%s: got %q (%v), want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// TestWriteSealedRenamed checks that a file written to a temporary name and
+// renamed in place reads back.
+func TestWriteSealedRenamed(t *testing.T) {
+	withKey(t)
+	name := path.Join(t.TempDir(), "summary.json")
+	if err := writeSealed(name+".tmp", []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readSealed(name); err != nil || string(data) != "[]" {
+		t.Errorf("got %q (%v), want what was written", data, err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MAXBACKFILL is the largest number of slots a single backfill will run
+const MAXBACKFILL = 1000
+
+// envname matches the names of environment variables a manual run may override
+var envname = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// ctlFields splits a ctl command into its space separated fields. Double quotes
+// group text containing spaces into a single field, within them a backslash
+// escapes the following character.
+func ctlFields(s string) ([]string, error) {
+	fields := []string{}
+	field, infield, quoted := []rune{}, false, false
+
+	rs := []rune(s)
+	for i := 0; i < len(rs); i++ {
+		switch r := rs[i]; {
+		case quoted && r == '\\' && i+1 < len(rs):
+			i++
+			field = append(field, rs[i])
+		case r == '"':
+			quoted, infield = !quoted, true
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if infield {
+				fields = append(fields, string(field))
+			}
+			field, infield = []rune{}, false
+		default:
+			field, infield = append(field, r), true
+		}
+	}
+
+	if quoted {
+		return nil, invalid("command", "unterminated quote: %s", s)
+	}
+	if infield {
+		fields = append(fields, string(field))
+	}
+
+	return fields, nil
+}
+
+// parseCtl parses a ctl command into the command, lower cased, and the fields
+// that follow it. It has no side effects, whatever is written to a ctl file
+// goes through it before anything is done.
+func parseCtl(s string) (string, []string, error) {
+	fields, err := ctlFields(s)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(fields) == 0 {
+		return "", nil, invalid("command", "missing")
+	}
+	return strings.ToLower(fields[0]), fields[1:], nil
+}
+
+// ctlArgs parses the key=value arguments that follow a ctl command.
+func ctlArgs(args []string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, invalid("argument", "expected name=value: %s", arg)
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result, nil
+}
+
+// backfillSlots returns the job's scheduled slots between from and to inclusive.
+func (j *job) backfillSlots(from, to time.Time) ([]time.Time, error) {
+	if to.Before(from) {
+		return nil, invalid("to", "before from: %s", to.Format(time.RFC3339))
+	}
+
+	slots := []time.Time{}
+	for t := from.Add(-time.Nanosecond); ; {
+		next, err := j.next(t)
+		if err != nil {
+			return nil, err
+		}
+		if next.IsZero() || next.After(to) {
+			break
+		}
+		if len(slots) == MAXBACKFILL {
+			return nil, invalid("to", "range has more than %d slots", MAXBACKFILL)
+		}
+		slots = append(slots, next)
+		t = next
+	}
+
+	return slots, nil
+}
+
+// runArgs turns the arguments of a run command into an invocation of the job
+// happening now. A cmd argument replaces the job's command and any others are
+// added to its environment, but only for this one invocation. An attach
+// argument connects the run to the job's attach files.
+func (j *job) runArgs(args []string) (invocation, error) {
+	now := time.Now()
+	inv := invocation{slot: now, key: slotKey(j.defn.name, now), cmd: j.defn.cmd, note: "manual run"}
+
+	if len(args) > 0 && args[0] == ATTACH {
+		inv.attach = true
+		args = args[1:]
+	}
+
+	kvs, err := ctlArgs(args)
+	if err != nil {
+		return invocation{}, err
+	}
+
+	for k, v := range kvs {
+		switch {
+		case k == "cmd":
+			inv.cmd = v
+		case envname.MatchString(k):
+			inv.env = append(inv.env, k+"="+v)
+		default:
+			return invocation{}, invalid(k, "not an environment variable name")
+		}
+	}
+
+	if len(kvs) > 0 {
+		inv.note = "manual parameterized run"
+	}
+
+	return inv, nil
+}
+
+// backfill runs the job's command once for each of the given slots, one after
+// the other, recording each in the job's history.
+func (j *job) backfill(slots []time.Time) {
+	j.record(fmt.Sprintf("backfill of %d slots started\n", len(slots)))
+	for _, slot := range slots {
+		j.exec(invocation{slot: slot, key: slotKey(j.defn.name, slot), cmd: j.defn.cmd, note: "backfill"})
+	}
+	j.record(fmt.Sprintf("backfill of %d slots completed\n", len(slots)))
+
+	j.slk.Lock()
+	j.backfilling = false
+	j.slk.Unlock()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// FuzzParseCtl checks that whatever is written to a ctl file parses into a
+// lower cased command, that valid UTF-8 without quotes splits on spaces, tabs
+// and newlines alone and that the arguments that follow don't upset ctlArgs.
+func FuzzParseCtl(f *testing.F) {
+	for _, seed := range []string{
+		"start",
+		"STOP",
+		"run note=\"nightly rerun\" env.DEBUG=1",
+		"backfill from=2014-02-11T00:00:00Z to=2014-02-12T00:00:00Z",
+		"annotate 42 \"disk \\\"full\\\"\"",
+		"\"unterminated",
+		"\t \n",
+		"ставка",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		cmd, args, err := parseCtl(s)
+		if err != nil {
+			return
+		}
+		if cmd != strings.ToLower(cmd) {
+			t.Fatalf("command of %q isn't lower cased: %q", s, cmd)
+		}
+		if utf8.ValidString(s) && !strings.ContainsAny(s, "\"") {
+			want := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == '\t' || r == '\n' })
+			got := append([]string{cmd}, args...)
+			if len(got) != len(want) || strings.Join(got[1:], "\x00") != strings.Join(want[1:], "\x00") || cmd != strings.ToLower(want[0]) {
+				t.Fatalf("%q split into %q, expected %q", s, got, want)
+			}
+		}
+		ctlArgs(args)
+	})
+}
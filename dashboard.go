@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// DASHFAILURES is the number of recent failures the dashboard lists
+const DASHFAILURES = 20
+
+// dashjob is a job as the dashboard lists it.
+type dashjob struct {
+	Name   string            `json:"name"`
+	State  string            `json:"state"`
+	Next   string            `json:"next,omitempty"`
+	Last   string            `json:"last,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// dashboard serves the single page dashboard.
+func dashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/dashboard" && r.URL.Path != "/dashboard/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashpage))
+}
+
+// dashboardState returns, as JSON, the jobs with their states, next runs and
+// the status of their last runs, along with the most recent failed runs.
+func dashboardState(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	jobs := []dashjob{}
+	for _, j := range jobsroot.list() {
+		j.slk.Lock()
+		dj := dashjob{Name: j.defn.name, State: j.defn.state, Labels: j.labels()}
+		started := j.defn.state == STARTED
+		j.slk.Unlock()
+
+		if next, err := j.next(now); err == nil && started {
+			dj.Next = j.stamp(next)
+		}
+		j.rlk.Lock()
+		if len(j.runs) > 0 {
+			last := j.runs[len(j.runs)-1]
+			last.Lock()
+			dj.Last = last.status
+			last.Unlock()
+		}
+		j.rlk.Unlock()
+		jobs = append(jobs, dj)
+	}
+
+	failures := []event{}
+	recent := recentEvents()
+	for i := len(recent) - 1; i >= 0 && len(failures) < DASHFAILURES; i-- {
+		if ev := recent[i]; ev.Kind == RUNFINISHED && ev.Status != SUCCEEDED && ev.Status != INTERRUPTED {
+			failures = append(failures, ev)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Jobs     []dashjob `json:"jobs"`
+		Failures []event   `json:"failures"`
+	}{jobs, failures})
+}
+
+// dashpage is the dashboard: the jobs, refreshed as events arrive, the recent
+// failures and the log of the job picked, tailed live. The page holds nothing
+// but itself, a key given as the access_token of its address' fragment, which
+// isn't sent with it, is sent as the bearer token of the requests it makes and
+// the access_token of the WebSocket it opens for events.
+const dashpage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>jobd</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+tr.job { cursor: pointer; }
+tr.job:hover { background: #f4f4f4; }
+.failed, .timedout, .signaled { color: #b00; }
+.succeeded { color: #070; }
+#panes { display: flex; gap: 2em; }
+#log { background: #111; color: #ddd; padding: 0.5em; height: 30em; width: 60em; overflow: auto; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>jobd</h1>
+<div id="panes">
+<div>
+<h2>Jobs</h2>
+<table><thead><tr><th>job</th><th>state</th><th>next run</th><th>last run</th></tr></thead><tbody id="jobs"></tbody></table>
+<h2>Recent failures</h2>
+<table><tbody id="failures"></tbody></table>
+</div>
+<div>
+<h2 id="logtitle">Log</h2>
+<pre id="log">Pick a job to tail its log.</pre>
+</div>
+</div>
+<script>
+var token = new URLSearchParams(location.hash.slice(1)).get("access_token");
+var picked = null;
+
+function get(path) {
+	return fetch(path, {headers: token ? {"Authorization": "Bearer " + token} : {}});
+}
+
+function cell(row, text, cls) {
+	var td = row.insertCell();
+	td.textContent = text || "";
+	if (cls) td.className = cls;
+}
+
+function refresh() {
+	get("/dashboard/state").then(function(r) { return r.json(); }).then(function(state) {
+		var jobs = document.getElementById("jobs");
+		jobs.innerHTML = "";
+		state.jobs.forEach(function(j) {
+			var row = jobs.insertRow();
+			row.className = "job";
+			row.onclick = function() { pick(j.name); };
+			cell(row, j.name);
+			cell(row, j.state);
+			cell(row, j.next);
+			cell(row, j.last, j.last);
+		});
+		var failures = document.getElementById("failures");
+		failures.innerHTML = "";
+		state.failures.forEach(function(ev) {
+			var row = failures.insertRow();
+			cell(row, ev.time);
+			cell(row, ev.job);
+			cell(row, "run " + ev.run);
+			cell(row, ev.status, ev.status);
+			cell(row, ev.message);
+		});
+	});
+}
+
+function tail() {
+	if (!picked) return;
+	var name = picked;
+	get("/fs/jobs/" + encodeURIComponent(name) + "/log").then(function(r) { return r.text(); }).then(function(text) {
+		if (name != picked) return;
+		var log = document.getElementById("log");
+		var bottom = log.scrollTop + log.clientHeight >= log.scrollHeight - 4;
+		log.textContent = text;
+		if (bottom) log.scrollTop = log.scrollHeight;
+	});
+}
+
+function pick(name) {
+	picked = name;
+	document.getElementById("logtitle").textContent = "Log of " + name;
+	document.getElementById("log").textContent = "";
+	tail();
+}
+
+var pending = null;
+var kinds = "job.started,job.stopped,job.changed,run.finished,run.drifted,alert.opened,alert.resolved";
+var events = new WebSocket((location.protocol == "https:" ? "wss://" : "ws://") + location.host + "/events/ws?kind=" + kinds + (token ? "&access_token=" + encodeURIComponent(token) : ""));
+events.onmessage = function(e) {
+	var ev = JSON.parse(e.data);
+	if (ev.job == picked) tail();
+	if (!pending) pending = setTimeout(function() { pending = null; refresh(); }, 500);
+};
+
+refresh();
+setInterval(tail, 5000);
+setInterval(refresh, 60000);
+</script>
+</body>
+</html>
+`
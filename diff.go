@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+)
+
+const (
+	// DIFFLINES is the most lines of each run's output compared by a diff
+	DIFFLINES = 2000
+
+	// DIFFCONTEXT is the number of unchanged lines shown around each change
+	DIFFCONTEXT = 3
+)
+
+// mkDiffFile creates the job's diff file. Writing the numbers of two of the
+// job's kept runs to it compares them, reading it returns the comparison.
+func mkDiffFile(job *job, user p.User) error {
+	var lk sync.Mutex
+	var result []byte
+
+	df := &jobfile{
+		// diff reader returns the last comparison.
+		reader: func() []byte {
+			lk.Lock()
+			defer lk.Unlock()
+
+			return result
+		},
+		// diff writer compares the two runs written to it.
+		writer: func(data []byte) (int, error) {
+			fields := strings.Fields(string(data))
+			if len(fields) != 2 {
+				return 0, invalid("diff", "expected <run> <run>")
+			}
+			a, err := job.lookupRun(fields[0])
+			if err != nil {
+				return 0, err
+			}
+			b, err := job.lookupRun(fields[1])
+			if err != nil {
+				return 0, err
+			}
+			compared := job.compare(a, b)
+			lk.Lock()
+			result = compared
+			lk.Unlock()
+			return len(data), nil
+		}}
+	if err := df.Add(&job.File, "diff", user, nil, 0644, df); err != nil {
+		glog.Errorf("Can't create %s/diff [%v]", job.defn.name, err)
+		return err
+	}
+
+	return nil
+}
+
+// compare renders the status, exit code and duration of two runs side by side
+// followed by a unified diff of their output.
+func (j *job) compare(a, b *run) []byte {
+	var out bytes.Buffer
+
+	for _, r := range []*run{a, b} {
+		r.Lock()
+		exit := "none"
+		if code, ok := exitCode(r.err); ok && r.status != RUNNING {
+			exit = fmt.Sprint(code)
+		}
+		duration := "running"
+		if !r.end.IsZero() {
+			duration = r.end.Sub(r.start).String()
+		}
+		fmt.Fprintf(&out, "run %d: %s exit=%s duration=%s started=%s\n", r.id, r.status, exit, duration, j.stamp(r.start))
+		r.Unlock()
+	}
+	out.WriteString("\n")
+
+	la, truncated := outputLines(a)
+	lb, truncatedb := outputLines(b)
+	if truncated || truncatedb {
+		fmt.Fprintf(&out, "comparing only the first %d lines of output\n", DIFFLINES)
+	}
+	d := unified(la, lb, fmt.Sprintf("run %d", a.id), fmt.Sprintf("run %d", b.id))
+	if d == "" {
+		out.WriteString("outputs are identical\n")
+	}
+	out.WriteString(d)
+
+	return out.Bytes()
+}
+
+// outputLines returns up to DIFFLINES lines of the run's output and whether
+// there were more.
+func outputLines(r *run) ([]string, bool) {
+	data, err := r.output()
+	if err != nil {
+		return nil, false
+	}
+	return splitOutput(data)
+}
+
+// splitOutput returns up to DIFFLINES lines of output and whether there were
+// more.
+func splitOutput(data []byte) ([]string, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) > DIFFLINES {
+		return lines[:DIFFLINES], true
+	}
+	return lines, false
+}
+
+// edit is one line of a diff: kept, removed from a or added from b.
+type edit struct {
+	op   byte
+	line string
+}
+
+// common returns, for each k, the length of the longest common subsequence of
+// the lines of a and of b[:k]. It keeps two rows of the table at a time, so
+// takes space linear in the length of b.
+func common(a, b []string) []int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for k := range b {
+			switch {
+			case a[i] == b[k]:
+				cur[k+1] = prev[k] + 1
+			case prev[k+1] >= cur[k]:
+				cur[k+1] = prev[k+1]
+			default:
+				cur[k+1] = cur[k]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+// reversed returns the lines in reverse order.
+func reversed(lines []string) []string {
+	r := make([]string, len(lines))
+	for i, line := range lines {
+		r[len(lines)-1-i] = line
+	}
+	return r
+}
+
+// script returns the edits turning a into b along a longest common subsequence
+// of their lines, found in linear space by Hirschberg's algorithm: a is split
+// in half and b where the common subsequences of the halves with its two parts
+// are longest together, and each half is diffed with its part.
+func script(a, b []string) []edit {
+	switch {
+	case len(a) == 0:
+		es := make([]edit, len(b))
+		for k, line := range b {
+			es[k] = edit{'+', line}
+		}
+		return es
+	case len(b) == 0:
+		es := make([]edit, len(a))
+		for i, line := range a {
+			es[i] = edit{'-', line}
+		}
+		return es
+	case len(a) == 1:
+		for k, line := range b {
+			if line == a[0] {
+				return append(append(script(nil, b[:k]), edit{' ', line}), script(nil, b[k+1:])...)
+			}
+		}
+		return append(script(a, nil), script(nil, b)...)
+	}
+
+	mid := len(a) / 2
+	head, tail := common(a[:mid], b), common(reversed(a[mid:]), reversed(b))
+	split := 0
+	for k := range head {
+		if head[k]+tail[len(b)-k] > head[split]+tail[len(b)-split] {
+			split = k
+		}
+	}
+	return append(script(a[:mid], b[:split]), script(a[mid:], b[split:])...)
+}
+
+// unified returns the unified diff turning a into b, or the empty string when
+// they're the same. It follows a longest common subsequence of their lines,
+// with the lines removed by each change ahead of those it adds.
+func unified(a, b []string, nameA, nameB string) string {
+	edits := script(a, b)
+
+	changed := false
+	for start := 0; start < len(edits); start++ {
+		if edits[start].op == ' ' {
+			continue
+		}
+		end := start
+		for end < len(edits) && edits[end].op != ' ' {
+			end++
+		}
+		change := edits[start:end]
+		sort.SliceStable(change, func(i, k int) bool { return change[i].op == '-' && change[k].op == '+' })
+		start, changed = end, true
+	}
+	if !changed {
+		return ""
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+
+	// Group the edits into hunks of changes with their surrounding context.
+	for start := 0; start < len(edits); {
+		first := start
+		for first < len(edits) && edits[first].op == ' ' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+		from := first - DIFFCONTEXT
+		if from < start {
+			from = start
+		}
+		to, kept := first, 0
+		for to < len(edits) && kept <= 2*DIFFCONTEXT {
+			if edits[to].op == ' ' {
+				kept++
+			} else {
+				kept = 0
+			}
+			to++
+		}
+		if kept > DIFFCONTEXT {
+			to -= kept - DIFFCONTEXT
+		}
+
+		linea, lineb := 1, 1
+		for _, e := range edits[:from] {
+			if e.op != '+' {
+				linea++
+			}
+			if e.op != '-' {
+				lineb++
+			}
+		}
+		counta, countb := 0, 0
+		for _, e := range edits[from:to] {
+			if e.op != '+' {
+				counta++
+			}
+			if e.op != '-' {
+				countb++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", linea, counta, lineb, countb)
+		for _, e := range edits[from:to] {
+			fmt.Fprintf(&out, "%c%s\n", e.op, e.line)
+		}
+		start = to
+	}
+
+	return out.String()
+}
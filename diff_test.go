@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestUnified checks that the diff of two outputs follows a longest common
+// subsequence of their lines, removals ahead of additions, and keeps only
+// DIFFCONTEXT lines of context around each change.
+func TestUnified(t *testing.T) {
+	lines := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, " ")
+	}
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"same", "a b c", "a b c", ""},
+		{"both empty", "", "", ""},
+		{"added", "", "a b", "@@ -1,0 +1,2 @@\n+a\n+b\n"},
+		{"removed", "a b", "", "@@ -1,2 +1,0 @@\n-a\n-b\n"},
+		{"replaced", "a b c", "a x c", "@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"moved", "a b c d", "b c d a", "@@ -1,4 +1,4 @@\n-a\n b\n c\n d\n+a\n"},
+		{"two hunks", "1 2 3 4 5 6 7 8 9 10 11 12", "0 1 2 3 4 5 6 7 8 9 10 11 x", "@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n@@ -9,4 +10,4 @@\n 9\n 10\n 11\n-12\n+x\n"},
+	}
+	for _, tt := range tests {
+		want := tt.want
+		if want != "" {
+			want = "--- a\n+++ b\n" + want
+		}
+		if got := unified(lines(tt.a), lines(tt.b), "a", "b"); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, want)
+		}
+	}
+}
+
+// TestCommon checks the lengths of the longest common subsequences of a and
+// each prefix of b.
+func TestCommon(t *testing.T) {
+	a, b := []string{"a", "b", "c", "d"}, []string{"b", "x", "d", "a"}
+	want := []int{0, 1, 1, 2, 2}
+	got := common(a, b)
+	for k := range want {
+		if got[k] != want[k] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
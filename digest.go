@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+const (
+	// DAILY digests cover the day before they're produced
+	DAILY = "daily"
+
+	// WEEKLY digests cover the week, Monday to Sunday, before they're produced
+	WEEKLY = "weekly"
+
+	// REPORTSKEPT is the number of digests kept in the reports directory
+	REPORTSKEPT = 30
+
+	// REPORTED the kind of event emitted when a digest is produced
+	REPORTED = "report.digest"
+)
+
+// digestEvery is how often digests are produced, daily, weekly or never if empty
+var digestEvery string
+
+// digestBy is the label whose value groups jobs in digests
+var digestBy = "team"
+
+// reportsdir is the path to the directory holding the digests
+var reportsdir string
+
+// reports is the reports directory of the jobd name space
+var reports = struct {
+	sync.Mutex
+	dir   *srv.File
+	user  p.User
+	names []string
+	last  time.Time
+}{}
+
+// tally counts the outcomes of a job's runs.
+type tally struct {
+	runs, succeeded, failed, signaled, timedout, skipped int
+}
+
+// validDigest checks that the value of -digest is a digest period.
+func validDigest(value string) error {
+	if value != "" && value != DAILY && value != WEEKLY {
+		return fmt.Errorf("not one of daily or weekly: %s", value)
+	}
+	return nil
+}
+
+// mkReportsDir creates the reports directory at the root of the jobd name space
+// and adds to it the digests produced by an earlier jobd.
+func mkReportsDir(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkReportsDir(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkReportsDir(%v, %v)", dir, user)
+
+	reports.dir, reports.user = new(srv.File), user
+	if err := reports.dir.Add(dir, "reports", user, nil, p.DMDIR|0555, nil); err != nil {
+		glog.Errorln("Can't create reports directory: ", err)
+		return err
+	}
+	reports.last = periodStart(time.Now())
+
+	fis, err := ioutil.ReadDir(reportsdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range fis {
+		if err := addReport(fi.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addReport adds the named digest to the reports directory, removing the oldest
+// digests beyond REPORTSKEPT. The caller must hold the reports lock, or be
+// setting the directory up.
+func addReport(name string) error {
+	rf := &jobfile{
+		// report reader returns the digest.
+		reader: func() []byte {
+			data, err := ioutil.ReadFile(path.Join(reportsdir, name))
+			if err != nil {
+				glog.Errorf("Can't read report %s [%v]", name, err)
+			}
+			return data
+		},
+		// reports are read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := rf.Add(reports.dir, name, reports.user, nil, 0444, rf); err != nil {
+		glog.Errorf("Can't create reports/%s [%v]", name, err)
+		return err
+	}
+	reports.names = append(reports.names, name)
+
+	for len(reports.names) > REPORTSKEPT {
+		old := reports.names[0]
+		reports.names = reports.names[1:]
+		if f := reports.dir.Find(old); f != nil {
+			f.Remove()
+		}
+		if err := os.Remove(path.Join(reportsdir, old)); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Can't remove report %s [%v]", old, err)
+		}
+	}
+
+	return nil
+}
+
+// periodStart returns the start of the digest period t falls within.
+func periodStart(t time.Time) time.Time {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if digestEvery == WEEKLY {
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+	}
+	return start
+}
+
+// digestDue produces a digest of the period that just ended, if one did, writes
+// it to the reports directory and sends it to the notification routes.
+func digestDue(now time.Time) {
+	if digestEvery == "" {
+		return
+	}
+
+	reports.Lock()
+	defer reports.Unlock()
+
+	start := periodStart(now)
+	if !start.After(reports.last) {
+		return
+	}
+	from := reports.last
+	reports.last = start
+
+	name := fmt.Sprintf("%s-%s", digestEvery, from.Format("2006-01-02"))
+	data, runs, failed := summarize(from, start)
+	if err := os.MkdirAll(reportsdir, 0755); err != nil {
+		glog.Errorf("Can't create reports directory [%v]", err)
+		return
+	}
+	if err := ioutil.WriteFile(path.Join(reportsdir, name), data, 0644); err != nil {
+		glog.Errorf("Can't write report %s [%v]", name, err)
+		return
+	}
+	if err := addReport(name); err != nil {
+		return
+	}
+
+	notify(event{
+		Kind:    REPORTED,
+		Message: fmt.Sprintf("%s digest: %d runs, %d failed", digestEvery, runs, failed),
+		Output:  string(data),
+		Path:    "/reports/" + name,
+	})
+}
+
+// summarize renders the outcome of every job's runs since the last digest, grouped
+// by the value of their digestBy label, along with their last failure if it
+// happened between from and to. It also returns the total number of runs and
+// of runs that didn't succeed.
+func summarize(from, to time.Time) ([]byte, int, int) {
+	groups := make(map[string][]*job)
+	for _, j := range jobsroot.list() {
+		group := j.labels()[digestBy]
+		groups[group] = append(groups[group], j)
+	}
+	names := []string{}
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+
+	runs, failed := 0, 0
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%s digest from %s to %s\n", digestEvery, formatTime(from, timefmt), formatTime(to, timefmt))
+	for _, group := range names {
+		if group == "" {
+			fmt.Fprintf(&out, "\n%s unset\n", digestBy)
+		} else {
+			fmt.Fprintf(&out, "\n%s=%s\n", digestBy, group)
+		}
+		for _, j := range groups[group] {
+			t := j.stats.since(&j.reported)
+			runs += t.runs
+			failed += t.runs - t.succeeded
+			fmt.Fprintf(&out, "  %s runs=%d succeeded=%d failed=%d signaled=%d timedout=%d skipped=%d\n",
+				j.defn.name, t.runs, t.succeeded, t.failed, t.signaled, t.timedout, t.skipped)
+
+			j.failed.Lock()
+			if !j.failed.when.Before(from) && j.failed.when.Before(to) {
+				fmt.Fprintf(&out, "    last failure: %s run %d %s, exit %s\n", j.stamp(j.failed.when), j.failed.run, j.failed.status, j.failed.exit)
+			}
+			j.failed.Unlock()
+		}
+	}
+
+	return out.Bytes(), runs, failed
+}
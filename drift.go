@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// OUTPUTDRIFT the kind of event emitted when a successful run's output differs
+// from the previous successful run's by more than the job's drift setting
+const OUTPUTDRIFT = "run.drifted"
+
+// validPercent checks that a setting's value is a percentage from 1 to 100.
+func validPercent(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 100 {
+		return fmt.Errorf("not a percentage from 1 to 100: %s", value)
+	}
+	return nil
+}
+
+// drifted flags the successful run if its output, given by the digests of its
+// lines, differs from that of the job's previous successful kept run in more
+// than the share of lines the job's drift setting allows. Flagged runs still
+// succeed, the drift is noted in their status and the job's log and announced
+// with an event.
+func (j *job) drifted(r *run, lines []string) {
+	threshold := j.count("drift", 0)
+	if threshold == 0 {
+		return
+	}
+
+	var prev *run
+	j.rlk.Lock()
+	for _, kept := range j.runs {
+		if kept == r {
+			break
+		}
+		kept.Lock()
+		if kept.status == SUCCEEDED {
+			prev = kept
+		}
+		kept.Unlock()
+	}
+	j.rlk.Unlock()
+	if prev == nil {
+		return
+	}
+
+	a, _ := outputLines(prev)
+	a, b := digests(a), lines
+	total := len(a) + len(b)
+	if total == 0 {
+		return
+	}
+	changed := total - 2*common(a, b)[len(b)]
+	pct := changed * 100 / total
+	if pct <= threshold {
+		return
+	}
+
+	drift := fmt.Sprintf("%d%% of lines changed since run %d", pct, prev.id)
+	glog.Warningf("Output of %s run %d drifted: %s", j.defn.name, r.id, drift)
+	r.Lock()
+	r.drift = drift
+	r.Unlock()
+
+	j.record(fmt.Sprintf("output drifted, %s\n", drift))
+	ev := j.runEvent(r)
+	ev.Kind, ev.Message = OUTPUTDRIFT, fmt.Sprintf("output drifted, %s", drift)
+	notify(ev)
+}
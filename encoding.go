@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// ansi matches ANSI CSI and OSC escape sequences along with any stray escapes
+var ansi = regexp.MustCompile("\x1b\\[[0-9;?]*[ -/]*[@-~]|\x1b\\][^\x07\x1b]*(\x07|\x1b\\\\)|\x1b[ -~]?")
+
+// cp1252 maps the bytes 0x80 to 0x9f of Windows-1252 to the runes they encode,
+// the remaining bytes encode the same runes as they do in ISO 8859-1
+var cp1252 = [32]rune{
+	'€', '�', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '�', 'Ž', '�',
+	'�', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '�', 'ž', 'Ÿ',
+}
+
+// decoders convert command output in each of the supported encodings to UTF-8
+var decoders = map[string]func([]byte) string{
+	"utf-8": func(b []byte) string {
+		return string(b)
+	},
+	"latin1": func(b []byte) string {
+		rs := make([]rune, len(b))
+		for i, c := range b {
+			rs[i] = rune(c)
+		}
+		return string(rs)
+	},
+	"windows-1252": func(b []byte) string {
+		rs := make([]rune, len(b))
+		for i, c := range b {
+			if c >= 0x80 && c < 0xa0 {
+				rs[i] = cp1252[c-0x80]
+			} else {
+				rs[i] = rune(c)
+			}
+		}
+		return string(rs)
+	},
+	"utf-16le": func(b []byte) string {
+		return decodeUTF16(b, binary.LittleEndian)
+	},
+	"utf-16be": func(b []byte) string {
+		return decodeUTF16(b, binary.BigEndian)
+	},
+}
+
+// decodeUTF16 converts UTF-16 text in the given byte order to UTF-8, a trailing
+// odd byte is replaced.
+func decodeUTF16(b []byte, order binary.ByteOrder) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = order.Uint16(b[2*i:])
+	}
+
+	s := string(utf16.Decode(units))
+	if len(b)%2 != 0 {
+		s += string(utf8.RuneError)
+	}
+	return s
+}
+
+// singlebyte are the supported encodings that encode a character per byte
+var singlebyte = map[string]bool{"latin1": true, "windows-1252": true}
+
+// textcount counts the characters of a command's output as it's written, along
+// with those that make it look like binary data: NULs, control characters and
+// invalid characters. Output is taken to be UTF-8, where a character split
+// between two writes is counted once whole, unless decode is set to the
+// decoder of a single byte encoding.
+type textcount struct {
+	n       int
+	odd     int
+	nul     bool
+	partial []byte
+	decode  func([]byte) string
+}
+
+// Write counts the characters of the output, never failing.
+func (c *textcount) Write(data []byte) (int, error) {
+	n := len(data)
+	if c.decode != nil {
+		for _, r := range c.decode(data) {
+			c.count(r, 1)
+		}
+		return n, nil
+	}
+	if len(c.partial) > 0 {
+		data = append(c.partial, data...)
+		c.partial = nil
+	}
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			c.partial = append([]byte{}, data...)
+			break
+		}
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+		c.count(r, size)
+	}
+	return n, nil
+}
+
+// count counts a character decoded from size bytes of the output.
+func (c *textcount) count(r rune, size int) {
+	c.n++
+	switch {
+	case r == 0:
+		c.nul = true
+	case r == utf8.RuneError && size == 1:
+		c.odd++
+	case r < ' ' && !strings.ContainsRune("\t\n\r\f\b\x1b", r):
+		c.odd++
+	}
+}
+
+// binary reports whether the output counted looks like binary data rather than
+// text: it contains a NUL or more than one in ten of its characters are control
+// characters or invalid. An incomplete character it ends with is invalid.
+func (c *textcount) binary() bool {
+	odd, n := c.odd+len(c.partial), c.n+len(c.partial)
+	return c.nul || odd*10 > n
+}
+
+// binary reports whether a command's output, as counted, looks like binary
+// data rather than text. Output in a UTF-16 encoding is always text.
+func (j *job) binary(text *textcount) bool {
+	if strings.HasPrefix(strings.ToLower(j.setting("encoding")), "utf-16") {
+		return false
+	}
+	return text.binary()
+}
+
+// validEncoding checks that a setting's value names a supported encoding.
+func validEncoding(value string) error {
+	if _, ok := decoders[strings.ToLower(value)]; !ok {
+		return fmt.Errorf("unsupported encoding: %s", value)
+	}
+	return nil
+}
+
+// clean converts a command's output from the job's declared encoding, UTF-8 if
+// it hasn't declared one, into valid UTF-8 replacing any invalid sequences and,
+// if the job asks for it, removing ANSI escape sequences.
+func (j *job) clean(out []byte) string {
+	decode, ok := decoders[strings.ToLower(j.setting("encoding"))]
+	if !ok {
+		decode = decoders["utf-8"]
+	}
+
+	s := strings.ToValidUTF8(decode(out), string(utf8.RuneError))
+	if j.enabled("stripansi") {
+		s = ansi.ReplaceAllString(s, "")
+	}
+	return s
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// fieldError reports that the value written for one field of a job definition,
+// ctl command or setting was rejected, and why.
+type fieldError struct {
+	field string
+	err   error
+}
+
+// Error returns the error as <field>: <reason>.
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.field, e.err)
+}
+
+// invalid returns a fieldError for the named field with a formatted reason.
+func invalid(field, format string, args ...interface{}) error {
+	return &fieldError{field: field, err: fmt.Errorf(format, args...)}
+}
+
+// rejection records a write to one of a job's files that was refused.
+type rejection struct {
+	sync.Mutex
+	when time.Time
+	file string
+	data string
+	err  error
+}
+
+// STDERRKEPT is the number of bytes at the end of a run's stderr kept for
+// diagnosing failures
+const STDERRKEPT = 4096
+
+// tail keeps the last STDERRKEPT bytes written to it.
+type tail struct {
+	sync.Mutex
+	buf []byte
+}
+
+// Write adds data to the tail discarding whatever no longer fits.
+func (t *tail) Write(data []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.buf = append(t.buf, data...)
+	if len(t.buf) > STDERRKEPT {
+		t.buf = t.buf[len(t.buf)-STDERRKEPT:]
+	}
+	return len(data), nil
+}
+
+// Bytes returns the tail's contents.
+func (t *tail) Bytes() []byte {
+	t.Lock()
+	defer t.Unlock()
+
+	return append([]byte{}, t.buf...)
+}
+
+// failure records the most recent run of a job that didn't succeed.
+type failure struct {
+	sync.Mutex
+	when     time.Time
+	run      int
+	status   string
+	exit     string
+	stderr   []byte
+	decision string
+}
+
+// mkErrorsFile creates the read only file that reports the job's most recent
+// failure in full followed by the last write to one of the job's files that was
+// rejected and the reason it was.
+func mkErrorsFile(job *job, user p.User) error {
+	ef := &jobfile{
+		// errors reader returns the job's last failure and last rejected write.
+		reader: func() []byte {
+			return []byte(job.failed.describe(job) + job.rejected.describe(job))
+		},
+		// errors is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := ef.Add(&job.File, "errors", user, nil, 0444, ef); err != nil {
+		glog.Errorf("Can't create %s/errors [%v]", job.defn.name, err)
+		return err
+	}
+
+	return nil
+}
+
+// reject records a write to the named file that was refused with err.
+func (rj *rejection) reject(file string, data []byte, err error) {
+	rj.Lock()
+	defer rj.Unlock()
+
+	rj.when, rj.file, rj.data, rj.err = time.Now(), file, string(data), err
+}
+
+// describe renders the rejection, with its time in the job's time format, or
+// returns the empty string if nothing has been rejected.
+func (rj *rejection) describe(j *job) string {
+	rj.Lock()
+	defer rj.Unlock()
+
+	if rj.err == nil {
+		return ""
+	}
+	return fmt.Sprintf("rejected: %s\nfile: %s\nwrite: %q\nerror: %v\n", j.stamp(rj.when), rj.file, rj.data, rj.err)
+}
+
+// fail records a run that didn't succeed along with the tail of its stderr.
+func (f *failure) fail(r *run, stderr []byte) {
+	r.Lock()
+	defer r.Unlock()
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.when, f.run, f.status, f.stderr, f.decision = r.end, r.id, r.status, stderr, "not retried"
+	f.exit = "none"
+	if ee, ok := r.err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+			switch {
+			case ws.Signaled():
+				f.exit = fmt.Sprintf("signal %d (%v)", int(ws.Signal()), ws.Signal())
+			case ws.Exited():
+				f.exit = fmt.Sprintf("status %d", ws.ExitStatus())
+			}
+		}
+	} else if r.err != nil {
+		f.exit = r.err.Error()
+	}
+}
+
+// decide records what was done about the most recent failure.
+func (f *failure) decide(decision string) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.decision = decision
+}
+
+// describe renders the failure, with its time in the job's time format, or
+// returns the empty string if the job hasn't failed.
+func (f *failure) describe(j *job) string {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.when.IsZero() {
+		return ""
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "failed: %s\nrun: %d\nstatus: %s\nexit: %s\nretry: %s\n", j.stamp(f.when), f.run, f.status, f.exit, f.decision)
+	if len(f.stderr) > 0 {
+		fmt.Fprintf(&out, "stderr:\n")
+		for _, line := range bytes.Split(bytes.TrimRight(f.stderr, "\n"), []byte("\n")) {
+			fmt.Fprintf(&out, "\t%s\n", line)
+		}
+	}
+	return out.String()
+}
+
+// owner returns the job whose directory contains f, or nil if f isn't part of
+// a job.
+func owner(f *srv.File) *job {
+	for ; f != nil; f = f.Parent {
+		if j, ok := f.Ops.(*job); ok {
+			return j
+		}
+	}
+	return nil
+}
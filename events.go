@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"container/ring"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+const (
+	// EVENTSKEPT is the number of events kept for the events file
+	EVENTSKEPT = 256
+
+	// OUTPUTLINES is the number of lines of output included in run events
+	OUTPUTLINES = 10
+
+	// SUBSCRIBERBACKLOG is the number of events a subscriber may fall behind by
+	// before it misses some
+	SUBSCRIBERBACKLOG = 64
+)
+
+const (
+	// JOBSTARTED the kind of event emitted when a job is started
+	JOBSTARTED = "job.started"
+
+	// JOBSTOPPED the kind of event emitted when a job is stopped
+	JOBSTOPPED = "job.stopped"
+
+	// RUNFINISHED the kind of event emitted when a run finishes
+	RUNFINISHED = "run.finished"
+)
+
+// event describes something that happened to a job.
+type event struct {
+	Time       time.Time         `json:"time"`
+	Kind       string            `json:"kind"`
+	Job        string            `json:"job,omitempty"`
+	JobID      string            `json:"job_id,omitempty"`
+	Run        int               `json:"run,omitempty"`
+	Status     string            `json:"status,omitempty"`
+	Severity   string            `json:"severity,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Message    string            `json:"message"`
+	Exit       string            `json:"exit,omitempty"`
+	Duration   time.Duration     `json:"duration,omitempty"`
+	Output     string            `json:"output,omitempty"`
+	Path       string            `json:"path,omitempty"`
+	Suppressed bool              `json:"suppressed,omitempty"`
+	Author     string            `json:"author,omitempty"`
+	Diff       string            `json:"diff,omitempty"`
+
+	// quiet is the end of the quiet hours of the event's job
+	quiet time.Time
+}
+
+// events holds the most recent events and the channels of those subscribed to
+// new ones
+var events = struct {
+	sync.Mutex
+	recent      *ring.Ring
+	subscribers map[chan event]bool
+}{recent: ring.New(EVENTSKEPT), subscribers: make(map[chan event]bool)}
+
+// mkEventsFile creates the read only events file at the root of the jobd name
+// space.
+func mkEventsFile(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkEventsFile(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkEventsFile(%v, %v)", dir, user)
+
+	ef := &jobfile{
+		// events reader returns the most recent events, oldest first.
+		reader: cached(func() []byte {
+			var out bytes.Buffer
+			for _, ev := range recentEvents() {
+				fmt.Fprintf(&out, "%s %s", formatTime(ev.Time, timefmt), ev.Kind)
+				if ev.Job != "" {
+					fmt.Fprintf(&out, " %s", ev.Job)
+				}
+				if ev.Run != 0 {
+					fmt.Fprintf(&out, " run=%d", ev.Run)
+				}
+				if ev.Status != "" {
+					fmt.Fprintf(&out, " status=%s", ev.Status)
+				}
+				if ev.Suppressed {
+					fmt.Fprintf(&out, " suppressed")
+				}
+				if ev.Author != "" {
+					fmt.Fprintf(&out, " by=%s", ev.Author)
+				}
+				fmt.Fprintf(&out, " %s\n", ev.Message)
+			}
+			return out.Bytes()
+		}),
+		// events is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := ef.Add(dir, "events", user, nil, 0444, ef); err != nil {
+		glog.Errorln("Can't create events file: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// emit adds an event to the recent events, passes it to the subscribers, except
+// those that have fallen SUBSCRIBERBACKLOG events behind, and feeds it to the
+// sinks. Every event goes through emit, those notified as well.
+func emit(ev event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	events.Lock()
+	defer events.Unlock()
+
+	events.recent.Value = ev
+	events.recent = events.recent.Next()
+	for c := range events.subscribers {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+	publish(ev)
+	touch()
+}
+
+// subscribe returns a channel the events emitted from now on are sent to,
+// until it's unsubscribed.
+func subscribe() chan event {
+	events.Lock()
+	defer events.Unlock()
+
+	c := make(chan event, SUBSCRIBERBACKLOG)
+	events.subscribers[c] = true
+	return c
+}
+
+// unsubscribe stops sending events to a subscriber's channel.
+func unsubscribe(c chan event) {
+	events.Lock()
+	defer events.Unlock()
+
+	delete(events.subscribers, c)
+}
+
+// recentEvents returns the recent events oldest first.
+func recentEvents() []event {
+	events.Lock()
+	defer events.Unlock()
+
+	result := []event{}
+	events.recent.Do(func(v interface{}) {
+		if v != nil {
+			result = append(result, v.(event))
+		}
+	})
+	return result
+}
+
+// event returns an event of the given kind about the job.
+func (j *job) event(kind, format string, args ...interface{}) event {
+	return event{
+		Kind:     kind,
+		Job:      j.defn.name,
+		JobID:    j.defn.id,
+		Severity: j.severity(),
+		Labels:   j.labels(),
+		Message:  fmt.Sprintf(format, args...),
+		quiet:    j.quiet(time.Now()),
+	}
+}
+
+// runEvent returns the event announcing that a run finished. It includes the
+// last lines of the run's output and the path of its directory in the jobd name
+// space.
+func (j *job) runEvent(r *run) event {
+	r.Lock()
+	defer r.Unlock()
+
+	ev := j.event(RUNFINISHED, "%s after %v", r.status, r.end.Sub(r.start))
+	ev.Time, ev.Run, ev.Status, ev.Duration = r.end, r.id, r.status, r.end.Sub(r.start)
+	ev.Path = fmt.Sprintf("/jobs/%s/runs/%d", j.defn.name, r.id)
+	if code, ok := exitCode(r.err); ok && r.err != nil {
+		ev.Exit = fmt.Sprintf("exit %d", code)
+	}
+	ev.Output = lastLines(r.out, OUTPUTLINES)
+	return ev
+}
+
+// lastLines returns up to n lines from the end of the named file, or the empty
+// string if it can't be read or looks like binary data.
+func lastLines(name string, n int) string {
+	data, err := readTail(name, STDERRKEPT)
+	if err != nil || bytes.IndexByte(data, 0) >= 0 {
+		return ""
+	}
+
+	lines := strings.Split(strings.TrimRight(strings.ToValidUTF8(string(data), "?"), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readTail returns up to the last n bytes of the named file. Encrypted files have
+// to be read whole to be decrypted.
+func readTail(name string, n int64) ([]byte, error) {
+	if sealer != nil {
+		data, err := readSealed(name)
+		if int64(len(data)) > n {
+			data = data[int64(len(data))-n:]
+		}
+		return data, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil && fi.Size() > n {
+		f.Seek(-n, io.SeekEnd)
+	}
+	return ioutil.ReadAll(f)
+}
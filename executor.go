@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// SHELL is the executor that runs commands with the job's shell
+	SHELL = "shell"
+
+	// FAKE is the executor that records commands instead of running them and
+	// reports the results set by the job's fake setting
+	FAKE = "fake"
+)
+
+// executor is how jobd executes the commands of runs
+var executor = SHELL
+
+// fakeExit is the error of a fake run that ended with a non zero exit code.
+type fakeExit int
+
+func (fe fakeExit) Error() string {
+	return fmt.Sprintf("exit status %d", int(fe))
+}
+
+// fakeresult is what a fake run reports, as given by the job's fake setting.
+type fakeresult struct {
+	exit     int
+	duration time.Duration
+	output   string
+}
+
+// validExecutor checks that an executor is one jobd knows.
+func validExecutor(name string) error {
+	switch name {
+	case SHELL, FAKE:
+		return nil
+	}
+	return fmt.Errorf("not one of %s or %s: %s", SHELL, FAKE, name)
+}
+
+// validFake checks that a setting's value describes the result of fake runs.
+func validFake(value string) error {
+	_, err := parseFake(value)
+	return err
+}
+
+// parseFake parses the result of fake runs given as a comma separated list of
+// exit=<code>, duration=<duration> and output=<text>, each optional.
+func parseFake(value string) (fakeresult, error) {
+	var result fakeresult
+	if value == "" {
+		return result, nil
+	}
+
+	for _, kv := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return fakeresult{}, fmt.Errorf("expected exit, duration or output=value: %s", kv)
+		}
+		switch parts[0] {
+		case "exit":
+			code, err := strconv.Atoi(parts[1])
+			if err != nil || code < 0 || code > 255 {
+				return fakeresult{}, fmt.Errorf("not an exit code: %s", parts[1])
+			}
+			result.exit = code
+		case "duration":
+			d, err := time.ParseDuration(parts[1])
+			if err != nil || d < 0 {
+				return fakeresult{}, fmt.Errorf("not a duration: %s", parts[1])
+			}
+			result.duration = d
+		case "output":
+			result.output = parts[1]
+		default:
+			return fakeresult{}, fmt.Errorf("expected exit, duration or output=value: %s", kv)
+		}
+	}
+	return result, nil
+}
+
+// fake stands in for running cmd in one of the job's runs. It writes the output
+// the job's fake setting gives, or a line naming the command, to stdout and
+// after the setting's duration, or the job's timeout if that's shorter, ends
+// with its exit code. The duration passes on the scheduler's clock, and is cut
+// short, as if by SIGTERM, when the job is stopped.
+func (j *job) fake(r *run, cmd string, stdout io.Writer) error {
+	result, err := parseFake(j.setting("fake"))
+	if err != nil {
+		glog.Errorf("Can't fake a run of %s [%v]", j.defn.name, err)
+		return err
+	}
+	glog.V(3).Infof("faking `%s`", cmd)
+
+	output := result.output
+	if output == "" {
+		output = fmt.Sprintf("fake run of %s", cmd)
+	}
+	fmt.Fprintln(stdout, output)
+
+	stopped := make(chan bool, 1)
+	defer j.interruptible(r, func() {
+		select {
+		case stopped <- true:
+		default:
+		}
+	})()
+	wait := func(d time.Duration) bool {
+		select {
+		case <-sched.After(d):
+			return true
+		case <-stopped:
+			return false
+		}
+	}
+
+	if timeout := j.duration("timeout"); timeout > 0 && result.duration > timeout {
+		if !wait(timeout) {
+			return fakeExit(143)
+		}
+		glog.Errorf("%s timed out after %v", cmd, timeout)
+		r.expire()
+		return fakeExit(137)
+	}
+	if !wait(result.duration) {
+		return fakeExit(143)
+	}
+
+	if result.exit != 0 {
+		return fakeExit(result.exit)
+	}
+	return nil
+}
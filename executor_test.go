@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFakeRun checks that a fake run reports the output and exit code given by
+// the job's fake setting, instead of running the job's command.
+func TestFakeRun(t *testing.T) {
+	h := mkharness(t)
+	ran := path.Join(t.TempDir(), "ran")
+	h.write("/clone", "faked:0 0 0 1 1 ? *:touch "+ran)
+	h.write("/jobs/faked/settings", "fake=exit=3,output=boom\n")
+
+	h.write("/jobs/faked/ctl", RUN)
+	h.eventually("the run to fail", func() bool { return strings.Contains(h.read("/jobs/faked/errors"), "exit status 3") })
+	if stdout := h.read("/jobs/faked/runs/1/stdout"); stdout != "boom\n" {
+		t.Errorf("got stdout %q, want the fake run's output", stdout)
+	}
+	if _, err := os.Stat(ran); !os.IsNotExist(err) {
+		t.Error("the command was run")
+	}
+}
+
+// TestFakeRunTakesClockTime checks that a fake run takes its duration on the
+// scheduler's clock, and is interrupted by stopping its job.
+func TestFakeRunTakesClockTime(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "slow:0 0 0 1 1 ? *:true")
+	h.write("/jobs/slow/settings", "fake=duration=1h\n")
+	lastStatus := func() string {
+		lines := strings.Split(strings.TrimSpace(h.read("/jobs/slow/records")), "\n")
+		var rec runrecord
+		json.Unmarshal([]byte(lines[len(lines)-1]), &rec)
+		return rec.Status
+	}
+
+	h.write("/jobs/slow/ctl", RUN)
+	h.eventually("the run to wait for the clock", func() bool { return h.clock.waiters() == 1 })
+	h.clock.advance(59 * time.Minute)
+	if h.read("/jobs/slow/records") != "" {
+		t.Fatal("the run finished before its duration passed")
+	}
+	h.clock.advance(time.Minute)
+	h.eventually("the run to succeed", func() bool { return lastStatus() == SUCCEEDED })
+
+	h.write("/jobs/slow/ctl", RUN)
+	h.eventually("the run to wait for the clock", func() bool { return h.clock.waiters() == 1 })
+	h.write("/jobs/slow/ctl", STOP)
+	h.eventually("the run to be interrupted", func() bool { return lastStatus() == INTERRUPTED })
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// FANOUT is the executor that runs the job's command once per item, given
+	// by its items or itemsfrom setting, with $ITEM set to the item
+	FANOUT = "fanout"
+
+	// MAXITEMS is the most items a fan out runs the job's command for
+	MAXITEMS = 1000
+)
+
+// syncWriter serializes the writes of the commands a fan out runs at once.
+type syncWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (sw *syncWriter) Write(data []byte) (int, error) {
+	sw.Lock()
+	defer sw.Unlock()
+
+	return sw.w.Write(data)
+}
+
+// validItems checks that a setting's value is a comma separated list of items.
+func validItems(value string) error {
+	items := splitItems(value)
+	if len(items) == 0 {
+		return fmt.Errorf("no items: %s", value)
+	}
+	if len(items) > MAXITEMS {
+		return fmt.Errorf("%d items, more than the limit of %d", len(items), MAXITEMS)
+	}
+	return nil
+}
+
+// validGenerator checks that a setting's value is a command that may be passed
+// to the shell.
+func validGenerator(value string) error {
+	if strings.IndexByte(value, 0) >= 0 {
+		return fmt.Errorf("contains a NUL byte")
+	}
+	return nil
+}
+
+// splitItems returns the non empty items of a comma separated list.
+func splitItems(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// items returns the items the job's command is run for, those of its items
+// setting or, if it has none, the lines its itemsfrom setting's command writes
+// to its stdout.
+func (j *job) items(ctx context.Context, shell string, env []string) ([]string, error) {
+	if value := j.setting("items"); value != "" {
+		return splitItems(value), nil
+	}
+	generator := j.setting("itemsfrom")
+	if generator == "" {
+		return nil, invalid("items", "neither items nor itemsfrom is set")
+	}
+
+	var out bytes.Buffer
+	k := exec.CommandContext(ctx, shell, "-c", generator)
+	k.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	k.Env = env
+	k.Stdout = &out
+	if err := k.Run(); err != nil {
+		return nil, fmt.Errorf("itemsfrom: %v", err)
+	}
+
+	items := []string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			items = append(items, line)
+		}
+	}
+	if len(items) > MAXITEMS {
+		return nil, invalid("itemsfrom", "%d items, more than the limit of %d", len(items), MAXITEMS)
+	}
+	return items, nil
+}
+
+// fanout runs the job's command once per item, with $ITEM set, up to the job's
+// parallel setting at once, one if it isn't set. Every item is run even if
+// some fail, and the run fails if any does. Each item's outcome is kept with
+// the run and exposed in its items directory. It stops once ctx is done.
+func (j *job) fanout(ctx context.Context, r *run, rc runctx, stdout, stderr io.Writer) error {
+	items, err := j.items(ctx, rc.Shell, rc.Env)
+	if err != nil {
+		return err
+	}
+	r.mkResultsDir(j, "items")
+
+	out, errout := &syncWriter{w: stdout}, &syncWriter{w: stderr}
+	slots := make(chan bool, j.count("parallel", 1))
+	var wg sync.WaitGroup
+	var lk sync.Mutex
+	failed := 0
+	for i, item := range items {
+		res := &stepresult{n: i + 1, item: item, cmd: rc.Cmd, status: SKIPPED}
+		r.addResult(j, "items", res)
+
+		slots <- true
+		if ctx.Err() != nil {
+			<-slots
+			continue
+		}
+		wg.Add(1)
+		go func(res *stepresult, item string) {
+			defer func() { <-slots; wg.Done() }()
+
+			env := append(append([]string{}, rc.Env...), "ITEM="+item)
+			fmt.Fprintf(out, "== item %d: %s\n", res.n, item)
+			if err := j.step(ctx, r, res, step{cmd: rc.Cmd}, rc.Shell, env, out, errout); err != nil {
+				lk.Lock()
+				failed++
+				lk.Unlock()
+			}
+		}(res, item)
+	}
+	wg.Wait()
+
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case failed > 0:
+		return fmt.Errorf("%d of %d items failed", failed, len(items))
+	}
+	return nil
+}
+
+// previewItems writes the items the job's command would be run for, a line
+// each, to stdout without running it for them.
+func (j *job) previewItems(ctx context.Context, stdout io.Writer) error {
+	env := append(os.Environ(), "JOBD_DRY_RUN=1")
+	items, err := j.items(ctx, j.shell(), env)
+	if err != nil {
+		return err
+	}
+	for i, item := range items {
+		fmt.Fprintf(stdout, "would run item %d: %s\n", i+1, item)
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/clnt"
+)
+
+// fusemount is the directory jobd's name space is mounted on through FUSE, as
+// well as being served over 9P, none if empty
+var fusemount string
+
+// fusefs exposes jobd's name space as a local file system through FUSE. It's a
+// 9P client of jobd's own listener, connected once for each local user making
+// requests, so that files behave, and their permissions are checked, exactly
+// as they are for 9P clients.
+type fusefs struct {
+	addr  string
+	msize uint32
+
+	sync.Mutex
+	clnts map[uint32]*clnt.Clnt
+}
+
+// fusenode is a file or directory of the FUSE file system, as last stat'ed.
+type fusenode struct {
+	fsys *fusefs
+	path string
+	dir  *p.Dir
+}
+
+// fusehandle is a file or directory of the FUSE file system opened over 9P.
+type fusehandle struct {
+	f *clnt.File
+}
+
+// mountFUSE mounts jobd's name space, served on addr, on dir through FUSE and
+// serves it until it's unmounted.
+func mountFUSE(dir, addr string, msize uint32) error {
+	glog.V(4).Infof("Entering mountFUSE(%s, %s, %d)", dir, addr, msize)
+	defer glog.V(4).Infof("Exiting mountFUSE(%s, %s, %d)", dir, addr, msize)
+
+	options := []fuse.MountOption{fuse.FSName("jobd"), fuse.Subtype("jobd")}
+	if os.Geteuid() == 0 {
+		options = append(options, fuse.AllowOther())
+	}
+	c, err := fuse.Mount(dir, options...)
+	if err != nil {
+		return err
+	}
+
+	fsys := &fusefs{addr: addr, msize: msize, clnts: make(map[uint32]*clnt.Clnt)}
+	go func() {
+		defer c.Close()
+		if err := fs.Serve(c, fsys); err != nil {
+			glog.Errorf("FUSE file system on %s failed [%v]", dir, err)
+		}
+		fsys.Lock()
+		defer fsys.Unlock()
+		for _, c := range fsys.clnts {
+			c.Unmount()
+		}
+	}()
+	glog.Infof("Mounted the name space on %s", dir)
+	return nil
+}
+
+// unmountFUSE unmounts jobd's name space from the -fusemount directory, if it
+// was mounted there.
+func unmountFUSE() {
+	if fusemount == "" {
+		return
+	}
+	if err := fuse.Unmount(fusemount); err != nil {
+		glog.Errorf("Can't unmount %s [%v]", fusemount, err)
+	}
+}
+
+// Root returns the root directory of the FUSE file system.
+func (fsys *fusefs) Root() (fs.Node, error) {
+	return &fusenode{fsys: fsys, path: "/"}, nil
+}
+
+// client returns the 9P connection of the local user uid, making it the first
+// time the user makes a request.
+func (fsys *fusefs) client(uid uint32) (*clnt.Clnt, error) {
+	fsys.Lock()
+	defer fsys.Unlock()
+
+	if c, ok := fsys.clnts[uid]; ok {
+		return c, nil
+	}
+	user := p.OsUsers.Uid2User(int(uid))
+	if user == nil {
+		return nil, fuse.EPERM
+	}
+	c, err := clnt.Mount("tcp", fsys.addr, "", fsys.msize, user)
+	if err != nil {
+		glog.Errorf("Can't connect %s to %s [%v]", user.Name(), fsys.addr, err)
+		return nil, fuse.EIO
+	}
+	fsys.clnts[uid] = c
+	return c, nil
+}
+
+// fuseErr returns the FUSE error of a 9P one, its error number when the server
+// gave one.
+func fuseErr(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case fuse.Errno:
+		return e
+	case *p.Error:
+		if e.Errornum != 0 {
+			return fuse.Errno(syscall.Errno(e.Errornum))
+		}
+	}
+	return fuse.EIO
+}
+
+// fill sets the attributes of a file from its 9P stat. Attributes aren't
+// cached since the contents of jobd's files change as they're read.
+func fill(d *p.Dir, attr *fuse.Attr) {
+	attr.Valid = 0
+	if d == nil {
+		attr.Mode = os.ModeDir | 0555
+		return
+	}
+	attr.Inode = d.Qid.Path
+	attr.Size = d.Length
+	attr.Mtime = time.Unix(int64(d.Mtime), 0)
+	attr.Mode = os.FileMode(d.Mode & 0777)
+	if d.Mode&p.DMDIR != 0 {
+		attr.Mode |= os.ModeDir
+	}
+	if u := p.OsUsers.Uname2User(d.Uid); u != nil {
+		attr.Uid = uint32(u.Id())
+	}
+}
+
+// Attr returns the attributes of the node as of its last stat.
+func (n *fusenode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	fill(n.dir, attr)
+	return nil
+}
+
+// Getattr stats the node on behalf of the user asking.
+func (n *fusenode) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+	c, err := n.fsys.client(req.Uid)
+	if err != nil {
+		return err
+	}
+	d, err := c.FStat(n.path)
+	if err != nil {
+		return fuseErr(err)
+	}
+	fill(d, &resp.Attr)
+	return nil
+}
+
+// Lookup returns the node of the named file in the directory.
+func (n *fusenode) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	c, err := n.fsys.client(req.Uid)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Join(n.path, req.Name)
+	d, err := c.FStat(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	return &fusenode{fsys: n.fsys, path: name, dir: d}, nil
+}
+
+// Open opens the node over 9P in the mode asked for. Files are read and written
+// directly, bypassing the page cache, so that each write reaches jobd as is.
+func (n *fusenode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	c, err := n.fsys.client(req.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	var mode uint8 = p.OREAD
+	switch {
+	case req.Flags.IsWriteOnly():
+		mode = p.OWRITE
+	case req.Flags.IsReadWrite():
+		mode = p.ORDWR
+	}
+	if req.Flags&fuse.OpenTruncate != 0 {
+		mode |= p.OTRUNC
+	}
+	f, err := c.FOpen(n.path, mode)
+	if err != nil {
+		return nil, fuseErr(err)
+	}
+	if !req.Dir {
+		resp.Flags |= fuse.OpenDirectIO
+	}
+	return &fusehandle{f}, nil
+}
+
+// Remove removes the named file from the directory.
+func (n *fusenode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	c, err := n.fsys.client(req.Uid)
+	if err != nil {
+		return err
+	}
+	return fuseErr(c.FRemove(path.Join(n.path, req.Name)))
+}
+
+// Setattr accepts, and ignores, changes to the node's attributes, as Wstat does
+// for 9P clients, so that truncating a file before writing it succeeds.
+func (n *fusenode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	fill(n.dir, &resp.Attr)
+	return nil
+}
+
+// ReadDirAll returns the entries of an open directory.
+func (h *fusehandle) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	entries := []fuse.Dirent{}
+	for {
+		dirs, err := h.f.Readdir(0)
+		if err != nil && err != io.EOF {
+			return nil, fuseErr(err)
+		}
+		if len(dirs) == 0 {
+			return entries, nil
+		}
+		for _, d := range dirs {
+			entry := fuse.Dirent{Inode: d.Qid.Path, Type: fuse.DT_File, Name: d.Name}
+			if d.Mode&p.DMDIR != 0 {
+				entry.Type = fuse.DT_Dir
+			}
+			entries = append(entries, entry)
+		}
+	}
+}
+
+// Read reads from an open file at the offset asked for.
+func (h *fusehandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := h.f.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return fuseErr(err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+// Write writes to an open file, a 9P write per FUSE one.
+func (h *fusehandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	n, err := h.f.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	return fuseErr(err)
+}
+
+// Release closes an open file.
+func (h *fusehandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return fuseErr(h.f.Close())
+}
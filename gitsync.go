@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// gitrepo is the Git repository of job definitions jobd syncs with, none if
+// empty
+var gitrepo string
+
+// gitbranch is the branch of gitrepo jobd syncs with
+var gitbranch = "main"
+
+// gitpath is the directory within gitrepo holding the definitions
+var gitpath string
+
+// gitinterval is how often jobd pulls gitrepo
+var gitinterval = 5 * time.Minute
+
+// gitdir is where jobd keeps its clone of gitrepo
+var gitdir string
+
+// synced is the commit of gitrepo jobd last reconciled with
+var synced struct {
+	sync.Mutex
+	head string
+}
+
+// git runs git with args in jobd's clone of the repository and returns its
+// output.
+func git(args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", gitdir}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// pull brings jobd's clone of the repository up to date with its branch,
+// cloning it the first time, and returns the commit it's at.
+func pull() (string, error) {
+	if _, err := os.Stat(path.Join(gitdir, ".git")); os.IsNotExist(err) {
+		out, err := exec.Command("git", "clone", "--branch", gitbranch, "--single-branch", gitrepo, gitdir).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git clone: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	} else {
+		if _, err := git("fetch", "origin", gitbranch); err != nil {
+			return "", err
+		}
+		if _, err := git("reset", "--hard", "origin/"+gitbranch); err != nil {
+			return "", err
+		}
+	}
+	return git("rev-parse", "HEAD")
+}
+
+// gitSync pulls the repository and, if it has moved since or force is set,
+// reconciles the jobs with the definitions it holds.
+func gitSync(force bool) error {
+	synced.Lock()
+	defer synced.Unlock()
+
+	head, err := pull()
+	if err != nil {
+		return err
+	}
+
+	if head == synced.head && !force {
+		return nil
+	}
+	glog.Infof("Reconciling jobs with %s at %s", gitrepo, head)
+	if err := reconcile(); err != nil {
+		return err
+	}
+	synced.head = head
+	return nil
+}
+
+// syncEvery pulls the repository every gitinterval.
+func syncEvery() {
+	for range time.Tick(gitinterval) {
+		if err := gitSync(false); err != nil {
+			glog.Errorf("Can't sync job definitions [%v]", err)
+		}
+	}
+}
+
+// commitOf returns the last commit of the repository that changed the named
+// file.
+func commitOf(name string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(name, gitdir), "/")
+	commit, err := git("log", "-1", "--format=%H", "--", rel)
+	if err != nil {
+		glog.Errorf("Can't find the commit of %s [%v]", name, err)
+		return ""
+	}
+	return commit
+}
+
+// mkOriginFile creates the job's read only origin file naming the file its
+// definition came from and, when it's in a Git repository, the commit.
+func mkOriginFile(job *job, user p.User) error {
+	of := &jobfile{
+		// origin reader returns where the job's definition came from.
+		reader: func() []byte {
+			job.rlk.Lock()
+			defer job.rlk.Unlock()
+			if job.origin == "" {
+				return []byte{}
+			}
+			return []byte(job.origin + "\n")
+		},
+		// origin is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := of.Add(&job.File, "origin", user, nil, 0444, of); err != nil {
+		glog.Errorf("Can't create %s/origin [%v]", job.defn.name, err)
+		return err
+	}
+
+	return nil
+}
+
+// setOrigin records where the job's definition came from.
+func (j *job) setOrigin(origin string) {
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	j.origin = origin
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// GUARDCMD the guard kind that runs a command, a non-zero exit status means
+	// there's nothing to do
+	GUARDCMD = "cmd"
+
+	// GUARDMTIME the guard kind that checks a file's modification time, an
+	// unchanged mtime means there's nothing to do
+	GUARDMTIME = "mtime"
+)
+
+// parseGuard splits a guard definition of the form "cmd <command>" or
+// "mtime <path>" into its kind and argument.
+func parseGuard(guard string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimSpace(guard), " ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return "", "", fmt.Errorf("invalid guard: %s", guard)
+	}
+
+	switch kind := parts[0]; kind {
+	case GUARDCMD, GUARDMTIME:
+		return kind, strings.TrimSpace(parts[1]), nil
+	default:
+		return "", "", fmt.Errorf("unknown guard kind: %s", kind)
+	}
+}
+
+// validGuard checks that a setting's value is a guard definition.
+func validGuard(value string) error {
+	_, _, err := parseGuard(value)
+	return err
+}
+
+// skip evaluates the job's guard, if it has one, and reports whether the next
+// run should be skipped because there's nothing for it to do.
+func (j *job) skip() bool {
+	guard := j.setting("guard")
+	if guard == "" {
+		return false
+	}
+
+	kind, arg, err := parseGuard(guard)
+	if err != nil {
+		glog.Errorf("%s has a bad guard [%v]", j.defn.name, err)
+		return false
+	}
+
+	switch kind {
+	case GUARDCMD:
+		if err := exec.Command(j.shell(), "-c", arg).Run(); err != nil {
+			glog.V(3).Infof("%s guard `%s` says skip [%v]", j.defn.name, arg, err)
+			return true
+		}
+	case GUARDMTIME:
+		fi, err := os.Stat(arg)
+		if err != nil {
+			glog.Errorf("%s can't stat guard file %s [%v]", j.defn.name, arg, err)
+			return false
+		}
+		if fi.ModTime().Equal(j.mtime) {
+			glog.V(3).Infof("%s guard file %s unchanged", j.defn.name, arg)
+			return true
+		}
+		j.mtime = fi.ModTime()
+	}
+
+	return false
+}
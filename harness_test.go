@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/clnt"
+	"github.com/vergult/go9p/srv"
+)
+
+// testclock is a scheduler clock that only moves when the test moves it,
+// waking the schedulers whose slots it moves past.
+type testclock struct {
+	sync.Mutex
+	now     time.Time
+	waiting []wakeup
+}
+
+// wakeup is a scheduler waiting on the test clock for the time at.
+type wakeup struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *testclock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// After returns a channel that's ready once the clock has moved by d.
+func (c *testclock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	w := wakeup{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+		return w.c
+	}
+	c.waiting = append(c.waiting, w)
+	return w.c
+}
+
+// advance moves the clock forward by d, waking the schedulers it moves past.
+func (c *testclock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.now = c.now.Add(d)
+	waiting := c.waiting[:0]
+	for _, w := range c.waiting {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiting = waiting
+}
+
+// waiters returns the number of schedulers waiting on the clock.
+func (c *testclock) waiters() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.waiting)
+}
+
+// harness is a jobd served over an in-memory 9P connection, with its
+// schedulers on a test clock and runs faked, and a client mounted on it.
+type harness struct {
+	tb    testing.TB
+	clock *testclock
+	c     *clnt.Clnt
+}
+
+// mkharness starts a jobd on a fresh store and mounts it through a pipe. Once
+// the test ends the jobs started through it are stopped and the runs in
+// progress waited for.
+func mkharness(tb testing.TB) *harness {
+	tb.Helper()
+
+	root, user := testStore(tb)
+	clock := &testclock{now: time.Date(2026, time.January, 1, 0, 0, 30, 0, time.UTC)}
+	sched = clock
+
+	s := srv.NewFileSrv(root)
+	s.Dotu = true
+	s.Msize = 8192
+	s.Start(&connsrv{s})
+
+	cc, sc := net.Pipe()
+	go s.NewConn(sc)
+	c, err := clnt.MountConn(cc, "", s.Msize, user)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		stopJobs(jobsroot.list())
+		for _, j := range jobsroot.list() {
+			for j.running() > 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		c.Unmount()
+		cc.Close()
+		sched = wallclock{}
+	})
+	return &harness{tb: tb, clock: clock, c: c}
+}
+
+// write writes data to the named file.
+func (h *harness) write(name, data string) {
+	h.tb.Helper()
+
+	if err := h.try(name, data); err != nil {
+		h.tb.Fatalf("can't write %q to %s: %v", data, name, err)
+	}
+}
+
+// try writes data to the named file, returning the error the write fails with.
+func (h *harness) try(name, data string) error {
+	f, err := h.c.FOpen(name, p.OWRITE)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteAt([]byte(data), 0)
+	return err
+}
+
+// read returns the contents of the named file.
+func (h *harness) read(name string) string {
+	h.tb.Helper()
+
+	f, err := h.c.FOpen(name, p.OREAD)
+	if err != nil {
+		h.tb.Fatalf("can't open %s: %v", name, err)
+	}
+	defer f.Close()
+
+	var out []byte
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.ReadAt(buf, int64(len(out)))
+		if err != nil {
+			h.tb.Fatalf("can't read %s: %v", name, err)
+		}
+		if n == 0 {
+			return string(out)
+		}
+		out = append(out, buf[:n]...)
+	}
+}
+
+// eventually fails the test unless cond holds within a few seconds.
+func (h *harness) eventually(what string, cond func() bool) {
+	h.tb.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			h.tb.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestCloneStartFire defines a job through the clone file, starts it through
+// its ctl file, moves the clock to its next slot and checks that the fake run
+// made then is in the job's log and records.
+func TestCloneStartFire(t *testing.T) {
+	h := mkharness(t)
+
+	h.write("/clone", "e2e:0 * * * * ? *:true")
+	h.write("/jobs/e2e/ctl", START)
+	h.eventually("the scheduler to wait for its slot", func() bool { return h.clock.waiters() == 1 })
+
+	h.clock.advance(time.Minute)
+	h.eventually("the run to be recorded", func() bool { return h.read("/jobs/e2e/records") != "" })
+
+	var rec runrecord
+	if err := json.Unmarshal([]byte(h.read("/jobs/e2e/records")), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != 1 || rec.Status != SUCCEEDED {
+		t.Errorf("got run %d %s, want run 1 %s", rec.ID, rec.Status, SUCCEEDED)
+	}
+	if want := time.Date(2026, time.January, 1, 0, 1, 0, 0, time.UTC); !rec.Slot.Equal(want) {
+		t.Errorf("got slot %v, want %v", rec.Slot, want)
+	}
+	if log := h.read("/jobs/e2e/log"); !strings.Contains(log, "fake run of true") {
+		t.Errorf("log doesn't hold the fake run's output:\n%s", log)
+	}
+}
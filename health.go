@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// listening is set once the 9P listener accepts connections
+var listening int32
+
+// check is a named health check that returns nil when healthy.
+type check struct {
+	name string
+	test func() error
+}
+
+// schedulerCheck fails when the scheduler hasn't ticked recently.
+func schedulerCheck() error {
+	if !alive(time.Now()) {
+		last, _ := lastBeat()
+		return fmt.Errorf("last tick at %s", formatTime(last, timefmt))
+	}
+	return nil
+}
+
+// storeCheck fails when one of jobd's databases can't be opened for writing.
+func storeCheck() error {
+	for _, db := range []string{jobsdb, settingsdb, slotsdb} {
+		f, err := os.OpenFile(db, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// drainCheck fails while jobd is draining.
+func drainCheck() error {
+	if isDraining() {
+		return fmt.Errorf("draining")
+	}
+	return nil
+}
+
+// listenerCheck fails until the 9P listener accepts connections.
+func listenerCheck() error {
+	if atomic.LoadInt32(&listening) == 0 {
+		return fmt.Errorf("not listening")
+	}
+	return nil
+}
+
+// healthz reports whether jobd is alive, which is whether its scheduler is.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	probe(w, []check{{"scheduler", schedulerCheck}})
+}
+
+// readyz reports whether jobd is ready to serve: its databases are writable, its
+// scheduler is alive, it isn't draining and its 9P listener is accepting
+// connections.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	probe(w, []check{{"store", storeCheck}, {"scheduler", schedulerCheck}, {"drain", drainCheck}, {"listener", listenerCheck}})
+}
+
+// probe runs the checks, answering 200 when they all pass and 503 otherwise,
+// with a line giving the outcome of each.
+func probe(w http.ResponseWriter, checks []check) {
+	status := http.StatusOK
+
+	var out bytes.Buffer
+	for _, c := range checks {
+		if err := c.test(); err != nil {
+			status = http.StatusServiceUnavailable
+			fmt.Fprintf(&out, "%s: %v\n", c.name, err)
+		} else {
+			fmt.Fprintf(&out, "%s: ok\n", c.name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(out.Bytes())
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// heartbeat records the scheduler's most recent tick
+var heartbeat = struct {
+	sync.Mutex
+	last  time.Time
+	ticks uint64
+}{}
+
+// mkHeartbeatFile creates the read only heartbeat file at the root of the jobd
+// name space.
+func mkHeartbeatFile(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkHeartbeatFile(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkHeartbeatFile(%v, %v)", dir, user)
+
+	hf := &jobfile{
+		// heartbeat reader returns the time of the scheduler's last tick and
+		// the number of ticks since jobd started.
+		reader: func() []byte {
+			last, ticks := lastBeat()
+			return []byte(fmt.Sprintf("%s %d\n", formatTime(last, timefmt), ticks))
+		},
+		// heartbeat is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := hf.Add(dir, "heartbeat", user, nil, 0444, hf); err != nil {
+		glog.Errorln("Can't create heartbeat file: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// beat records a tick of the scheduler.
+func beat(now time.Time) {
+	heartbeat.Lock()
+	defer heartbeat.Unlock()
+
+	heartbeat.last = now
+	heartbeat.ticks++
+}
+
+// lastBeat returns the time of the scheduler's last tick and the number of
+// ticks so far.
+func lastBeat() (time.Time, uint64) {
+	heartbeat.Lock()
+	defer heartbeat.Unlock()
+
+	return heartbeat.last, heartbeat.ticks
+}
+
+// alive reports whether the scheduler has ticked recently enough.
+func alive(now time.Time) bool {
+	last, _ := lastBeat()
+	return now.Sub(last) <= 3*WATCHINTERVAL
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+const (
+	// SUMMARYDAYS is the number of days of summaries kept for each job
+	SUMMARYDAYS = 400
+
+	// FAILURESKEPT is the number of failures listed in a day's summary
+	FAILURESKEPT = 100
+
+	// DAYFMT is the layout of the day a summary covers
+	DAYFMT = "2006-01-02"
+)
+
+// summary rolls up the runs of a job that started on a given day, along with
+// the notes they were annotated with. Durations are kept while the day is in
+// progress and replaced by their percentiles once it is over.
+type summary struct {
+	Day         string          `json:"day"`
+	Runs        int             `json:"runs"`
+	Succeeded   int             `json:"succeeded"`
+	Failed      int             `json:"failed"`
+	Failures    []string        `json:"failures,omitempty"`
+	Annotations []string        `json:"annotations,omitempty"`
+	Durations   []time.Duration `json:"durations,omitempty"`
+	P50         time.Duration   `json:"p50"`
+	P90         time.Duration   `json:"p90"`
+	P99         time.Duration   `json:"p99"`
+}
+
+// summaries holds a job's daily summaries, oldest first.
+type summaries struct {
+	sync.Mutex
+	days []*summary
+}
+
+// mkHistoryFile creates the read only file that reports a job's daily summaries
+// and loads any summaries saved by an earlier jobd.
+func mkHistoryFile(job *job, user p.User) error {
+	if err := job.summaries.load(job.summaryPath()); err != nil {
+		glog.Errorf("Can't load %s summaries [%v]", job.defn.name, err)
+	}
+
+	hf := &jobfile{
+		// history reader returns the job's daily summaries.
+		reader: func() []byte {
+			return job.summaries.report()
+		},
+		// history is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := hf.Add(&job.File, "history", user, nil, 0444, hf); err != nil {
+		glog.Errorf("Can't create %s/history [%v]", job.defn.name, err)
+		return err
+	}
+
+	return nil
+}
+
+// summaryPath returns the path of the file holding the job's summaries.
+func (j *job) summaryPath() string {
+	return path.Join(outdir, j.defn.name, "summary.json")
+}
+
+// fold rolls a run that has left the job's recent runs into the summary of the
+// day it started and saves the job's summaries.
+func (j *job) fold(r *run) {
+	r.Lock()
+	day := r.start.Format(DAYFMT)
+	status, start, d := r.status, r.start, r.end.Sub(r.start)
+	annotations := []string{}
+	for _, a := range r.annotations {
+		annotations = append(annotations, fmt.Sprintf("run %d %s", r.id, a))
+	}
+	r.Unlock()
+
+	if status == RUNNING {
+		return
+	}
+
+	ss := &j.summaries
+	ss.Lock()
+	defer ss.Unlock()
+
+	var s *summary
+	if n := len(ss.days); n > 0 && ss.days[n-1].Day == day {
+		s = ss.days[n-1]
+	} else {
+		for _, old := range ss.days {
+			old.compact()
+		}
+		s = &summary{Day: day}
+		ss.days = append(ss.days, s)
+		if len(ss.days) > SUMMARYDAYS {
+			ss.days = ss.days[len(ss.days)-SUMMARYDAYS:]
+		}
+	}
+
+	s.Runs++
+	switch status {
+	case SUCCEEDED:
+		s.Succeeded++
+	case INTERRUPTED:
+	default:
+		s.Failed++
+		if len(s.Failures) < FAILURESKEPT {
+			s.Failures = append(s.Failures, fmt.Sprintf("%s %s", j.stamp(start), status))
+		}
+	}
+	s.Durations = append(s.Durations, d)
+	s.Annotations = append(s.Annotations, annotations...)
+
+	if err := ss.save(j.summaryPath()); err != nil {
+		glog.Errorf("Can't save %s summaries [%v]", j.defn.name, err)
+	}
+}
+
+// compact replaces the summary's durations by their percentiles.
+func (s *summary) compact() {
+	if len(s.Durations) == 0 {
+		return
+	}
+	s.P50, s.P90, s.P99 = s.percentiles()
+	s.Durations = nil
+}
+
+// percentiles returns the 50th, 90th and 99th percentile durations of the
+// summary's runs.
+func (s *summary) percentiles() (time.Duration, time.Duration, time.Duration) {
+	if len(s.Durations) == 0 {
+		return s.P50, s.P90, s.P99
+	}
+
+	ds := append([]time.Duration{}, s.Durations...)
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	pct := func(p int) time.Duration {
+		return ds[(len(ds)-1)*p/100]
+	}
+	return pct(50), pct(90), pct(99)
+}
+
+// report renders the summaries one day per line, followed by that day's
+// failures, annotations and maintenance windows.
+func (ss *summaries) report() []byte {
+	ss.Lock()
+	defer ss.Unlock()
+
+	var out bytes.Buffer
+	for _, s := range ss.days {
+		p50, p90, p99 := s.percentiles()
+		fmt.Fprintf(&out, "%s runs: %d succeeded: %d failed: %d p50: %v p90: %v p99: %v\n",
+			s.Day, s.Runs, s.Succeeded, s.Failed, p50, p90, p99)
+		for _, f := range s.Failures {
+			fmt.Fprintf(&out, "\t%s\n", f)
+		}
+		for _, a := range s.Annotations {
+			fmt.Fprintf(&out, "\tannotation: %s\n", a)
+		}
+		for _, w := range maintenanceOn(s.Day) {
+			fmt.Fprintf(&out, "\tmaintenance: %s\n", w.describe())
+		}
+	}
+	return out.Bytes()
+}
+
+// save writes the summaries to the named file. The caller must hold the
+// summaries lock.
+func (ss *summaries) save(name string) error {
+	data, err := json.Marshal(ss.days)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	if err := writeSealed(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// load reads the summaries saved in the named file, if there is one.
+func (ss *summaries) load(name string) error {
+	data, err := readSealed(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	return json.Unmarshal(data, &ss.days)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// startHTTP starts the optional HTTP listener that serves jobd's metrics, its
+// health and readiness probes, a read only view of its name space, its events
+// as they happen, a dashboard and the OpenAPI description of it all, and lets
+// holders of API keys run and manage jobs.
+func startHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", authorize(SCOPEREAD, metrics))
+	mux.HandleFunc("/fs/", authorize(SCOPEREAD, browse))
+	mux.HandleFunc("/events", authorize(SCOPEREAD, stream))
+	mux.HandleFunc("/events/ws", authorize(SCOPEREAD, streamWebSocket))
+	mux.HandleFunc("/dashboard/state", authorize(SCOPEREAD, dashboardState))
+	mux.HandleFunc("/dashboard/", dashboard)
+	mux.HandleFunc("/dashboard", dashboard)
+	mux.HandleFunc("/jobs/", jobsAPI)
+	mux.HandleFunc("/ids/", authorize(SCOPEREAD, readJobByID))
+	mux.HandleFunc("/apply", authorize(SCOPEFULL, applyJobs))
+	mux.HandleFunc("/runs", authorize(SCOPEREAD, searchRuns))
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	mux.HandleFunc("/openapi.json", openapi)
+
+	go func() {
+		glog.Infof("HTTP listener starting on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			glog.Errorf("HTTP listener failed (%v)", err)
+		}
+	}()
+}
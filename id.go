@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"regexp"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// uuid is what a job's ID looks like
+var uuid = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// idspace is the namespace of the name based IDs given to jobs defined before
+// jobs had IDs
+var idspace = []byte("jobd.vergult.github.com")
+
+// newID returns a random, version 4, UUID for a new job.
+func newID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(err)
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return formatUUID(u)
+}
+
+// nameID returns the name based, version 5, UUID of a job defined before jobs
+// had IDs. It's derived from the job's name so the job keeps it until its
+// record is rewritten with it.
+func nameID(name string) string {
+	h := sha1.New()
+	h.Write(idspace)
+	h.Write([]byte(name))
+
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return formatUUID(u)
+}
+
+// formatUUID renders a UUID in its canonical form.
+func formatUUID(u [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// mkIDFile creates the read only file that returns the job's ID.
+func mkIDFile(job *job, user p.User) error {
+	f := &jobfile{
+		// id reader returns the job's ID.
+		reader: func() []byte {
+			return []byte(job.defn.id + "\n")
+		},
+		// id is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := f.Add(&job.File, "id", user, nil, 0444, f); err != nil {
+		glog.Errorf("Can't create %s/id [%v]", job.defn.name, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// LOCKENV names the environment variable in which jobd hands the file
+	// descriptor of its instance lock to the jobd replacing it
+	LOCKENV = "JOBD_LOCK"
+
+	// LOCKFD is the file descriptor of the instance lock a replacing jobd
+	// inherits, after the listener's
+	LOCKFD = LISTENFDSSTART + 1
+
+	// REPLACEWAIT is how long -replace waits for the jobd it terminates to exit
+	REPLACEWAIT = 30 * time.Second
+)
+
+// instance is jobd's pid file, locked for as long as jobd serves the database
+var instance *os.File
+
+// single makes sure jobd is the only one serving the database in dbdir by
+// taking an exclusive flock on its jobd.pid file, which then holds jobd's pid.
+// If another jobd holds the lock single fails, unless replace is set in which
+// case it terminates that jobd and waits up to REPLACEWAIT for it to exit. A
+// jobd started by an upgrade inherits the lock of the jobd it replaces.
+func single(dbdir string, replace bool) error {
+	glog.V(4).Infof("Entering single(%s, %v)", dbdir, replace)
+	defer glog.V(4).Infof("Exiting single(%s, %v)", dbdir, replace)
+
+	if err := os.MkdirAll(dbdir, 0755); err != nil {
+		return err
+	}
+	name := path.Join(dbdir, "jobd.pid")
+
+	var f *os.File
+	if fd := os.Getenv(LOCKENV); fd != "" {
+		os.Unsetenv(LOCKENV)
+		if n, err := strconv.Atoi(fd); err == nil {
+			// the jobs' commands mustn't inherit the lock
+			syscall.CloseOnExec(n)
+			f = os.NewFile(uintptr(n), name)
+		}
+	}
+	if f == nil {
+		var err error
+		if f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+			return err
+		}
+	}
+
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		err = supplant(f, name, replace)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0); err != nil {
+		f.Close()
+		return err
+	}
+	instance = f
+	return nil
+}
+
+// supplant terminates the jobd holding the lock of the pid file when replace
+// is set and waits for it to exit, taking the lock once it has.
+func supplant(f *os.File, name string, replace bool) error {
+	data, _ := ioutil.ReadFile(name)
+	holder := strings.TrimSpace(string(data))
+	if !replace {
+		return fmt.Errorf("%s is locked by jobd %s, use -replace to take over", name, holder)
+	}
+	pid, err := strconv.Atoi(holder)
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("%s is locked by a process of unknown pid", name)
+	}
+
+	glog.Infof("Replacing jobd %d", pid)
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("can't terminate jobd %d: %v", pid, err)
+	}
+	for deadline := time.Now().Add(REPLACEWAIT); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+	}
+	return fmt.Errorf("jobd %d didn't exit within %v", pid, REPLACEWAIT)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/vergult/go9p/srv"
+)
+
+// sumPath returns the path of the file holding the checksums of the files
+// saved for the run, in the format sha256sum -c checks.
+func (r *run) sumPath() string {
+	return strings.TrimSuffix(r.out, ".out") + ".sum"
+}
+
+// saved returns the paths of the files saved for the run that are checksummed.
+func (r *run) saved() []string {
+	return []string{r.out, r.contextPath(), r.stdinPath()}
+}
+
+// checksum returns the hex encoded SHA-256 checksum of the named file.
+func checksum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// seal records the checksums of the files saved for the finished run so that
+// later changes to them, or their truncation, can be detected.
+func (r *run) seal() error {
+	var sums bytes.Buffer
+	for _, name := range r.saved() {
+		sum, err := checksum(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sums, "%s  %s\n", sum, path.Base(name))
+	}
+
+	f, err := os.OpenFile(r.sumPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(sums.Bytes())
+	return err
+}
+
+// verify checks the files saved for the run against the checksums recorded
+// when it finished, returning a line for each naming the file, its recorded
+// checksum and whether it is intact, modified or missing.
+func (r *run) verify() []byte {
+	f, err := os.Open(r.sumPath())
+	if os.IsNotExist(err) {
+		return []byte("no checksums recorded\n")
+	}
+	if err != nil {
+		glog.Errorf("Can't read %s [%v]", r.sumPath(), err)
+		return []byte(fmt.Sprintf("can't read checksums: %v\n", err))
+	}
+	defer f.Close()
+
+	var out bytes.Buffer
+	dir := path.Dir(r.out)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		want, name := fields[0], fields[1]
+		state := "ok"
+		got, err := checksum(path.Join(dir, name))
+		switch {
+		case os.IsNotExist(err):
+			state = "missing"
+		case err != nil:
+			state = err.Error()
+		case got != want:
+			state = "modified"
+		}
+		fmt.Fprintf(&out, "%s: %s %s\n", name, want, state)
+	}
+
+	return out.Bytes()
+}
+
+// mkSumsFile creates the run's sums file reporting the integrity of the files
+// saved for it.
+func (r *run) mkSumsFile(j *job) error {
+	sums := &jobfile{
+		// sums reader verifies the run's saved files against their checksums.
+		reader: func() []byte {
+			return r.verify()
+		},
+		// sums is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	return sums.Add(r.dir, "sums", j.user, nil, 0444, sums)
+}
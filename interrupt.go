@@ -0,0 +1,83 @@
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// STOPGRACE is how long the command of a run interrupted by stopping its job
+// has to exit after SIGTERM before it's killed, unless the job's stopgrace
+// setting says otherwise
+const STOPGRACE = 10 * time.Second
+
+// interruptible registers the function that interrupts the run when its job is
+// stopped and returns the function that unregisters it.
+func (j *job) interruptible(r *run, interrupt func()) func() {
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	j.interrupts[r] = interrupt
+	return func() {
+		j.rlk.Lock()
+		defer j.rlk.Unlock()
+
+		delete(j.interrupts, r)
+	}
+}
+
+// interrupt interrupts the job's runs in progress without waiting for them to
+// finish. Each is marked as interrupted and noted as such in the job's log.
+func (j *job) interrupt() {
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	for r, interrupt := range j.interrupts {
+		glog.V(3).Infof("Interrupting %s run %d", j.defn.name, r.id)
+		r.Lock()
+		r.interrupted = true
+		r.Unlock()
+		go interrupt()
+	}
+}
+
+// terminate sends SIGTERM to the process group of a run's command and, if it
+// hasn't finished once the job's stop grace has passed, SIGKILL.
+func (j *job) terminate(pgrp int, finished chan bool) {
+	grace := j.grace()
+
+	select {
+	case <-finished:
+		return
+	default:
+	}
+	if err := syscall.Kill(-pgrp, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		glog.Errorf("Can't terminate %s [%v]", j.defn.name, err)
+	}
+
+	select {
+	case <-finished:
+	case <-time.After(grace):
+		glog.Warningf("%s didn't exit within %v of SIGTERM, killing it", j.defn.name, grace)
+		if err := syscall.Kill(-pgrp, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			glog.Errorf("Can't kill %s [%v]", j.defn.name, err)
+		}
+	}
+}
+
+// grace returns how long an interrupted run has to exit after SIGTERM.
+func (j *job) grace() time.Duration {
+	if j.setting("stopgrace") != "" {
+		return j.duration("stopgrace")
+	}
+	return STOPGRACE
+}
+
+// wasInterrupted reports whether the run was interrupted by stopping its job.
+func (r *run) wasInterrupted() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.interrupted
+}
@@ -8,10 +8,15 @@ import (
 
 	"bytes"
 	"container/ring"
+	"context"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -27,25 +32,106 @@ const (
 
 	// START the ctl file command string to start a job
 	START = "start"
+
+	// BACKFILL the ctl file command string to run a job for past slots
+	BACKFILL = "backfill"
+
+	// RUN the ctl file command string to run a job right away
+	RUN = "run"
+
+	// KICK the ctl file command string to run a job right away, as run does
+	KICK = "kick"
+
+	// ATTACH the run command argument that attaches the run to the attach files
+	ATTACH = "attach"
+
+	// DETACH the ctl file command string to close an attached run's stdin
+	DETACH = "detach"
+
+	// SCHEDSEP separates the cron expressions that make up a job's schedule
+	SCHEDSEP = "|"
+
+	// MAXNAME is the longest a job's name may be
+	MAXNAME = 64
 )
 
+// reserved are the names, in any case, jobs may not have as they're, or could
+// become, names in the jobd name space
+var reserved = map[string]bool{"clone": true, "ctl": true, "index": true, "log": true}
+
+// foldnames, when set, lower cases the names of the jobs defined through the
+// clone file
+var foldnames bool
+
 type jobdef struct {
 	name     string
 	schedule string
 	cmd      string
 	state    string
+	settings map[string]string
+	id       string
+}
+
+// invocation describes a single execution of a job's command.
+type invocation struct {
+	slot   time.Time
+	key    string
+	cmd    string
+	env    []string
+	note   string
+	attach bool
+	replay *runctx
 }
 
 type jobreader func() []byte
 type jobwriter func([]byte) (int, error)
 
+// job is a job's directory in the jobd name space along with its state. The
+// directory's own lock is left to the file server, which holds it while
+// walking or listing the directory, and jobd's locks cover the rest: slk the
+// job's definition and protection, writes to the job's files, its backfilling
+// and the writer of a file and the channel closed once the write returned,
+// looping that a single scheduler runs at a time, hlk its history, rlk its
+// runs, orphans, sessions and active count and settingslk the settings of
+// every job. The stats, summaries, records, alert, failed and rejected fields
+// carry locks of their own.
 type job struct {
 	srv.File
-	defn    jobdef
-	done    chan bool
-	history *ring.Ring
+	defn        jobdef
+	slk         sync.Mutex
+	looping     sync.Mutex
+	done        chan bool
+	hlk         sync.Mutex
+	history     *ring.Ring
+	rejected    rejection
+	failed      failure
+	mtime       time.Time
+	backfilling bool
+	attached    *attachment
+	user        p.User
+	rlk         sync.Mutex
+	runsdir     *srv.File
+	runs        []*run
+	lastrun     int
+	orphans     map[int]*orphangroup
+	sessions    map[int]bool
+	active      int
+	interrupts  map[*run]func()
+	stats       stats
+	summaries   summaries
+	records     records
+	alert       alert
+	reported    tally
+	tested      testrun
+	origin      string
+	writer      string
+	written     chan bool
+	protected   bool
 }
 
+// rootlk serializes writes to the files at the root of the jobd name space
+var rootlk sync.Mutex
+
 type jobfile struct {
 	srv.File
 	reader jobreader
@@ -60,7 +146,7 @@ func mkJob(root *srv.File, user p.User, def jobdef) (*job, error) {
 
 	glog.V(3).Infoln("Creating job directory: ", def.name)
 
-	job := &job{defn: def, done: make(chan bool), history: ring.New(32)}
+	job := &job{defn: def, history: ring.New(32), attached: new(attachment), user: user, orphans: make(map[int]*orphangroup), sessions: make(map[int]bool), interrupts: make(map[*run]func())}
 
 	ctl := &jobfile{
 		// ctl reader returns the current state of the job.
@@ -69,26 +155,118 @@ func mkJob(root *srv.File, user p.User, def jobdef) (*job, error) {
 		},
 		// ctl writer is responsible for stopping or starting the job.
 		writer: func(data []byte) (int, error) {
-			switch cmd := strings.ToLower(string(data)); cmd {
+			cmd, args, err := parseCtl(string(data))
+			if err != nil {
+				return 0, err
+			}
+			switch cmd {
 			case STOP:
 				if job.defn.state != STOPPED {
 					glog.V(3).Infof("Stopping job: %v", job.defn.name)
-					job.defn.state = STOPPED
-					job.done <- true
+					job.stop()
+					notify(job.event(JOBSTOPPED, "stopped"))
 				}
+				job.interrupt()
+				job.reap()
 				return len(data), nil
 			case START:
 				if job.defn.state != STARTED {
 					glog.V(3).Infof("Starting job: %v", job.defn.name)
-					job.defn.state = STARTED
-					go job.run()
+					job.start()
+					notify(job.event(JOBSTARTED, "started"))
+				}
+				return len(data), nil
+			case BACKFILL:
+				kvs, err := ctlArgs(args)
+				if err != nil {
+					return 0, err
+				}
+				from, err := time.Parse(time.RFC3339, kvs["from"])
+				if err != nil {
+					return 0, invalid("from", "not an RFC3339 time: %s", kvs["from"])
+				}
+				to, err := time.Parse(time.RFC3339, kvs["to"])
+				if err != nil {
+					return 0, invalid("to", "not an RFC3339 time: %s", kvs["to"])
+				}
+				slots, err := job.backfillSlots(from, to)
+				if err != nil {
+					return 0, err
+				}
+				if job.backfilling {
+					return 0, fmt.Errorf("backfill already in progress")
+				}
+				if isDraining() {
+					return 0, fmt.Errorf("draining, no new runs")
+				}
+				glog.V(3).Infof("Backfilling job: %v (%d slots)", job.defn.name, len(slots))
+				job.backfilling = true
+				go job.backfill(slots)
+				return len(data), nil
+			case RUN, KICK:
+				inv, err := job.runArgs(args)
+				if err != nil {
+					return 0, err
+				}
+				if isDraining() {
+					return 0, fmt.Errorf("draining, no new runs")
+				}
+				if inv.attach {
+					if err := job.attached.attach(); err != nil {
+						return 0, err
+					}
+				}
+				glog.V(3).Infof("Running job: %v (%s)", job.defn.name, inv.note)
+				go job.exec(inv)
+				return len(data), nil
+			case REPLAY:
+				inv, err := job.replayArgs(args)
+				if err != nil {
+					return 0, err
+				}
+				if isDraining() {
+					return 0, fmt.Errorf("draining, no new runs")
+				}
+				glog.V(3).Infof("Running job: %v (%s)", job.defn.name, inv.note)
+				go job.exec(inv)
+				return len(data), nil
+			case TEST:
+				glog.V(3).Infof("Testing job: %v", job.defn.name)
+				if err := job.test(); err != nil {
+					return 0, err
+				}
+				return len(data), nil
+			case DETACH:
+				if err := job.attached.detach(); err != nil {
+					return 0, err
+				}
+				return len(data), nil
+			case ANNOTATE:
+				if err := job.annotate(args); err != nil {
+					return 0, err
+				}
+				return len(data), nil
+			case TRASH:
+				glog.V(3).Infof("Deleting job: %v", job.defn.name)
+				t, err := jobsroot.bin(job, job.writer)
+				if err != nil {
+					return 0, err
+				}
+				// The job's files, ctl among them, can't be torn down while
+				// one is being written.
+				go func(written chan bool) {
+					<-written
+					t.clear(job)
+				}(job.written)
+				if err := saveDeleted(); err != nil {
+					return 0, err
 				}
 				return len(data), nil
 			default:
-				return 0, fmt.Errorf("unknown command: %s", cmd)
+				return 0, invalid("command", "unknown: %s", cmd)
 			}
 		}}
-	if err := ctl.Add(&job.File, "ctl", user, nil, 0666, ctl); err != nil {
+	if err := ctl.Add(&job.File, "ctl", user, nil, 0644, ctl); err != nil {
 		glog.Errorf("Can't create %s/ctl [%v]", def.name, err)
 		return nil, err
 	}
@@ -98,16 +276,34 @@ func mkJob(root *srv.File, user p.User, def jobdef) (*job, error) {
 		// next scheduled execution time.
 		reader: func() []byte {
 			if job.defn.state == STARTED {
-				e, _ := cronexpr.Parse(job.defn.schedule)
-				return []byte(fmt.Sprintf("%s:%v", job.defn.schedule, e.Next(time.Now())))
+				next, _ := job.next(time.Now())
+				return []byte(fmt.Sprintf("%s:%s", job.defn.schedule, job.stamp(next)))
 			}
 			return []byte(job.defn.schedule)
 		},
-		// schedule is read only.
+		// schedule writer checks the schedule written to it as a new job's
+		// would be and, unless the job is protected, reschedules the job.
 		writer: func(data []byte) (int, error) {
-			return 0, srv.Eperm
+			if job.protected {
+				return 0, invalid("job", "%s is protected, unprotect it first", job.defn.name)
+			}
+			jd, err := mkJobDefinition(job.defn.name, strings.TrimSpace(string(data)), job.defn.cmd)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := checkSchedule(*jd); err != nil {
+				return 0, err
+			}
+
+			before := job.spec()
+			job.reschedule(jd.schedule)
+			job.changed(job.author(), before)
+			if err := saveJobs(); err != nil {
+				return 0, err
+			}
+			return len(data), nil
 		}}
-	if err := sched.Add(&job.File, "schedule", user, nil, 0444, sched); err != nil {
+	if err := sched.Add(&job.File, "schedule", user, nil, 0644, sched); err != nil {
 		glog.Errorf("Can't create %s/schedule [%v]", job.defn.name, err)
 		return nil, err
 	}
@@ -115,20 +311,43 @@ func mkJob(root *srv.File, user p.User, def jobdef) (*job, error) {
 	cmd := &jobfile{
 		// cmd reader returns the job's command.
 		reader: func() []byte {
-			return []byte(def.cmd)
+			return []byte(job.defn.cmd)
 		},
-		// cmd is read only.
+		// cmd writer, unless the job is protected, replaces the job's command
+		// with the one written to it from the job's next run on.
 		writer: func(data []byte) (int, error) {
-			return 0, srv.Eperm
+			if job.protected {
+				return 0, invalid("job", "%s is protected, unprotect it first", job.defn.name)
+			}
+			jd, err := mkJobDefinition(job.defn.name, job.defn.schedule, strings.TrimSpace(string(data)))
+			if err != nil {
+				return 0, err
+			}
+			for _, w := range lint(*jd) {
+				glog.Warningf("New command of %s: %s", job.defn.name, w)
+			}
+
+			before := job.spec()
+			settingslk.Lock()
+			job.defn.cmd = jd.cmd
+			settingslk.Unlock()
+			job.changed(job.author(), before)
+			if err := saveJobs(); err != nil {
+				return 0, err
+			}
+			return len(data), nil
 		}}
-	if err := cmd.Add(&job.File, "cmd", user, nil, 0444, cmd); err != nil {
+	if err := cmd.Add(&job.File, "cmd", user, nil, 0644, cmd); err != nil {
 		glog.Errorf("Can't create %s/cmd [%v]", job.defn.name, err)
 		return nil, err
 	}
 
 	log := &jobfile{
 		// log reader returns the job's execution history.
-		reader: func() []byte {
+		reader: cached(func() []byte {
+			job.hlk.Lock()
+			defer job.hlk.Unlock()
+
 			result := []byte{}
 			job.history.Do(func(v interface{}) {
 				if v != nil {
@@ -138,7 +357,7 @@ func mkJob(root *srv.File, user p.User, def jobdef) (*job, error) {
 				}
 			})
 			return result
-		},
+		}),
 		// log is read only.
 		writer: func(data []byte) (int, error) {
 			return 0, srv.Eperm
@@ -148,29 +367,144 @@ func mkJob(root *srv.File, user p.User, def jobdef) (*job, error) {
 		return nil, err
 	}
 
+	if err := mkStatsFile(job, user); err != nil {
+		return nil, err
+	}
+
+	if err := mkErrorsFile(job, user); err != nil {
+		return nil, err
+	}
+
+	if err := mkSettingsFile(job, user); err != nil {
+		return nil, err
+	}
+
+	if err := mkHistoryFile(job, user); err != nil {
+		return nil, err
+	}
+
+	if err := mkRecordsFiles(job, user); err != nil {
+		return nil, err
+	}
+
+	if err := mkAttachDir(job, user); err != nil {
+		return nil, err
+	}
+
+	if err := mkRunsDir(job, user); err != nil {
+		return nil, err
+	}
+
+	if err := mkTestFile(job, user); err != nil {
+		return nil, err
+	}
+
+	if err := mkSimulateFile(&job.File, user, job.alone); err != nil {
+		return nil, err
+	}
+
+	if err := mkDiffFile(job, user); err != nil {
+		return nil, err
+	}
+
+	if err := mkOriginFile(job, user); err != nil {
+		return nil, err
+	}
+
+	if err := mkIDFile(job, user); err != nil {
+		return nil, err
+	}
+
+	if err := mkSettingFile(job, user, "guard", validGuard); err != nil {
+		return nil, err
+	}
+
+	if err := mkSettingFile(job, user, "dedup", validBool); err != nil {
+		return nil, err
+	}
+
+	if err := mkSettingFile(job, user, "capture", validBool); err != nil {
+		return nil, err
+	}
+
+	if err := mkSettingFile(job, user, "encoding", validEncoding); err != nil {
+		return nil, err
+	}
+
+	if err := mkSettingFile(job, user, "stripansi", validBool); err != nil {
+		return nil, err
+	}
+
+	if err := mkSettingFile(job, user, "timefmt", validTimefmt); err != nil {
+		return nil, err
+	}
+
+	if err := mkSettingFile(job, user, "timeout", validDuration); err != nil {
+		return nil, err
+	}
+
 	return job, nil
 }
 
 // mkJobDefinition examines the components of a job definition it is given and
 // returns a new jobdef struct containing them if they are valid.
 func mkJobDefinition(name, schedule, cmd string) (*jobdef, error) {
+	if name == "" {
+		return nil, invalid("name", "empty")
+	}
+
+	if len(name) > MAXNAME {
+		return nil, invalid("name", "longer than %d characters: %s", MAXNAME, name)
+	}
+
+	if reserved[strings.ToLower(name)] {
+		return nil, invalid("name", "reserved: %s", name)
+	}
+
 	if ok, err := regexp.MatchString("[^[:word:]]", name); ok || err != nil {
 		switch {
 		case ok:
-			return nil, fmt.Errorf("invalid job name: %s", name)
+			return nil, invalid("name", "only letters, digits and underscores are allowed: %s", name)
 		default:
 			return nil, err
 		}
 	}
 
-	if _, err := cronexpr.Parse(schedule); err != nil {
-		return nil, err
+	for _, expr := range strings.Split(schedule, SCHEDSEP) {
+		if _, err := cronexpr.Parse(expr); err != nil {
+			return nil, invalid("schedule", "%s: %v", expr, err)
+		}
+	}
+
+	if strings.TrimSpace(cmd) == "" {
+		return nil, invalid("cmd", "empty")
+	}
+
+	return &jobdef{name, schedule, cmd, STOPPED, map[string]string{}, ""}, nil
+}
+
+// next returns the earliest time after t at which any of the cron expressions
+// in the job's schedule fires.
+func (jd *jobdef) next(t time.Time) (time.Time, error) {
+	var next time.Time
+
+	for _, expr := range strings.Split(jd.schedule, SCHEDSEP) {
+		e, err := cronexpr.Parse(expr)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if n := e.Next(t); !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
 	}
 
-	return &jobdef{name, schedule, cmd, STOPPED}, nil
+	return next, nil
 }
 
-// Read handles read operations on a jobfile using its associated reader.
+// Read handles read operations on a jobfile using its associated reader. It
+// returns as much of the contents from offset as fits in buf, which the server
+// sizes to the count asked for within the negotiated msize.
 func (jf jobfile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
 	glog.V(4).Infof("Entering jobfile.Read(%v, %v, %)", fid, buf, offset)
 	defer glog.V(4).Infof("Exiting jobfile.Read(%v, %v, %v)", fid, buf, offset)
@@ -183,13 +517,27 @@ func (jf jobfile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
 
 	contout := cont[offset:]
 
-	copy(buf, contout)
-	return len(contout), nil
+	return copy(buf, contout), nil
+}
+
+// Stat sets the length of a jobfile to that of its contents before the server
+// replies, so that Linux v9fs mounts, which take a file's length from its stat,
+// see as much of it as reading it returns.
+func (jf *jobfile) Stat(fid *srv.FFid) error {
+	glog.V(4).Infof("Entering jobfile.Stat(%v)", fid)
+	defer glog.V(4).Infof("Exiting jobfile.Stat(%v)", fid)
+
+	n := len(jf.reader())
+
+	jf.Lock()
+	defer jf.Unlock()
+
+	jf.Length = uint64(n)
+	return nil
 }
 
 // Wstat doesn't do anything but support for the operation is required to make
-// the OS file system calls happy.
-// TODO: verify it's still necessary.
+// the OS file system calls happy, v9fs truncates files opened with O_TRUNC.
 func (jf jobfile) Wstat(fid *srv.FFid, dir *p.Dir) error {
 	glog.V(4).Infof("Entering jobfile.Wstat(%v, %v)", fid, dir)
 	defer glog.V(4).Infof("Exiting jobfile.Wstat(%v, %v, %v)", fid, dir)
@@ -197,48 +545,422 @@ func (jf jobfile) Wstat(fid *srv.FFid, dir *p.Dir) error {
 	return nil
 }
 
-// Write handles write operations on a jobfile using its associated writer.
+// Write handles write operations on a jobfile using its associated writer,
+// writes that are rejected are recorded by the job the jobfile belongs to. The
+// writing user must be allowed to write the file by its owner and mode. Writes
+// to a job's files hold the job's slk, those to the files at the root of the
+// name space rootlk, rather than the lock of the directory holding the file so
+// that walking and listing it carry on while the writer works.
 func (jf *jobfile) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
 	glog.V(4).Infof("Entering jobfile.Write(%v, %v, %v)", fid, data, offset)
 	defer glog.V(4).Infof("Exiting jobfile.Write(%v, %v, %v)", fid, data, offset)
 
-	jf.Parent.Lock()
-	defer jf.Parent.Unlock()
+	written := make(chan bool)
+	defer close(written)
+
+	lk := &rootlk
+	if j := owner(&jf.File); j != nil {
+		lk = &j.slk
+	}
+	lk.Lock()
+	defer lk.Unlock()
+
+	if !jf.CheckPerm(fid.Fid.User, p.DMWRITE) {
+		if j := owner(&jf.File); j != nil {
+			j.rejected.reject(jf.Name, data, srv.Eperm)
+		}
+		return 0, srv.Eperm
+	}
+
+	if j := owner(&jf.File); j != nil {
+		j.writer, j.written = fid.Fid.User.Name(), written
+		defer func() { j.writer, j.written = "", nil }()
+	}
+
+	n, err := jf.writer(data)
+	if err != nil {
+		if j := owner(&jf.File); j != nil {
+			j.rejected.reject(jf.Name, data, err)
+		}
+		return n, err
+	}
+
+	jf.Lock()
+	jf.Mtime = uint32(time.Now().Unix())
+	jf.Unlock()
+	return n, nil
+}
+
+// start starts the job's scheduler. The caller holds the job's slk.
+func (j *job) start() {
+	j.defn.state = STARTED
+	j.rearm()
+	j.done = make(chan bool)
+	go j.run(j.done)
+}
+
+// reschedule changes the job's schedule, restarting its scheduler if it's
+// started so that its next run is on the new schedule. The caller holds the
+// job's slk.
+func (j *job) reschedule(schedule string) {
+	started := j.defn.state == STARTED
+	if started {
+		j.stop()
+	}
+
+	settingslk.Lock()
+	j.defn.schedule = schedule
+	settingslk.Unlock()
+
+	if started {
+		j.start()
+	}
+}
+
+// stop tells the job's scheduler to stop without waiting for it, it stops once
+// the run in progress, if any, finishes. The caller holds the job's slk.
+func (j *job) stop() {
+	j.defn.state = STOPPED
+	if j.done != nil {
+		close(j.done)
+		j.done = nil
+	}
+}
 
-	return jf.writer(data)
+// stopped reports whether the scheduler owning done has been told to stop.
+func stopped(done chan bool) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
 }
 
 // run executes the command associated with a job according to its schedule and
-// records the results until it is told to stop.
-func (j *job) run() {
-	j.history.Value = fmt.Sprintf("%s:started\n", time.Now().String())
-	j.history = j.history.Next()
+// records the results until done is closed. A scheduler started while an
+// earlier one is still finishing a run waits for it.
+func (j *job) run(done chan bool) {
+	j.looping.Lock()
+	defer j.looping.Unlock()
+
+	if stopped(done) {
+		return
+	}
+	j.record("started\n")
 	for {
-		now := time.Now()
-		e, err := cronexpr.Parse(j.defn.schedule)
+		now := sched.Now()
+		next, err := j.next(now)
 		if err != nil {
 			glog.Errorf("Can't parse %s [%s]", j.defn.schedule, err)
 			return
 		}
 
 		select {
-		case <-time.After(e.Next(now).Sub(now)):
-			glog.V(3).Infof("running `%s`", j.defn.cmd)
-			var out bytes.Buffer
-			k := exec.Command("/bin/bash", "-c", j.defn.cmd)
-			k.Stdout = &out
-			if err := k.Run(); err != nil {
-				glog.Errorf("%s failed: %v", j.defn.cmd, err)
+		case <-sched.After(next.Sub(now) + j.splay()):
+		case <-done:
+		}
+		if stopped(done) {
+			glog.V(3).Infof("completed")
+			j.record("completed\n")
+			return
+		}
+
+		switch j.overlap() {
+		case OVERLAPSKIP:
+			if j.running() > 0 {
+				j.stats.skip()
+				j.record("skipped, overlaps a run in progress\n")
 				continue
 			}
-			glog.V(3).Infof("%s returned: %s", j.defn.name, out.String())
-			j.history.Value = fmt.Sprintf("%s:%s", time.Now().String(), out.String())
-			j.history = j.history.Next()
-		case <-j.done:
-			glog.V(3).Infof("completed")
-			j.history.Value = fmt.Sprintf("%s:completed\n", time.Now().String())
-			j.history = j.history.Next()
+			j.execute(next)
+		case OVERLAPALLOW:
+			go j.execute(next)
+		default:
+			j.execute(next)
+		}
+	}
+}
+
+// execute runs the job's command for the given scheduled slot, unless its guard
+// says there's nothing to do or, when deduplication is on, the slot has already
+// been run, and records the outcome in the job's history. Failed runs are
+// retried as many times as the job's retries setting allows.
+func (j *job) execute(slot time.Time) {
+	if isDraining() {
+		j.stats.skip()
+		j.record("skipped, draining\n")
+		return
+	}
+
+	if j.skip() {
+		j.stats.skip()
+		j.record("skipped\n")
+		return
+	}
+
+	key := slotKey(j.defn.name, slot)
+	if j.enabled("dedup") && completed(j.defn.name, key) {
+		glog.V(3).Infof("%s already ran slot %v [%s]", j.defn.name, slot, key)
+		j.record(fmt.Sprintf("duplicate %s\n", key))
+		return
+	}
+
+	if !j.acquire() {
+		return
+	}
+	defer j.relinquish()
+
+	inv := invocation{slot: slot, key: key, cmd: j.defn.cmd}
+	retries := j.count("retries", 0)
+	for retry := 1; !j.exec(inv); retry++ {
+		if retry > retries {
+			if retries > 0 {
+				j.failed.decide(fmt.Sprintf("gave up after %d retries", retries))
+			}
 			return
 		}
+		glog.V(3).Infof("Retrying %s (%d)", j.defn.name, retry)
+		j.failed.decide(fmt.Sprintf("retrying (%d of %d)", retry, retries))
+		inv.note = fmt.Sprintf("retry %d", retry)
+	}
+}
+
+// running returns the number of the job's runs in progress.
+func (j *job) running() int {
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	return j.active
+}
+
+// settle waits for the job's scheduler and runs in progress to finish, as they
+// shortly do once the job is stopped and its runs interrupted.
+func (j *job) settle() {
+	j.looping.Lock()
+	j.looping.Unlock()
+	for j.running() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// exec runs the command of an invocation of the job, records its output in the
+// job's history, marked with the invocation's note if it has one, and reports
+// whether it succeeded. The command runs in a session, and so a process group,
+// of its own which is killed if it runs longer than the job's timeout. If it
+// fails, or times out, what remains of the group is captured when the job asks
+// for it and whatever is left running once it finishes is tracked so it can be
+// killed later. Stopping the job interrupts the run, which isn't retried, its
+// command is sent SIGTERM and, if it hasn't exited within the job's stop grace,
+// SIGKILL. Runs wait for room in the job's mutual exclusion group and
+// resources, and are skipped while another process holds the job's lock file.
+func (j *job) exec(inv invocation) bool {
+	if inv.attach {
+		defer j.attached.done()
+	}
+	defer j.exclude()()
+
+	locked, unlock := j.lockFile()
+	if !locked {
+		j.stats.skip()
+		return true
+	}
+	defer unlock()
+
+	glog.V(3).Infof("running `%s`", inv.cmd)
+	j.rlk.Lock()
+	j.active++
+	j.rlk.Unlock()
+	defer func() {
+		j.rlk.Lock()
+		j.active--
+		j.rlk.Unlock()
+	}()
+
+	r := j.begin(inv)
+
+	out := j.limited()
+	stderr := new(tail)
+	ctx := runctx{Cmd: inv.cmd, Shell: j.shell(), Slot: inv.slot, Key: inv.key, Stdin: inv.attach}
+	ctx.Env = append(os.Environ(),
+		"SCHEDULED_TIME="+inv.slot.Format(time.RFC3339),
+		"IDEMPOTENCY_KEY="+inv.key)
+	if inv.replay != nil {
+		ctx = *inv.replay
+	} else if params, err := j.params(); err != nil {
+		glog.Errorf("Can't read the parameters of %s [%v]", j.defn.name, err)
+		r.finish(err)
+		j.keep(r)
+		j.stats.add(r)
+		j.failed.fail(r, nil)
+		return false
+	} else {
+		ctx.Cmd, ctx.Env = parameterize(ctx.Cmd, ctx.Env, params)
+		ctx.Env = append(ctx.Env, inv.env...)
+	}
+	k := exec.Command(ctx.Shell, "-c", ctx.Cmd)
+	k.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	k.Env = ctx.Env
+	k.Stdout = out
+	k.Stderr = stderr
+	if f, err := r.create(); err != nil {
+		glog.Errorf("Can't save output of %s run %d [%v]", j.defn.name, r.id, err)
+	} else {
+		defer f.Close()
+		k.Stdout = io.MultiWriter(out, f)
+	}
+	if err := r.save(ctx); err != nil {
+		glog.Errorf("Can't save context of %s run %d [%v]", j.defn.name, r.id, err)
+	}
+	if inv.replay != nil && inv.replay.Stdin {
+		if stdin, err := readSealed(inv.replay.stdin); err != nil {
+			glog.Errorf("Can't replay stdin of %s [%v]", j.defn.name, err)
+		} else if saved, err := os.Create(r.stdinPath()); err != nil {
+			k.Stdin = bytes.NewReader(stdin)
+		} else {
+			sw := sealWriter(saved)
+			defer sw.Close()
+			k.Stdin = io.TeeReader(bytes.NewReader(stdin), sw)
+		}
 	}
+	if inv.attach {
+		in, err := k.StdinPipe()
+		if err != nil {
+			glog.Errorf("Can't attach to %s [%v]", j.defn.name, err)
+			r.finish(err)
+			j.keep(r)
+			return false
+		}
+		if saved, err := os.Create(r.stdinPath()); err != nil {
+			glog.Errorf("Can't save stdin of %s run %d [%v]", j.defn.name, r.id, err)
+			j.attached.connect(in)
+		} else {
+			j.attached.connect(recorder{in, sealWriter(saved)})
+		}
+		k.Stdout = io.MultiWriter(k.Stdout, j.attached)
+		k.Stderr = io.MultiWriter(stderr, j.attached)
+	}
+	var err error
+	var cpu time.Duration
+	switch {
+	case executor == FAKE:
+		err = j.fake(r, ctx.Cmd, k.Stdout)
+	case j.jobExecutor() == PRUNE:
+		err = j.native(r, func(c context.Context) error {
+			return j.prune(c, ctx.Cmd, k.Stdout, false)
+		})
+	case j.jobExecutor() == SQL:
+		err = j.native(r, func(c context.Context) error {
+			return j.query(c, ctx.Cmd, k.Stdout, false)
+		})
+	case j.jobExecutor() == SYNC:
+		err = j.native(r, func(c context.Context) error {
+			return j.mirror(c, ctx.Cmd, k.Stdout, false)
+		})
+	case j.jobExecutor() == PIPELINE:
+		err = j.native(r, func(c context.Context) error {
+			return j.pipeline(c, r, ctx, k.Stdout, k.Stderr)
+		})
+	case j.jobExecutor() == FANOUT:
+		err = j.native(r, func(c context.Context) error {
+			return j.fanout(c, r, ctx, k.Stdout, k.Stderr)
+		})
+	default:
+		if err := k.Start(); err != nil {
+			glog.Errorf("%s failed to start: %v", inv.cmd, err)
+			r.finish(err)
+			j.keep(r)
+			j.stats.add(r)
+			j.failed.fail(r, nil)
+			return false
+		}
+		pgrp := k.Process.Pid
+		j.prioritize(pgrp)
+
+		if timeout := j.duration("timeout"); timeout > 0 {
+			timer := time.AfterFunc(timeout, func() {
+				glog.Errorf("%s timed out after %v", inv.cmd, timeout)
+				j.capture(r, pgrp)
+				r.expire()
+				if err := syscall.Kill(-pgrp, syscall.SIGKILL); err != nil {
+					glog.Errorf("Can't kill %s [%v]", j.defn.name, err)
+				}
+			})
+			defer timer.Stop()
+		}
+
+		finished := make(chan bool)
+		unregister := j.interruptible(r, func() { j.terminate(pgrp, finished) })
+		ended := j.session(pgrp)
+		err = k.Wait()
+		close(finished)
+		unregister()
+		ended()
+		if err != nil && !r.expired() && !r.wasInterrupted() {
+			j.capture(r, pgrp)
+		}
+		j.track(pgrp)
+		cpu = k.ProcessState.UserTime() + k.ProcessState.SystemTime()
+	}
+	r.finish(err)
+	j.charged(r, cpu)
+	if err := r.seal(); err != nil {
+		glog.Errorf("Can't record checksums of %s run %d [%v]", j.defn.name, r.id, err)
+	}
+	j.keep(r)
+	if r.wasInterrupted() {
+		emit(j.runEvent(r))
+		j.record("interrupted, the job was stopped\n")
+		return true
+	}
+	j.stats.add(r)
+	if err != nil {
+		j.failed.fail(r, stderr.Bytes())
+		notify(j.runEvent(r))
+	} else {
+		emit(j.runEvent(r))
+	}
+	j.observe(err == nil)
+	if r.expired() {
+		j.record(fmt.Sprintf("timed out after %v\n", j.duration("timeout")))
+		return false
+	}
+	if signaled(err) {
+		glog.Errorf("%s killed: %v", inv.cmd, err)
+		j.record(r.signalNote())
+		return false
+	}
+	if err != nil {
+		glog.Errorf("%s failed: %v", inv.cmd, err)
+		return false
+	}
+	j.drifted(r, out.sums())
+	output := j.clean(out.Bytes()) + out.note()
+	if j.binary(&out.text) {
+		output = fmt.Sprintf("<binary output, %d bytes>\n", out.Size())
+	}
+	glog.V(3).Infof("%s returned: %s", j.defn.name, output)
+	if inv.note != "" {
+		j.record(fmt.Sprintf("[%s] %s", inv.note, output))
+	} else {
+		j.record(output)
+	}
+
+	if j.enabled("dedup") {
+		if err := complete(j.defn.name, inv.key); err != nil {
+			glog.Errorf("Can't record slot %s for %s [%v]", inv.key, j.defn.name, err)
+		}
+	}
+
+	return true
+}
+
+// record adds a timestamped entry to the job's execution history.
+func (j *job) record(entry string) {
+	j.hlk.Lock()
+	defer j.hlk.Unlock()
+
+	j.history.Value = fmt.Sprintf("%s:%s", j.stamp(time.Now()), entry)
+	j.history = j.history.Next()
+	touch()
 }
@@ -3,87 +3,398 @@ package main
 import (
 	"bufio"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"path"
-	"strings"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/golang/glog"
 	p "github.com/vergult/go9p"
 	"github.com/vergult/go9p/srv"
 )
 
+// MAXMSIZE is the largest 9P message size jobd may be started with
+const MAXMSIZE = 16*1024*1024 + p.IOHDRSZ
+
 // jobsroot is the root of the jobd file hierarchy
 var jobsroot *jobsdir
 
 // jobsdb is the path to the jobs database
 var jobsdb string
 
+// routesfile and slacktmplfile are the files reload loads the notification
+// routes and Slack template from
+var routesfile, slacktmplfile string
+
 func main() {
 	flfsaddr := flag.String("fsaddr", "0.0.0.0:5640", "Address where job file service listens for connections")
 	fldbdir := flag.String("dbdir", "/var/lib/jobd", "Location of the jobd jobs database")
 	fldebug := flag.Bool("debug", false, "9p debugging to stderr")
+	flag.StringVar(&fusemount, "fusemount", "", "Directory the name space is mounted on through FUSE, as well as served over 9P, none if empty")
+	flmsize := flag.Uint("msize", p.MSIZE, "Largest 9P message size offered to clients, who may negotiate a smaller one")
+	flreplace := flag.Bool("replace", false, "Terminate the jobd serving the same -dbdir, and take over once it exits, rather than refusing to start")
+	flcheck := flag.Bool("check", false, "Check the databases and the files saved for runs, report the problems found and exit")
+	flmigrate := flag.Bool("migrate", false, "Convert the jobs database from the legacy colon delimited format, report the entries that failed and exit")
+	flencryptkey := flag.String("encryptkey", "", "File holding the AES-256 key the jobs database, history and run files are encrypted with, unencrypted if empty")
+	flag.Var(defaultsFlag{}, "default", "Default setting, name=value, for jobs that don't override it (repeatable)")
+	flag.StringVar(&jobsgroup, "jobsgroup", "", "Group whose members, with jobd's user, may define jobs, anyone may if empty")
+	flapikeys := flag.String("apikeys", "", "File of the API keys, and their scopes and rates, of the HTTP listener")
+	flag.BoolVar(&openreads, "openreads", false, "Let requests without an API key read jobd's state, the output of runs included, when there are no -apikeys")
+	fldatabases := flag.String("databases", "", "File of the databases, and their drivers and data source names, jobs run SQL statements against")
+	flag.Var(admins, "admins", "Comma separated users who, along with jobd's user, administer jobd and every job")
+	flag.StringVar(&routesfile, "routes", "", "File of notification routing rules")
+	flag.StringVar(&sinksfile, "sinks", "", "File of the sinks, webhooks, NATS subjects, Kafka topics and logs, events are fed to")
+	flag.StringVar(&definitions, "definitions", "", "File, or directory of .json files, of the jobs jobd is reconciled with on reload, none if empty")
+	flag.StringVar(&gitrepo, "gitrepo", "", "Git repository of job definitions jobd pulls and reconciles with, none if empty")
+	flag.StringVar(&gitbranch, "gitbranch", gitbranch, "Branch of -gitrepo jobd pulls")
+	flag.StringVar(&gitpath, "gitpath", "", "Directory of -gitrepo holding the job definitions")
+	flag.DurationVar(&gitinterval, "gitinterval", gitinterval, "How often jobd pulls -gitrepo")
+	flag.StringVar(&smtpaddr, "smtp", "", "Address, host:port, of the mail server used for email notifications")
+	flag.StringVar(&mailfrom, "mailfrom", "jobd@localhost", "Sender of email notifications")
+	flag.StringVar(&slacktmplfile, "slacktemplate", "", "File holding the Go template of Slack notifications")
+	flhttpaddr := flag.String("httpaddr", "", "Address where the optional HTTP listener serves metrics and health probes, disabled if empty")
+	fldigest := flag.String("digest", "", "How often to produce digests of the jobs' runs: daily, weekly or never if empty")
+	flag.StringVar(&digestBy, "digestby", digestBy, "Label whose value groups jobs in digests")
+	flag.BoolVar(&foldnames, "foldnames", false, "Lower case the names of jobs as they're defined")
+	flag.DurationVar(&mininterval, "mininterval", mininterval, "Shortest time allowed between two runs of a new job")
+	flag.Var(allowfast, "allowfast", "Comma separated jobs exempt from -mininterval")
+	flag.IntVar(&warnfires, "warnfires", warnfires, "Runs per hour above which a new job's schedule draws a warning")
+	flag.IntVar(&maxcoincident, "maxcoincident", maxcoincident, "Most other jobs a new job may run together with, unlimited if 0")
+	flag.IntVar(&maxjobs, "maxjobs", maxjobs, "Most jobs jobd holds, unlimited if 0")
+	flag.IntVar(&workers, "workers", workers, "Most scheduled runs executed at once, unlimited if 0")
+	flag.IntVar(&queuesize, "queuesize", queuesize, "Most scheduled runs that may wait for a worker, unlimited if 0")
+	flexecutor := flag.String("executor", executor, "How commands are executed: shell, or fake to record them and report the results of the jobs' fake setting")
+	flqueuefull := flag.String("queuefull", queuefull, "What happens to a run due when the queue is full: drop-oldest, drop-new or block")
+	flag.Var(sharesFlag{}, "shares", "Weight, user=weight, of the claim on the workers of the jobs a user owns, 1 if not given (repeatable)")
+	flag.Var(semaphoresFlag{}, "semaphore", "Capacity, name=count, of a resource jobs name in their resources setting, 1 if not given (repeatable)")
+	flag.DurationVar(&shedafter, "shedafter", shedafter, "How long the workers may be saturated before low priority runs are shed")
+	flag.DurationVar(&trashfor, "trashfor", trashfor, "How long deleted jobs are kept in the trash")
+	flag.DurationVar(&maxage, "maxage", maxage, "How long the files saved for a run are kept, forever if 0")
+	flag.Int64Var(&maxstore, "maxstore", maxstore, "Most bytes the files saved for runs may take up, unlimited if 0")
+	flag.IntVar(&clonerate, "clonerate", clonerate, "Most jobs a user may define per minute, unlimited if 0")
+	fltimefmt := flag.String("timefmt", timefmt, "Format of timestamps: rfc3339, rfc3339nano, rfc1123, unix, ... or a Go time layout")
 	flag.Parse()
 
+	if err := validTimefmt(*fltimefmt); err != nil {
+		glog.Errorf("invalid -timefmt (%v)", err)
+		os.Exit(1)
+	}
+	timefmt = *fltimefmt
+
+	if *flmsize < 2*p.IOHDRSZ || *flmsize > MAXMSIZE {
+		glog.Errorf("invalid -msize (not between %d and %d: %d)", 2*p.IOHDRSZ, MAXMSIZE, *flmsize)
+		os.Exit(1)
+	}
+
+	if err := validExecutor(*flexecutor); err != nil {
+		glog.Errorf("invalid -executor (%v)", err)
+		os.Exit(1)
+	}
+	executor = *flexecutor
+
+	if err := validQueuefull(*flqueuefull); err != nil {
+		glog.Errorf("invalid -queuefull (%v)", err)
+		os.Exit(1)
+	}
+	queuefull = *flqueuefull
+
+	if err := validDigest(*fldigest); err != nil {
+		glog.Errorf("invalid -digest (%v)", err)
+		os.Exit(1)
+	}
+	digestEvery = *fldigest
+
+	if jobsgroup != "" && p.OsUsers.Gname2Group(jobsgroup) == nil {
+		glog.Errorf("invalid -jobsgroup (unknown group: %s)", jobsgroup)
+		os.Exit(1)
+	}
+
+	if slacktmplfile != "" {
+		if err := loadSlackTemplate(slacktmplfile); err != nil {
+			glog.Errorf("can't load Slack template (%v)", err)
+			os.Exit(1)
+		}
+	}
+
+	if routesfile != "" {
+		if err := loadRoutes(routesfile); err != nil {
+			glog.Errorf("can't load notification routes (%v)", err)
+			os.Exit(1)
+		}
+	}
+
+	if sinksfile != "" {
+		if err := loadSinks(sinksfile); err != nil {
+			glog.Errorf("can't load event sinks (%v)", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flencryptkey != "" {
+		if err := loadKey(*flencryptkey); err != nil {
+			glog.Errorf("can't load encryption key (%v)", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flapikeys != "" {
+		if err := loadAPIKeys(*flapikeys); err != nil {
+			glog.Errorf("can't load API keys (%v)", err)
+			os.Exit(1)
+		}
+	}
+
+	if *fldatabases != "" {
+		if err := loadDatabases(*fldatabases); err != nil {
+			glog.Errorf("can't load databases (%v)", err)
+			os.Exit(1)
+		}
+	}
+
 	var err error
 
-	jobsdb, err = mkjobdb(*fldbdir)
-	if err != nil {
+	if !*flcheck {
+		if err := single(*fldbdir, *flreplace); err != nil {
+			glog.Errorf("can't lock the jobs database (%v)", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := mkstore(*fldbdir); err != nil {
+		glog.Errorf("can't create the store (%v)", err)
 		os.Exit(1)
 	}
 
+	if gitrepo != "" {
+		gitdir = path.Join(*fldbdir, "definitions.git")
+		definitions = path.Join(gitdir, gitpath)
+	}
+
+	if *flmigrate {
+		backup, converted, failures, err := migrate()
+		if err != nil {
+			glog.Errorf("can't migrate the jobs database (%v)", err)
+			os.Exit(1)
+		}
+		fmt.Printf("converted %d jobs, the original is saved as %s\n", converted, backup)
+		for _, f := range failures {
+			fmt.Printf("failed: %s\n", f)
+		}
+		if len(failures) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *flcheck {
+		findings, err := fsck()
+		if err != nil {
+			glog.Errorf("can't check the store (%v)", err)
+			os.Exit(1)
+		}
+		for _, f := range findings {
+			fmt.Println(f)
+		}
+		if len(findings) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	root, err := mkjobfs()
 	if err != nil {
+		glog.Errorf("can't create the jobd name space (%v)", err)
+		os.Exit(1)
+	}
+
+	owners, err := loadOwners()
+	if err != nil {
+		glog.Errorf("can't load job owners (%v)", err)
 		os.Exit(1)
 	}
 
 	db, err := os.Open(jobsdb)
 	if err != nil {
+		glog.Errorf("can't open the jobs database (%v)", err)
 		os.Exit(1)
 	}
 
 	scanner := bufio.NewScanner(db)
-	for scanner.Scan() {
-		data := scanner.Text()
-		jdparts := strings.Split(data, ":")
-		if len(jdparts) != 3 {
-			glog.Errorf("jobdb corruption: invalid job definition (%v)", data)
-			os.Exit(1)
-		}
-
-		jd, err := mkJobDefinition(jdparts[0], jdparts[1], jdparts[2])
+	for n := 1; scanner.Scan(); n++ {
+		jd, err := decodeJob(scanner.Text())
 		if err != nil {
-			glog.Errorf("unable to create job definition (%v)", err)
+			glog.Errorf("can't load job definition at %s line %d (%v)", jobsdb, n, err)
 			os.Exit(1)
 		}
 
-		if err := jobsroot.addJob(*jd); err != nil {
+		if err := jobsroot.addJob(*jd, owners[jd.name]); err != nil {
 			glog.Errorf("can't add job (%v)", err)
 			os.Exit(1)
 		}
 	}
 
+	if err := jobsroot.loadSettings(); err != nil {
+		glog.Errorf("can't load job settings (%v)", err)
+		os.Exit(1)
+	}
+
+	if err := loadSlots(); err != nil {
+		glog.Errorf("can't load completed slots (%v)", err)
+		os.Exit(1)
+	}
+
+	if err := jobsroot.loadProtection(); err != nil {
+		glog.Errorf("can't load job protection (%v)", err)
+		os.Exit(1)
+	}
+
+	if gitrepo != "" {
+		if err := gitSync(true); err != nil {
+			glog.Errorf("can't sync jobs with %s, keeping those stored (%v)", gitrepo, err)
+		}
+		go syncEvery()
+	} else if definitions != "" {
+		if err := reconcile(); err != nil {
+			glog.Errorf("can't reconcile jobs with their definitions, keeping those stored (%v)", err)
+		}
+	}
+
+	reapOnExit()
+	reloadOnHangup()
+
+	go watch()
+	go reap()
+	go watchdog()
+
+	if *flhttpaddr != "" {
+		startHTTP(*flhttpaddr)
+	}
+
 	s := srv.NewFileSrv(root)
 	s.Dotu = true
+	s.Msize = uint32(*flmsize)
 	if *fldebug {
 		s.Debuglevel = 1
 	}
-	s.Start(s)
+	s.Start(&connsrv{s})
 
-	if err := s.StartNetListener("tcp", *flfsaddr); err != nil {
+	l, err := listener(*flfsaddr)
+	if err != nil {
 		glog.Errorf("listener failed to start (%v)", err)
 		os.Exit(1)
 	}
+	atomic.StoreInt32(&listening, 1)
+	nsaddr, nsmsize = l.Addr().String(), uint32(*flmsize)
+	if fusemount != "" {
+		if err := mountFUSE(fusemount, nsaddr, nsmsize); err != nil {
+			glog.Errorf("can't mount the name space on %s (%v)", fusemount, err)
+			os.Exit(1)
+		}
+	}
+	upgradeOnSignal(l)
+	takeOver()
+	sdnotify("READY=1")
+
+	if err := s.StartListener(l); err != nil {
+		if atomic.LoadInt32(&upgrading) == 1 {
+			// upgrade exits once the runs in progress finish
+			select {}
+		}
+		glog.Errorf("listener failed (%v)", err)
+		os.Exit(1)
+	}
+}
+
+// reloadOnHangup reloads the notification routes and Slack template when jobd
+// receives SIGHUP.
+func reloadOnHangup() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	go func() {
+		for range sigs {
+			glog.Infoln("Received SIGHUP, reloading")
+			if err := reload(); err != nil {
+				glog.Errorf("can't reload (%v)", err)
+			}
+		}
+	}()
+}
+
+// reload reloads the notification routes, event sinks and Slack template,
+// keeping the ones in use if they're invalid, and reconciles the jobs with their
+// definitions.
+func reload() error {
+	sdnotify("RELOADING=1")
+	defer sdnotify("READY=1")
+
+	if routesfile != "" {
+		if err := loadRoutes(routesfile); err != nil {
+			return fmt.Errorf("can't reload notification routes: %v", err)
+		}
+	}
+	if sinksfile != "" {
+		if err := loadSinks(sinksfile); err != nil {
+			return fmt.Errorf("can't reload event sinks: %v", err)
+		}
+	}
+	if slacktmplfile != "" {
+		if err := loadSlackTemplate(slacktmplfile); err != nil {
+			return fmt.Errorf("can't reload Slack template: %v", err)
+		}
+	}
+	if gitrepo != "" {
+		if err := gitSync(true); err != nil {
+			return fmt.Errorf("can't sync jobs with %s: %v", gitrepo, err)
+		}
+	} else if definitions != "" {
+		if err := reconcile(); err != nil {
+			return fmt.Errorf("can't reconcile jobs with their definitions: %v", err)
+		}
+	}
+	return nil
+}
+
+// mkstore creates the jobd databases in dbdir, empty if they don't exist, and
+// the directory holding the files saved for runs, and points jobd at them.
+func mkstore(dbdir string) error {
+	dbs := []struct {
+		path *string
+		name string
+	}{{&jobsdb, "jobs.db"}, {&settingsdb, "settings.db"}, {&slotsdb, "slots.db"}, {&ownersdb, "owners.db"}, {&protectdb, "protect.db"}}
+	for _, db := range dbs {
+		name, err := mkjobdb(dbdir, db.name)
+		if err != nil {
+			return err
+		}
+		*db.path = name
+	}
+
+	outdir = path.Join(dbdir, "runs")
+	if err := os.MkdirAll(outdir, 0755); err != nil {
+		return fmt.Errorf("can't create run output directory: %v", err)
+	}
+
+	reportsdir = path.Join(dbdir, "reports")
+	auditlog = path.Join(dbdir, "audit.log")
+	usagelog = path.Join(dbdir, "usage.log")
+	trashdb = path.Join(dbdir, "trash.db")
+	trashdir = path.Join(dbdir, "trash")
+	maintenancedb = path.Join(dbdir, "maintenance.db")
+	return nil
 }
 
-// mkjobdb checks to see if the specified path to the jobd database exists and creates it
-// if necessary, it also creates an empty database if none exists and returns the full
-// path to the jobs database
-func mkjobdb(dbdir string) (string, error) {
+// mkjobdb checks to see if the specified path to the jobd databases exists and creates it
+// if necessary, it also creates the named database, empty, if none exists and returns its
+// full path
+func mkjobdb(dbdir, name string) (string, error) {
 	if err := os.MkdirAll(dbdir, 0755); err != nil {
 		return "", err
 	}
 
-	dbpath := path.Join(dbdir, "jobs.db")
+	dbpath := path.Join(dbdir, name)
 
 	f, err := os.OpenFile(dbpath, os.O_CREATE|os.O_RDONLY, 0755)
 	if err != nil {
@@ -113,6 +424,91 @@ func mkjobfs() (*srv.File, error) {
 		return nil, err
 	}
 
+	err = mkSimulateFile(root, user, func() []*job { return jobsroot.list() })
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkValidateFile(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkImportFile(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkExportFile(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkPlanFile(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkAuditFile(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkSchedulerFile(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkAdminCtlFile(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkEventsFile(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkConfigDir(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkHeartbeatFile(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkProblemsFile(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkReportsDir(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkUsageDir(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkConnectionsDir(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkTrashDir(root, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkMaintenanceFile(root, user)
+	if err != nil {
+		return nil, err
+	}
+
 	jobsroot, err = mkJobsDir(root, user)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// testStore points jobd at a store in a fresh directory, removed once the test
+// ends, with runs faked rather than executed and no jobs counted against
+// -clonerate yet, and builds the name space over it. It returns the root of the
+// name space and jobd's user.
+func testStore(tb testing.TB) (*srv.File, p.User) {
+	tb.Helper()
+
+	if err := mkstore(tb.TempDir()); err != nil {
+		tb.Fatal(err)
+	}
+	executor = FAKE
+	maxjobs, clonerate = 0, 0
+	slots.done, slots.kept, slots.lines = make(map[string][]string), 0, 0
+	cloned.made = make(map[string][]time.Time)
+
+	root, err := mkjobfs()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return root, p.OsUsers.Uid2User(os.Geteuid())
+}
+
+// testJobs adds n jobs, named <prefix><i>, that run true once a year, starting
+// them if start is set. They're stopped once the test ends, waiting for their
+// schedulers to exit.
+func testJobs(tb testing.TB, prefix string, n int, start bool) []*job {
+	tb.Helper()
+
+	jobs := make([]*job, 0, n)
+	for i := 0; i < n; i++ {
+		jd, err := mkJobDefinition(fmt.Sprintf("%s%d", prefix, i), "0 0 0 1 1 ? *", "true")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err := jobsroot.addJob(*jd, nil); err != nil {
+			tb.Fatal(err)
+		}
+		j, _ := jobsroot.lookup(jd.name)
+		if start {
+			j.slk.Lock()
+			j.start()
+			j.slk.Unlock()
+		}
+		jobs = append(jobs, j)
+	}
+
+	tb.Cleanup(func() { stopJobs(jobs) })
+	return jobs
+}
+
+// stopJobs stops the jobs that are started and waits for their schedulers to
+// exit.
+func stopJobs(jobs []*job) {
+	for _, j := range jobs {
+		j.slk.Lock()
+		if j.defn.state == STARTED {
+			j.stop()
+		}
+		j.slk.Unlock()
+		j.looping.Lock()
+		j.looping.Unlock()
+	}
+}
+
+// testFid returns the fid through which user reads and writes the file.
+func testFid(f *srv.File, user p.User) *srv.FFid {
+	return &srv.FFid{F: f, Fid: &srv.Fid{User: user}}
+}
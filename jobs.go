@@ -1,14 +1,23 @@
 package main
 
 import (
+	"sort"
+	"sync"
+
 	"github.com/golang/glog"
 	p "github.com/vergult/go9p"
 	"github.com/vergult/go9p/srv"
 )
 
+// jobsgroup names the group whose members, along with jobd's user, may define
+// jobs, anyone may when it's empty
+var jobsgroup string
+
 type jobsdir struct {
 	srv.File
 	user p.User
+	lk   sync.RWMutex
+	jobs map[string]*job
 }
 
 // mkJobsDir create the jobs directory at the root of the jobd name space.
@@ -18,8 +27,9 @@ func mkJobsDir(dir *srv.File, user p.User) (*jobsdir, error) {
 
 	glog.V(3).Infoln("Create the jobs directory")
 
-	jobs := &jobsdir{user: user}
-	if err := jobs.Add(dir, "jobs", user, nil, p.DMDIR|0555, jobs); err != nil {
+	group, mode := definers()
+	jobs := &jobsdir{user: user, jobs: make(map[string]*job)}
+	if err := jobs.Add(dir, "jobs", user, group, p.DMDIR|mode, jobs); err != nil {
 		glog.Errorln("Can't create jobs directory ", err)
 		return nil, err
 	}
@@ -27,23 +37,122 @@ func mkJobsDir(dir *srv.File, user p.User) (*jobsdir, error) {
 	return jobs, nil
 }
 
+// definers returns the group that may define jobs, if any, and the mode of the
+// jobs directory that grants it, along with jobd's user, the right to.
+func definers() (p.Group, uint32) {
+	if jobsgroup == "" {
+		return nil, 0777
+	}
+	return p.OsUsers.Gname2Group(jobsgroup), 0775
+}
+
+// Create refuses to create files in the jobs directory, which 9P only lets
+// users who may define jobs attempt, as jobs are defined through the clone
+// file.
+func (jd *jobsdir) Create(fid *srv.FFid, name string, perm uint32) (*srv.File, error) {
+	return nil, invalid("definition", "write <name>:<schedule>:<cmd> to the clone file to create %s", name)
+}
+
 // addJob uses mkJob to create a new job subtree for the given job definition and adds it to
-// the jobd name space under the jobs directory.
-func (jd *jobsdir) addJob(def jobdef) error {
-	glog.V(4).Infof("Entering jobsdir.addJob(%s)", def)
-	defer glog.V(4).Infof("Leaving jobsdir.addJob(%s)", def)
+// the jobd name space under the jobs directory. The job's files belong to its owner, or to
+// jobd's user if it has none. A definition without an ID is given a new one.
+func (jd *jobsdir) addJob(def jobdef, owner p.User) error {
+	glog.V(4).Infof("Entering jobsdir.addJob(%s, %v)", def, owner)
+	defer glog.V(4).Infof("Leaving jobsdir.addJob(%s, %v)", def, owner)
 
 	glog.V(3).Info("Add job: ", def)
 
-	job, err := mkJob(&jd.File, jd.user, def)
+	if owner == nil {
+		owner = jd.user
+	}
+	if def.id == "" {
+		def.id = newID()
+	}
+
+	job, err := mkJob(&jd.File, owner, def)
 	if err != nil {
 		return err
 	}
 
-	if err := job.Add(&jd.File, def.name, jd.user, nil, p.DMDIR|0555, job); err != nil {
+	if err := job.Add(&jd.File, def.name, owner, nil, p.DMDIR|0555, job); err != nil {
 		glog.Errorf("Can't add job %s to jobs directory", def.name)
 		return err
 	}
 
+	jd.lk.Lock()
+	jd.jobs[def.name] = job
+	jd.lk.Unlock()
+	touch()
+
+	return nil
+}
+
+// removeJob stops the named job, interrupts its runs in progress, kills what
+// its runs left behind and removes it from the jobd name space.
+func (jd *jobsdir) removeJob(name string) error {
+	jd.lk.Lock()
+	j, ok := jd.jobs[name]
+	delete(jd.jobs, name)
+	jd.lk.Unlock()
+	if !ok {
+		return invalid("job", "no such job: %s", name)
+	}
+
+	j.slk.Lock()
+	j.halt()
+	j.slk.Unlock()
+	j.Remove()
+	touch()
+
 	return nil
 }
+
+// halt stops the job, interrupts its runs in progress and kills what its runs
+// left behind. The caller must hold the job's slk.
+func (j *job) halt() {
+	if j.defn.state == STARTED {
+		j.stop()
+	}
+	j.interrupt()
+	j.reap()
+}
+
+// lookup returns the named job if it's in the jobs directory.
+func (jd *jobsdir) lookup(name string) (*job, bool) {
+	jd.lk.RLock()
+	defer jd.lk.RUnlock()
+
+	j, ok := jd.jobs[name]
+	return j, ok
+}
+
+// lookupID returns the job with the given ID, if there is one.
+func (jd *jobsdir) lookupID(id string) (*job, bool) {
+	jd.lk.RLock()
+	defer jd.lk.RUnlock()
+
+	for _, j := range jd.jobs {
+		if j.defn.id == id {
+			return j, true
+		}
+	}
+	return nil, false
+}
+
+// list returns the jobs in the jobs directory ordered by name.
+func (jd *jobsdir) list() []*job {
+	jd.lk.RLock()
+	defer jd.lk.RUnlock()
+
+	names := []string{}
+	for name := range jd.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	jobs := []*job{}
+	for _, name := range names {
+		jobs = append(jobs, jd.jobs[name])
+	}
+	return jobs
+}
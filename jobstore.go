@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// JOBSCHEMA is the version of the job records this jobd writes, and the newest
+// it reads
+const JOBSCHEMA = 2
+
+// jobrecord is how a job's definition is stored in the jobs database, a JSON
+// object per line. Records without a version were written before records had
+// one and are version 0.
+type jobrecord struct {
+	Version  int    `json:"v,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Cmd      string `json:"cmd"`
+}
+
+// upgrades turn a record of each version, by index, into one of the next.
+var upgrades = []func(*jobrecord) error{
+	// 0 to 1 only adds the version.
+	func(rec *jobrecord) error {
+		return nil
+	},
+	// 1 to 2 gives the job an ID derived from its name.
+	func(rec *jobrecord) error {
+		rec.ID = nameID(rec.Name)
+		return nil
+	},
+}
+
+// upgrade brings a record up to JOBSCHEMA one version at a time. Records newer
+// than that were written by a newer jobd and are refused rather than
+// misread.
+func (rec *jobrecord) upgrade() error {
+	if rec.Version > JOBSCHEMA {
+		return fmt.Errorf("%s was written by a newer jobd, its schema version %d is newer than %d, the newest this one reads", rec.Name, rec.Version, JOBSCHEMA)
+	}
+	for rec.Version < JOBSCHEMA {
+		if err := upgrades[rec.Version](rec); err != nil {
+			return fmt.Errorf("can't upgrade %s from schema version %d: %v", rec.Name, rec.Version, err)
+		}
+		rec.Version++
+	}
+	return nil
+}
+
+// encodeJob returns the line of the jobs database that stores the definition.
+func encodeJob(jd *jobdef) (string, error) {
+	data, err := json.Marshal(jobrecord{Version: JOBSCHEMA, ID: jd.id, Name: jd.name, Schedule: jd.schedule, Cmd: jd.cmd})
+	if err != nil {
+		panic(err)
+	}
+	return sealLine(string(data))
+}
+
+// decodeJob returns the definition stored on a line of the jobs database,
+// upgraded to the current schema.
+func decodeJob(line string) (*jobdef, error) {
+	data, err := unsealLine(line)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(data, "{") {
+		return nil, fmt.Errorf("legacy job definition, convert the jobs database with jobd -migrate: %s", data)
+	}
+
+	var rec jobrecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return nil, fmt.Errorf("invalid job definition, jobd -migrate leaves it out of the jobs database (%v)", err)
+	}
+	if err := rec.upgrade(); err != nil {
+		return nil, err
+	}
+	jd, err := mkJobDefinition(rec.Name, rec.Schedule, rec.Cmd)
+	if err != nil {
+		return nil, err
+	}
+	jd.id = rec.ID
+	return jd, nil
+}
+
+// migrate converts the jobs database from the legacy format, a
+// <name>:<schedule>:<cmd> line per job, to the current one. The original is
+// first backed up, under the name returned, and entries that can't be
+// converted are left out of the converted database and described in the
+// failures returned. Entries already converted are kept as they are.
+func migrate() (string, int, []string, error) {
+	data, err := ioutil.ReadFile(jobsdb)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	backup := fmt.Sprintf("%s.%d.bak", jobsdb, time.Now().Unix())
+	if err := ioutil.WriteFile(backup, data, 0600); err != nil {
+		return "", 0, nil, err
+	}
+
+	lines, failures := []string{}, []string{}
+	converted := 0
+	err = scan(jobsdb, func(n int, text string) {
+		line, err := unsealLine(text)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("line %d: %v", n, err))
+			return
+		}
+		if strings.HasPrefix(line, "{") {
+			var rec jobrecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				failures = append(failures, fmt.Sprintf("line %d: invalid job definition (%v)", n, err))
+				return
+			}
+			lines = append(lines, text)
+			return
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			failures = append(failures, fmt.Sprintf("line %d: not a job definition: %s", n, line))
+			return
+		}
+		jd, err := mkJobDefinition(parts[0], parts[1], parts[2])
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("line %d: %v", n, err))
+			return
+		}
+		jd.id = nameID(jd.name)
+		encoded, err := encodeJob(jd)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("line %d: %v", n, err))
+			return
+		}
+		lines = append(lines, encoded)
+		converted++
+	})
+	if err != nil {
+		return backup, 0, nil, err
+	}
+
+	return backup, converted, failures, rewrite(jobsdb, lines)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// TestMigrate checks that a legacy jobs database is backed up and converted,
+// that the entries already converted are kept and that those that can't be,
+// or aren't valid JSON, are reported.
+func TestMigrate(t *testing.T) {
+	var err error
+	if jobsdb, err = mkjobdb(t.TempDir(), "jobs.db"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := encodeJob(&jobdef{name: "new", schedule: "0 0 0 1 1 ? *", cmd: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := "old:0 0 0 1 1 ? *:echo old: done\n" + line + "\nbroken\n{broken\n"
+	if err := ioutil.WriteFile(jobsdb, []byte(legacy), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeJob("old:0 0 0 1 1 ? *:echo old"); err == nil || !strings.Contains(err.Error(), "-migrate") {
+		t.Errorf("decoding a legacy definition: got %v, want it to point at -migrate", err)
+	}
+
+	backup, converted, failures, err := migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted != 1 || len(failures) != 2 || !strings.HasPrefix(failures[0], "line 3:") || !strings.HasPrefix(failures[1], "line 4:") {
+		t.Errorf("got %d converted and failures %q, want 1 converted and lines 3 and 4 failed", converted, failures)
+	}
+	if data, err := ioutil.ReadFile(backup); err != nil || string(data) != legacy {
+		t.Errorf("the backup holds %q (%v), want the original", data, err)
+	}
+
+	want := map[string]string{"old": "echo old: done", "new": "true"}
+	err = scan(jobsdb, func(n int, text string) {
+		jd, err := decodeJob(text)
+		if err != nil {
+			t.Errorf("line %d: %v", n, err)
+			return
+		}
+		if want[jd.name] != jd.cmd {
+			t.Errorf("got %s with command %q, want %q", jd.name, jd.cmd, want[jd.name])
+		}
+		delete(want, jd.name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 0 {
+		t.Errorf("jobs missing once migrated: %v", want)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MAXLINE is the most bytes of a line of a run's output kept in the job's
+	// log, unless its maxline setting says otherwise
+	MAXLINE = 4096
+
+	// MAXLINES is the most lines of a run's output kept in the job's log,
+	// unless its maxlines setting says otherwise
+	MAXLINES = 1000
+)
+
+// limited holds as much of a run's output as the job's limits allow: lines
+// longer than maxline bytes are cut short, at the start of a character, and
+// those after the first maxlines are dropped. The run's output file still gets
+// all of it, as do the digests of its first DIFFLINES lines, the count of its
+// characters, which drift and binary output are judged by, and its size.
+type limited struct {
+	buf      bytes.Buffer
+	total    int
+	maxline  int
+	maxlines int
+	line     int
+	lines    int
+	cutting  bool
+	cut      int
+	dropping bool
+	dropped  int
+	text     textcount
+	digests  []string
+	digest   hash.Hash64
+	pending  bool
+}
+
+// limited returns the buffer holding a run's output within the job's limits.
+func (j *job) limited() *limited {
+	l := &limited{maxline: j.count("maxline", MAXLINE), maxlines: j.count("maxlines", MAXLINES), digest: newDigest()}
+	if encoding := strings.ToLower(j.setting("encoding")); singlebyte[encoding] {
+		l.text.decode = decoders[encoding]
+	}
+	return l
+}
+
+// Write keeps what it can of the output, never failing.
+func (l *limited) Write(data []byte) (int, error) {
+	n := len(data)
+	l.total += n
+	l.text.Write(data)
+	for len(data) > 0 {
+		seg, end := data, false
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			seg, end = data[:i], true
+			data = data[i+1:]
+		} else {
+			data = nil
+		}
+
+		l.sum(seg, end)
+
+		if l.lines >= l.maxlines {
+			l.dropping = !end
+			if end {
+				l.dropped++
+			}
+			continue
+		}
+		if l.cutting {
+			seg = nil
+		} else if room := l.maxline - l.line; len(seg) > room {
+			l.buf.Write(seg[:room])
+			l.trimPartial()
+			seg, l.cutting = nil, true
+			l.cut++
+		}
+		l.buf.Write(seg)
+		l.line += len(seg)
+		if end {
+			l.buf.WriteByte('\n')
+			l.line, l.lines, l.cutting = 0, l.lines+1, false
+		}
+	}
+	return n, nil
+}
+
+// sum adds a segment of a line of the output to the line's digest, which is
+// kept once the line ends if it's one of the first DIFFLINES.
+func (l *limited) sum(seg []byte, end bool) {
+	if len(l.digests) >= DIFFLINES {
+		return
+	}
+	l.digest.Write(seg)
+	l.pending = !end
+	if end {
+		l.digests = append(l.digests, strconv.FormatUint(l.digest.Sum64(), 16))
+		l.digest.Reset()
+	}
+}
+
+// trimPartial drops the incomplete character the output kept ends with, if it
+// ends with one.
+func (l *limited) trimPartial() {
+	b := l.buf.Bytes()
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				l.buf.Truncate(i)
+			}
+			return
+		}
+	}
+}
+
+// sums returns the digests of the first DIFFLINES lines of the whole output,
+// the last one included even if it doesn't end with a newline.
+func (l *limited) sums() []string {
+	if l.pending && len(l.digests) < DIFFLINES {
+		return append(l.digests, strconv.FormatUint(l.digest.Sum64(), 16))
+	}
+	return l.digests
+}
+
+// newDigest returns the hash lines of output are digested with.
+func newDigest() hash.Hash64 {
+	return fnv.New64a()
+}
+
+// digests returns the digests of the lines given, as the output's are taken.
+func digests(lines []string) []string {
+	sums := make([]string, len(lines))
+	for i, line := range lines {
+		h := newDigest()
+		h.Write([]byte(line))
+		sums[i] = strconv.FormatUint(h.Sum64(), 16)
+	}
+	return sums
+}
+
+// Bytes returns the output kept.
+func (l *limited) Bytes() []byte {
+	return l.buf.Bytes()
+}
+
+// Size returns the length of the whole output, what was left out of it
+// included.
+func (l *limited) Size() int {
+	return l.total
+}
+
+// note returns the line noting what was left out of the output, if anything.
+func (l *limited) note() string {
+	dropped := l.dropped
+	if l.dropping {
+		dropped++
+	}
+	switch {
+	case l.cut > 0 && dropped > 0:
+		return fmt.Sprintf("[%d lines cut to %d bytes, %d lines after the first %d left out]\n", l.cut, l.maxline, dropped, l.maxlines)
+	case l.cut > 0:
+		return fmt.Sprintf("[%d lines cut to %d bytes]\n", l.cut, l.maxline)
+	case dropped > 0:
+		return fmt.Sprintf("[%d lines after the first %d left out]\n", dropped, l.maxlines)
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// write writes each chunk to a fresh limited buffer with the given limits.
+func write(maxline, maxlines int, chunks ...string) *limited {
+	l := &limited{maxline: maxline, maxlines: maxlines, digest: newDigest()}
+	for _, chunk := range chunks {
+		l.Write([]byte(chunk))
+	}
+	return l
+}
+
+// TestLimited checks that lines are cut to maxline bytes, that those after the
+// first maxlines are left out, even when split between writes, and that what
+// was left out is noted.
+func TestLimited(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+		note   string
+	}{
+		{"fits", []string{"abc\nde\n"}, "abc\nde\n", ""},
+		{"cut", []string{"abcdefgh\nij\n"}, "abcde\nij\n", "[1 lines cut to 5 bytes]\n"},
+		{"cut across writes", []string{"abc", "defgh", "ijk\nl\n"}, "abcde\nl\n", "[1 lines cut to 5 bytes]\n"},
+		{"dropped", []string{"a\nb\nc\nd\n"}, "a\nb\nc\n", "[1 lines after the first 3 left out]\n"},
+		{"dropped unterminated", []string{"a\nb\nc\nd\ne"}, "a\nb\nc\n", "[2 lines after the first 3 left out]\n"},
+		{"both", []string{"abcdefgh\nb\nc\nd\n"}, "abcde\nb\nc\n", "[1 lines cut to 5 bytes, 1 lines after the first 3 left out]\n"},
+	}
+	for _, tt := range tests {
+		l := write(5, 3, tt.chunks...)
+		if got := string(l.Bytes()); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if got := l.note(); got != tt.note {
+			t.Errorf("%s: got note %q, want %q", tt.name, got, tt.note)
+		}
+	}
+}
+
+// TestLimitedCutsCharacters checks that lines are cut at the start of a
+// character, even one split between two writes.
+func TestLimitedCutsCharacters(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"fits", []string{"abcé\n"}, "abcé\n"},
+		{"cut inside", []string{"abcdé and more\n"}, "abcd\n"},
+		{"cut across writes", []string{"abcd\xc3", "\xa9 and more\n"}, "abcd\n"},
+		{"rest of a cut line", []string{"abcdefgh", "ijk\nnext\n"}, "abcde\nnext\n"},
+	}
+	for _, tt := range tests {
+		got := string(write(5, MAXLINES, tt.chunks...).Bytes())
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestLimitedJudgesWholeOutput checks that drift and binary output are judged
+// by the whole output, not only what the limits keep of it.
+func TestLimitedJudgesWholeOutput(t *testing.T) {
+	out := strings.Repeat("x", 100) + "\nsecond\n\x00\x01\x02 beyond the limits\nlast"
+	l := write(10, 1, out[:50], out[50:])
+
+	want := digests(strings.Split(out, "\n"))
+	if got := l.sums(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got digests %v, want %v", got, want)
+	}
+	if !l.text.binary() {
+		t.Error("output with a NUL beyond the limits isn't binary")
+	}
+	if l.Size() != len(out) {
+		t.Errorf("got size %d, want %d", l.Size(), len(out))
+	}
+
+	var text textcount
+	text.Write([]byte("caf\xc3"))
+	text.Write([]byte("\xa9\n"))
+	if text.binary() || text.n != 5 {
+		t.Errorf("a character split between writes was counted as %d characters, binary %v", text.n, text.binary())
+	}
+}
+
+// TestTextcountDecodes checks that output in a single byte encoding is judged
+// by its characters once decoded rather than as UTF-8.
+func TestTextcountDecodes(t *testing.T) {
+	for _, encoding := range []string{"latin1", "windows-1252"} {
+		text := textcount{decode: decoders[encoding]}
+		text.Write([]byte("caf\xe9 cr\xe8me br\xfbl\xe9e\n"))
+		if text.binary() {
+			t.Errorf("%s text was judged binary", encoding)
+		}
+		text.Write([]byte("\x00"))
+		if !text.binary() {
+			t.Errorf("%s output with a NUL wasn't judged binary", encoding)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LINTTIMEOUT is how long the shell may take to check a command's syntax
+const LINTTIMEOUT = 2 * time.Second
+
+// jobenv are the variables jobd adds to the environment of every run
+var jobenv = []string{"SCHEDULED_TIME", "IDEMPOTENCY_KEY"}
+
+// varref matches references to shell variables, $NAME or ${NAME...}
+var varref = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)`)
+
+// cmdsep splits a command into the simple commands it's made of
+var cmdsep = regexp.MustCompile(`\|\||&&|[|;&\n(]|\$\(|` + "`")
+
+// lint looks for likely mistakes in the command of a job: syntax errors,
+// absolute paths to executables that don't exist and references to variables
+// that won't be set when it runs. It returns a warning for each.
+func lint(jd jobdef) []string {
+	warnings := []string{}
+
+	sh := (&job{defn: jd}).shell()
+	ctx, cancel := context.WithTimeout(context.Background(), LINTTIMEOUT)
+	defer cancel()
+	var stderr bytes.Buffer
+	k := exec.CommandContext(ctx, sh, "-n", "-c", jd.cmd)
+	k.Stderr = &stderr
+	if err := k.Run(); err != nil {
+		msg := strings.TrimSpace(strings.SplitN(stderr.String(), "\n", 2)[0])
+		if msg == "" {
+			msg = err.Error()
+		}
+		warnings = append(warnings, fmt.Sprintf("%s syntax check: %s", sh, msg))
+	}
+
+	for _, simple := range cmdsep.Split(jd.cmd, -1) {
+		exe := ""
+		for _, word := range strings.Fields(simple) {
+			if !strings.Contains(word, "=") || strings.HasPrefix(word, "/") {
+				exe = word
+				break
+			}
+		}
+		if !strings.HasPrefix(exe, "/") {
+			continue
+		}
+		if fi, err := os.Stat(exe); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s does not exist", exe))
+		} else if fi.IsDir() || fi.Mode()&0111 == 0 {
+			warnings = append(warnings, fmt.Sprintf("%s is not executable", exe))
+		}
+	}
+
+	set := make(map[string]bool)
+	for _, name := range jobenv {
+		set[name] = true
+	}
+	for _, kv := range os.Environ() {
+		set[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	for _, m := range varref.FindAllStringSubmatch(jd.cmd, -1) {
+		name := m[1]
+		if set[name] || regexp.MustCompile(`\b`+name+`=`).MatchString(jd.cmd) || strings.Contains(jd.cmd, "for "+name+" ") {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("$%s is not set in the job's environment", name))
+		set[name] = true
+	}
+
+	return warnings
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// validLockFile checks that a setting's value is the clean absolute path of a
+// lock file.
+func validLockFile(value string) error {
+	if !filepath.IsAbs(value) || filepath.Clean(value) != value {
+		return fmt.Errorf("not a clean absolute path: %s", value)
+	}
+	return nil
+}
+
+// lockFile takes an exclusive flock on the job's lock file, if it has one,
+// creating the file if need be, the way flock(1) does for a crontab entry. It
+// reports whether the lock was taken, and so the run may go ahead, along with
+// a function releasing it. A lock held by another process isn't waited for.
+func (j *job) lockFile() (bool, func()) {
+	name := j.setting("lockfile")
+	if name == "" {
+		return true, func() {}
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		glog.Errorf("Can't open %s lock file %s [%v]", j.defn.name, name, err)
+		j.record(fmt.Sprintf("skipped, can't open lock file %s: %v\n", name, err))
+		return false, nil
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			glog.V(3).Infof("%s lock file %s is held", j.defn.name, name)
+			j.record(fmt.Sprintf("skipped, lock file %s is held\n", name))
+		} else {
+			glog.Errorf("Can't lock %s lock file %s [%v]", j.defn.name, name, err)
+			j.record(fmt.Sprintf("skipped, can't lock %s: %v\n", name, err))
+		}
+		return false, nil
+	}
+
+	return true, func() {
+		if err := f.Close(); err != nil {
+			glog.Errorf("Can't release %s lock file %s [%v]", j.defn.name, name, err)
+		}
+	}
+}
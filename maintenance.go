@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// MAINTENANCE the root ctl file command string to record a maintenance window
+const MAINTENANCE = "maintenance"
+
+// maintenancedb is the path to the database of the maintenance windows
+var maintenancedb string
+
+// maintwindow is a period of planned maintenance, a JSON object per line of
+// the maintenance database. Runs failing and jobs going stale during it don't
+// open alerts.
+type maintwindow struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Reason string    `json:"reason"`
+	By     string    `json:"by"`
+}
+
+// maintenance holds the maintenance windows ordered by start, those that ended
+// more than SUMMARYDAYS ago forgotten.
+var maintenance = struct {
+	sync.Mutex
+	windows []maintwindow
+}{}
+
+// mkMaintenanceFile creates the read only file at the root of the jobd name
+// space that lists the maintenance windows and loads those recorded under an
+// earlier jobd.
+func mkMaintenanceFile(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkMaintenanceFile(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkMaintenanceFile(%v, %v)", dir, user)
+
+	maintenance.Lock()
+	err := scan(maintenancedb, func(n int, text string) {
+		var w maintwindow
+		data, err := unsealLine(text)
+		if err == nil {
+			err = json.Unmarshal([]byte(data), &w)
+		}
+		if err != nil {
+			glog.Warningf("Skipping line %d of the maintenance windows [%v]", n, err)
+			return
+		}
+		maintenance.windows = append(maintenance.windows, w)
+	})
+	maintenance.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	mf := &jobfile{
+		// maintenance reader returns a line per maintenance window.
+		reader: func() []byte {
+			var out bytes.Buffer
+			for _, w := range maintenanceWindows() {
+				fmt.Fprintln(&out, w.describe())
+			}
+			return out.Bytes()
+		},
+		// maintenance is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := mf.Add(dir, "maintenance", user, nil, 0444, mf); err != nil {
+		glog.Errorln("Can't create maintenance file: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// maintenanceArgs turns the arguments of a maintenance command, from and to
+// times in RFC3339 and a reason, into a maintenance window.
+func maintenanceArgs(args []string, by string) (maintwindow, error) {
+	kvs, err := ctlArgs(args)
+	if err != nil {
+		return maintwindow{}, err
+	}
+	from, err := time.Parse(time.RFC3339, kvs["from"])
+	if err != nil {
+		return maintwindow{}, invalid("from", "not an RFC3339 time: %s", kvs["from"])
+	}
+	to, err := time.Parse(time.RFC3339, kvs["to"])
+	if err != nil {
+		return maintwindow{}, invalid("to", "not an RFC3339 time: %s", kvs["to"])
+	}
+	if !to.After(from) {
+		return maintwindow{}, invalid("to", "not after from: %s", kvs["to"])
+	}
+	if kvs["reason"] == "" {
+		return maintwindow{}, invalid("reason", "missing")
+	}
+	return maintwindow{From: from, To: to, Reason: kvs["reason"], By: by}, nil
+}
+
+// plan records the maintenance window and rewrites the maintenance database.
+func (w maintwindow) plan(now time.Time) error {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	horizon := now.AddDate(0, 0, -SUMMARYDAYS)
+	windows := []maintwindow{w}
+	for _, old := range maintenance.windows {
+		if old.To.After(horizon) {
+			windows = append(windows, old)
+		}
+	}
+	sort.Slice(windows, func(a, b int) bool { return windows[a].From.Before(windows[b].From) })
+
+	lines := []string{}
+	for _, w := range windows {
+		data, err := json.Marshal(w)
+		if err != nil {
+			return err
+		}
+		line, err := sealLine(string(data))
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	if err := rewrite(maintenancedb, lines); err != nil {
+		return err
+	}
+	maintenance.windows = windows
+	return nil
+}
+
+// maintenanceWindows returns the maintenance windows ordered by start.
+func maintenanceWindows() []maintwindow {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	return append([]maintwindow{}, maintenance.windows...)
+}
+
+// underMaintenance reports whether t falls within a maintenance window.
+func underMaintenance(t time.Time) bool {
+	for _, w := range maintenanceWindows() {
+		if !t.Before(w.From) && t.Before(w.To) {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceOn returns the maintenance windows overlapping the day, given in
+// DAYFMT.
+func maintenanceOn(day string) []maintwindow {
+	start, err := time.ParseInLocation(DAYFMT, day, time.Local)
+	if err != nil {
+		return nil
+	}
+	end := start.AddDate(0, 0, 1)
+
+	windows := []maintwindow{}
+	for _, w := range maintenanceWindows() {
+		if w.From.Before(end) && w.To.After(start) {
+			windows = append(windows, w)
+		}
+	}
+	return windows
+}
+
+// describe renders the maintenance window as a line.
+func (w maintwindow) describe() string {
+	return fmt.Sprintf("%s - %s %s (%s)", formatTime(w.From, timefmt), formatTime(w.To, timefmt), w.Reason, w.By)
+}
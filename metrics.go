@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// metrics writes the statistics of every job in the Prometheus text exposition
+// format.
+func metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	jobs := jobsroot.list()
+
+	help(w, "jobd_runs_total", "counter", "Runs finished by job and outcome.")
+	for _, j := range jobs {
+		j.stats.Lock()
+		fmt.Fprintf(w, "jobd_runs_total{job=%q,status=%q} %d\n", j.defn.name, SUCCEEDED, j.stats.succeeded)
+		fmt.Fprintf(w, "jobd_runs_total{job=%q,status=%q} %d\n", j.defn.name, FAILED, j.stats.failed)
+		fmt.Fprintf(w, "jobd_runs_total{job=%q,status=%q} %d\n", j.defn.name, SIGNALED, j.stats.signaled)
+		fmt.Fprintf(w, "jobd_runs_total{job=%q,status=%q} %d\n", j.defn.name, TIMEDOUT, j.stats.timedout)
+		j.stats.Unlock()
+	}
+
+	help(w, "jobd_runs_skipped_total", "counter", "Runs skipped by job.")
+	for _, j := range jobs {
+		j.stats.Lock()
+		fmt.Fprintf(w, "jobd_runs_skipped_total{job=%q} %d\n", j.defn.name, j.stats.skipped)
+		j.stats.Unlock()
+	}
+
+	help(w, "jobd_runs_shed_total", "counter", "Scheduled runs shed by job while the workers were saturated.")
+	for _, j := range jobs {
+		j.stats.Lock()
+		fmt.Fprintf(w, "jobd_runs_shed_total{job=%q} %d\n", j.defn.name, j.stats.shed)
+		j.stats.Unlock()
+	}
+
+	help(w, "jobd_runs_overflowed_total", "counter", "Scheduled runs dropped by job because the queue was full.")
+	for _, j := range jobs {
+		j.stats.Lock()
+		fmt.Fprintf(w, "jobd_runs_overflowed_total{job=%q} %d\n", j.defn.name, j.stats.overflows)
+		j.stats.Unlock()
+	}
+
+	help(w, "jobd_run_exit_codes_total", "counter", "Runs finished by job and exit code, 128 plus the signal for runs killed by one.")
+	for _, j := range jobs {
+		j.stats.Lock()
+		for _, code := range j.stats.codes() {
+			fmt.Fprintf(w, "jobd_run_exit_codes_total{job=%q,code=\"%d\"} %d\n", j.defn.name, code, j.stats.exits[code])
+		}
+		j.stats.Unlock()
+	}
+
+	help(w, "jobd_dispatch_lag_seconds", "summary", "Delay between a run's scheduled slot and its start.")
+	for _, j := range jobs {
+		j.stats.Lock()
+		fmt.Fprintf(w, "jobd_dispatch_lag_seconds_sum{job=%q} %g\n", j.defn.name, j.stats.lagsum.Seconds())
+		fmt.Fprintf(w, "jobd_dispatch_lag_seconds_count{job=%q} %d\n", j.defn.name, j.stats.lagn)
+		j.stats.Unlock()
+	}
+
+	help(w, "jobd_dispatch_lag_max_seconds", "gauge", "Largest delay between a run's scheduled slot and its start.")
+	for _, j := range jobs {
+		j.stats.Lock()
+		fmt.Fprintf(w, "jobd_dispatch_lag_max_seconds{job=%q} %g\n", j.defn.name, j.stats.lagmax.Seconds())
+		j.stats.Unlock()
+	}
+
+	names, totals := consumers()
+	help(w, "jobd_owner_runs_total", "counter", "Runs finished by the owner of their job.")
+	for _, name := range names {
+		fmt.Fprintf(w, "jobd_owner_runs_total{owner=%q} %d\n", name, totals[name].runs)
+	}
+
+	help(w, "jobd_owner_cpu_seconds_total", "counter", "CPU time used by the runs of each owner's jobs.")
+	for _, name := range names {
+		fmt.Fprintf(w, "jobd_owner_cpu_seconds_total{owner=%q} %g\n", name, totals[name].cpu.Seconds())
+	}
+
+	pool.Lock()
+	busy, depth := pool.busy, len(pool.queue)
+	pool.Unlock()
+
+	help(w, "jobd_workers_busy", "gauge", "Workers executing scheduled runs.")
+	fmt.Fprintf(w, "jobd_workers_busy %d\n", busy)
+
+	help(w, "jobd_queue_depth", "gauge", "Scheduled runs waiting for a worker.")
+	fmt.Fprintf(w, "jobd_queue_depth %d\n", depth)
+}
+
+// help writes the HELP and TYPE lines that introduce a metric.
+func help(w io.Writer, name, kind, text string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, text, name, kind)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SYNC is the executor that copies the files under a directory that are
+	// new or changed to another, as given by the job's command
+	SYNC = "sync"
+
+	// SYNCPROGRESS is how often a sync reports its progress in the run's output
+	SYNCPROGRESS = 10 * time.Second
+)
+
+// mirroring is what a sync copies, as given by a job's command.
+type mirroring struct {
+	source      string
+	destination string
+	include     []string
+	exclude     []string
+	dryrun      bool
+}
+
+// parseMirroring parses the command of a sync job, source=<directory> and
+// destination=<directory>, optionally followed by include=<patterns>,
+// exclude=<patterns> and dryrun=true. Patterns are comma separated and matched
+// against the names of files and directories. The directories must be clean
+// absolute paths, neither within the other, and the destination outside the
+// system's directories.
+func parseMirroring(cmd string) (mirroring, error) {
+	fields, err := ctlFields(cmd)
+	if err != nil {
+		return mirroring{}, err
+	}
+	kvs, err := ctlArgs(fields)
+	if err != nil {
+		return mirroring{}, err
+	}
+
+	var m mirroring
+	for name, value := range kvs {
+		switch name {
+		case "source":
+			if !filepath.IsAbs(value) || filepath.Clean(value) != value {
+				return mirroring{}, invalid("source", "not a clean absolute path: %s", value)
+			}
+			m.source = value
+		case "destination":
+			if err := checkPath("destination", value); err != nil {
+				return mirroring{}, err
+			}
+			m.destination = value
+		case "include", "exclude":
+			patterns := strings.Split(value, ",")
+			for _, pattern := range patterns {
+				if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" || strings.Contains(pattern, "/") {
+					return mirroring{}, invalid(name, "not a file name pattern: %s", pattern)
+				}
+			}
+			if name == "include" {
+				m.include = patterns
+			} else {
+				m.exclude = patterns
+			}
+		case "dryrun":
+			if m.dryrun, err = strconv.ParseBool(value); err != nil {
+				return mirroring{}, invalid("dryrun", "not a boolean: %s", value)
+			}
+		default:
+			return mirroring{}, invalid("command", "expected source, destination, include, exclude or dryrun=value: %s", name)
+		}
+	}
+	switch {
+	case m.source == "":
+		return mirroring{}, invalid("source", "missing")
+	case m.destination == "":
+		return mirroring{}, invalid("destination", "missing")
+	case within(m.source, m.destination) || within(m.destination, m.source):
+		return mirroring{}, invalid("destination", "%s overlaps %s", m.destination, m.source)
+	}
+	return m, nil
+}
+
+// within reports whether path is dir or under it.
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// matches reports whether the name matches any of the patterns.
+func matches(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mirror copies the regular files under the job's source directory that are
+// missing from its destination, or differ from it in size or modification
+// time, creating directories as needed. Excluded files and directories are left
+// out, and when there are include patterns so are files matching none of them.
+// Files are never deleted from the destination and symbolic links are skipped.
+// It writes a line for each file copied to stdout, its progress every
+// SYNCPROGRESS and a total. A dry run, or a sync whose command asks for one,
+// only lists what it would copy. It stops once ctx is done.
+func (j *job) mirror(ctx context.Context, cmd string, stdout io.Writer, dryrun bool) error {
+	m, err := parseMirroring(cmd)
+	if err != nil {
+		return err
+	}
+	dryrun = dryrun || m.dryrun
+	verb := "copied"
+	if dryrun {
+		verb = "would copy"
+	}
+
+	files, size, last := 0, int64(0), time.Now()
+	err = filepath.Walk(m.source, func(name string, fi os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "skipped %s: %v\n", name, err)
+			return nil
+		}
+		if name != m.source && matches(fi.Name(), m.exclude) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(m.source, name)
+		target := filepath.Join(m.destination, rel)
+		switch {
+		case fi.IsDir():
+			if !dryrun {
+				if err := os.MkdirAll(target, fi.Mode().Perm()|0700); err != nil {
+					return err
+				}
+			}
+			return nil
+		case fi.Mode()&os.ModeSymlink != 0:
+			fmt.Fprintf(stdout, "skipped %s: symbolic link\n", name)
+			return nil
+		case !fi.Mode().IsRegular():
+			return nil
+		case len(m.include) > 0 && !matches(fi.Name(), m.include):
+			return nil
+		}
+		if tfi, err := os.Lstat(target); err == nil && tfi.Size() == fi.Size() && tfi.ModTime().Equal(fi.ModTime()) {
+			return nil
+		}
+		if !dryrun {
+			if err := copyFile(name, target, fi); err != nil {
+				fmt.Fprintf(stdout, "skipped %s: %v\n", name, err)
+				return nil
+			}
+		}
+		fmt.Fprintf(stdout, "%s %s\n", verb, rel)
+		files++
+		size += fi.Size()
+		if now := time.Now(); now.Sub(last) >= SYNCPROGRESS {
+			fmt.Fprintf(stdout, "progress: %d files, %d bytes\n", files, size)
+			last = now
+		}
+		return nil
+	})
+	fmt.Fprintf(stdout, "%s %d files, %d bytes\n", verb, files, size)
+	return err
+}
+
+// copyFile copies the file to target, through a temporary file renamed once
+// complete, with the original's permissions and modification time.
+func copyFile(name, target string, fi os.FileInfo) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := target + ".jobd-tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chtimes(tmp, fi.ModTime(), fi.ModTime()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, target)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// WEBHOOK the channel that posts events as JSON to a URL
+	WEBHOOK = "webhook"
+
+	// EMAIL the channel that mails events to an address
+	EMAIL = "email"
+
+	// EVENTS the channel that only records events in the events file
+	EVENTS = "events"
+)
+
+// route sends the failures of jobs matching its selector to a channel, holding
+// them back during its quiet hours.
+type route struct {
+	id       int
+	selector map[string]string
+	channel  string
+	target   string
+	quiet    window
+}
+
+// routes are the notification routing rules, in the order they were given
+var routes struct {
+	sync.RWMutex
+	rules  []route
+	lastid int
+}
+
+// smtpaddr is the address of the mail server used by the email channel
+var smtpaddr string
+
+// mailfrom is the sender of the mail sent by the email channel
+var mailfrom string
+
+// notifier posts webhooks
+var notifier = &http.Client{Timeout: 10 * time.Second}
+
+// loadRoutes reads notification routing rules from the named file. Each line
+// holds a rule of the form <selector> <channel> [<target>] [quiet=HH:MM-HH:MM],
+// where the selector is * or a comma separated list of label=value pairs a job's
+// labels, or its severity, must all match. Blank lines and lines starting with #
+// are ignored. The rules replace those loaded before only if they're all valid.
+func loadRoutes(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rules := []route{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rt, err := parseRoute(line)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", name, n, err)
+		}
+		rules = append(rules, rt)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	routes.Lock()
+	defer routes.Unlock()
+
+	for i := range rules {
+		routes.lastid++
+		rules[i].id = routes.lastid
+	}
+	routes.rules = rules
+	return nil
+}
+
+// currentRoutes returns the notification routing rules.
+func currentRoutes() []route {
+	routes.RLock()
+	defer routes.RUnlock()
+
+	return routes.rules
+}
+
+// parseRoute parses a single routing rule.
+func parseRoute(line string) (route, error) {
+	fields := strings.Fields(line)
+	rt := route{selector: make(map[string]string)}
+	if n := len(fields); n > 0 && strings.HasPrefix(fields[n-1], "quiet=") {
+		w, err := parseWindow(strings.TrimPrefix(fields[n-1], "quiet="))
+		if err != nil {
+			return route{}, invalid("quiet", "%v", err)
+		}
+		rt.quiet, fields = w, fields[:n-1]
+	}
+	if len(fields) < 2 {
+		return route{}, invalid("route", "expected <selector> <channel> [<target>]: %s", line)
+	}
+	rt.channel = fields[1]
+
+	if fields[0] != "*" {
+		for _, kv := range strings.Split(fields[0], ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return route{}, invalid("selector", "expected label=value: %s", kv)
+			}
+			rt.selector[parts[0]] = parts[1]
+		}
+	}
+
+	switch rt.channel {
+	case EVENTS:
+	case WEBHOOK, EMAIL, SLACK, PAGERDUTY, OPSGENIE:
+		if len(fields) != 3 {
+			return route{}, invalid("target", "%s needs a target", rt.channel)
+		}
+		rt.target = fields[2]
+	default:
+		return route{}, invalid("channel", "unknown: %s", rt.channel)
+	}
+
+	return rt, nil
+}
+
+// matches reports whether an event's job has every label, or severity, in the
+// route's selector.
+func (rt route) matches(ev event) bool {
+	for k, v := range rt.selector {
+		if k == "severity" {
+			if ev.Severity != v {
+				return false
+			}
+			continue
+		}
+		if ev.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// notify records an event and sends it through the channel of every route that
+// matches it. During the quiet hours of the event's job, or of a route, the
+// route holds the event back until they end, and it's recorded as suppressed.
+func notify(ev event) {
+	now := time.Now()
+
+	send := []route{}
+	for _, rt := range currentRoutes() {
+		if !rt.matches(ev) {
+			continue
+		}
+		end := ev.quiet
+		if until := rt.quiet.until(now); until.After(end) {
+			end = until
+		}
+		if end.IsZero() {
+			send = append(send, rt)
+			continue
+		}
+		ev.Suppressed = true
+		later := ev
+		later.quiet = end
+		hold(rt, later)
+	}
+
+	emit(ev)
+
+	for _, rt := range send {
+		go rt.send(ev)
+	}
+}
+
+// send delivers an event through the route's channel.
+func (rt route) send(ev event) {
+	var err error
+
+	switch rt.channel {
+	case WEBHOOK:
+		err = postJSON(rt.target, ev)
+	case EMAIL:
+		err = mail(rt.target, ev)
+	case SLACK:
+		err = slack(rt.target, ev)
+	case PAGERDUTY:
+		err = pagerduty(rt.target, ev)
+	case OPSGENIE:
+		err = opsgenie(rt.target, ev)
+	}
+
+	if err != nil {
+		glog.Errorf("Can't send %s event for %s via %s [%v]", ev.Kind, ev.Job, rt.channel, err)
+	}
+}
+
+// postJSON posts v, encoded as JSON, to url.
+func postJSON(url string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	resp, err := notifier.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// mail sends an event to the given address.
+func mail(to string, ev event) error {
+	if smtpaddr == "" {
+		return fmt.Errorf("no mail server, see -smtp")
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\n", mailfrom, to)
+	fmt.Fprintf(&msg, "Subject: jobd: %s %s %s\r\n\r\n", ev.Job, ev.Kind, ev.Status)
+	fmt.Fprintf(&msg, "%s\r\n", ev.Message)
+	if ev.Output != "" {
+		fmt.Fprintf(&msg, "\r\n%s\r\n", strings.Replace(ev.Output, "\n", "\r\n", -1))
+	}
+
+	return smtp.SendMail(smtpaddr, nil, mailfrom, []string{to}, msg.Bytes())
+}
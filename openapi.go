@@ -0,0 +1,363 @@
+package main
+
+import (
+	"net/http"
+)
+
+// openapi serves the OpenAPI description of the HTTP API.
+func openapi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openapiSpec))
+}
+
+// openapiSpec is the OpenAPI description of the HTTP API, kept in step with the
+// handlers startHTTP registers and with the client package.
+const openapiSpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "jobd",
+    "description": "The HTTP API of jobd, a job scheduler with a 9P interface. Requests bear an API key from the -apikeys file as a bearer token, or, opening /events/ws, as the access_token parameter; without keys reads are open given -openreads and everything else is refused.",
+    "version": "1"
+  },
+  "security": [{"bearer": []}],
+  "paths": {
+    "/jobs/": {
+      "get": {
+        "operationId": "listJobs",
+        "summary": "Every job.",
+        "responses": {
+          "200": {"description": "The jobs.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/JobResource"}}}}},
+          "401": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/jobs/{job}": {
+      "get": {
+        "operationId": "getJob",
+        "summary": "A job, with its version as its ETag.",
+        "parameters": [{"$ref": "#/components/parameters/job"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/job"},
+          "401": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "put": {
+        "operationId": "putJob",
+        "summary": "Create the job, or make it match the one given. Its schedule, command and settings are replaced, and it's started or stopped if a state is given. Nothing changes if it already matches.",
+        "description": "Needs the full scope. Jobs created belong to the user the key is named after, or jobd's user if there's none, count against -clonerate and are stopped unless started is asked for.",
+        "parameters": [
+          {"$ref": "#/components/parameters/job"},
+          {"$ref": "#/components/parameters/ifMatch"},
+          {"$ref": "#/components/parameters/ifNoneMatch"}
+        ],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/JobResource"}}}},
+        "responses": {
+          "200": {"$ref": "#/components/responses/job"},
+          "201": {"$ref": "#/components/responses/job"},
+          "400": {"$ref": "#/components/responses/error"},
+          "401": {"$ref": "#/components/responses/error"},
+          "403": {"$ref": "#/components/responses/error"},
+          "409": {"$ref": "#/components/responses/error"},
+          "412": {"$ref": "#/components/responses/error"},
+          "429": {"$ref": "#/components/responses/error"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteJob",
+        "summary": "Delete the job, moving it to the trash. Deleting a job that doesn't exist succeeds.",
+        "description": "Needs the full scope.",
+        "parameters": [
+          {"$ref": "#/components/parameters/job"},
+          {"$ref": "#/components/parameters/ifMatch"}
+        ],
+        "responses": {
+          "204": {"description": "The job is gone."},
+          "401": {"$ref": "#/components/responses/error"},
+          "403": {"$ref": "#/components/responses/error"},
+          "409": {"$ref": "#/components/responses/error"},
+          "412": {"$ref": "#/components/responses/error"},
+          "429": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/apply": {
+      "post": {
+        "operationId": "applyJobs",
+        "summary": "Make each of the jobs given match, as putJob does, and return the outcome for each. Each is applied on its own and jobs that already match are left alone.",
+        "description": "Needs the full scope.",
+        "parameters": [{"name": "check", "in": "query", "schema": {"type": "boolean"}, "description": "Change nothing, only report the outcomes applying the jobs would have."}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/JobResource"}}}}},
+        "responses": {
+          "200": {"description": "The outcomes.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Applied"}}}},
+          "400": {"$ref": "#/components/responses/error"},
+          "401": {"$ref": "#/components/responses/error"},
+          "403": {"$ref": "#/components/responses/error"},
+          "429": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/runs": {
+      "get": {
+        "operationId": "searchRuns",
+        "summary": "The finished runs of every job matching the search, as recorded in the jobs' records files, the most recently started first.",
+        "parameters": [
+          {"name": "job", "in": "query", "schema": {"type": "string"}, "description": "Comma separated jobs whose runs are wanted."},
+          {"name": "status", "in": "query", "schema": {"type": "string"}, "description": "Comma separated statuses of the runs wanted, e.g. failed,signaled,timedout."},
+          {"name": "since", "in": "query", "schema": {"type": "string"}, "description": "How recently the runs wanted started, e.g. 24h."},
+          {"name": "longer", "in": "query", "schema": {"type": "string"}, "description": "How long the runs wanted took at least, e.g. 5m."},
+          {"name": "output", "in": "query", "schema": {"type": "string"}, "description": "Text the saved output of the runs wanted holds."},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}, "description": "The most runs wanted."}
+        ],
+        "responses": {
+          "200": {"description": "The runs found.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Run"}}}}},
+          "400": {"$ref": "#/components/responses/error"},
+          "401": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/ids/{id}": {
+      "get": {
+        "operationId": "getJobByID",
+        "summary": "The job with the given ID, with its version as its ETag.",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string", "format": "uuid"}}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/job"},
+          "401": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/jobs/{job}/run": {
+      "post": {
+        "operationId": "runJob",
+        "summary": "Run a job now, outside its schedule.",
+        "description": "Needs the trigger scope.",
+        "parameters": [{"$ref": "#/components/parameters/job"}],
+        "responses": {
+          "202": {"description": "The run was started."},
+          "400": {"$ref": "#/components/responses/error"},
+          "401": {"$ref": "#/components/responses/error"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"},
+          "429": {"$ref": "#/components/responses/error"},
+          "503": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/dashboard/state": {
+      "get": {
+        "operationId": "getState",
+        "summary": "The jobs, with their states, next runs and the status of their last runs, and the most recent failed runs.",
+        "responses": {
+          "200": {"description": "The state of the jobs.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/State"}}}},
+          "401": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/events": {
+      "get": {
+        "operationId": "streamEvents",
+        "summary": "The events emitted from now on as Server-Sent Events, each named for its kind with its JSON encoding as data.",
+        "parameters": [
+          {"$ref": "#/components/parameters/jobs"},
+          {"$ref": "#/components/parameters/kinds"},
+          {"$ref": "#/components/parameters/labels"}
+        ],
+        "responses": {
+          "200": {"description": "The event stream.", "content": {"text/event-stream": {"schema": {"type": "string"}}}},
+          "400": {"$ref": "#/components/responses/error"},
+          "401": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/events/ws": {
+      "get": {
+        "operationId": "streamEventsWebSocket",
+        "summary": "The events emitted from now on over a WebSocket, a text message holding each one's JSON encoding.",
+        "security": [{"bearer": []}, {"token": []}],
+        "parameters": [
+          {"$ref": "#/components/parameters/jobs"},
+          {"$ref": "#/components/parameters/kinds"},
+          {"$ref": "#/components/parameters/labels"}
+        ],
+        "responses": {
+          "101": {"description": "Switched to the WebSocket protocol."},
+          "400": {"$ref": "#/components/responses/error"},
+          "401": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/fs/{path}": {
+      "get": {
+        "operationId": "getFile",
+        "summary": "A file of the name space, or the HTML listing of a directory, as anyone may read it.",
+        "parameters": [{"name": "path", "in": "path", "required": true, "schema": {"type": "string"}, "description": "The path of the file in the name space, e.g. jobs/backup/log."}],
+        "responses": {
+          "200": {"description": "The file's contents.", "content": {"*/*": {"schema": {"type": "string", "format": "binary"}}}},
+          "301": {"description": "A directory asked for without a trailing slash."},
+          "401": {"$ref": "#/components/responses/error"},
+          "403": {"$ref": "#/components/responses/error"},
+          "404": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "operationId": "getMetrics",
+        "summary": "The statistics of every job in the Prometheus text format.",
+        "responses": {
+          "200": {"description": "The metrics.", "content": {"text/plain": {"schema": {"type": "string"}}}},
+          "401": {"$ref": "#/components/responses/error"}
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "operationId": "getHealth",
+        "summary": "Whether the scheduler is alive, a line per check.",
+        "security": [],
+        "responses": {
+          "200": {"$ref": "#/components/responses/probe"},
+          "503": {"$ref": "#/components/responses/probe"}
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "operationId": "getReadiness",
+        "summary": "Whether jobd is ready to serve, a line per check.",
+        "security": [],
+        "responses": {
+          "200": {"$ref": "#/components/responses/probe"},
+          "503": {"$ref": "#/components/responses/probe"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "operationId": "getOpenAPI",
+        "summary": "This document.",
+        "security": [],
+        "responses": {
+          "200": {"description": "The OpenAPI description of the HTTP API.", "content": {"application/json": {"schema": {"type": "object"}}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer"},
+      "token": {"type": "apiKey", "in": "query", "name": "access_token"}
+    },
+    "parameters": {
+      "job": {"name": "job", "in": "path", "required": true, "schema": {"type": "string"}},
+      "ifMatch": {"name": "If-Match", "in": "header", "schema": {"type": "string"}, "description": "The version the job must be at, as an entity tag, or * for it to exist."},
+      "ifNoneMatch": {"name": "If-None-Match", "in": "header", "schema": {"type": "string"}, "description": "* for the job not to exist yet."},
+      "jobs": {"name": "job", "in": "query", "schema": {"type": "string"}, "description": "Comma separated jobs whose events are wanted."},
+      "kinds": {"name": "kind", "in": "query", "schema": {"type": "string"}, "description": "Comma separated kinds of events wanted, e.g. run.finished."},
+      "labels": {"name": "labels", "in": "query", "schema": {"type": "string"}, "description": "Comma separated label=value pairs, or severity=value, the event's job must have."}
+    },
+    "responses": {
+      "job": {"description": "The job.", "headers": {"ETag": {"schema": {"type": "string"}, "description": "The job's version."}}, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/JobResource"}}}},
+      "error": {"description": "The reason the request failed.", "content": {"text/plain": {"schema": {"type": "string"}}}},
+      "probe": {"description": "The outcome of each check, <check>: ok or <check>: <error>.", "content": {"text/plain": {"schema": {"type": "string"}}}}
+    },
+    "schemas": {
+      "State": {
+        "type": "object",
+        "required": ["jobs", "failures"],
+        "properties": {
+          "jobs": {"type": "array", "items": {"$ref": "#/components/schemas/Job"}},
+          "failures": {"type": "array", "items": {"$ref": "#/components/schemas/Event"}}
+        }
+      },
+      "Job": {
+        "type": "object",
+        "required": ["name", "state"],
+        "properties": {
+          "name": {"type": "string"},
+          "state": {"type": "string", "enum": ["started", "stopped"]},
+          "next": {"type": "string", "description": "When the job next runs, in its time format, if it's started."},
+          "last": {"type": "string", "description": "The status of its last run kept."},
+          "labels": {"type": "object", "additionalProperties": {"type": "string"}}
+        }
+      },
+      "JobResource": {
+        "type": "object",
+        "required": ["schedule", "cmd"],
+        "properties": {
+          "id": {"type": "string", "format": "uuid", "description": "The job's ID, which stays with it whatever it's called. Given when it's created, or else made up."},
+          "name": {"type": "string", "description": "Must match the path if given."},
+          "schedule": {"type": "string"},
+          "cmd": {"type": "string"},
+          "settings": {"type": "object", "additionalProperties": {"type": "string"}},
+          "state": {"type": "string", "enum": ["started", "stopped"]},
+          "owner": {"type": "string", "readOnly": true},
+          "version": {"type": "string", "readOnly": true, "description": "Changes whenever the job's definition, settings, state or owner do."}
+        }
+      },
+      "Applied": {
+        "type": "object",
+        "required": ["changed", "failed", "jobs"],
+        "properties": {
+          "changed": {"type": "boolean", "description": "Whether any job was, or would be, created or changed."},
+          "failed": {"type": "boolean", "description": "Whether any job failed to apply."},
+          "jobs": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["name", "outcome"],
+              "properties": {
+                "name": {"type": "string"},
+                "outcome": {"type": "string", "enum": ["created", "changed", "unchanged", "failed"]},
+                "version": {"type": "string"},
+                "error": {"type": "string"}
+              }
+            }
+          }
+        }
+      },
+      "Run": {
+        "type": "object",
+        "required": ["job", "id", "status", "slot", "start", "end", "duration"],
+        "properties": {
+          "job": {"type": "string"},
+          "id": {"type": "integer"},
+          "status": {"type": "string", "enum": ["succeeded", "failed", "signaled", "timedout", "interrupted"]},
+          "slot": {"type": "string", "format": "date-time"},
+          "start": {"type": "string", "format": "date-time"},
+          "end": {"type": "string", "format": "date-time"},
+          "duration": {"type": "integer", "format": "int64", "description": "In nanoseconds."},
+          "exit": {"type": "integer", "description": "128 plus the signal for runs killed by one."},
+          "error": {"type": "string"},
+          "note": {"type": "string"},
+          "annotations": {"type": "array", "items": {"type": "string"}, "description": "The notes the run was annotated with, each after the time it was."}
+        }
+      },
+      "Event": {
+        "type": "object",
+        "required": ["time", "kind", "message"],
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "kind": {"type": "string", "description": "e.g. job.started, job.stopped, job.changed, run.finished, run.drifted, alert.opened or alert.resolved."},
+          "job": {"type": "string"},
+          "job_id": {"type": "string"},
+          "run": {"type": "integer"},
+          "status": {"type": "string"},
+          "severity": {"type": "string"},
+          "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+          "message": {"type": "string"},
+          "exit": {"type": "string"},
+          "duration": {"type": "integer", "format": "int64", "description": "In nanoseconds."},
+          "output": {"type": "string"},
+          "path": {"type": "string"},
+          "suppressed": {"type": "boolean"},
+          "author": {"type": "string"},
+          "diff": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+`
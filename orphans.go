@@ -0,0 +1,207 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// orphangroup is the process group a finished run left processes running in,
+// remembered by their pids along with their start times and by their session.
+type orphangroup struct {
+	sid  int
+	pids map[int]uint64
+}
+
+// members returns the processes in the given process group that haven't exited,
+// leaving out those exited but not yet waited for.
+func members(all []proc, pgrp int) []proc {
+	group := []proc{}
+	for _, pr := range all {
+		if pr.pgrp == pgrp && pr.state != "Z" {
+			group = append(group, pr)
+		}
+	}
+	return group
+}
+
+// remaining returns the processes still running in the given process group if
+// it's still the orphans' group, nil otherwise. It is as long as one of the
+// processes seen in it last time is still there: once they all exited the
+// kernel may hand the group's ID to another session. Processes the orphans
+// started since are remembered for next time.
+func (o *orphangroup) remaining(all []proc, pgrp int) []proc {
+	group, ours := members(all, pgrp), false
+	for _, pr := range group {
+		if start, ok := o.pids[pr.pid]; ok && start == pr.start && pr.sid == o.sid {
+			ours = true
+			break
+		}
+	}
+	if !ours {
+		return nil
+	}
+
+	o.pids = make(map[int]uint64)
+	for _, pr := range group {
+		o.pids[pr.pid] = pr.start
+	}
+	return group
+}
+
+// track remembers the process group of a finished run if any of its processes,
+// typically started in the background by the command, are still running.
+func (j *job) track(pgrp int) {
+	all, err := procs()
+	if err != nil {
+		glog.Errorf("Can't list processes [%v]", err)
+		return
+	}
+	group := members(all, pgrp)
+	if len(group) == 0 {
+		return
+	}
+
+	glog.Warningf("%s left %d processes behind in group %d", j.defn.name, len(group), pgrp)
+
+	o := &orphangroup{sid: group[0].sid, pids: make(map[int]uint64)}
+	for _, pr := range group {
+		o.pids[pr.pid] = pr.start
+	}
+
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	j.orphans[pgrp] = o
+}
+
+// reap kills the processes remaining in the process groups of the job's
+// finished runs, leaving alone the groups whose ID now belongs to others.
+func (j *job) reap() {
+	all, err := procs()
+	if err != nil {
+		glog.Errorf("Can't list processes [%v]", err)
+		return
+	}
+
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	for pgrp, o := range j.orphans {
+		if len(o.remaining(all, pgrp)) > 0 {
+			glog.V(3).Infof("Killing %s orphans in group %d", j.defn.name, pgrp)
+			if err := syscall.Kill(-pgrp, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				glog.Errorf("Can't kill %s orphans in group %d [%v]", j.defn.name, pgrp, err)
+				continue
+			}
+		}
+		delete(j.orphans, pgrp)
+	}
+}
+
+// tidy forgets the process groups of the job's finished runs whose orphans
+// have all exited, before their IDs can be reused.
+func (j *job) tidy() {
+	j.rlk.Lock()
+	n := len(j.orphans)
+	j.rlk.Unlock()
+	if n == 0 {
+		return
+	}
+
+	all, err := procs()
+	if err != nil {
+		glog.Errorf("Can't list processes [%v]", err)
+		return
+	}
+
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	for pgrp, o := range j.orphans {
+		if len(o.remaining(all, pgrp)) == 0 {
+			glog.V(3).Infof("%s orphans in group %d exited", j.defn.name, pgrp)
+			delete(j.orphans, pgrp)
+		}
+	}
+}
+
+// session registers the process group of a run in progress, so that it's
+// killed if jobd is told to terminate, and returns the function that
+// unregisters it once the run's command exited.
+func (j *job) session(pgrp int) func() {
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	j.sessions[pgrp] = true
+	return func() {
+		j.rlk.Lock()
+		defer j.rlk.Unlock()
+
+		delete(j.sessions, pgrp)
+	}
+}
+
+// kill kills the process groups of the job's runs in progress.
+func (j *job) kill() {
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	for pgrp := range j.sessions {
+		glog.V(3).Infof("Killing %s run in group %d", j.defn.name, pgrp)
+		if err := syscall.Kill(-pgrp, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			glog.Errorf("Can't kill %s run in group %d [%v]", j.defn.name, pgrp, err)
+		}
+	}
+}
+
+// shutdown interrupts the runs in progress of the given jobs, gives them the
+// longest of the jobs' stop grace to exit and then kills what's left of them
+// along with their orphans. As runs are in sessions of their own, nothing else
+// would stop them once jobd is gone.
+func shutdown(jobs []*job) {
+	grace := time.Duration(0)
+	for _, j := range jobs {
+		j.slk.Lock()
+		j.interrupt()
+		j.slk.Unlock()
+		if g := j.grace(); g > grace {
+			grace = g
+		}
+	}
+
+	for deadline := time.Now().Add(grace); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		running := 0
+		for _, j := range jobs {
+			running += j.running()
+		}
+		if running == 0 {
+			break
+		}
+	}
+
+	for _, j := range jobs {
+		j.kill()
+		j.reap()
+	}
+}
+
+// reapOnExit arranges for the runs in progress and the orphans of every job to
+// be killed when jobd is told to terminate.
+func reapOnExit() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		glog.Infof("Received %v, shutting down", sig)
+		sdnotify("STOPPING=1")
+		shutdown(jobsroot.list())
+		unmountFUSE()
+		glog.Flush()
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// living returns the number of processes in the given process group that
+// haven't exited.
+func living(pgrp int) int {
+	all, err := procs()
+	if err != nil {
+		return 0
+	}
+	return len(members(all, pgrp))
+}
+
+// orphan starts a shell in a session of its own that leaves a sleep running in
+// the background, and returns their process group once the shell exited.
+func orphan(t *testing.T) int {
+	k := exec.Command("/bin/sh", "-c", "sleep 60 &")
+	k.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := k.Run(); err != nil {
+		t.Fatal(err)
+	}
+	pgrp := k.Process.Pid
+	t.Cleanup(func() { syscall.Kill(-pgrp, syscall.SIGKILL) })
+	return pgrp
+}
+
+// TestReapKillsOrphans checks that what a run leaves running in its session is
+// tracked, and killed once the job reaps its orphans.
+func TestReapKillsOrphans(t *testing.T) {
+	pgrp := orphan(t)
+
+	j := &job{defn: jobdef{name: "orphans"}, orphans: make(map[int]*orphangroup)}
+	j.track(pgrp)
+	if j.orphans[pgrp] == nil {
+		t.Fatal("the process left running isn't tracked")
+	}
+
+	j.reap()
+	for deadline := time.Now().Add(5 * time.Second); living(pgrp) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the process left running is still running once reaped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(j.orphans) != 0 {
+		t.Errorf("got %d groups still tracked once reaped", len(j.orphans))
+	}
+}
+
+// TestReapSparesOthers checks that a group whose processes aren't those left
+// running by the job, as when its ID was reused, isn't killed.
+func TestReapSparesOthers(t *testing.T) {
+	pgrp := orphan(t)
+
+	j := &job{defn: jobdef{name: "orphans"}, orphans: make(map[int]*orphangroup)}
+	j.track(pgrp)
+	for pid, start := range j.orphans[pgrp].pids {
+		j.orphans[pgrp].pids[pid] = start + 1
+	}
+
+	j.reap()
+	if living(pgrp) == 0 {
+		t.Error("a group that isn't the orphans' was killed")
+	}
+	if len(j.orphans) != 0 {
+		t.Errorf("got %d groups still tracked once reaped", len(j.orphans))
+	}
+}
+
+// TestTidyForgetsExited checks that a group is forgotten once its orphans
+// exited, and kept while they run.
+func TestTidyForgetsExited(t *testing.T) {
+	pgrp := orphan(t)
+
+	j := &job{defn: jobdef{name: "orphans"}, orphans: make(map[int]*orphangroup)}
+	j.track(pgrp)
+	j.tidy()
+	if j.orphans[pgrp] == nil {
+		t.Fatal("a group was forgotten while its orphans run")
+	}
+
+	syscall.Kill(-pgrp, syscall.SIGKILL)
+	for deadline := time.Now().Add(5 * time.Second); living(pgrp) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the orphans don't exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	j.tidy()
+	if len(j.orphans) != 0 {
+		t.Error("a group is still tracked once its orphans exited")
+	}
+}
+
+// TestShutdownKillsRuns checks that a run in progress that doesn't exit once
+// interrupted is killed when jobd shuts down, its stop grace passed.
+func TestShutdownKillsRuns(t *testing.T) {
+	k := exec.Command("/bin/sh", "-c", `trap "" TERM; sleep 60`)
+	k.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := k.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer k.Wait()
+	pgrp := k.Process.Pid
+
+	j := &job{
+		defn:       jobdef{name: "stubborn", settings: map[string]string{"stopgrace": "100ms"}},
+		orphans:    make(map[int]*orphangroup),
+		sessions:   make(map[int]bool),
+		interrupts: make(map[*run]func()),
+		active:     1,
+	}
+	j.session(pgrp)
+
+	shutdown([]*job{j})
+	for deadline := time.Now().Add(5 * time.Second); living(pgrp) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the run is still running once jobd shut down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+)
+
+// ownersdb is the path to the database of the jobs' owners
+var ownersdb string
+
+// loadOwners reads the owners of the jobs, by job name, from the owners
+// database. Later lines override earlier ones. Owners that are no longer users
+// are left out, leaving their jobs to jobd's user.
+func loadOwners() (map[string]p.User, error) {
+	f, err := os.Open(ownersdb)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	owners := make(map[string]p.User)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("ownersdb corruption: %s", scanner.Text())
+		}
+		user := p.OsUsers.Uname2User(parts[1])
+		if user == nil {
+			glog.Warningf("Owner %s of %s is not a user", parts[1], parts[0])
+			delete(owners, parts[0])
+			continue
+		}
+		owners[parts[0]] = user
+	}
+
+	return owners, scanner.Err()
+}
+
+// saveOwner records the owner of the named job in the owners database.
+func saveOwner(name string, user p.User) error {
+	storelk.Lock()
+	defer storelk.Unlock()
+
+	db, err := os.OpenFile(ownersdb, os.O_WRONLY|os.O_APPEND, 0755)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = fmt.Fprintf(db, "%s:%s\n", name, user.Name())
+	return err
+}
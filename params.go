@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// MAXPARAMS is the largest parameters file a run reads, in bytes
+const MAXPARAMS = 64 * 1024
+
+// validParams checks that a setting's value is the absolute path of a
+// parameters file.
+func validParams(value string) error {
+	if !path.IsAbs(value) {
+		return fmt.Errorf("not an absolute path: %s", value)
+	}
+	return nil
+}
+
+// params reads the job's parameters file, if it has one, a name=value line per
+// parameter. Names are those of environment variables, blank lines and lines
+// starting with # are ignored.
+func (j *job) params() (map[string]string, error) {
+	name := j.setting("params")
+	if name == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil {
+		return nil, err
+	} else if fi.Size() > MAXPARAMS {
+		return nil, invalid("params", "%s is %d bytes, larger than the limit of %d", name, fi.Size(), MAXPARAMS)
+	}
+
+	params := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || !envname.MatchString(kv[0]) {
+			return nil, invalid("params", "%s line %d: expected name=value", name, n)
+		}
+		params[kv[0]] = kv[1]
+	}
+	return params, scanner.Err()
+}
+
+// parameterize adds the parameters to the environment and replaces the
+// {{name}} placeholders for them in the command.
+func parameterize(cmd string, env []string, params map[string]string) (string, []string) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+params[name])
+		cmd = strings.Replace(cmd, "{{"+name+"}}", params[name], -1)
+	}
+	return cmd, env
+}
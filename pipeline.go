@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+const (
+	// PIPELINE is the executor that runs the steps the job's command lists, a
+	// line each, in order
+	PIPELINE = "pipeline"
+
+	// SKIPPED the status of a pipeline's step that didn't run because an
+	// earlier one failed
+	SKIPPED = "skipped"
+)
+
+// step is one of the steps of a pipeline.
+type step struct {
+	cmd      string
+	timeout  time.Duration
+	tolerate bool
+}
+
+// stepresult is the outcome of one of the steps of a pipeline's run, or of the
+// run of a fan out job's command for one of its items.
+type stepresult struct {
+	n      int
+	item   string
+	cmd    string
+	status string
+	start  time.Time
+	end    time.Time
+	err    error
+}
+
+// parseSteps parses the command of a pipeline job, a line per step of the form
+// cmd=<command>, optionally followed by timeout=<duration> and continue=true,
+// to carry on with the next step when it fails. Commands holding spaces are
+// quoted. Blank lines are ignored.
+func parseSteps(cmd string) ([]step, error) {
+	steps := []step{}
+	for n, line := range strings.Split(cmd, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields, err := ctlFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %v", n+1, err)
+		}
+		kvs, err := ctlArgs(fields)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %v", n+1, err)
+		}
+
+		var s step
+		for name, value := range kvs {
+			switch name {
+			case "cmd":
+				s.cmd = value
+			case "timeout":
+				if s.timeout, err = time.ParseDuration(value); err != nil || s.timeout <= 0 {
+					return nil, fmt.Errorf("step %d: %v", n+1, invalid("timeout", "not a positive duration: %s", value))
+				}
+			case "continue":
+				if s.tolerate, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("step %d: %v", n+1, invalid("continue", "not a boolean: %s", value))
+				}
+			default:
+				return nil, fmt.Errorf("step %d: %v", n+1, invalid("step", "expected cmd, timeout or continue=value: %s", name))
+			}
+		}
+		if strings.TrimSpace(s.cmd) == "" {
+			return nil, fmt.Errorf("step %d: %v", n+1, invalid("cmd", "missing"))
+		}
+		steps = append(steps, s)
+	}
+	if len(steps) == 0 {
+		return nil, invalid("cmd", "no steps")
+	}
+	return steps, nil
+}
+
+// pipeline runs the steps of the job's command in order with the shell and
+// environment of the run, their output going to stdout and stderr, each
+// preceded by a line naming it. A step that fails, or runs longer than its
+// timeout, ends the pipeline unless it may continue, the steps after it being
+// skipped. Each step's outcome is kept with the run and exposed in its steps
+// directory. It stops once ctx is done.
+func (j *job) pipeline(ctx context.Context, r *run, rc runctx, stdout, stderr io.Writer) error {
+	steps, err := parseSteps(rc.Cmd)
+	if err != nil {
+		return err
+	}
+	r.mkResultsDir(j, "steps")
+
+	var failed error
+	for i, s := range steps {
+		res := &stepresult{n: i + 1, cmd: s.cmd, status: SKIPPED}
+		r.addResult(j, "steps", res)
+		if failed != nil || ctx.Err() != nil {
+			continue
+		}
+
+		fmt.Fprintf(stdout, "== step %d: %s\n", res.n, s.cmd)
+		err := j.step(ctx, r, res, s, rc.Shell, rc.Env, stdout, stderr)
+		if err != nil && !s.tolerate {
+			failed = fmt.Errorf("step %d %s: %v", res.n, res.status, err)
+		}
+	}
+	if failed == nil && ctx.Err() != nil {
+		failed = ctx.Err()
+	}
+	return failed
+}
+
+// step runs one of the steps of a pipeline, or a fan out job's command for one
+// of its items, with the given shell and environment, killing its process group
+// if it runs longer than its timeout or ctx is done first, and records its
+// outcome.
+func (j *job) step(ctx context.Context, r *run, res *stepresult, s step, shell string, env []string, stdout, stderr io.Writer) error {
+	c, cancel := ctx, context.CancelFunc(func() {})
+	if s.timeout > 0 {
+		c, cancel = context.WithTimeout(ctx, s.timeout)
+	}
+	defer cancel()
+
+	k := exec.Command(shell, "-c", s.cmd)
+	k.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	k.Env = env
+	k.Stdout, k.Stderr = stdout, stderr
+
+	r.Lock()
+	res.start, res.status = time.Now(), RUNNING
+	r.Unlock()
+
+	err := k.Start()
+	if err == nil {
+		pgrp := k.Process.Pid
+		j.prioritize(pgrp)
+		done := make(chan bool)
+		go func() {
+			select {
+			case <-c.Done():
+				glog.Errorf("%s step %d timed out", j.defn.name, res.n)
+				if err := syscall.Kill(-pgrp, syscall.SIGKILL); err != nil {
+					glog.Errorf("Can't kill %s step %d [%v]", j.defn.name, res.n, err)
+				}
+			case <-done:
+			}
+		}()
+		err = k.Wait()
+		close(done)
+		j.track(pgrp)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	res.end, res.err = time.Now(), err
+	switch {
+	case err == nil:
+		res.status = SUCCEEDED
+	case c.Err() == context.DeadlineExceeded:
+		res.status = TIMEDOUT
+	default:
+		res.status = FAILED
+	}
+	return err
+}
+
+// previewSteps writes the steps of the job's command, a line each, to stdout
+// without running them.
+func previewSteps(cmd string, stdout io.Writer) error {
+	steps, err := parseSteps(cmd)
+	if err != nil {
+		return err
+	}
+	for i, s := range steps {
+		fmt.Fprintf(stdout, "would run step %d: %s", i+1, s.cmd)
+		if s.timeout > 0 {
+			fmt.Fprintf(stdout, " timeout=%v", s.timeout)
+		}
+		if s.tolerate {
+			fmt.Fprint(stdout, " continue=true")
+		}
+		fmt.Fprintln(stdout)
+	}
+	return nil
+}
+
+// mkResultsDir creates the named directory of the run that holds a file per
+// step of its pipeline, or per item of its fan out.
+func (r *run) mkResultsDir(j *job, name string) {
+	if r.dir == nil {
+		return
+	}
+	dir := new(srv.File)
+	if err := dir.Add(r.dir, name, j.user, nil, p.DMDIR|0555, nil); err != nil {
+		glog.Errorf("Can't create %s run %d %s directory [%v]", j.defn.name, r.id, name, err)
+	}
+}
+
+// addResult keeps the outcome of a step or item with the run and adds a file
+// describing it to the run's named results directory.
+func (r *run) addResult(j *job, name string, res *stepresult) {
+	r.Lock()
+	r.steps = append(r.steps, res)
+	r.Unlock()
+
+	if r.dir == nil {
+		return
+	}
+	dir := r.dir.Find(name)
+	if dir == nil {
+		return
+	}
+	f := &jobfile{
+		// step reader returns the step's outcome.
+		reader: func() []byte {
+			r.Lock()
+			defer r.Unlock()
+			return []byte(res.describe(j))
+		},
+		// step is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := f.Add(dir, strconv.Itoa(res.n), j.user, nil, 0444, f); err != nil {
+		glog.Errorf("Can't create %s run %d %s/%d file [%v]", j.defn.name, r.id, name, res.n, err)
+	}
+}
+
+// describe returns a textual description of the step's, or item's, outcome.
+// The caller holds the run's lock.
+func (res *stepresult) describe(j *job) string {
+	desc := fmt.Sprintf("step: %d\ncmd: %s\nstatus: %s\n", res.n, res.cmd, res.status)
+	if res.item != "" {
+		desc = fmt.Sprintf("item: %s\nstatus: %s\n", res.item, res.status)
+	}
+	if !res.start.IsZero() {
+		desc += fmt.Sprintf("start: %s\n", j.stamp(res.start))
+	}
+	if !res.end.IsZero() {
+		desc += fmt.Sprintf("end: %s\nduration: %v\n", j.stamp(res.end), res.end.Sub(res.start))
+	}
+	if code, ok := exitCode(res.err); ok && res.err != nil {
+		desc += fmt.Sprintf("exit: %d\n", code)
+	} else if res.err != nil {
+		desc += fmt.Sprintf("error: %v\n", res.err)
+	}
+	return desc
+}
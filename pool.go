@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// workers is the most scheduled runs jobd executes at once, unlimited if zero
+var workers = 0
+
+// shedafter is how long the workers may be saturated before low priority runs
+// are shed rather than queued
+var shedafter = time.Minute
+
+// queuesize is the most runs that may wait for a worker, unlimited if zero
+var queuesize = 0
+
+// queuefull is what happens to a run due when the queue is full
+var queuefull = DROPNEW
+
+// shares weighs each job owner's claim on the workers, one for those not given
+// a share with -shares
+var shares = map[string]int{}
+
+const (
+	// DROPOLDEST drops the run that has waited longest to make room
+	DROPOLDEST = "drop-oldest"
+
+	// DROPNEW drops the run that's due
+	DROPNEW = "drop-new"
+
+	// BLOCK holds up the job's scheduler until there's room
+	BLOCK = "block"
+)
+
+const (
+	// SHED is why runs are shed when the workers have been saturated too long
+	SHED = "shed"
+
+	// OVERFLOW is why runs are dropped when the queue is full
+	OVERFLOW = "overflow"
+)
+
+// QUEUEOVERFLOW the kind of event emitted when a run is dropped from a full
+// queue
+const QUEUEOVERFLOW = "queue.overflow"
+
+// waiter is a scheduled run queued for a worker. It's told through ready
+// whether it may run, given the empty string, or why it was dropped.
+type waiter struct {
+	j      *job
+	tenant string
+	rank   int
+	since  time.Time
+	ready  chan string
+}
+
+// pool tracks the busy workers, by the owner of the job using them, and the
+// runs queued for one, highest priority first
+var pool = struct {
+	sync.Mutex
+	busy      int
+	running   map[string]int
+	queue     []*waiter
+	saturated time.Time
+	shed      int
+	overflows int
+	room      *sync.Cond
+}{running: make(map[string]int)}
+
+func init() {
+	pool.room = sync.NewCond(&pool)
+}
+
+// validQueuefull checks that a policy is one of those for a full queue.
+func validQueuefull(policy string) error {
+	switch policy {
+	case DROPOLDEST, DROPNEW, BLOCK:
+		return nil
+	}
+	return fmt.Errorf("not one of %s, %s or %s: %s", DROPOLDEST, DROPNEW, BLOCK, policy)
+}
+
+// sharesFlag collects the -shares flags given to jobd.
+type sharesFlag struct{}
+
+// String renders the shares as a comma separated list of user=weight.
+func (sharesFlag) String() string {
+	var weights []string
+	for user, n := range shares {
+		weights = append(weights, fmt.Sprintf("%s=%d", user, n))
+	}
+	sort.Strings(weights)
+	return strings.Join(weights, ",")
+}
+
+// Set validates a user's share given as user=weight.
+func (sharesFlag) Set(kv string) error {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 {
+		return invalid("shares", "expected user=weight: %s", kv)
+	}
+
+	user := strings.TrimSpace(parts[0])
+	n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || n < 1 {
+		return invalid(user, "not a weight: %s", parts[1])
+	}
+
+	shares[user] = n
+	return nil
+}
+
+// share returns the weight of a job owner's claim on the workers.
+func share(tenant string) int {
+	if n, ok := shares[tenant]; ok {
+		return n
+	}
+	return 1
+}
+
+// ranks names the priority of each rank
+var ranks = []string{"high", "normal", "low"}
+
+// rank orders the job's runs in the queue by its priority, lowest first.
+func (j *job) rank() int {
+	switch j.setting("priority") {
+	case "high":
+		return 0
+	case "low":
+		return 2
+	}
+	return 1
+}
+
+// acquire waits for a worker to run one of the job's scheduled runs. Free
+// workers go to the owner using the fewest for its share, among the runs of
+// each owner those of higher or equal priority already waiting go first. Once
+// the workers have been
+// saturated for longer than shedafter low priority runs are shed instead and
+// when the queue is full runs are dropped according to queuefull. It returns
+// false if the run was shed or dropped.
+func (j *job) acquire() bool {
+	now := time.Now()
+	tenant := j.user.Name()
+
+	pool.Lock()
+	if workers == 0 || (pool.busy < workers && len(pool.queue) == 0) {
+		pool.busy++
+		pool.running[tenant]++
+		pool.Unlock()
+		return true
+	}
+
+	w := &waiter{j: j, tenant: tenant, rank: j.rank(), since: now, ready: make(chan string, 1)}
+	if w.rank == 2 && shedding(now) {
+		pool.shed++
+		pool.Unlock()
+		j.turnedAway(SHED, now)
+		return false
+	}
+
+	for queuesize > 0 && len(pool.queue) >= queuesize {
+		switch queuefull {
+		case BLOCK:
+			pool.room.Wait()
+			continue
+		case DROPOLDEST:
+			oldest := 0
+			for i, q := range pool.queue {
+				if q.since.Before(pool.queue[oldest].since) {
+					oldest = i
+				}
+			}
+			pool.queue[oldest].ready <- OVERFLOW
+			pool.queue = append(pool.queue[:oldest], pool.queue[oldest+1:]...)
+			pool.overflows++
+			continue
+		}
+		pool.overflows++
+		pool.Unlock()
+		j.turnedAway(OVERFLOW, now)
+		return false
+	}
+	if workers == 0 || (pool.busy < workers && len(pool.queue) == 0) {
+		pool.busy++
+		pool.running[tenant]++
+		pool.Unlock()
+		return true
+	}
+
+	i := len(pool.queue)
+	for i > 0 && pool.queue[i-1].rank > w.rank {
+		i--
+	}
+	pool.queue = append(pool.queue, nil)
+	copy(pool.queue[i+1:], pool.queue[i:])
+	pool.queue[i] = w
+	if pool.saturated.IsZero() {
+		pool.saturated = now
+	}
+	pool.Unlock()
+
+	if why := <-w.ready; why != "" {
+		j.turnedAway(why, now)
+		return false
+	}
+	return true
+}
+
+// relinquish frees the worker of one of the job's finished runs, handing it to
+// a run queued, if any.
+func (j *job) relinquish() {
+	pool.Lock()
+	defer pool.Unlock()
+
+	tenant := j.user.Name()
+	pool.busy--
+	if pool.running[tenant]--; pool.running[tenant] <= 0 {
+		delete(pool.running, tenant)
+	}
+	assign()
+}
+
+// assign hands free workers to the runs queued for them, fairly among the
+// owners of their jobs. The caller holds the pool lock.
+func assign() {
+	for len(pool.queue) > 0 && (workers == 0 || pool.busy < workers) {
+		i := fairest()
+		w := pool.queue[i]
+		pool.queue = append(pool.queue[:i], pool.queue[i+1:]...)
+		pool.busy++
+		pool.running[w.tenant]++
+		w.ready <- ""
+	}
+	if len(pool.queue) == 0 {
+		pool.saturated = time.Time{}
+	}
+	pool.room.Broadcast()
+}
+
+// fairest returns the index of the first run queued whose job's owner uses the
+// fewest workers for its share. The caller holds the pool lock.
+func fairest() int {
+	best := 0
+	for i, w := range pool.queue {
+		b := pool.queue[best]
+		// running/share < best's running/share, without dividing
+		if pool.running[w.tenant]*share(b.tenant) < pool.running[b.tenant]*share(w.tenant) {
+			best = i
+		}
+	}
+	return best
+}
+
+// shedding reports whether the workers have been saturated for longer than
+// shedafter. The caller holds the pool lock.
+func shedding(now time.Time) bool {
+	return !pool.saturated.IsZero() && now.Sub(pool.saturated) > shedafter
+}
+
+// shedQueued sheds the low priority runs waiting in the queue once the workers
+// have been saturated for longer than shedafter.
+func shedQueued(now time.Time) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	if !shedding(now) {
+		return
+	}
+	kept := pool.queue[:0]
+	for _, w := range pool.queue {
+		if w.rank == 2 {
+			pool.shed++
+			w.ready <- SHED
+			continue
+		}
+		kept = append(kept, w)
+	}
+	pool.queue = kept
+	if len(pool.queue) == 0 {
+		pool.saturated = time.Time{}
+	}
+	pool.room.Broadcast()
+}
+
+// turnedAway records that one of the job's scheduled runs, due at since, was
+// shed or dropped from a full queue.
+func (j *job) turnedAway(why string, since time.Time) {
+	if why == SHED {
+		glog.Warningf("Shedding a run of %s, the workers are saturated", j.defn.name)
+		j.stats.shedding()
+		j.record(fmt.Sprintf("shed, the workers have been saturated since %s\n", j.stamp(since)))
+		return
+	}
+
+	glog.Warningf("Dropping a run of %s, the queue is full", j.defn.name)
+	j.stats.overflow()
+	j.record(fmt.Sprintf("dropped, the queue of %d runs was full, due %s\n", queuesize, j.stamp(since)))
+	emit(j.event(QUEUEOVERFLOW, "run due %s dropped, the queue of %d runs is full", j.stamp(since), queuesize))
+}
+
+// mkSchedulerFile creates the read only file at the root of the jobd name space
+// that describes the workers, the runs waiting for them and the mutual exclusion
+// groups and resources held.
+func mkSchedulerFile(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkSchedulerFile(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkSchedulerFile(%v, %v)", dir, user)
+
+	sf := &jobfile{
+		// scheduler reader describes the workers, the queue and the resources held.
+		reader: func() []byte {
+			return append(schedulerState(), heldResources()...)
+		},
+		// scheduler is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := sf.Add(dir, "scheduler", user, nil, 0444, sf); err != nil {
+		glog.Errorln("Can't create scheduler file: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// schedulerState renders the workers in use, the runs shed and the queue, a
+// line per waiting run.
+func schedulerState() []byte {
+	pool.Lock()
+	defer pool.Unlock()
+
+	var out bytes.Buffer
+	limit := "unlimited"
+	if workers > 0 {
+		limit = fmt.Sprint(workers)
+	}
+	fmt.Fprintf(&out, "workers: %d busy of %s\n", pool.busy, limit)
+	size := "unlimited"
+	if queuesize > 0 {
+		size = fmt.Sprintf("%d, %s when full", queuesize, queuefull)
+	}
+	fmt.Fprintf(&out, "queued: %d of %s\n", len(pool.queue), size)
+	fmt.Fprintf(&out, "shed: %d\n", pool.shed)
+	fmt.Fprintf(&out, "overflows: %d\n", pool.overflows)
+	if !pool.saturated.IsZero() {
+		fmt.Fprintf(&out, "saturated: since %s\n", formatTime(pool.saturated, timefmt))
+	}
+	var tenants []string
+	for tenant := range pool.running {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		fmt.Fprintf(&out, "owner: %s %d busy share=%d\n", tenant, pool.running[tenant], share(tenant))
+	}
+	for _, w := range pool.queue {
+		fmt.Fprintf(&out, "waiting: %s owner=%s priority=%s since %s\n", w.j.defn.name, w.tenant, ranks[w.rank], formatTime(w.since, timefmt))
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// proc describes a process as found in /proc.
+type proc struct {
+	pid   int
+	ppid  int
+	pgrp  int
+	sid   int
+	start uint64
+	state string
+	cmd   string
+}
+
+// procs returns every process found in /proc.
+func procs() ([]proc, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	result := []proc{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+
+		stat, err := ioutil.ReadFile(path.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+
+		// The command name in parentheses may itself contain spaces and
+		// parentheses so the remaining fields follow the last ')'.
+		s := string(stat)
+		i := strings.LastIndex(s, ")")
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(s[i+1:])
+		if len(fields) < 20 {
+			continue
+		}
+
+		pr := proc{pid: pid, state: fields[0]}
+		pr.ppid, _ = strconv.Atoi(fields[1])
+		pr.pgrp, _ = strconv.Atoi(fields[2])
+		pr.sid, _ = strconv.Atoi(fields[3])
+		pr.start, _ = strconv.ParseUint(fields[19], 10, 64)
+
+		cmdline, _ := ioutil.ReadFile(path.Join("/proc", e.Name(), "cmdline"))
+		pr.cmd = strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1)))
+		if pr.cmd == "" {
+			pr.cmd = "[" + s[strings.Index(s, "(")+1:i] + "]"
+		}
+
+		result = append(result, pr)
+	}
+
+	return result, nil
+}
+
+// captureProcTree returns a snapshot of the processes in the given process
+// group: their pid, parent, state and command line followed by their kernel
+// stack and wait channel when /proc makes them available.
+func captureProcTree(pgrp int) ([]byte, error) {
+	all, err := procs()
+	if err != nil {
+		return nil, err
+	}
+
+	group := []proc{}
+	for _, pr := range all {
+		if pr.pgrp == pgrp {
+			group = append(group, pr)
+		}
+	}
+	sort.Slice(group, func(i, j int) bool { return group[i].pid < group[j].pid })
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "process group %d: %d processes\n", pgrp, len(group))
+	for _, pr := range group {
+		fmt.Fprintf(&out, "%d %d %s %s\n", pr.pid, pr.ppid, pr.state, pr.cmd)
+
+		dir := path.Join("/proc", strconv.Itoa(pr.pid))
+		if wchan, err := ioutil.ReadFile(path.Join(dir, "wchan")); err == nil && len(wchan) > 0 {
+			fmt.Fprintf(&out, "\twchan: %s\n", wchan)
+		}
+		if stack, err := ioutil.ReadFile(path.Join(dir, "stack")); err == nil {
+			for _, line := range strings.Split(strings.TrimSpace(string(stack)), "\n") {
+				fmt.Fprintf(&out, "\t%s\n", line)
+			}
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// corePath returns where the core dump of the given process ended up, or the
+// empty string if it can't be found. Patterns piped to a handler, such as
+// systemd-coredump, are reported as the handler's command line.
+func corePath(pid int, name string) string {
+	pattern, err := ioutil.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil {
+		return ""
+	}
+
+	pat := strings.TrimSpace(string(pattern))
+	if strings.HasPrefix(pat, "|") {
+		return pat
+	}
+
+	r := strings.NewReplacer("%%", "%", "%p", strconv.Itoa(pid), "%e", name)
+	candidates := []string{r.Replace(pat)}
+	if pat == "core" {
+		candidates = append(candidates, fmt.Sprintf("core.%d", pid))
+	}
+
+	for _, c := range candidates {
+		if strings.Contains(c, "%") {
+			continue
+		}
+		if fi, err := os.Stat(c); err == nil && !fi.IsDir() {
+			if abs, err := filepath.Abs(c); err == nil {
+				return abs
+			}
+			return c
+		}
+	}
+
+	return ""
+}
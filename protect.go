@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// PROTECT keeps a job from being deleted or having its schedule or command
+	// changed
+	PROTECT = "protect"
+
+	// UNPROTECT lets a protected job be deleted and changed again
+	UNPROTECT = "unprotect"
+)
+
+// protectdb is the path to the database of the jobs' protection
+var protectdb string
+
+// loadProtection reads whether each job is protected from the protection
+// database. Later lines override earlier ones.
+func (jd *jobsdir) loadProtection() error {
+	db, err := os.Open(protectdb)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	scanner := bufio.NewScanner(db)
+	for scanner.Scan() {
+		data := scanner.Text()
+		parts := strings.SplitN(data, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("protectdb corruption: %s", data)
+		}
+		on, err := strconv.ParseBool(parts[1])
+		if err != nil {
+			return fmt.Errorf("protectdb corruption: %s", data)
+		}
+
+		j, ok := jd.lookup(parts[0])
+		if !ok {
+			glog.Warningf("Ignoring protection of unknown job: %s", data)
+			continue
+		}
+		j.slk.Lock()
+		j.protected = on
+		j.slk.Unlock()
+	}
+
+	return scanner.Err()
+}
+
+// protect protects or unprotects the job and records it in the protection
+// database.
+func (j *job) protect(on bool) error {
+	j.slk.Lock()
+	j.protected = on
+	j.slk.Unlock()
+
+	storelk.Lock()
+	defer storelk.Unlock()
+
+	db, err := os.OpenFile(protectdb, os.O_WRONLY|os.O_APPEND, 0755)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = fmt.Fprintf(db, "%s:%v\n", j.defn.name, on)
+	return err
+}
+
+// isProtected reports whether the job may be neither deleted nor have its
+// schedule or command changed.
+func (j *job) isProtected() bool {
+	j.slk.Lock()
+	defer j.slk.Unlock()
+
+	return j.protected
+}
+
+// protectedJobs returns the names of the protected jobs, ordered by name.
+func protectedJobs() []string {
+	names := []string{}
+	for _, j := range jobsroot.list() {
+		if j.isProtected() {
+			names = append(names, j.defn.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// PRUNE is the executor that deletes the files older than a number of days
+// whose names match a pattern under a directory, as given by the job's command
+const PRUNE = "prune"
+
+// system are the directories the built in executors may neither start from nor
+// write to
+var system = []string{"/bin", "/boot", "/dev", "/etc", "/lib", "/lib64", "/proc", "/sbin", "/sys", "/usr"}
+
+// pruning is what a prune deletes, as given by a job's command.
+type pruning struct {
+	root   string
+	match  string
+	age    time.Duration
+	dryrun bool
+}
+
+// validJobExecutor checks that a setting's value is an executor a job may use.
+func validJobExecutor(value string) error {
+	switch value {
+	case SHELL, PRUNE, SQL, SYNC, PIPELINE, FANOUT:
+		return nil
+	}
+	return fmt.Errorf("not one of %s, %s, %s, %s, %s or %s: %s", SHELL, PRUNE, SQL, SYNC, PIPELINE, FANOUT, value)
+}
+
+// checkPath checks that the value of a path argument of a built in executor's
+// command is a clean absolute path outside the system's directories.
+func checkPath(field, value string) error {
+	if !filepath.IsAbs(value) || filepath.Clean(value) != value {
+		return invalid(field, "not a clean absolute path: %s", value)
+	}
+	if value == "/" {
+		return invalid(field, "the root directory isn't allowed")
+	}
+	for _, dir := range system {
+		if value == dir || strings.HasPrefix(value, dir+"/") {
+			return invalid(field, "%s is a system directory", value)
+		}
+	}
+	return nil
+}
+
+// jobExecutor returns the executor that runs the job's commands.
+func (j *job) jobExecutor() string {
+	if e := j.setting("executor"); e != "" {
+		return e
+	}
+	return SHELL
+}
+
+// parsePruning parses the command of a prune job, path=<directory>,
+// match=<pattern> and days=<n>, optionally followed by dryrun=true. The
+// directory must be absolute, clean and outside the system's directories, and
+// the pattern is matched against the names of files.
+func parsePruning(cmd string) (pruning, error) {
+	fields, err := ctlFields(cmd)
+	if err != nil {
+		return pruning{}, err
+	}
+	kvs, err := ctlArgs(fields)
+	if err != nil {
+		return pruning{}, err
+	}
+
+	var pr pruning
+	for name, value := range kvs {
+		switch name {
+		case "path":
+			if err := checkPath("path", value); err != nil {
+				return pruning{}, err
+			}
+			pr.root = value
+		case "match":
+			if _, err := filepath.Match(value, ""); err != nil || value == "" || strings.Contains(value, "/") {
+				return pruning{}, invalid("match", "not a file name pattern: %s", value)
+			}
+			pr.match = value
+		case "days":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return pruning{}, invalid("days", "not a positive integer: %s", value)
+			}
+			pr.age = time.Duration(n) * 24 * time.Hour
+		case "dryrun":
+			if pr.dryrun, err = strconv.ParseBool(value); err != nil {
+				return pruning{}, invalid("dryrun", "not a boolean: %s", value)
+			}
+		default:
+			return pruning{}, invalid("command", "expected path, match, days or dryrun=value: %s", name)
+		}
+	}
+	switch {
+	case pr.root == "":
+		return pruning{}, invalid("path", "missing")
+	case pr.match == "":
+		return pruning{}, invalid("match", "missing")
+	case pr.age == 0:
+		return pruning{}, invalid("days", "missing")
+	}
+	return pr, nil
+}
+
+// prune deletes the regular files the job's command describes, writing a line
+// for each to stdout followed by a total. Symbolic links are neither followed
+// nor deleted. A dry run, or a prune whose command asks for one, only lists
+// what it would delete. It stops once ctx is done.
+func (j *job) prune(ctx context.Context, cmd string, stdout io.Writer, dryrun bool) error {
+	pr, err := parsePruning(cmd)
+	if err != nil {
+		return err
+	}
+	dryrun = dryrun || pr.dryrun
+	verb := "removed"
+	if dryrun {
+		verb = "would remove"
+	}
+
+	cutoff := time.Now().Add(-pr.age)
+	files, size := 0, int64(0)
+	err = filepath.Walk(pr.root, func(name string, fi os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "skipped %s: %v\n", name, err)
+			return nil
+		}
+		if !fi.Mode().IsRegular() || !fi.ModTime().Before(cutoff) {
+			return nil
+		}
+		if ok, _ := filepath.Match(pr.match, fi.Name()); !ok {
+			return nil
+		}
+		if !dryrun {
+			if err := os.Remove(name); err != nil {
+				fmt.Fprintf(stdout, "skipped %s: %v\n", name, err)
+				return nil
+			}
+		}
+		fmt.Fprintf(stdout, "%s %s\n", verb, name)
+		files++
+		size += fi.Size()
+		return nil
+	})
+	fmt.Fprintf(stdout, "%s %d files, %d bytes\n", verb, files, size)
+	return err
+}
+
+// native runs one of the built in executors, which stops once the job's
+// timeout, if it has one, expires and the run is then marked as timed out, or
+// when the job is stopped.
+func (j *job) native(r *run, execute func(context.Context) error) error {
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer j.interruptible(r, cancel)()
+	if timeout := j.duration("timeout"); timeout > 0 {
+		var expire context.CancelFunc
+		c, expire = context.WithTimeout(c, timeout)
+		defer expire()
+	}
+
+	err := execute(c)
+	if c.Err() == context.DeadlineExceeded {
+		glog.Errorf("%s timed out after %v", j.defn.name, j.duration("timeout"))
+		r.expire()
+	}
+	return err
+}
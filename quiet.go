@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DIGEST the kind of event sent when quiet hours end, summarizing the
+// notifications they held back
+const DIGEST = "notify.digest"
+
+// window is a daily period of quiet hours, from and to being minutes since
+// midnight. It wraps around midnight when to is before from.
+type window struct {
+	from, to int
+}
+
+// held are the notifications held back by quiet hours, by route id
+var held = struct {
+	sync.Mutex
+	events map[int][]event
+	routes map[int]route
+}{events: make(map[int][]event), routes: make(map[int]route)}
+
+// parseWindow parses quiet hours of the form HH:MM-HH:MM.
+func parseWindow(value string) (window, error) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return window{}, fmt.Errorf("expected HH:MM-HH:MM: %s", value)
+	}
+
+	var w window
+	for i, part := range parts {
+		t, err := time.Parse("15:04", part)
+		if err != nil {
+			return window{}, fmt.Errorf("expected HH:MM: %s", part)
+		}
+		if i == 0 {
+			w.from = t.Hour()*60 + t.Minute()
+		} else {
+			w.to = t.Hour()*60 + t.Minute()
+		}
+	}
+	if w.from == w.to {
+		return window{}, fmt.Errorf("empty: %s", value)
+	}
+
+	return w, nil
+}
+
+// validQuiet checks that a setting's value is quiet hours.
+func validQuiet(value string) error {
+	_, err := parseWindow(value)
+	return err
+}
+
+// until returns the end of the quiet hours t falls within, or the zero time if
+// it falls outside them.
+func (w window) until(t time.Time) time.Time {
+	if w == (window{}) {
+		return time.Time{}
+	}
+
+	m := t.Hour()*60 + t.Minute()
+	if w.from < w.to && (m < w.from || m >= w.to) || w.from > w.to && m < w.from && m >= w.to {
+		return time.Time{}
+	}
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	end := midnight.Add(time.Duration(w.to) * time.Minute)
+	if !end.After(t) {
+		end = midnight.AddDate(0, 0, 1).Add(time.Duration(w.to) * time.Minute)
+	}
+	return end
+}
+
+// quiet returns the end of the job's quiet hours if t falls within them,
+// evaluated in the job's time zone, or the zero time otherwise.
+func (j *job) quiet(t time.Time) time.Time {
+	value := j.setting("quiet")
+	if value == "" {
+		return time.Time{}
+	}
+	w, err := parseWindow(value)
+	if err != nil {
+		return time.Time{}
+	}
+	if tz := j.setting("tz"); tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			t = t.In(loc)
+		}
+	}
+	return w.until(t)
+}
+
+// hold keeps back an event a route would have sent during quiet hours.
+func hold(rt route, ev event) {
+	glog.V(3).Infof("Holding %s event for %s via %s during quiet hours", ev.Kind, ev.Job, rt.channel)
+
+	held.Lock()
+	defer held.Unlock()
+
+	held.events[rt.id] = append(held.events[rt.id], ev)
+	held.routes[rt.id] = rt
+}
+
+// release sends the events held back by routes whose quiet hours have ended.
+// Alerting channels get each event, as they deduplicate them, the others get a
+// single digest.
+func release(now time.Time) {
+	held.Lock()
+	ready := make(map[int][]event)
+	for i, evs := range held.events {
+		keep := evs[:0]
+		for _, ev := range evs {
+			if ev.quiet.After(now) {
+				keep = append(keep, ev)
+			} else {
+				ready[i] = append(ready[i], ev)
+			}
+		}
+		held.events[i] = keep
+	}
+	rts := make(map[int]route)
+	for i := range ready {
+		rts[i] = held.routes[i]
+		if len(held.events[i]) == 0 {
+			delete(held.events, i)
+			delete(held.routes, i)
+		}
+	}
+	held.Unlock()
+
+	for i, evs := range ready {
+		rt := rts[i]
+		if rt.channel == PAGERDUTY || rt.channel == OPSGENIE {
+			for _, ev := range evs {
+				rt.send(ev)
+			}
+			continue
+		}
+		rt.send(digest(evs))
+	}
+}
+
+// digest returns the event summarizing the given held back events.
+func digest(evs []event) event {
+	lines := make([]string, 0, len(evs))
+	for _, ev := range evs {
+		lines = append(lines, fmt.Sprintf("%s %s %s %s", formatTime(ev.Time, timefmt), ev.Kind, ev.Job, ev.Message))
+	}
+	return event{
+		Time:    time.Now(),
+		Kind:    DIGEST,
+		Message: fmt.Sprintf("%d notifications held during quiet hours", len(evs)),
+		Output:  strings.Join(lines, "\n"),
+	}
+}
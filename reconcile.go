@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// definitions is the file, or directory of .json files, holding the jobs jobd
+// is reconciled with on reload, none if empty
+var definitions string
+
+const (
+	// CREATE the change that creates a job
+	CREATE = '+'
+
+	// UPDATE the change that updates a job's schedule, command or settings
+	UPDATE = '~'
+
+	// DELETE the change that deletes a job
+	DELETE = '-'
+)
+
+// change is one of the changes that reconciles jobd with its definitions. It's
+// blocked if it would delete a protected job or change its schedule or command.
+type change struct {
+	op      byte
+	def     *jobdef
+	what    []string
+	blocked bool
+}
+
+// loadDefinitions reads the jobs in the definitions file or, if it's a
+// directory, in each of its .json files, in the format of the export file. It
+// checks them all as the clone file would. Along with the jobs it returns the
+// file each came from.
+func loadDefinitions() ([]*jobdef, map[string]string, error) {
+	names := []string{definitions}
+	if fi, err := os.Stat(definitions); err != nil {
+		return nil, nil, err
+	} else if fi.IsDir() {
+		if names, err = filepath.Glob(path.Join(definitions, "*.json")); err != nil {
+			return nil, nil, err
+		}
+		sort.Strings(names)
+	}
+
+	defs := []*jobdef{}
+	seen := make(map[string]string)
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		var specs []jobspec
+		if err := json.Unmarshal(data, &specs); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		for _, spec := range specs {
+			jd, _, err := validateDef(spec.Name, spec.Schedule, spec.Cmd)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %s: %v", name, spec.Name, err)
+			}
+			if first, ok := seen[jd.name]; ok {
+				return nil, nil, fmt.Errorf("%s: %s: already defined in %s", name, jd.name, first)
+			}
+			for setting, value := range spec.Settings {
+				if _, _, err := parseSetting(setting + "=" + value); err != nil {
+					return nil, nil, fmt.Errorf("%s: %s: %v", name, jd.name, err)
+				}
+				jd.settings[setting] = value
+			}
+			seen[jd.name] = name
+			defs = append(defs, jd)
+		}
+	}
+
+	return defs, seen, nil
+}
+
+// plan returns the changes that make the jobs jobd holds match defs, ordered
+// by job name.
+func plan(defs []*jobdef) []change {
+	settingslk.RLock()
+	defer settingslk.RUnlock()
+
+	changes := []change{}
+	wanted := make(map[string]bool)
+	for _, jd := range defs {
+		wanted[jd.name] = true
+		j, ok := jobsroot.lookup(jd.name)
+		if !ok {
+			changes = append(changes, change{op: CREATE, def: jd})
+			continue
+		}
+		what := []string{}
+		if j.defn.schedule != jd.schedule {
+			what = append(what, fmt.Sprintf("schedule %q -> %q", j.defn.schedule, jd.schedule))
+		}
+		if j.defn.cmd != jd.cmd {
+			what = append(what, fmt.Sprintf("cmd %q -> %q", j.defn.cmd, jd.cmd))
+		}
+		for _, name := range settingNames(j.defn.settings, jd.settings) {
+			if was, is := j.defn.settings[name], jd.settings[name]; was != is {
+				what = append(what, fmt.Sprintf("%s %q -> %q", name, was, is))
+			}
+		}
+		if len(what) > 0 {
+			redefined := j.defn.schedule != jd.schedule || j.defn.cmd != jd.cmd
+			changes = append(changes, change{op: UPDATE, def: jd, what: what, blocked: redefined && j.isProtected()})
+		}
+	}
+	for _, j := range jobsroot.list() {
+		if !wanted[j.defn.name] {
+			changes = append(changes, change{op: DELETE, def: &j.defn, blocked: j.isProtected()})
+		}
+	}
+
+	sort.Slice(changes, func(a, b int) bool { return changes[a].def.name < changes[b].def.name })
+	return changes
+}
+
+// settingNames returns the names of the settings in either group, sorted.
+func settingNames(a, b map[string]string) []string {
+	names := []string{}
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// describe renders the change as a line, followed by a line for each thing an
+// update changes.
+func (c change) describe() string {
+	out := fmt.Sprintf("%c %s\n", c.op, c.def.name)
+	if c.blocked {
+		out = fmt.Sprintf("%c %s (protected)\n", c.op, c.def.name)
+	}
+	for _, w := range c.what {
+		out += fmt.Sprintf("    %s\n", w)
+	}
+	return out
+}
+
+// reconcile creates, updates and deletes jobs so that those jobd holds match
+// its definitions. Nothing changes if any definition is invalid or any change is
+// blocked by a protected job. Created jobs belong to jobd's user.
+func reconcile() error {
+	defs, sources, err := loadDefinitions()
+	if err != nil {
+		return err
+	}
+	defer origins(sources)
+
+	changes := plan(defs)
+	if len(changes) == 0 {
+		return nil
+	}
+	for _, c := range changes {
+		if c.blocked {
+			return invalid("job", "%s is protected, unprotect it first", c.def.name)
+		}
+	}
+
+	for _, c := range changes {
+		glog.Infof("Reconciling: %s", c.describe())
+		switch c.op {
+		case CREATE:
+			err = jobsroot.addJob(*c.def, nil)
+		case UPDATE:
+			if j, ok := jobsroot.lookup(c.def.name); ok {
+				before := j.spec()
+				j.redefine(c.def.schedule, c.def.cmd, c.def.settings)
+				j.changed(reconciler(sources[c.def.name]), before)
+			}
+		case DELETE:
+			err = jobsroot.trashJob(c.def.name, "reconcile")
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Save the changes made even if one of them failed.
+	if serr := saveJobs(); serr != nil && err == nil {
+		err = serr
+	}
+	if serr := jobsroot.saveSettings(); serr != nil && err == nil {
+		err = serr
+	}
+	return err
+}
+
+// reconciler names the author of the changes reconciling a job with its
+// definition in the named file, the commit that last changed it when the
+// definitions are synced from Git.
+func reconciler(source string) string {
+	if gitrepo != "" {
+		return "git:" + commitOf(source)
+	}
+	return "reconcile:" + source
+}
+
+// origins records the file each defined job came from, along with its commit
+// when the definitions are synced from Git.
+func origins(sources map[string]string) {
+	for name, source := range sources {
+		j, ok := jobsroot.lookup(name)
+		if !ok {
+			continue
+		}
+		origin := source
+		if gitrepo != "" {
+			origin = fmt.Sprintf("%s %s", commitOf(source), strings.TrimPrefix(source, gitdir+"/"))
+		}
+		j.setOrigin(origin)
+	}
+}
+
+// redefine replaces the job's schedule, command and settings, restarting its
+// scheduler if it's started so the new schedule takes effect.
+func (j *job) redefine(schedule, cmd string, settings map[string]string) {
+	j.slk.Lock()
+	defer j.slk.Unlock()
+
+	started := j.defn.state == STARTED
+	if started {
+		j.stop()
+	}
+
+	settingslk.Lock()
+	j.defn.schedule, j.defn.cmd = schedule, cmd
+	j.defn.settings = make(map[string]string)
+	for name, value := range settings {
+		j.defn.settings[name] = value
+	}
+	settingslk.Unlock()
+
+	if started {
+		j.start()
+	}
+}
+
+// mkPlanFile creates the read only file at the root of the jobd name space that
+// shows the changes the next reload would make to reconcile jobd with its
+// definitions.
+func mkPlanFile(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkPlanFile(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkPlanFile(%v, %v)", dir, user)
+
+	pf := &jobfile{
+		// diff reader returns the pending changes, a line per job.
+		reader: func() []byte {
+			if definitions == "" {
+				return []byte("no definitions to reconcile with\n")
+			}
+			defs, _, err := loadDefinitions()
+			if err != nil {
+				return []byte(fmt.Sprintf("error: %v\n", err))
+			}
+			var out bytes.Buffer
+			for _, c := range plan(defs) {
+				out.WriteString(c.describe())
+			}
+			return out.Bytes()
+		},
+		// diff is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := pf.Add(dir, "diff", user, nil, 0444, pf); err != nil {
+		glog.Errorln("Can't create diff file: ", err)
+		return err
+	}
+
+	return nil
+}
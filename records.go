@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// RECORDSKEPT is the number of run records a job's records file keeps once it
+// has grown to twice that many
+const RECORDSKEPT = 10000
+
+// runrecord is the record of a finished run kept in the job's records file, a
+// JSON object per line.
+type runrecord struct {
+	ID          int           `json:"id"`
+	Status      string        `json:"status"`
+	Slot        time.Time     `json:"slot"`
+	Start       time.Time     `json:"start"`
+	End         time.Time     `json:"end"`
+	Duration    time.Duration `json:"duration"`
+	Exit        *int          `json:"exit,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Note        string        `json:"note,omitempty"`
+	Annotations []string      `json:"annotations,omitempty"`
+}
+
+// offset locates a run's record: off and n are where it starts and its length
+// in the records file as it's read, at and size in the file saved on disk,
+// which differ when records are encrypted.
+type offset struct {
+	id   int
+	off  int64
+	n    int64
+	at   int64
+	size int64
+}
+
+// records indexes a job's run records, oldest first, by where they are in the
+// file saved on disk.
+type records struct {
+	sync.Mutex
+	offsets []offset
+}
+
+// recordsfile serves a job's run records from the file saved on disk, reading
+// only the records a read covers rather than the whole file.
+type recordsfile struct {
+	srv.File
+	job *job
+}
+
+// mkRecordsFiles creates the read only files holding the records of a job's
+// finished runs and their offsets, loading the records of an earlier jobd so
+// that the job's run numbers carry on from the last one recorded.
+func mkRecordsFiles(job *job, user p.User) error {
+	if err := job.records.load(job.recordsPath()); err != nil {
+		glog.Errorf("Can't load %s records [%v]", job.defn.name, err)
+	}
+	job.lastrun = job.records.last()
+
+	rf := &recordsfile{job: job}
+	if err := rf.Add(&job.File, "records", user, nil, 0444, rf); err != nil {
+		glog.Errorf("Can't create %s/records [%v]", job.defn.name, err)
+		return err
+	}
+
+	of := &jobfile{
+		// offsets reader returns the run number, offset and length of each
+		// record in the records file.
+		reader: func() []byte {
+			return job.records.report()
+		},
+		// offsets is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := of.Add(&job.File, "offsets", user, nil, 0444, of); err != nil {
+		glog.Errorf("Can't create %s/offsets [%v]", job.defn.name, err)
+		return err
+	}
+
+	return nil
+}
+
+// recordsPath returns the path of the file holding the job's run records.
+func (j *job) recordsPath() string {
+	return path.Join(outdir, j.defn.name, "records.jsonl")
+}
+
+// Read returns the records from offset, reading those it covers from disk.
+func (rf *recordsfile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	glog.V(4).Infof("Entering recordsfile.Read(%v, %v, %v)", fid, len(buf), offset)
+	defer glog.V(4).Infof("Exiting recordsfile.Read(%v, %v, %v)", fid, len(buf), offset)
+
+	n, err := rf.job.records.readAt(rf.job.recordsPath(), buf, int64(offset))
+	if err != nil {
+		glog.Errorf("Can't read %s records [%v]", rf.job.defn.name, err)
+		return 0, err
+	}
+	return n, nil
+}
+
+// Stat sets the length of the records file before the server replies.
+func (rf *recordsfile) Stat(fid *srv.FFid) error {
+	n := rf.job.records.size()
+
+	rf.Lock()
+	defer rf.Unlock()
+
+	rf.Length = uint64(n)
+	return nil
+}
+
+// keep appends the record of a finished run to the job's records file.
+func (j *job) keep(r *run) {
+	r.Lock()
+	rec := runrecord{ID: r.id, Status: r.status, Slot: r.inv.slot, Start: r.start, End: r.end, Duration: r.end.Sub(r.start), Note: r.inv.note}
+	rec.Annotations = append(rec.Annotations, r.annotations...)
+	if code, ok := exitCode(r.err); ok {
+		rec.Exit = &code
+	}
+	if r.err != nil {
+		rec.Error = r.err.Error()
+	}
+	r.Unlock()
+
+	data, err := json.Marshal(rec)
+	if err == nil {
+		err = j.records.add(j.recordsPath(), rec.ID, data)
+	}
+	if err != nil {
+		glog.Errorf("Can't record %s run %d [%v]", j.defn.name, rec.ID, err)
+	}
+}
+
+// add appends a run's record to the named file, dropping the oldest records
+// once there are twice RECORDSKEPT of them.
+func (rs *records) add(name string, id int, data []byte) error {
+	rs.Lock()
+	defer rs.Unlock()
+
+	if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	line, err := sealLine(string(data))
+	if err != nil {
+		return err
+	}
+	line += "\n"
+	if _, err := f.WriteString(line); err != nil {
+		return err
+	}
+
+	o := offset{id: id, n: int64(len(data)) + 1, at: fi.Size(), size: int64(len(line))}
+	if n := len(rs.offsets); n > 0 {
+		o.off = rs.offsets[n-1].off + rs.offsets[n-1].n
+	}
+	rs.offsets = append(rs.offsets, o)
+
+	if len(rs.offsets) >= 2*RECORDSKEPT {
+		return rs.trim(name, RECORDSKEPT)
+	}
+	return nil
+}
+
+// trim rewrites the named file with only its last n records. The caller must
+// hold the records lock.
+func (rs *records) trim(name string, n int) error {
+	if len(rs.offsets) <= n {
+		return nil
+	}
+	kept := rs.offsets[len(rs.offsets)-n:]
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data[kept[0].at:], 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+
+	off, at := kept[0].off, kept[0].at
+	rs.offsets = append([]offset{}, kept...)
+	for i := range rs.offsets {
+		rs.offsets[i].off -= off
+		rs.offsets[i].at -= at
+	}
+	return nil
+}
+
+// amend rewrites the named file with the record of the given run changed by
+// fn, doing nothing if the run isn't recorded.
+func (rs *records) amend(name string, id int, fn func(*runrecord)) error {
+	rs.Lock()
+	defer rs.Unlock()
+
+	i := len(rs.offsets) - 1
+	for ; i >= 0 && rs.offsets[i].id != id; i-- {
+	}
+	if i < 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	o := rs.offsets[i]
+	line, err := unsealLine(string(bytes.TrimSuffix(data[o.at:o.at+o.size], []byte("\n"))))
+	if err != nil {
+		return err
+	}
+	var rec runrecord
+	if err := json.Unmarshal([]byte(line), &rec); err != nil {
+		return fmt.Errorf("record at %d: %v", o.at, err)
+	}
+	fn(&rec)
+	amended, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealLine(string(amended))
+	if err != nil {
+		return err
+	}
+	sealed += "\n"
+
+	var out bytes.Buffer
+	out.Write(data[:o.at])
+	out.WriteString(sealed)
+	out.Write(data[o.at+o.size:])
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+
+	dn, dsize := int64(len(amended))+1-o.n, int64(len(sealed))-o.size
+	rs.offsets[i].n, rs.offsets[i].size = o.n+dn, o.size+dsize
+	for k := i + 1; k < len(rs.offsets); k++ {
+		rs.offsets[k].off += dn
+		rs.offsets[k].at += dsize
+	}
+	return nil
+}
+
+// load indexes the records saved in the named file, if there is one. A record
+// that can't be read ends the records loaded, and one left unfinished, by a jobd
+// that stopped while writing it, is cut from the file.
+func (rs *records) load(name string) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rs.Lock()
+	defer rs.Unlock()
+
+	rd := bufio.NewReader(f)
+	var off, at int64
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return os.Truncate(name, at)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err := unsealLine(string(bytes.TrimSuffix(line, []byte("\n"))))
+		if err != nil {
+			return err
+		}
+		var rec runrecord
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			return fmt.Errorf("record at %d: %v", at, err)
+		}
+		o := offset{id: rec.ID, off: off, n: int64(len(data)) + 1, at: at, size: int64(len(line))}
+		rs.offsets = append(rs.offsets, o)
+		off, at = off+o.n, at+o.size
+	}
+}
+
+// all returns the records saved in the named file, oldest first.
+func (rs *records) all(name string) ([]runrecord, error) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	if len(rs.offsets) == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	recs := make([]runrecord, 0, len(rs.offsets))
+	for _, o := range rs.offsets {
+		if o.at+o.size > int64(len(data)) {
+			break
+		}
+		line, err := unsealLine(string(bytes.TrimSuffix(data[o.at:o.at+o.size], []byte("\n"))))
+		if err != nil {
+			return recs, err
+		}
+		var rec runrecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return recs, fmt.Errorf("record at %d: %v", o.at, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// last returns the number of the last run recorded, 0 if there are none.
+func (rs *records) last() int {
+	rs.Lock()
+	defer rs.Unlock()
+
+	if n := len(rs.offsets); n > 0 {
+		return rs.offsets[n-1].id
+	}
+	return 0
+}
+
+// size returns the length of the records as they're read.
+func (rs *records) size() int64 {
+	rs.Lock()
+	defer rs.Unlock()
+
+	if n := len(rs.offsets); n > 0 {
+		return rs.offsets[n-1].off + rs.offsets[n-1].n
+	}
+	return 0
+}
+
+// report lists the run number, offset and length of each record, a record per
+// line, oldest first.
+func (rs *records) report() []byte {
+	rs.Lock()
+	defer rs.Unlock()
+
+	var out bytes.Buffer
+	for _, o := range rs.offsets {
+		fmt.Fprintf(&out, "%d %d %d\n", o.id, o.off, o.n)
+	}
+	return out.Bytes()
+}
+
+// readAt fills buf with the records, as they're read, from off, reading from
+// the named file only the records it covers.
+func (rs *records) readAt(name string, buf []byte, off int64) (int, error) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	i := sort.Search(len(rs.offsets), func(i int) bool {
+		return rs.offsets[i].off+rs.offsets[i].n > off
+	})
+	if i == len(rs.offsets) {
+		return 0, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	for ; i < len(rs.offsets) && n < len(buf); i++ {
+		o := rs.offsets[i]
+		line := make([]byte, o.size)
+		if _, err := f.ReadAt(line, o.at); err != nil {
+			return n, err
+		}
+		data, err := unsealLine(string(bytes.TrimSuffix(line, []byte("\n"))))
+		if err != nil {
+			return n, err
+		}
+		rec := data + "\n"
+		from := int64(0)
+		if off > o.off {
+			from = off - o.off
+		}
+		n += copy(buf[n:], rec[from:])
+	}
+	return n, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RENDERTTL is how long the rendering of an expensive file is served before
+// it's rendered again
+const RENDERTTL = time.Second
+
+// generation counts the changes to the state of jobd's jobs, a change
+// invalidates the cached renderings
+var generation uint64
+
+// touch records a change to the state of jobd's jobs.
+func touch() {
+	atomic.AddUint64(&generation, 1)
+}
+
+// cached returns a reader that serves what the given reader rendered for up to
+// RENDERTTL, rendering it again sooner once the state of the jobs changes. The
+// reads of a file too large for a single message are served from the same
+// rendering as long as it lasts.
+func cached(reader jobreader) jobreader {
+	var lk sync.Mutex
+	var content []byte
+	var valid bool
+	var gen uint64
+	var at time.Time
+
+	return func() []byte {
+		lk.Lock()
+		defer lk.Unlock()
+
+		now, g := time.Now(), atomic.LoadUint64(&generation)
+		if !valid || g != gen || now.Sub(at) > RENDERTTL {
+			content, valid, gen, at = reader(), true, g, now
+		}
+		return content
+	}
+}
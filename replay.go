@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// REPLAY the ctl file command string to run a past run again exactly as it ran
+const REPLAY = "replay"
+
+// runctx is what a run ran with, saved so it can be replayed.
+type runctx struct {
+	Cmd   string    `json:"cmd"`
+	Shell string    `json:"shell"`
+	Env   []string  `json:"env"`
+	Slot  time.Time `json:"slot"`
+	Key   string    `json:"key"`
+	Stdin bool      `json:"stdin,omitempty"`
+
+	// stdin is the path of the replayed run's saved stdin
+	stdin string
+}
+
+// contextPath returns the path of the file holding the run's context.
+func (r *run) contextPath() string {
+	return strings.TrimSuffix(r.out, ".out") + ".ctx"
+}
+
+// stdinPath returns the path of the file holding what an attached run read
+// from its stdin.
+func (r *run) stdinPath() string {
+	return strings.TrimSuffix(r.out, ".out") + ".stdin"
+}
+
+// save saves the run's context.
+func (r *run) save(ctx runctx) error {
+	data, err := json.Marshal(ctx)
+	if err != nil {
+		return err
+	}
+	return writeSealed(r.contextPath(), data, 0600)
+}
+
+// context loads the run's saved context.
+func (r *run) context() (*runctx, error) {
+	data, err := readSealed(r.contextPath())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := new(runctx)
+	if err := json.Unmarshal(data, ctx); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// remove removes the files saved for the run.
+func (r *run) remove() {
+	for _, name := range append(r.saved(), r.sumPath()) {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Can't remove %s [%v]", name, err)
+		}
+	}
+}
+
+// replayArgs turns the arguments of a replay command, the number of one of the
+// job's kept runs, into an invocation that runs the same command, with the same
+// shell, environment, slot and stdin.
+func (j *job) replayArgs(args []string) (invocation, error) {
+	if len(args) != 1 {
+		return invocation{}, invalid("command", "expected replay <run>")
+	}
+
+	r, err := j.lookupRun(args[0])
+	if err != nil {
+		return invocation{}, err
+	}
+
+	ctx, err := r.context()
+	if err != nil {
+		return invocation{}, fmt.Errorf("run %d can't be replayed: %v", r.id, err)
+	}
+	ctx.stdin = r.stdinPath()
+
+	return invocation{slot: ctx.Slot, key: ctx.Key, cmd: ctx.Cmd, note: fmt.Sprintf("replay of run %d", r.id), replay: ctx}, nil
+}
+
+// lookupRun returns the kept run with the given number.
+func (j *job) lookupRun(id string) (*run, error) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, invalid("run", "not a run number: %s", id)
+	}
+
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	for _, r := range j.runs {
+		if r.id == n {
+			return r, nil
+		}
+	}
+	return nil, invalid("run", "no such run: %d", n)
+}
+
+// recorder passes what's written to an attached run's stdin to the run and
+// saves it for replays.
+type recorder struct {
+	io.WriteCloser
+	saved io.WriteCloser
+}
+
+func (rc recorder) Write(data []byte) (int, error) {
+	rc.saved.Write(data)
+	return rc.WriteCloser.Write(data)
+}
+
+func (rc recorder) Close() error {
+	rc.saved.Close()
+	return rc.WriteCloser.Close()
+}
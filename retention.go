@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// GC the root ctl file command string to apply the retention limits now
+	GC = "gc"
+
+	// GCINTERVAL is how often the retention limits are applied
+	GCINTERVAL = time.Hour
+)
+
+// maxstore is the most bytes the files saved for runs may take up altogether,
+// unlimited if zero
+var maxstore int64
+
+// maxage is how long the files saved for a run are kept, forever if zero
+var maxage time.Duration
+
+// collected describes the last garbage collection
+var collected struct {
+	sync.Mutex
+	last string
+}
+
+// saved groups the files saved for one run, found in the output directory.
+type saved struct {
+	prefix string
+	start  time.Time
+	size   int64
+	job    *job
+	run    *run
+}
+
+// reap applies the retention limits, and empties the trash of the jobs deleted
+// longer than trashfor ago, every GCINTERVAL.
+func reap() {
+	for now := range time.Tick(GCINTERVAL) {
+		if _, _, err := gc(now); err != nil {
+			glog.Errorf("Can't collect garbage [%v]", err)
+		}
+		if err := emptyTrash(now.Add(-trashfor)); err != nil {
+			glog.Errorf("Can't empty the trash [%v]", err)
+		}
+	}
+}
+
+// gc removes the files saved for runs older than maxage, then those of the
+// oldest runs until what remains fits in maxstore. Runs still in progress are
+// left alone and kept runs that are removed are rolled into their job's daily
+// summaries. It returns the number of runs removed and the bytes freed.
+func gc(now time.Time) (int, int64, error) {
+	found, err := stored()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var total int64
+	for _, s := range found {
+		total += s.size
+	}
+
+	removed, freed := 0, int64(0)
+	for _, s := range found {
+		expired := maxage > 0 && now.Sub(s.start) > maxage
+		if !expired && (maxstore == 0 || total <= maxstore) {
+			break
+		}
+		if s.run != nil {
+			if !s.job.forget(s.run) {
+				continue
+			}
+		} else {
+			for _, suffix := range []string{".out", ".ctx", ".stdin", ".sum"} {
+				if err := os.Remove(s.prefix + suffix); err != nil && !os.IsNotExist(err) {
+					glog.Errorf("Can't remove %s [%v]", s.prefix+suffix, err)
+				}
+			}
+		}
+		total -= s.size
+		freed += s.size
+		removed++
+	}
+
+	summary := fmt.Sprintf("%s removed %d runs, freed %d bytes, %d bytes in use", now.Format(time.RFC3339), removed, freed, total)
+	glog.Infof("Garbage collected: %s", summary)
+	collected.Lock()
+	collected.last = summary
+	collected.Unlock()
+
+	return removed, freed, nil
+}
+
+// stored returns the runs whose files are in the output directory, the oldest
+// first, matched with the jobs' kept runs.
+func stored() ([]*saved, error) {
+	kept := make(map[string]*saved)
+	for _, j := range jobsroot.list() {
+		j.rlk.Lock()
+		for _, r := range j.runs {
+			prefix := strings.TrimSuffix(r.out, ".out")
+			kept[prefix] = &saved{prefix: prefix, job: j, run: r}
+		}
+		j.rlk.Unlock()
+	}
+
+	dirs, err := ioutil.ReadDir(outdir)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make(map[string]*saved)
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(path.Join(outdir, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			ext := path.Ext(f.Name())
+			nanos, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), ext), 10, 64)
+			if err != nil || f.IsDir() {
+				continue
+			}
+			prefix := path.Join(outdir, d.Name(), strconv.FormatInt(nanos, 10))
+			s, ok := runs[prefix]
+			if !ok {
+				if s, ok = kept[prefix]; !ok {
+					s = &saved{prefix: prefix}
+				}
+				s.start = time.Unix(0, nanos)
+				runs[prefix] = s
+			}
+			s.size += f.Size()
+		}
+	}
+
+	found := []*saved{}
+	for _, s := range runs {
+		found = append(found, s)
+	}
+	sort.Slice(found, func(a, b int) bool { return found[a].start.Before(found[b].start) })
+	return found, nil
+}
+
+// forget removes one of the job's kept runs, unless it's still in progress, and
+// reports whether it did.
+func (j *job) forget(r *run) bool {
+	r.Lock()
+	running := r.status == RUNNING
+	r.Unlock()
+	if running {
+		return false
+	}
+
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	for i := range j.runs {
+		if j.runs[i] == r {
+			j.drop(i)
+			return true
+		}
+	}
+	return false
+}
+
+// lastGC describes the last garbage collection.
+func lastGC() string {
+	collected.Lock()
+	defer collected.Unlock()
+
+	if collected.last == "" {
+		return "never"
+	}
+	return collected.last
+}
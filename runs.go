@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// RUNSKEPT is the number of runs whose directories are kept for each job that
+// doesn't set its retention
+const RUNSKEPT = 32
+
+// outdir is the path to the directory holding the output of every run
+var outdir string
+
+const (
+	// RUNNING indicates the run's command hasn't finished
+	RUNNING = "running"
+
+	// SUCCEEDED indicates the run's command exited successfully
+	SUCCEEDED = "succeeded"
+
+	// FAILED indicates the run's command failed
+	FAILED = "failed"
+
+	// SIGNALED indicates the run's command was killed by a signal
+	SIGNALED = "signaled"
+
+	// TIMEDOUT indicates the run's command was killed for running too long
+	TIMEDOUT = "timedout"
+
+	// INTERRUPTED indicates the run's command was stopped along with its job
+	INTERRUPTED = "interrupted"
+)
+
+// run records a single execution of a job's command.
+type run struct {
+	sync.Mutex
+	id          int
+	inv         invocation
+	start       time.Time
+	end         time.Time
+	status      string
+	err         error
+	signal      syscall.Signal
+	core        string
+	ps          []byte
+	dir         *srv.File
+	out         string
+	timedout    bool
+	interrupted bool
+	annotations []string
+	drift       string
+	steps       []*stepresult
+}
+
+// mkRunsDir creates the directory that holds the job's recent runs.
+func mkRunsDir(job *job, user p.User) error {
+	glog.V(4).Infof("Entering mkRunsDir(%v, %v)", job.defn.name, user)
+	defer glog.V(4).Infof("Exiting mkRunsDir(%v, %v)", job.defn.name, user)
+
+	job.runsdir = new(srv.File)
+	if err := job.runsdir.Add(&job.File, "runs", user, nil, p.DMDIR|0555, nil); err != nil {
+		glog.Errorf("Can't create %s/runs [%v]", job.defn.name, err)
+		return err
+	}
+
+	return nil
+}
+
+// begin records the start of an invocation of the job, creating a directory
+// for it in the job's runs directory. Once more than the job's retention are
+// present the oldest are removed and rolled into the job's daily summaries.
+func (j *job) begin(inv invocation) *run {
+	j.rlk.Lock()
+	defer j.rlk.Unlock()
+
+	j.lastrun++
+	r := &run{id: j.lastrun, inv: inv, start: time.Now(), status: RUNNING}
+	r.out = path.Join(outdir, j.defn.name, fmt.Sprintf("%d.out", r.start.UnixNano()))
+	if err := r.mkdir(j); err != nil {
+		glog.Errorf("Can't create run %d directory for %s [%v]", r.id, j.defn.name, err)
+	}
+
+	j.runs = append(j.runs, r)
+	for len(j.runs) > j.count("retention", RUNSKEPT) {
+		j.drop(0)
+	}
+
+	return r
+}
+
+// drop removes the job's i'th kept run, its directory and saved files, and
+// rolls it into the job's daily summaries. The caller holds j.rlk.
+func (j *job) drop(i int) {
+	old := j.runs[i]
+	if old.dir != nil {
+		old.dir.Remove()
+	}
+	old.remove()
+	j.fold(old)
+	j.runs = append(j.runs[:i], j.runs[i+1:]...)
+}
+
+// mkdir creates the run's directory with its status, cmd, stdout and sums
+// files.
+func (r *run) mkdir(j *job) error {
+	dir := new(srv.File)
+	if err := dir.Add(j.runsdir, strconv.Itoa(r.id), j.user, nil, p.DMDIR|0555, nil); err != nil {
+		return err
+	}
+	r.dir = dir
+
+	status := &jobfile{
+		// status reader returns the run's state and timing.
+		reader: func() []byte {
+			return []byte(r.describe(j))
+		},
+		// status is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := status.Add(dir, "status", j.user, nil, 0444, status); err != nil {
+		return err
+	}
+
+	cmd := &jobfile{
+		// cmd reader returns the command the run executed.
+		reader: func() []byte {
+			return []byte(r.inv.cmd)
+		},
+		// cmd is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := cmd.Add(dir, "cmd", j.user, nil, 0444, cmd); err != nil {
+		return err
+	}
+
+	stdout := &jobfile{
+		// stdout reader returns the run's output exactly as the command wrote it.
+		reader: func() []byte {
+			out, err := r.output()
+			if err != nil && !os.IsNotExist(err) {
+				glog.Errorf("Can't read %s [%v]", r.out, err)
+			}
+			return out
+		},
+		// stdout is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := stdout.Add(dir, "stdout", j.user, nil, 0444, stdout); err != nil {
+		return err
+	}
+
+	return r.mkSumsFile(j)
+}
+
+// create creates the file that receives the run's output.
+func (r *run) create() (io.WriteCloser, error) {
+	if err := os.MkdirAll(path.Dir(r.out), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(r.out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return sealWriter(f), nil
+}
+
+// output returns what the run wrote, as far as it got if it's still in
+// progress.
+func (r *run) output() ([]byte, error) {
+	r.Lock()
+	done := !r.end.IsZero()
+	r.Unlock()
+
+	if done {
+		return readSealed(r.out)
+	}
+	return readGrowing(r.out)
+}
+
+// finish records the outcome of the run distinguishing commands interrupted by
+// stopping their job and commands killed by a signal, and the core dump they
+// left if any, from ordinary failures.
+func (r *run) finish(err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.end = time.Now()
+	r.err = err
+
+	switch {
+	case r.interrupted:
+		r.status = INTERRUPTED
+	case err == nil:
+		r.status = SUCCEEDED
+	case r.timedout:
+		r.status = TIMEDOUT
+	case signaled(err):
+		ee := err.(*exec.ExitError)
+		ws := ee.Sys().(syscall.WaitStatus)
+		r.status = SIGNALED
+		r.signal = ws.Signal()
+		if ws.CoreDump() {
+			r.core = corePath(ee.Pid(), r.exe())
+			if r.core == "" {
+				r.core = "dumped, location unknown"
+			}
+		}
+	default:
+		r.status = FAILED
+	}
+}
+
+// exe returns the name the kernel most likely gave the run's process, that of
+// the first word of its command truncated as the kernel does.
+func (r *run) exe() string {
+	fields := strings.Fields(r.inv.cmd)
+	if len(fields) == 0 {
+		return "bash"
+	}
+	name := path.Base(fields[0])
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+// expire marks the run as having run for too long.
+func (r *run) expire() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.timedout = true
+}
+
+// expired reports whether the run ran for too long.
+func (r *run) expired() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.timedout
+}
+
+// signaled reports whether err says a command was killed by a signal.
+func signaled(err error) bool {
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+			return ws.Signaled()
+		}
+	}
+	return false
+}
+
+// signalNote returns the history entry for a run killed by a signal.
+func (r *run) signalNote() string {
+	r.Lock()
+	defer r.Unlock()
+
+	note := fmt.Sprintf("killed by signal %d (%v)", int(r.signal), r.signal)
+	if r.core != "" {
+		note += fmt.Sprintf(", core: %s", r.core)
+	}
+	return note + "\n"
+}
+
+// attachPs saves a process tree snapshot with the run and exposes it through a
+// ps file in the run's directory.
+func (r *run) attachPs(j *job, ps []byte) {
+	r.Lock()
+	r.ps = ps
+	r.Unlock()
+
+	if r.dir == nil {
+		return
+	}
+
+	f := &jobfile{
+		// ps reader returns the process tree captured during the run.
+		reader: func() []byte {
+			r.Lock()
+			defer r.Unlock()
+			return r.ps
+		},
+		// ps is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := f.Add(r.dir, "ps", j.user, nil, 0444, f); err != nil {
+		glog.Errorf("Can't create %s run %d ps file [%v]", j.defn.name, r.id, err)
+	}
+}
+
+// describe returns a textual description of the run's state with times in the
+// job's time format.
+func (r *run) describe(j *job) string {
+	r.Lock()
+	defer r.Unlock()
+
+	desc := fmt.Sprintf("id: %d\nstatus: %s\nslot: %s\nstart: %s\n", r.id, r.status, j.stamp(r.inv.slot), j.stamp(r.start))
+	if r.inv.note != "" {
+		desc += fmt.Sprintf("note: %s\n", r.inv.note)
+	}
+	if r.inv.note == "" {
+		desc += fmt.Sprintf("lag: %v\n", r.start.Sub(r.inv.slot))
+	}
+	if !r.end.IsZero() {
+		desc += fmt.Sprintf("end: %s\nduration: %v\n", j.stamp(r.end), r.end.Sub(r.start))
+	}
+	if r.err != nil {
+		desc += fmt.Sprintf("error: %v\n", r.err)
+	}
+	if r.status == SIGNALED {
+		desc += fmt.Sprintf("signal: %d (%v)\n", int(r.signal), r.signal)
+	}
+	if r.core != "" {
+		desc += fmt.Sprintf("core: %s\n", r.core)
+	}
+	if r.drift != "" {
+		desc += fmt.Sprintf("drift: %s\n", r.drift)
+	}
+	for _, a := range r.annotations {
+		desc += fmt.Sprintf("annotation: %s\n", a)
+	}
+	return desc
+}
+
+// capture snapshots the run's process group, if the job asks for it, and saves
+// the snapshot with the run.
+func (j *job) capture(r *run, pgrp int) {
+	if !j.enabled("capture") {
+		return
+	}
+
+	ps, err := captureProcTree(pgrp)
+	if err != nil {
+		glog.Errorf("Can't capture process tree for %s run %d [%v]", j.defn.name, r.id, err)
+		return
+	}
+	r.attachPs(j, ps)
+}
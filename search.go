@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// FOUND is the number of runs a search returns unless it asks for another
+	FOUND = 100
+
+	// MAXFOUND is the most runs a search returns
+	MAXFOUND = 1000
+)
+
+// hit is a run matched by a search, the record of the run and its job.
+type hit struct {
+	Job string `json:"job"`
+	runrecord
+}
+
+// query is what a search for runs looks for: runs of the given jobs, with one
+// of the given statuses, started since the given time, that took longer than
+// the given duration and whose saved output holds the given text. Each is left
+// out when it's empty.
+type query struct {
+	jobs     map[string]bool
+	statuses map[string]bool
+	since    time.Time
+	longer   time.Duration
+	output   string
+	limit    int
+}
+
+// parseQuery parses the search of a request: job and status, comma separated
+// lists of the jobs and statuses of the runs wanted, since and longer,
+// durations, the runs wanted having started within the first and taken longer
+// than the second, output, text their saved output holds, and limit, the most
+// runs wanted.
+func parseQuery(params url.Values, now time.Time) (*query, error) {
+	q := &query{jobs: make(map[string]bool), statuses: make(map[string]bool), output: params.Get("output"), limit: FOUND}
+	for _, value := range params["job"] {
+		for _, name := range splitItems(value) {
+			q.jobs[name] = true
+		}
+	}
+	for _, value := range params["status"] {
+		for _, status := range splitItems(value) {
+			q.statuses[status] = true
+		}
+	}
+
+	if v := params.Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, invalid("since", "expected a positive duration, e.g. 24h: %s", v)
+		}
+		q.since = now.Add(-d)
+	}
+	if v := params.Get("longer"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, invalid("longer", "expected a duration, e.g. 5m: %s", v)
+		}
+		q.longer = d
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > MAXFOUND {
+			return nil, invalid("limit", "expected a number from 1 to %d: %s", MAXFOUND, v)
+		}
+		q.limit = n
+	}
+	return q, nil
+}
+
+// matches reports whether the run's record matches the search, leaving its
+// output, which has to be read, to holds.
+func (q *query) matches(rec runrecord) bool {
+	switch {
+	case len(q.statuses) > 0 && !q.statuses[rec.Status]:
+		return false
+	case !q.since.IsZero() && rec.Start.Before(q.since):
+		return false
+	case q.longer > 0 && rec.Duration <= q.longer:
+		return false
+	}
+	return true
+}
+
+// holds reports whether the saved output of the job's run holds the searched
+// for text. Runs whose output is no longer saved hold nothing.
+func (q *query) holds(j *job, rec runrecord) bool {
+	if q.output == "" {
+		return true
+	}
+	data, err := readSealed(path.Join(outdir, j.defn.name, fmt.Sprintf("%d.out", rec.Start.UnixNano())))
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(data, []byte(q.output))
+}
+
+// searchRuns returns the runs of every job, as recorded in their records files,
+// that match the search asked for by the request's query parameters, the most
+// recently started first.
+func searchRuns(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	type candidate struct {
+		job *job
+		rec runrecord
+	}
+	candidates := []candidate{}
+	for _, j := range jobsroot.list() {
+		if len(q.jobs) > 0 && !q.jobs[j.defn.name] {
+			continue
+		}
+		recs, err := j.records.all(j.recordsPath())
+		if err != nil {
+			glog.Errorf("Can't read %s records [%v]", j.defn.name, err)
+		}
+		for _, rec := range recs {
+			if q.matches(rec) {
+				candidates = append(candidates, candidate{j, rec})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool { return candidates[a].rec.Start.After(candidates[b].rec.Start) })
+
+	runs := []hit{}
+	for _, c := range candidates {
+		if len(runs) == q.limit {
+			break
+		}
+		if q.holds(c.job, c.rec) {
+			runs = append(runs, hit{Job: c.job.defn.name, runrecord: c.rec})
+		}
+	}
+	reply(w, http.StatusOK, runs)
+}
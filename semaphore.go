@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// groupname is what the name of a mutual exclusion group or resource looks like
+var groupname = regexp.MustCompile(`^[[:word:]-]+$`)
+
+// capacities is how many runs may hold each resource at once, one for those
+// not given a capacity with -semaphore
+var capacities = map[string]int{}
+
+// semaphores records the jobs holding each mutual exclusion group and resource
+var semaphores = struct {
+	sync.Mutex
+	held map[string][]string
+	free *sync.Cond
+}{held: make(map[string][]string)}
+
+func init() {
+	semaphores.free = sync.NewCond(&semaphores)
+}
+
+// claim is a mutual exclusion group or resource a job's runs have to hold
+// while they execute.
+type claim struct {
+	kind     string
+	name     string
+	capacity int
+}
+
+// validMutex checks that a setting's value names a mutual exclusion group.
+func validMutex(value string) error {
+	if !groupname.MatchString(value) {
+		return fmt.Errorf("not a group name, letters, digits, underscores and dashes: %s", value)
+	}
+	return nil
+}
+
+// validResources checks that a setting's value is a comma separated list of
+// resource names.
+func validResources(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); !groupname.MatchString(name) {
+			return fmt.Errorf("not a resource name, letters, digits, underscores and dashes: %s", name)
+		}
+	}
+	return nil
+}
+
+// semaphoresFlag collects the -semaphore flags given to jobd.
+type semaphoresFlag struct{}
+
+// String renders the capacities as a comma separated list of name=capacity.
+func (semaphoresFlag) String() string {
+	var caps []string
+	for name, n := range capacities {
+		caps = append(caps, fmt.Sprintf("%s=%d", name, n))
+	}
+	sort.Strings(caps)
+	return strings.Join(caps, ",")
+}
+
+// Set validates a resource's capacity given as name=capacity.
+func (semaphoresFlag) Set(kv string) error {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 {
+		return invalid("semaphore", "expected name=capacity: %s", kv)
+	}
+
+	name := strings.TrimSpace(parts[0])
+	if !groupname.MatchString(name) {
+		return invalid("semaphore", "not a resource name, letters, digits, underscores and dashes: %s", name)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || n < 1 {
+		return invalid(name, "not a capacity: %s", parts[1])
+	}
+
+	capacities[name] = n
+	return nil
+}
+
+// claims returns the job's mutual exclusion group and resources, each once,
+// with the capacity of each. A mutual exclusion group is a resource of
+// capacity one.
+func (j *job) claims() []claim {
+	var claims []claim
+	seen := make(map[string]int)
+	add := func(c claim) {
+		if i, ok := seen[c.name]; ok {
+			if c.capacity < claims[i].capacity {
+				claims[i] = c
+			}
+			return
+		}
+		seen[c.name] = len(claims)
+		claims = append(claims, c)
+	}
+
+	if group := j.setting("mutex"); group != "" {
+		add(claim{kind: "mutex", name: group, capacity: 1})
+	}
+	for _, name := range strings.Split(j.setting("resources"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		n, ok := capacities[name]
+		if !ok {
+			n = 1
+		}
+		add(claim{kind: "resource", name: name, capacity: n})
+	}
+	return claims
+}
+
+// exclude waits until the job's mutual exclusion group and every resource it
+// uses have room for another run and then holds them all until the function it
+// returns is called. Holding them all at once, or none, keeps jobs waiting on
+// each other's resources from deadlocking.
+func (j *job) exclude() func() {
+	claims := j.claims()
+	if len(claims) == 0 {
+		return func() {}
+	}
+
+	semaphores.Lock()
+	defer semaphores.Unlock()
+
+	noted := false
+	for c := full(claims); c != nil; c = full(claims) {
+		if !noted {
+			holders := strings.Join(semaphores.held[c.name], ", ")
+			glog.V(3).Infof("%s waiting for %s %s held by %s", j.defn.name, c.kind, c.name, holders)
+			j.record(fmt.Sprintf("waiting for %s %s, held by %s\n", c.kind, c.name, holders))
+			noted = true
+		}
+		semaphores.free.Wait()
+	}
+	for _, c := range claims {
+		semaphores.held[c.name] = append(semaphores.held[c.name], j.defn.name)
+	}
+
+	return func() {
+		semaphores.Lock()
+		defer semaphores.Unlock()
+
+		for _, c := range claims {
+			holders := semaphores.held[c.name]
+			for i, holder := range holders {
+				if holder == j.defn.name {
+					holders = append(holders[:i], holders[i+1:]...)
+					break
+				}
+			}
+			if len(holders) == 0 {
+				delete(semaphores.held, c.name)
+			} else {
+				semaphores.held[c.name] = holders
+			}
+		}
+		semaphores.free.Broadcast()
+	}
+}
+
+// full returns the first of the claims without room for another run, or nil if
+// they all have room. The caller holds the semaphores lock.
+func full(claims []claim) *claim {
+	for i := range claims {
+		if len(semaphores.held[claims[i].name]) >= claims[i].capacity {
+			return &claims[i]
+		}
+	}
+	return nil
+}
+
+// heldResources renders the mutual exclusion groups and resources in use, a
+// line per group or resource, along with the jobs holding them.
+func heldResources() []byte {
+	semaphores.Lock()
+	defer semaphores.Unlock()
+
+	var names []string
+	for name := range semaphores.held {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out bytes.Buffer
+	for _, name := range names {
+		limit := 1
+		if n, ok := capacities[name]; ok {
+			limit = n
+		}
+		holders := semaphores.held[name]
+		fmt.Fprintf(&out, "held: %s %d of %d by %s\n", name, len(holders), limit, strings.Join(holders, ", "))
+	}
+	return out.Bytes()
+}
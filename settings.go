@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+)
+
+// settingsdb is the path to the job settings database
+var settingsdb string
+
+// settingslk protects the settings of every job and the defaults
+var settingslk sync.RWMutex
+
+// defaults holds the server wide settings that apply to every job that doesn't
+// override them
+var defaults = make(map[string]string)
+
+// tunables maps the name of every setting to the function that checks its
+// values
+var tunables = map[string]func(string) error{
+	"alertafter": validCount,
+	"capture":    validBool,
+	"database":   validDatabase,
+	"dedup":      validBool,
+	"drift":      validPercent,
+	"encoding":   validEncoding,
+	"executor":   validJobExecutor,
+	"fake":       validFake,
+	"guard":      validGuard,
+	"items":      validItems,
+	"itemsfrom":  validGenerator,
+	"labels":     validLabels,
+	"lockfile":   validLockFile,
+	"maxline":    validCount,
+	"maxlines":   validCount,
+	"mutex":      validMutex,
+	"overlap":    validOverlap,
+	"parallel":   validCount,
+	"params":     validParams,
+	"priority":   validPriority,
+	"quiet":      validQuiet,
+	"resources":  validResources,
+	"retention":  validCount,
+	"retries":    validRetries,
+	"severity":   validSeverity,
+	"shell":      validShell,
+	"splay":      validDuration,
+	"stale":      validDuration,
+	"stopgrace":  validDuration,
+	"stripansi":  validBool,
+	"timefmt":    validTimefmt,
+	"timeout":    validDuration,
+	"tz":         validTZ,
+}
+
+// defaultsFlag collects the -default flags given to jobd.
+type defaultsFlag struct{}
+
+// String renders the defaults as a comma separated list of settings.
+func (defaultsFlag) String() string {
+	settingslk.RLock()
+	defer settingslk.RUnlock()
+
+	return strings.Join(render(defaults), ",")
+}
+
+// Set validates a setting given as name=value and adds it to the defaults.
+func (defaultsFlag) Set(kv string) error {
+	name, value, err := parseSetting(kv)
+	if err != nil {
+		return err
+	}
+
+	settingslk.Lock()
+	defer settingslk.Unlock()
+
+	defaults[name] = value
+	return nil
+}
+
+// parseSetting splits a setting given as name=value and checks that it names a
+// known setting with a valid value.
+func parseSetting(kv string) (string, string, error) {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 {
+		return "", "", invalid("setting", "expected name=value: %s", kv)
+	}
+
+	name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	valid, ok := tunables[name]
+	if !ok {
+		return "", "", invalid(name, "unknown setting")
+	}
+	if value != "" {
+		if err := valid(value); err != nil {
+			return "", "", &fieldError{field: name, err: err}
+		}
+	}
+
+	return name, value, nil
+}
+
+// render returns the given settings as name=value strings ordered by name.
+func render(settings map[string]string) []string {
+	lines := []string{}
+	for name, value := range settings {
+		lines = append(lines, name+"="+value)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// setting returns the value of a job's named setting, or the default if the job
+// doesn't override it, or the empty string if neither is set.
+func (j *job) setting(name string) string {
+	settingslk.RLock()
+	defer settingslk.RUnlock()
+
+	if value, ok := j.defn.settings[name]; ok {
+		return value
+	}
+	return defaults[name]
+}
+
+// effective returns the job's settings merged with the defaults.
+func (j *job) effective() map[string]string {
+	settingslk.RLock()
+	defer settingslk.RUnlock()
+
+	merged := make(map[string]string)
+	for name, value := range defaults {
+		merged[name] = value
+	}
+	for name, value := range j.defn.settings {
+		merged[name] = value
+	}
+	return merged
+}
+
+// set changes the value of a job's named setting, an empty value removes it, and
+// persists the result to the settings database.
+func (j *job) set(name, value string) error {
+	glog.V(3).Infof("Setting %s.%s to %q", j.defn.name, name, value)
+
+	before := j.spec()
+	defer j.changed(j.author(), before)
+
+	settingslk.Lock()
+	if value == "" {
+		delete(j.defn.settings, name)
+	} else {
+		j.defn.settings[name] = value
+	}
+	settingslk.Unlock()
+
+	return jobsroot.saveSettings()
+}
+
+// mkSettingFile creates a file in a job's directory through which the named
+// setting is read and written. Writes are checked with valid, if it isn't nil,
+// before being applied and an empty write removes the setting.
+func mkSettingFile(job *job, user p.User, name string, valid func(string) error) error {
+	sf := &jobfile{
+		reader: func() []byte {
+			return []byte(job.setting(name))
+		},
+		writer: func(data []byte) (int, error) {
+			value := strings.TrimSpace(string(data))
+			if value != "" && valid != nil {
+				if err := valid(value); err != nil {
+					return 0, &fieldError{field: name, err: err}
+				}
+			}
+			if err := job.set(name, value); err != nil {
+				return 0, err
+			}
+			return len(data), nil
+		}}
+	if err := sf.Add(&job.File, name, user, nil, 0644, sf); err != nil {
+		glog.Errorf("Can't create %s/%s [%v]", job.defn.name, name, err)
+		return err
+	}
+
+	return nil
+}
+
+// mkSettingsFile creates the file that shows a job's effective settings, its own
+// merged with the defaults, as name=value lines. Writing name=value lines to it
+// changes the job's settings, an empty value removing the job's own so that the
+// default applies.
+func mkSettingsFile(job *job, user p.User) error {
+	sf := &jobfile{
+		// settings reader returns the job's effective settings.
+		reader: func() []byte {
+			lines := render(job.effective())
+			if len(lines) == 0 {
+				return []byte{}
+			}
+			return []byte(strings.Join(lines, "\n") + "\n")
+		},
+		// settings writer validates and applies the settings written to it.
+		writer: func(data []byte) (int, error) {
+			changes, err := parseSettings(string(data))
+			if err != nil {
+				return 0, err
+			}
+			if err := job.update(changes); err != nil {
+				return 0, err
+			}
+			return len(data), nil
+		}}
+	if err := sf.Add(&job.File, "settings", user, nil, 0644, sf); err != nil {
+		glog.Errorf("Can't create %s/settings [%v]", job.defn.name, err)
+		return err
+	}
+
+	return nil
+}
+
+// validBool checks that a setting's value is a boolean.
+func validBool(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("not a boolean: %s", value)
+	}
+	return nil
+}
+
+// validCount checks that a setting's value is a positive integer.
+func validCount(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n < 1 {
+		return fmt.Errorf("not a positive integer: %s", value)
+	}
+	return nil
+}
+
+// validShell checks that a setting's value is the absolute path of an
+// executable.
+func validShell(value string) error {
+	if !path.IsAbs(value) {
+		return fmt.Errorf("not an absolute path: %s", value)
+	}
+	fi, err := os.Stat(value)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || fi.Mode()&0111 == 0 {
+		return fmt.Errorf("not executable: %s", value)
+	}
+	return nil
+}
+
+// count returns the value of a job's named integer setting or def if it isn't
+// set.
+func (j *job) count(name string, def int) int {
+	if n, err := strconv.Atoi(j.setting(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// shell returns the shell the job's commands are run with.
+func (j *job) shell() string {
+	if sh := j.setting("shell"); sh != "" {
+		return sh
+	}
+	return "/bin/bash"
+}
+
+// enabled reports whether a job's named boolean setting is set and true.
+func (j *job) enabled(name string) bool {
+	on, _ := strconv.ParseBool(j.setting(name))
+	return on
+}
+
+// update validates and then applies a group of settings changes to the job,
+// all or none of them, and persists the result to the settings database.
+func (j *job) update(changes map[string]string) error {
+	for name, value := range changes {
+		if _, _, err := parseSetting(name + "=" + value); err != nil {
+			return err
+		}
+	}
+
+	before := j.spec()
+	defer j.changed(j.author(), before)
+
+	settingslk.Lock()
+	for name, value := range changes {
+		if value == "" {
+			delete(j.defn.settings, name)
+		} else {
+			j.defn.settings[name] = value
+		}
+	}
+	settingslk.Unlock()
+
+	return jobsroot.saveSettings()
+}
+
+// parseSettings parses name=value lines, ignoring blank ones, into a group of
+// settings changes. Errors identify the offending line and setting.
+func parseSettings(data string) (map[string]string, error) {
+	changes := make(map[string]string)
+	for i, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, value, err := parseSetting(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		changes[name] = value
+	}
+	return changes, nil
+}
+
+// saveSettings rewrites the settings database from the settings of every job in
+// the jobs directory. Each setting is stored on a line of its own in the form
+// <jobname>:<setting>=<value>.
+func (jd *jobsdir) saveSettings() error {
+	settingslk.RLock()
+	defer settingslk.RUnlock()
+
+	tmp := settingsdb + ".tmp"
+	db, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range jd.list() {
+		names := []string{}
+		for name := range j.defn.settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Fprintf(db, "%s:%s=%s\n", j.defn.name, name, j.defn.settings[name])
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, settingsdb)
+}
+
+// loadSettings reads the settings database and applies each of the settings it
+// contains to the corresponding job.
+func (jd *jobsdir) loadSettings() error {
+	db, err := os.Open(settingsdb)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	settingslk.Lock()
+	defer settingslk.Unlock()
+
+	scanner := bufio.NewScanner(db)
+	for scanner.Scan() {
+		data := scanner.Text()
+		parts := strings.SplitN(data, ":", 2)
+		if len(parts) != 2 || !strings.Contains(parts[1], "=") {
+			return fmt.Errorf("settingsdb corruption: invalid setting (%v)", data)
+		}
+
+		j, ok := jd.lookup(parts[0])
+		if !ok {
+			glog.Warningf("Ignoring setting for unknown job: %s", data)
+			continue
+		}
+
+		kv := strings.SplitN(parts[1], "=", 2)
+		j.defn.settings[kv[0]] = kv[1]
+	}
+
+	return scanner.Err()
+}
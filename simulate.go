@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// MAXSIMULATED is the most dispatches a simulation reports for a job
+const MAXSIMULATED = MAXBACKFILL
+
+// dispatch is a run the scheduler would start.
+type dispatch struct {
+	at   time.Time
+	job  string
+	note string
+}
+
+// simulate returns the runs the scheduler would dispatch for the job between
+// from and to, moving a simulated clock through its schedule as the scheduler
+// would the real one, without running anything. Each notes what would happen
+// to the run: delayed by the job's splay, skipped because its slot already
+// completed, or not dispatched at all while the job is stopped.
+func (j *job) simulate(from, to time.Time) ([]dispatch, error) {
+	if to.Before(from) {
+		return nil, invalid("to", "before from: %s", to.Format(time.RFC3339))
+	}
+
+	dispatches := []dispatch{}
+	c := &simclock{now: from.Add(-time.Nanosecond)}
+	for len(dispatches) < MAXSIMULATED {
+		now := c.Now()
+		next, err := j.next(now)
+		if err != nil {
+			return nil, err
+		}
+		if next.IsZero() || next.After(to) {
+			break
+		}
+		<-c.After(next.Sub(now))
+
+		notes := []string{}
+		if j.defn.state != STARTED {
+			notes = append(notes, "job stopped")
+		}
+		if splay := j.duration("splay"); splay > 0 {
+			notes = append(notes, fmt.Sprintf("delayed up to %v", splay))
+		}
+		if j.setting("guard") != "" {
+			notes = append(notes, "if its guard allows")
+		}
+		if j.enabled("dedup") && completed(j.defn.name, slotKey(j.defn.name, next)) {
+			notes = append(notes, "skipped, slot already completed")
+		}
+		if len(notes) == 0 {
+			notes = append(notes, "run")
+		}
+		dispatches = append(dispatches, dispatch{at: next, job: j.defn.name, note: strings.Join(notes, ", ")})
+	}
+
+	return dispatches, nil
+}
+
+// simulation parses a simulate request, from=<t1> to=<t2>, and renders the
+// dispatches of the given jobs over that window in time order.
+func simulation(data []byte, jobs []*job) ([]byte, error) {
+	fields, err := ctlFields(string(data))
+	if err != nil {
+		return nil, err
+	}
+	args, err := ctlArgs(fields)
+	if err != nil {
+		return nil, err
+	}
+	from, err := time.Parse(time.RFC3339, args["from"])
+	if err != nil {
+		return nil, invalid("from", "not an RFC3339 time: %s", args["from"])
+	}
+	to, err := time.Parse(time.RFC3339, args["to"])
+	if err != nil {
+		return nil, invalid("to", "not an RFC3339 time: %s", args["to"])
+	}
+
+	all := []dispatch{}
+	for _, j := range jobs {
+		ds, err := j.simulate(from, to)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", j.defn.name, err)
+		}
+		all = append(all, ds...)
+	}
+	sortDispatches(all)
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "simulated %s to %s: %d runs\n", formatTime(from, timefmt), formatTime(to, timefmt), len(all))
+	for _, d := range all {
+		fmt.Fprintf(&out, "%s %s %s\n", formatTime(d.at, timefmt), d.job, d.note)
+	}
+	return out.Bytes(), nil
+}
+
+// sortDispatches orders dispatches by time, then by job.
+func sortDispatches(ds []dispatch) {
+	sort.Slice(ds, func(a, b int) bool {
+		if ds[a].at.Equal(ds[b].at) {
+			return ds[a].job < ds[b].job
+		}
+		return ds[a].at.Before(ds[b].at)
+	})
+}
+
+// alone returns just the job, for simulating it on its own.
+func (j *job) alone() []*job {
+	return []*job{j}
+}
+
+// mkSimulateFile creates a simulate file in dir. Writing from=<t1> to=<t2> to it
+// simulates the jobs returned by jobs over that window, reading it returns the
+// last simulation.
+func mkSimulateFile(dir *srv.File, user p.User, jobs func() []*job) error {
+	var result []byte
+
+	sf := &jobfile{
+		// simulate reader returns the last simulation.
+		reader: func() []byte {
+			return result
+		},
+		// simulate writer simulates the window written to it.
+		writer: func(data []byte) (int, error) {
+			out, err := simulation(data, jobs())
+			if err != nil {
+				return 0, err
+			}
+			result = out
+			return len(data), nil
+		}}
+	if err := sf.Add(dir, "simulate", user, nil, 0666, sf); err != nil {
+		glog.Errorf("Can't create simulate file [%v]", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// NATS the sink that publishes events to a NATS subject
+	NATS = "nats"
+
+	// KAFKA the sink that writes events to a Kafka topic
+	KAFKA = "kafka"
+
+	// LOG the sink that appends events to a file, or jobd's log
+	LOG = "log"
+
+	// SINKBACKLOG is the number of events a sink may fall behind by before it
+	// misses some
+	SINKBACKLOG = 1024
+
+	// SINKTIMEOUT is how long a sink may take to deliver an event
+	SINKTIMEOUT = 10 * time.Second
+)
+
+// sink feeds the events matching its filter to a downstream system in order,
+// from a queue of its own so that a slow one holds up neither jobd nor the
+// other sinks.
+type sink struct {
+	filter  eventfilter
+	kind    string
+	target  string
+	queue   chan event
+	deliver func(ev event) error
+	close   func()
+}
+
+// sinksfile is the file of the sinks every event is fed to, none if empty
+var sinksfile string
+
+// sinks are the sinks loaded from the -sinks file, in the order they were given
+var sinks struct {
+	sync.RWMutex
+	all []*sink
+}
+
+// loadSinks reads sinks from the named file. Each line holds a sink of the form
+// <selector> <sink> [<target>], where the selector is * or a comma separated
+// list of job=<name>, kind=<kind>, severity=<severity> and label=value pairs an
+// event must all match. Blank lines and lines starting with # are ignored. The
+// sinks replace those loaded before only if they're all valid.
+func loadSinks(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	loaded := []*sink{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		s, err := parseSink(line)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", name, n, err)
+		}
+		loaded = append(loaded, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	sinks.Lock()
+	defer sinks.Unlock()
+
+	for _, s := range sinks.all {
+		close(s.queue)
+	}
+	for _, s := range loaded {
+		go s.run()
+	}
+	sinks.all = loaded
+	return nil
+}
+
+// parseSelector parses the selector of a sink.
+func parseSelector(selector string) (eventfilter, error) {
+	f := newFilter()
+	if selector == "*" {
+		return f, nil
+	}
+	for _, kv := range strings.Split(selector, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return eventfilter{}, invalid("selector", "expected label=value: %s", kv)
+		}
+		switch parts[0] {
+		case "job":
+			f.jobs[parts[1]] = true
+		case "kind":
+			f.kinds[parts[1]] = true
+		default:
+			f.route.selector[parts[0]] = parts[1]
+		}
+	}
+	return f, nil
+}
+
+// parseSink parses a single sink, without connecting to its target.
+func parseSink(line string) (*sink, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, invalid("sink", "expected <selector> <sink> [<target>]: %s", line)
+	}
+	filter, err := parseSelector(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	s := &sink{filter: filter, kind: fields[1], queue: make(chan event, SINKBACKLOG)}
+	if len(fields) == 3 {
+		s.target = fields[2]
+	}
+	if s.target == "" && s.kind != LOG {
+		return nil, invalid("target", "%s needs a target", s.kind)
+	}
+
+	switch s.kind {
+	case WEBHOOK:
+		s.deliver = func(ev event) error {
+			return postJSON(s.target, ev)
+		}
+	case LOG:
+		if s.target != "" && !filepath.IsAbs(s.target) {
+			return nil, invalid("target", "not an absolute path: %s", s.target)
+		}
+		s.deliver, s.close = s.logger()
+	case NATS:
+		u, err := url.Parse(s.target)
+		if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			return nil, invalid("target", "expected nats://<host>:<port>/<subject>: %s", s.target)
+		}
+		s.deliver, s.close = publisher(u.Scheme+"://"+u.Host, strings.Trim(u.Path, "/"))
+	case KAFKA:
+		parts := strings.SplitN(strings.TrimPrefix(s.target, "kafka://"), "/", 2)
+		if !strings.HasPrefix(s.target, "kafka://") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, invalid("target", "expected kafka://<broker>[,<broker>...]/<topic>: %s", s.target)
+		}
+		s.deliver, s.close = producer(strings.Split(parts[0], ","), parts[1])
+	default:
+		return nil, invalid("sink", "unknown: %s", s.kind)
+	}
+
+	return s, nil
+}
+
+// publish queues an event for every sink whose filter it matches. A sink whose
+// queue is full misses it.
+func publish(ev event) {
+	sinks.RLock()
+	defer sinks.RUnlock()
+
+	for _, s := range sinks.all {
+		if !s.filter.matches(ev) {
+			continue
+		}
+		select {
+		case s.queue <- ev:
+		default:
+			glog.Errorf("Dropped %s event for %s, %s sink %s is %d events behind", ev.Kind, ev.Job, s.kind, s.target, SINKBACKLOG)
+		}
+	}
+}
+
+// run delivers the events queued for the sink until its queue is closed.
+func (s *sink) run() {
+	for ev := range s.queue {
+		if err := s.deliver(ev); err != nil {
+			glog.Errorf("Can't send %s event for %s to %s sink %s [%v]", ev.Kind, ev.Job, s.kind, s.target, err)
+		}
+	}
+	if s.close != nil {
+		s.close()
+	}
+}
+
+// logger returns the functions appending events, a JSON line each, to the
+// sink's file, or writing them to jobd's log when it has none, and closing the
+// file.
+func (s *sink) logger() (func(event) error, func()) {
+	var f *os.File
+	deliver := func(ev event) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if s.target == "" {
+			glog.Infof("Event %s", data)
+			return nil
+		}
+		if f == nil {
+			if f, err = os.OpenFile(s.target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+				return err
+			}
+		}
+		_, err = f.Write(append(data, '\n'))
+		return err
+	}
+	return deliver, func() {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// publisher returns the functions publishing events to a NATS subject,
+// connecting to the server the first time, and disconnecting.
+func publisher(server, subject string) (func(event) error, func()) {
+	var nc *nats.Conn
+	deliver := func(ev event) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if nc == nil {
+			if nc, err = nats.Connect(server, nats.Name("jobd")); err != nil {
+				return err
+			}
+		}
+		return nc.Publish(subject, data)
+	}
+	return deliver, func() {
+		if nc != nil {
+			nc.Close()
+		}
+	}
+}
+
+// producer returns the functions writing events to a Kafka topic, keyed by
+// their job so that a job's events stay in order, and closing the writer.
+func producer(brokers []string, topic string) (func(event) error, func()) {
+	w := &kafka.Writer{Addr: kafka.TCP(brokers...), Topic: topic, Balancer: &kafka.Hash{}, WriteTimeout: SINKTIMEOUT}
+	deliver := func(ev event) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), SINKTIMEOUT)
+		defer cancel()
+		return w.WriteMessages(ctx, kafka.Message{Key: []byte(ev.Job), Value: data})
+	}
+	return deliver, func() {
+		if err := w.Close(); err != nil {
+			glog.Errorf("Can't close Kafka writer for %s [%v]", topic, err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"text/template"
+)
+
+// SLACK the channel that posts events to a Slack or Mattermost webhook
+const SLACK = "slack"
+
+// slackTemplate is the default template of the messages sent to Slack
+const slackTemplate = `*{{.Job}}* run {{.Run}} {{.Status}}{{if .Exit}} ({{.Exit}}){{end}} after {{.Duration}}
+path: {{.Path}}{{if .Output}}
+` + "```" + `
+{{.Output}}
+` + "```" + `{{end}}`
+
+// slackmsg renders the text of the messages sent to Slack
+var slackmsg = template.Must(template.New("slack").Parse(slackTemplate))
+
+// loadSlackTemplate replaces the default Slack message template with the one in
+// the named file. The template is given the event being sent.
+func loadSlackTemplate(name string) error {
+	text, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	t, err := template.New("slack").Parse(string(text))
+	if err != nil {
+		return err
+	}
+
+	slackmsg = t
+	return nil
+}
+
+// slack posts an event to a Slack compatible incoming webhook.
+func slack(url string, ev event) error {
+	var text bytes.Buffer
+	if err := slackmsg.Execute(&text, ev); err != nil {
+		return err
+	}
+
+	return postJSON(url, map[string]string{"text": text.String()})
+}
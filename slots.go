@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SLOTSKEPT is the number of completed slots remembered for each job
+const SLOTSKEPT = 64
+
+// slotsdb is the path to the database of completed slots
+var slotsdb string
+
+// slots records the idempotency keys of each job's most recently completed
+// slots, how many are remembered in all and how many lines the slots database
+// has grown to
+var slots = struct {
+	sync.Mutex
+	done  map[string][]string
+	kept  int
+	lines int
+}{done: make(map[string][]string)}
+
+// slotKey returns the idempotency key for the run of the named job scheduled at
+// slot. The key is the same every time that slot comes around, even across
+// restarts, so commands can use it to recognize repeated work.
+func slotKey(name string, slot time.Time) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s@%d", name, slot.Unix())))
+	return hex.EncodeToString(sum[:16])
+}
+
+// completed reports whether the slot with the given key has already been run
+// to completion by the named job.
+func completed(name, key string) bool {
+	slots.Lock()
+	defer slots.Unlock()
+
+	for _, k := range slots.done[name] {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// complete remembers that the named job has run the slot with the given key and
+// appends it to the slots database, which is rewritten with only the slots
+// still remembered once it holds twice as many lines as that.
+func complete(name, key string) error {
+	slots.Lock()
+	defer slots.Unlock()
+
+	remember(name, key)
+
+	db, err := os.OpenFile(slotsdb, os.O_WRONLY|os.O_APPEND, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(db, "%s:%s\n", name, key)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	slots.lines++
+	if slots.lines > 2*slots.kept {
+		return saveSlots()
+	}
+	return nil
+}
+
+// remember adds key to the named job's completed slots discarding the oldest
+// once more than SLOTSKEPT have been recorded. The caller must hold the slots
+// lock.
+func remember(name, key string) {
+	done := append(slots.done[name], key)
+	if len(done) > SLOTSKEPT {
+		done = done[len(done)-SLOTSKEPT:]
+	}
+	slots.kept += len(done) - len(slots.done[name])
+	slots.done[name] = done
+}
+
+// loadSlots reads the slots database and then rewrites it with only the slots
+// still remembered so that it doesn't grow without bound.
+func loadSlots() error {
+	slots.Lock()
+	defer slots.Unlock()
+
+	db, err := os.Open(slotsdb)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(db)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			db.Close()
+			return fmt.Errorf("slotsdb corruption: invalid slot (%v)", scanner.Text())
+		}
+		remember(parts[0], parts[1])
+	}
+	db.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return saveSlots()
+}
+
+// saveSlots rewrites the slots database with only the slots still remembered.
+// The caller must hold the slots lock.
+func saveSlots() error {
+	tmp := slotsdb + ".tmp"
+	db, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	for name, keys := range slots.done {
+		for _, key := range keys {
+			fmt.Fprintf(db, "%s:%s\n", name, key)
+		}
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, slotsdb); err != nil {
+		return err
+	}
+	slots.lines = slots.kept
+	return nil
+}
+
+// forgetSlots forgets the slots completed by the named job, so that a job
+// later given its name doesn't take them for its own, and rewrites the slots
+// database without them.
+func forgetSlots(name string) error {
+	slots.Lock()
+	defer slots.Unlock()
+
+	done, ok := slots.done[name]
+	if !ok {
+		return nil
+	}
+	slots.kept -= len(done)
+	delete(slots.done, name)
+	return saveSlots()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// TestSlotsRemembered checks that completed slots are recognized by the job
+// that ran them, also once reloaded from the slots database, and that only the
+// last SLOTSKEPT of them are.
+func TestSlotsRemembered(t *testing.T) {
+	testStore(t)
+
+	start := time.Now().Truncate(time.Minute)
+	keys := make([]string, SLOTSKEPT+1)
+	for i := range keys {
+		keys[i] = slotKey("slots", start.Add(time.Duration(i)*time.Minute))
+		if err := complete("slots", keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slots.done = make(map[string][]string)
+	if err := loadSlots(); err != nil {
+		t.Fatal(err)
+	}
+	if completed("slots", keys[0]) {
+		t.Errorf("more than %d slots are remembered", SLOTSKEPT)
+	}
+	for i, key := range keys[1:] {
+		if !completed("slots", key) {
+			t.Fatalf("slot %d isn't remembered once reloaded", i+1)
+		}
+	}
+	if completed("other", keys[1]) {
+		t.Error("a slot is remembered for a job that didn't run it")
+	}
+	if slotKey("other", start) == keys[0] {
+		t.Error("two jobs have the same key for a slot")
+	}
+}
+
+// TestSlotsRecordedWithDedup checks that only jobs deduplicating their runs
+// record the slots they complete.
+func TestSlotsRecordedWithDedup(t *testing.T) {
+	testStore(t)
+	jobs := testJobs(t, "slots", 2, false)
+	if err := jobs[1].update(map[string]string{"dedup": "true"}); err != nil {
+		t.Fatal(err)
+	}
+
+	slot := time.Now().Truncate(time.Minute)
+	for _, j := range jobs {
+		j.execute(slot)
+	}
+
+	if completed(jobs[0].defn.name, slotKey(jobs[0].defn.name, slot)) {
+		t.Error("a job without dedup recorded its slot")
+	}
+	if !completed(jobs[1].defn.name, slotKey(jobs[1].defn.name, slot)) {
+		t.Error("a job with dedup didn't record its slot")
+	}
+}
+
+// TestSlotsCompacted checks that the slots database is rewritten with only the
+// slots remembered before it grows to more than twice as many lines.
+func TestSlotsCompacted(t *testing.T) {
+	testStore(t)
+
+	start := time.Now()
+	for i := 0; i < 10*SLOTSKEPT; i++ {
+		if err := complete("busy", slotKey("busy", start.Add(time.Duration(i)*time.Minute))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(slotsdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("\n")); n > 2*SLOTSKEPT {
+		t.Errorf("the slots database has %d lines, want at most %d", n, 2*SLOTSKEPT)
+	}
+}
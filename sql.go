@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+
+	// The drivers of the databases the sql executor connects to.
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// SQL is the executor that runs the job's command as a SQL statement
+	// against the database its database setting names
+	SQL = "sql"
+
+	// SQLROWS is the most rows of a query's result a run's output shows
+	SQLROWS = 100
+)
+
+// drivers are the database drivers a database may use
+var drivers = []string{"postgres", "mysql", "sqlite"}
+
+// database is a database jobs may run statements against, as loaded from the
+// -databases file.
+type database struct {
+	driver string
+	dsn    string
+	db     *sql.DB
+}
+
+// databases are the databases loaded from the -databases file, by name
+var databases = struct {
+	sync.Mutex
+	named map[string]*database
+}{named: make(map[string]*database)}
+
+// loadDatabases reads databases from the named file. Each line holds a database
+// of the form <name> <driver> <data source name>. Blank lines and lines
+// starting with # are ignored.
+func loadDatabases(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	databases.Lock()
+	defer databases.Unlock()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s line %d: expected <name> <driver> <data source name>", name, n)
+		}
+		if !known(fields[1]) {
+			return fmt.Errorf("%s line %d: driver not one of %s: %s", name, n, strings.Join(drivers, ", "), fields[1])
+		}
+		databases.named[fields[0]] = &database{driver: fields[1], dsn: strings.TrimSpace(fields[2])}
+	}
+
+	return scanner.Err()
+}
+
+// known reports whether driver is one of the database drivers.
+func known(driver string) bool {
+	for _, d := range drivers {
+		if driver == d {
+			return true
+		}
+	}
+	return false
+}
+
+// validDatabase checks that a setting's value names a database from the
+// -databases file.
+func validDatabase(value string) error {
+	databases.Lock()
+	defer databases.Unlock()
+
+	if _, ok := databases.named[value]; !ok {
+		return fmt.Errorf("no such database: %s", value)
+	}
+	return nil
+}
+
+// open returns the connection pool of the named database, opening it the first
+// time it's used.
+func open(name string) (*sql.DB, error) {
+	databases.Lock()
+	defer databases.Unlock()
+
+	d, ok := databases.named[name]
+	if !ok {
+		return nil, invalid("database", "no such database: %s", name)
+	}
+	if d.db == nil {
+		db, err := sql.Open(d.driver, d.dsn)
+		if err != nil {
+			return nil, err
+		}
+		d.db = db
+	}
+	return d.db, nil
+}
+
+// querying reports whether a statement returns rows rather than changing them.
+func querying(stmt string) bool {
+	fields := strings.Fields(stmt)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToLower(fields[0]) {
+	case "select", "with", "show", "explain", "values", "pragma":
+		return true
+	}
+	return false
+}
+
+// query runs the statement against the job's database in a transaction. A query
+// writes its columns and up to SQLROWS rows, tab separated, to stdout followed
+// by the number of rows, any other statement the number of rows it affected.
+// A dry run rolls the transaction back. It stops once ctx is done.
+func (j *job) query(ctx context.Context, stmt string, stdout io.Writer, dryrun bool) error {
+	db, err := open(j.setting("database"))
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	glog.V(3).Infof("querying `%s`", stmt)
+	if querying(stmt) {
+		err = snapshot(ctx, tx, stmt, stdout)
+	} else {
+		var res sql.Result
+		if res, err = tx.ExecContext(ctx, stmt); err == nil {
+			if n, rerr := res.RowsAffected(); rerr == nil {
+				fmt.Fprintf(stdout, "%d rows affected\n", n)
+			}
+		}
+	}
+	if err != nil || dryrun {
+		if dryrun {
+			fmt.Fprintln(stdout, "rolled back")
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// snapshot writes the result of a query to stdout.
+func snapshot(ctx context.Context, tx *sql.Tx, stmt string, stdout io.Writer) error {
+	rows, err := tx.QueryContext(ctx, stmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, strings.Join(columns, "\t"))
+
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	n := 0
+	for ; rows.Next(); n++ {
+		if n >= SQLROWS {
+			continue
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		fields := make([]string, len(values))
+		for i, v := range values {
+			fields[i] = "NULL"
+			if v.Valid {
+				fields[i] = v.String
+			}
+		}
+		fmt.Fprintln(stdout, strings.Join(fields, "\t"))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if n > SQLROWS {
+		fmt.Fprintf(stdout, "... %d more\n", n-SQLROWS)
+	}
+	fmt.Fprintf(stdout, "%d rows\n", n)
+	return nil
+}
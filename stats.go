@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// stats accumulates the outcome of a job's runs.
+type stats struct {
+	sync.Mutex
+	runs      int
+	succeeded int
+	failed    int
+	signaled  int
+	timedout  int
+	skipped   int
+	shed      int
+	overflows int
+	lagn      int
+	lagsum    time.Duration
+	lagmax    time.Duration
+	laglast   time.Duration
+	exits     map[int]int
+}
+
+// mkStatsFile creates the read only file that reports a job's statistics.
+func mkStatsFile(job *job, user p.User) error {
+	sf := &jobfile{
+		// stats reader returns the job's run statistics.
+		reader: cached(func() []byte {
+			return job.stats.report()
+		}),
+		// stats is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := sf.Add(&job.File, "stats", user, nil, 0444, sf); err != nil {
+		glog.Errorf("Can't create %s/stats [%v]", job.defn.name, err)
+		return err
+	}
+
+	return nil
+}
+
+// add accounts for a finished run. Dispatch lag, how long after its slot the
+// run started, is only meaningful for scheduled runs so manual runs and
+// backfills don't contribute to it.
+func (s *stats) add(r *run) {
+	r.Lock()
+	defer r.Unlock()
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.runs++
+	if code, ok := exitCode(r.err); ok {
+		if s.exits == nil {
+			s.exits = make(map[int]int)
+		}
+		s.exits[code]++
+	}
+	switch r.status {
+	case SUCCEEDED:
+		s.succeeded++
+	case SIGNALED:
+		s.signaled++
+	case TIMEDOUT:
+		s.timedout++
+	default:
+		s.failed++
+	}
+
+	if r.inv.note == "" {
+		lag := r.start.Sub(r.inv.slot)
+		s.lagn++
+		s.lagsum += lag
+		s.laglast = lag
+		if lag > s.lagmax {
+			s.lagmax = lag
+		}
+	}
+}
+
+// exitCode returns the exit code of a finished command given the error it
+// returned. Commands killed by a signal are given 128 plus the signal's number,
+// as the shell reports them. It returns false if the command never ran.
+func exitCode(err error) (int, bool) {
+	if err == nil {
+		return 0, true
+	}
+	if fe, ok := err.(fakeExit); ok {
+		return int(fe), true
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+			if ws.Signaled() {
+				return 128 + int(ws.Signal()), true
+			}
+			return ws.ExitStatus(), true
+		}
+	}
+	return 0, false
+}
+
+// codes returns the exit codes the job's runs have ended with in order.
+func (s *stats) codes() []int {
+	codes := []int{}
+	for code := range s.exits {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	return codes
+}
+
+// since returns the outcomes of the runs accounted for after the given tally was
+// taken, and updates it to the current one.
+func (s *stats) since(prev *tally) tally {
+	s.Lock()
+	defer s.Unlock()
+
+	now := tally{s.runs, s.succeeded, s.failed, s.signaled, s.timedout, s.skipped}
+	delta := tally{
+		runs:      now.runs - prev.runs,
+		succeeded: now.succeeded - prev.succeeded,
+		failed:    now.failed - prev.failed,
+		signaled:  now.signaled - prev.signaled,
+		timedout:  now.timedout - prev.timedout,
+		skipped:   now.skipped - prev.skipped,
+	}
+	*prev = now
+	return delta
+}
+
+// skip accounts for a run that was skipped.
+func (s *stats) skip() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.skipped++
+}
+
+// shedding accounts for a run that was shed.
+func (s *stats) shedding() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.shed++
+}
+
+// overflow accounts for a run dropped from a full queue.
+func (s *stats) overflow() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.overflows++
+}
+
+// meanLag returns the average dispatch lag of the job's scheduled runs.
+func (s *stats) meanLag() time.Duration {
+	if s.lagn == 0 {
+		return 0
+	}
+	return s.lagsum / time.Duration(s.lagn)
+}
+
+// report renders the statistics one per line as name: value.
+func (s *stats) report() []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "runs: %d\n", s.runs)
+	fmt.Fprintf(&out, "succeeded: %d\n", s.succeeded)
+	fmt.Fprintf(&out, "failed: %d\n", s.failed)
+	fmt.Fprintf(&out, "signaled: %d\n", s.signaled)
+	fmt.Fprintf(&out, "timedout: %d\n", s.timedout)
+	fmt.Fprintf(&out, "skipped: %d\n", s.skipped)
+	fmt.Fprintf(&out, "shed: %d\n", s.shed)
+	fmt.Fprintf(&out, "overflows: %d\n", s.overflows)
+	fmt.Fprintf(&out, "lag.last: %v\n", s.laglast)
+	fmt.Fprintf(&out, "lag.mean: %v\n", s.meanLag())
+	fmt.Fprintf(&out, "lag.max: %v\n", s.lagmax)
+	for _, code := range s.codes() {
+		fmt.Fprintf(&out, "exit.%d: %d\n", code, s.exits[code])
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+)
+
+const (
+	// FSCK the root ctl file command string to check the databases and the
+	// files saved for runs
+	FSCK = "fsck"
+
+	// COMPACT the root ctl file command string to rewrite the databases with
+	// only what's current
+	COMPACT = "compact"
+)
+
+const (
+	// STOREFINDING the kind of event emitted for each problem a check finds
+	STOREFINDING = "store.finding"
+
+	// STORECHECKED the kind of event emitted when a check finishes
+	STORECHECKED = "store.checked"
+
+	// STORECOMPACTED the kind of event emitted when the databases are compacted
+	STORECOMPACTED = "store.compacted"
+)
+
+// storelk serializes appends to the jobs and owners databases with their
+// compaction
+var storelk sync.Mutex
+
+// checked describes the last check of the store
+var checked struct {
+	sync.Mutex
+	last string
+}
+
+// scan calls line with each line of the named database and its number.
+func scan(name string, line func(n int, text string)) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line(n, scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// fsck checks every record of the databases, the jobs' summaries and the
+// checksums of the files saved for runs, returning a line for each problem.
+func fsck() ([]string, error) {
+	findings := []string{}
+	found := func(format string, args ...interface{}) {
+		findings = append(findings, fmt.Sprintf(format, args...))
+	}
+
+	jobs := make(map[string]bool)
+	err := scan(jobsdb, func(n int, text string) {
+		jd, err := decodeJob(text)
+		if err != nil {
+			found("jobs.db:%d: %v", n, err)
+			return
+		}
+		if jobs[jd.name] {
+			found("jobs.db:%d: %s is defined again", n, jd.name)
+		}
+		jobs[jd.name] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, db := range []struct {
+		name, sep string
+	}{{settingsdb, "="}, {slotsdb, ""}, {ownersdb, ""}, {protectdb, ""}} {
+		base := path.Base(db.name)
+		err := scan(db.name, func(n int, text string) {
+			parts := strings.SplitN(text, ":", 2)
+			if len(parts) != 2 || !strings.Contains(parts[1], db.sep) {
+				found("%s:%d: malformed record", base, n)
+				return
+			}
+			if !jobs[parts[0]] {
+				found("%s:%d: no such job: %s", base, n, parts[0])
+			}
+			if db.name == ownersdb && p.OsUsers.Uname2User(parts[1]) == nil {
+				found("%s:%d: no such user: %s", base, n, parts[1])
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	leftovers, _ := filepath.Glob(path.Join(path.Dir(jobsdb), "*.tmp"))
+	for _, name := range leftovers {
+		found("%s: left by an interrupted rewrite", path.Base(name))
+	}
+
+	dirs, err := ioutil.ReadDir(outdir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		name := path.Join(outdir, d.Name(), "summary.json")
+		data, err := readSealed(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		var days []*summary
+		if err == nil {
+			err = json.Unmarshal(data, &days)
+		}
+		if err != nil {
+			found("runs/%s/summary.json: %v", d.Name(), err)
+		}
+	}
+
+	runs, err := stored()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range runs {
+		r := &run{out: s.prefix + ".out"}
+		if _, err := os.Stat(r.sumPath()); os.IsNotExist(err) {
+			continue
+		}
+		for _, line := range strings.Split(string(r.verify()), "\n") {
+			if strings.HasSuffix(line, " ok") || line == "" {
+				continue
+			}
+			found("runs/%s/%s", path.Base(path.Dir(s.prefix)), line)
+		}
+	}
+
+	return findings, nil
+}
+
+// checkStore runs fsck and reports what it finds to the events.
+func checkStore() error {
+	findings, err := fsck()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range findings {
+		glog.Warningf("Store check: %s", f)
+		emit(event{Kind: STOREFINDING, Message: f})
+	}
+	summary := fmt.Sprintf("%s found %d problems", time.Now().Format(time.RFC3339), len(findings))
+	emit(event{Kind: STORECHECKED, Message: fmt.Sprintf("found %d problems", len(findings))})
+
+	checked.Lock()
+	checked.last = summary
+	checked.Unlock()
+
+	return nil
+}
+
+// lastCheck describes the last check of the store.
+func lastCheck() string {
+	checked.Lock()
+	defer checked.Unlock()
+
+	if checked.last == "" {
+		return "never"
+	}
+	return checked.last
+}
+
+// compact rewrites the databases from what jobd holds, leaving out records of
+// jobs it doesn't hold, redefinitions, superseded owners and forgotten slots,
+// and removes files left by interrupted rewrites. It returns the bytes it
+// reclaimed.
+func compact() (int64, error) {
+	dbs := []string{jobsdb, settingsdb, slotsdb, ownersdb}
+	before := sizes(dbs)
+
+	storelk.Lock()
+	defer storelk.Unlock()
+
+	if err := rewriteJobs(); err != nil {
+		return 0, err
+	}
+	if err := jobsroot.saveSettings(); err != nil {
+		return 0, err
+	}
+
+	slots.Lock()
+	err := saveSlots()
+	slots.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	leftovers, _ := filepath.Glob(path.Join(path.Dir(jobsdb), "*.tmp"))
+	for _, name := range leftovers {
+		if err := os.Remove(name); err != nil {
+			return 0, err
+		}
+	}
+
+	reclaimed := before - sizes(dbs)
+	glog.Infof("Compacted the databases, reclaimed %d bytes", reclaimed)
+	emit(event{Kind: STORECOMPACTED, Message: fmt.Sprintf("reclaimed %d bytes", reclaimed)})
+
+	return reclaimed, nil
+}
+
+// saveJobs rewrites the jobs and owners databases from the jobs jobd holds.
+func saveJobs() error {
+	storelk.Lock()
+	defer storelk.Unlock()
+
+	return rewriteJobs()
+}
+
+// rewriteJobs rewrites the jobs and owners databases from the jobs jobd holds.
+// The caller holds storelk. Each job's definition is read under settingslk and
+// its owner under its rlk, one after the other since runs take settingslk while
+// holding rlk.
+func rewriteJobs() error {
+	defs, owners := []string{}, []string{}
+	for _, j := range jobsroot.list() {
+		j.rlk.Lock()
+		owner := j.user.Name()
+		j.rlk.Unlock()
+
+		settingslk.RLock()
+		def, err := encodeJob(&j.defn)
+		name := j.defn.name
+		settingslk.RUnlock()
+		if err != nil {
+			return err
+		}
+		defs = append(defs, def)
+
+		owners = append(owners, fmt.Sprintf("%s:%s", name, owner))
+	}
+	if err := rewrite(jobsdb, defs); err != nil {
+		return err
+	}
+	return rewrite(ownersdb, owners)
+}
+
+// rewrite replaces the named database with the given lines.
+func rewrite(name string, lines []string) error {
+	tmp := name + ".tmp"
+	db, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Fprintln(db, line)
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// sizes returns the total size of the named files.
+func sizes(names []string) int64 {
+	var total int64
+	for _, name := range names {
+		if fi, err := os.Stat(name); err == nil {
+			total += fi.Size()
+		}
+	}
+	return total
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestCompactWhileChanging compacts the store while jobs are started, stopped
+// and rescheduled, for the race detector to check that the jobs' definitions
+// are read under the locks they're changed under.
+func TestCompactWhileChanging(t *testing.T) {
+	_, user := testStore(t)
+	jobs := testJobs(t, "store", 4, false)
+
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j *job) {
+			defer wg.Done()
+			ctl := j.Find("ctl").Ops.(*jobfile)
+			schedule := j.Find("schedule").Ops.(*jobfile)
+			for i := 0; i < 20; i++ {
+				for _, w := range []struct {
+					f    *jobfile
+					data string
+				}{{ctl, START}, {schedule, "0 0 0 1 1 ? *"}, {ctl, STOP}} {
+					if _, err := w.f.Write(testFid(&w.f.File, user), []byte(w.data), 0); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(j)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
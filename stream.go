@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// STREAMKEEPALIVE is how often an idle event stream sends a comment, or a
+	// WebSocket a ping, so that proxies don't close it
+	STREAMKEEPALIVE = 30 * time.Second
+
+	// STREAMWRITETIMEOUT is how long a WebSocket client may take to accept an
+	// event before it's disconnected
+	STREAMWRITETIMEOUT = 10 * time.Second
+)
+
+// upgrader turns requests for the WebSocket event stream into WebSockets, from
+// any origin since the API keys, not cookies, authorize them
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+// eventfilter selects the events a stream sends, or a sink is fed.
+type eventfilter struct {
+	jobs  map[string]bool
+	kinds map[string]bool
+	route route
+}
+
+// parseFilter parses the filter of an event stream request: job and kind,
+// comma separated lists of the jobs and kinds of events wanted, and labels, a
+// comma separated list of label=value pairs, or severity=value, the event's job
+// must have, as in the selector of a notification route. Every event is sent
+// when none are given.
+func parseFilter(q url.Values) (eventfilter, error) {
+	f := newFilter()
+	for _, value := range q["job"] {
+		for _, name := range splitItems(value) {
+			f.jobs[name] = true
+		}
+	}
+	for _, value := range q["kind"] {
+		for _, kind := range splitItems(value) {
+			f.kinds[kind] = true
+		}
+	}
+	for _, value := range q["labels"] {
+		for _, kv := range splitItems(value) {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return eventfilter{}, invalid("labels", "expected label=value: %s", kv)
+			}
+			f.route.selector[parts[0]] = parts[1]
+		}
+	}
+	return f, nil
+}
+
+// newFilter returns a filter matching every event.
+func newFilter() eventfilter {
+	return eventfilter{jobs: make(map[string]bool), kinds: make(map[string]bool), route: route{selector: make(map[string]string)}}
+}
+
+// matches reports whether the stream, or sink, takes the event.
+func (f eventfilter) matches(ev event) bool {
+	if len(f.jobs) > 0 && !f.jobs[ev.Job] {
+		return false
+	}
+	if len(f.kinds) > 0 && !f.kinds[ev.Kind] {
+		return false
+	}
+	return f.route.matches(ev)
+}
+
+// stream sends the events emitted from now on that match the request's filter
+// as Server-Sent Events, each named for its kind with its JSON encoding as
+// data, until the client goes away.
+func stream(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	c := subscribe()
+	defer unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(STREAMKEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev := <-c:
+			if !filter.matches(ev) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Kind, data)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// streamWebSocket sends the events emitted from now on that match the
+// request's filter over a WebSocket, a text message holding each one's JSON
+// encoding, until either end closes it. Messages from the client are ignored.
+func streamWebSocket(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		glog.V(3).Infof("Can't open the event WebSocket of %s [%v]", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	c := subscribe()
+	defer unsubscribe(c)
+
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(STREAMKEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev := <-c:
+			if !filter.matches(ev) {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(STREAMWRITETIMEOUT))
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(STREAMWRITETIMEOUT)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// LISTENFDSSTART is the first file descriptor passed by socket activation
+const LISTENFDSSTART = 3
+
+// sdnotify sends a state change, e.g. READY=1, to systemd when it started jobd
+// as a Type=notify service, and does nothing otherwise.
+func sdnotify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		glog.Errorf("Can't notify systemd of %s [%v]", state, err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		glog.Errorf("Can't notify systemd of %s [%v]", state, err)
+	}
+}
+
+// watchdog pets systemd's watchdog, when it's enabled for jobd, at half its
+// interval for as long as the scheduler keeps ticking. A wedged scheduler lets
+// the watchdog fire and systemd restart jobd.
+func watchdog() {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	for now := range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+		if !alive(now) {
+			glog.Warningln("Scheduler isn't ticking, not petting the watchdog")
+			continue
+		}
+		sdnotify("WATCHDOG=1")
+	}
+}
+
+// listener returns the 9P listener passed to jobd by systemd's socket
+// activation, or by the jobd it replaces, or when there's none, a new one
+// listening on addr. A parent process can't know jobd's pid before starting it,
+// so LISTEN_PID only has to match when it's set. The variables are removed so
+// the jobs' commands don't inherit them.
+func listener(addr string) (net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return net.Listen("tcp", addr)
+	}
+	if n, err := strconv.Atoi(fds); err != nil || n < 1 {
+		return net.Listen("tcp", addr)
+	}
+
+	f := os.NewFile(LISTENFDSSTART, "listener")
+	defer f.Close()
+
+	glog.Infoln("Using the inherited listener")
+	return net.FileListener(f)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+const (
+	// TEST the ctl file command string to smoke test a job's command
+	TEST = "test"
+
+	// TESTTIMEOUT is how long a test run may take
+	TESTTIMEOUT = 30 * time.Second
+
+	// TESTOUTPUT is the most output kept from a test run
+	TESTOUTPUT = 64 * 1024
+
+	// TESTLIMITS are the resource limits of a test run: 10 seconds of CPU, 1GB
+	// of memory, 100MB files and 256 open files
+	TESTLIMITS = "ulimit -t 10; ulimit -v 1048576; ulimit -f 204800; ulimit -n 256"
+)
+
+// testrun is the outcome of the last test of a job's command.
+type testrun struct {
+	sync.Mutex
+	start  time.Time
+	end    time.Time
+	status string
+	err    error
+	out    []byte
+}
+
+// mkTestFile creates the read only file that reports the outcome of the last
+// test of the job's command.
+func mkTestFile(job *job, user p.User) error {
+	tf := &jobfile{
+		// test reader returns the outcome and output of the last test.
+		reader: func() []byte {
+			return job.tested.describe(job)
+		},
+		// test is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := tf.Add(&job.File, "test", user, nil, 0444, tf); err != nil {
+		glog.Errorf("Can't create %s/test [%v]", job.defn.name, err)
+		return err
+	}
+
+	return nil
+}
+
+// test runs the job's command once, with a short timeout, low resource limits
+// and JOBD_DRY_RUN set in its environment, or as a dry run for the built in
+// executors, and keeps the outcome for the test file. Unlike a run it leaves no trace in the job's log, runs, statistics or
+// events.
+func (j *job) test() error {
+	t := &j.tested
+	t.Lock()
+	if t.status == RUNNING {
+		t.Unlock()
+		return fmt.Errorf("test already in progress")
+	}
+	t.start, t.end, t.status, t.err, t.out = time.Now(), time.Time{}, RUNNING, nil, nil
+	t.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), TESTTIMEOUT)
+		defer cancel()
+
+		var out bytes.Buffer
+		var err error
+		switch j.jobExecutor() {
+		case PRUNE:
+			err = j.prune(ctx, j.defn.cmd, &out, true)
+		case SQL:
+			err = j.query(ctx, j.defn.cmd, &out, true)
+		case SYNC:
+			err = j.mirror(ctx, j.defn.cmd, &out, true)
+		case PIPELINE:
+			err = previewSteps(j.defn.cmd, &out)
+		case FANOUT:
+			err = j.previewItems(ctx, &out)
+		default:
+			k := exec.CommandContext(ctx, "/bin/sh", "-c", TESTLIMITS+`; exec "$0" -c "$1"`, j.shell(), j.defn.cmd)
+			k.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+			k.Env = append(os.Environ(),
+				"JOBD_DRY_RUN=1",
+				"SCHEDULED_TIME="+time.Now().Format(time.RFC3339),
+				"IDEMPOTENCY_KEY="+slotKey(j.defn.name+"-test", time.Now()))
+			k.Stdout, k.Stderr = &out, &out
+			err = k.Run()
+		}
+
+		t.Lock()
+		defer t.Unlock()
+
+		t.end, t.err, t.out = time.Now(), err, out.Bytes()
+		if len(t.out) > TESTOUTPUT {
+			t.out = t.out[len(t.out)-TESTOUTPUT:]
+		}
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			t.status = TIMEDOUT
+		case err == nil:
+			t.status = SUCCEEDED
+		case signaled(err):
+			t.status = SIGNALED
+		default:
+			t.status = FAILED
+		}
+	}()
+
+	return nil
+}
+
+// describe renders the test's outcome followed by its combined stdout and
+// stderr, or returns nothing if the job's command hasn't been tested.
+func (t *testrun) describe(j *job) []byte {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.start.IsZero() {
+		return nil
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "status: %s\nstarted: %s\n", t.status, j.stamp(t.start))
+	if !t.end.IsZero() {
+		fmt.Fprintf(&out, "duration: %v\n", t.end.Sub(t.start))
+	}
+	if code, ok := exitCode(t.err); ok && t.status != RUNNING {
+		fmt.Fprintf(&out, "exit: %d\n", code)
+	} else if t.err != nil {
+		fmt.Fprintf(&out, "error: %v\n", t.err)
+	}
+	fmt.Fprintf(&out, "\n%s", t.out)
+	return out.Bytes()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UNIXTIME the time format that renders times as seconds since the epoch
+const UNIXTIME = "unix"
+
+// timefmt is the default format of the timestamps jobd renders
+var timefmt = "rfc3339"
+
+// layouts maps the names of well known time formats to their layouts
+var layouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"rfc1123":     time.RFC1123,
+	"rfc1123z":    time.RFC1123Z,
+	"rfc822":      time.RFC822,
+	"ansic":       time.ANSIC,
+	"unixdate":    time.UnixDate,
+	"kitchen":     time.Kitchen,
+	"stamp":       time.StampMilli,
+}
+
+// validTimefmt checks that a setting's value is the name of a well known time
+// format, unix, or a Go time layout.
+func validTimefmt(value string) error {
+	if _, ok := layouts[strings.ToLower(value)]; ok || strings.ToLower(value) == UNIXTIME {
+		return nil
+	}
+	if time.Unix(0, 0).UTC().Format(value) == value {
+		return fmt.Errorf("not a time format: %s", value)
+	}
+	return nil
+}
+
+// formatTime renders t according to format which may name a well known time
+// format, be unix, or be a Go time layout.
+func formatTime(t time.Time, format string) string {
+	if strings.ToLower(format) == UNIXTIME {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	if layout, ok := layouts[strings.ToLower(format)]; ok {
+		return t.Format(layout)
+	}
+	return t.Format(format)
+}
+
+// stamp renders t in the job's time format or, if it doesn't have one, jobd's.
+func (j *job) stamp(t time.Time) string {
+	format := j.setting("timefmt")
+	if format == "" {
+		format = timefmt
+	}
+	return formatTime(t, format)
+}
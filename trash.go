@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+const (
+	// TRASH the ctl file command string to delete a job, moving it to the trash
+	TRASH = "delete"
+
+	// UNDELETE brings a deleted job back from the trash
+	UNDELETE = "undelete"
+
+	// EMPTY removes every deleted job from the trash at once
+	EMPTY = "empty"
+)
+
+// trashfor is how long deleted jobs are kept in the trash
+var trashfor = 7 * 24 * time.Hour
+
+// trashdb is the path to the database of the deleted jobs
+var trashdb string
+
+// trashdir is the directory holding the files saved for the runs of deleted
+// jobs, a directory per job named for its ID
+var trashdir string
+
+// trashed is a deleted job as kept in the trash, a JSON object per line of the
+// trash database.
+type trashed struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Schedule string            `json:"schedule"`
+	Cmd      string            `json:"cmd"`
+	Settings map[string]string `json:"settings,omitempty"`
+	Owner    string            `json:"owner"`
+	History  []string          `json:"history,omitempty"`
+	Deleted  time.Time         `json:"deleted"`
+	By       string            `json:"by"`
+
+	// moving is done once the job's files are torn down and its saved runs
+	// moved to the trash.
+	moving sync.WaitGroup
+}
+
+// trash holds the deleted jobs, by name, and the directory with a file for
+// each.
+var trash = struct {
+	sync.Mutex
+	dir  *srv.File
+	user p.User
+	jobs map[string]*trashed
+	file map[string]*jobfile
+}{jobs: make(map[string]*trashed), file: make(map[string]*jobfile)}
+
+// mkTrashDir creates the trash directory at the root of the jobd name space and
+// adds to it the jobs deleted under an earlier jobd.
+func mkTrashDir(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkTrashDir(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkTrashDir(%v, %v)", dir, user)
+
+	trash.dir, trash.user = new(srv.File), user
+	if err := trash.dir.Add(dir, "trash", user, nil, p.DMDIR|0555, nil); err != nil {
+		glog.Errorln("Can't create trash directory: ", err)
+		return err
+	}
+
+	trash.Lock()
+	defer trash.Unlock()
+
+	err := scan(trashdb, func(n int, text string) {
+		var t trashed
+		data, err := unsealLine(text)
+		if err == nil {
+			err = json.Unmarshal([]byte(data), &t)
+		}
+		if err != nil {
+			glog.Warningf("Skipping line %d of the trash [%v]", n, err)
+			return
+		}
+		binned(&t)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// binned adds a deleted job to the trash, replacing any deleted earlier under
+// the same name. The caller holds the trash lock.
+func binned(t *trashed) {
+	if tf, ok := trash.file[t.Name]; ok {
+		tf.Remove()
+	}
+	if old, ok := trash.jobs[t.Name]; ok && old.ID != t.ID {
+		old.discard()
+	}
+	tf := &jobfile{
+		// trashed job reader describes the deleted job.
+		reader: func() []byte {
+			return t.describe()
+		},
+		// trashed jobs are read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := tf.Add(trash.dir, t.Name, trash.user, nil, 0444, tf); err != nil {
+		glog.Errorf("Can't create trash/%s [%v]", t.Name, err)
+	}
+	trash.jobs[t.Name], trash.file[t.Name] = t, tf
+}
+
+// unbinned takes a job out of the trash. The caller holds the trash lock.
+func unbinned(name string) {
+	if tf, ok := trash.file[name]; ok {
+		tf.Remove()
+	}
+	delete(trash.jobs, name)
+	delete(trash.file, name)
+}
+
+// saveTrash rewrites the trash database from the jobs in the trash. The caller
+// holds the trash lock.
+func saveTrash() error {
+	names := []string{}
+	for name := range trash.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	for _, name := range names {
+		data, err := json.Marshal(trash.jobs[name])
+		if err != nil {
+			return err
+		}
+		line, err := sealLine(string(data))
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	return rewrite(trashdb, lines)
+}
+
+// trashJob deletes the named job, keeping its definition, settings, owner, log
+// and saved runs in the trash for trashfor.
+func (jd *jobsdir) trashJob(name, by string) error {
+	j, ok := jd.lookup(name)
+	if !ok {
+		return invalid("job", "no such job: %s", name)
+	}
+
+	j.slk.Lock()
+	t, err := jd.bin(j, by)
+	j.slk.Unlock()
+	if err != nil {
+		return err
+	}
+	t.clear(j)
+	return nil
+}
+
+// bin moves the job to the trash, unless it's protected: its definition,
+// settings, owner and log are kept in the trash, it's removed from the jobs
+// directory and stopped, and its runs in progress are interrupted. Its files
+// and saved runs are left for clear. The caller must hold the job's slk.
+func (jd *jobsdir) bin(j *job, by string) (*trashed, error) {
+	if j.protected {
+		return nil, invalid("job", "%s is protected, unprotect it first", j.defn.name)
+	}
+
+	settingslk.RLock()
+	t := &trashed{ID: j.defn.id, Name: j.defn.name, Schedule: j.defn.schedule, Cmd: j.defn.cmd, Owner: j.user.Name(), Deleted: time.Now(), By: by}
+	if len(j.defn.settings) > 0 {
+		t.Settings = make(map[string]string)
+		for name, value := range j.defn.settings {
+			t.Settings[name] = value
+		}
+	}
+	settingslk.RUnlock()
+	t.History = j.entries()
+
+	jd.lk.Lock()
+	delete(jd.jobs, j.defn.name)
+	jd.lk.Unlock()
+	j.halt()
+	glog.Infof("Moved %s to the trash, deleted by %s", j.defn.name, by)
+
+	t.moving.Add(1)
+	trash.Lock()
+	defer trash.Unlock()
+
+	binned(t)
+	return t, saveTrash()
+}
+
+// clear tears down the files of the job moved to the trash and, once its runs
+// in progress have finished, moves its saved runs to the trash.
+func (t *trashed) clear(j *job) {
+	defer t.moving.Done()
+
+	j.Remove()
+	touch()
+	j.settle()
+	if err := t.stash(); err != nil {
+		glog.Errorf("Can't move the saved runs of %s to the trash [%v]", t.Name, err)
+	}
+}
+
+// deleteJob moves the named job to the trash for the given user, and saves the
+// jobs and settings databases without it.
+func deleteJob(name, by string) error {
+	if err := jobsroot.trashJob(name, by); err != nil {
+		return err
+	}
+	return saveDeleted()
+}
+
+// saveDeleted saves the jobs and settings databases once a job was deleted.
+func saveDeleted() error {
+	if err := saveJobs(); err != nil {
+		return err
+	}
+	return jobsroot.saveSettings()
+}
+
+// removeJobDir deletes the job whose directory a 9P remove names, as writing
+// delete to its ctl file does, for those who may write that file.
+func removeJobDir(req *srv.Req, j *job) {
+	ctl := j.Find("ctl")
+	if ctl == nil || !ctl.CheckPerm(req.Fid.User, p.DMWRITE) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+	if err := deleteJob(j.defn.name, req.Fid.User.Name()); err != nil {
+		req.RespondError(err)
+		return
+	}
+	req.RespondRremove()
+}
+
+// undelete brings the named job back from the trash, stopped, with its ID,
+// settings, owner, log and saved runs. It fails, leaving the job in the trash,
+// if the saved runs can't be brought back. The jobs and settings databases are
+// saved.
+func undelete(name, by string) error {
+	trash.Lock()
+	defer trash.Unlock()
+
+	t, ok := trash.jobs[name]
+	if !ok {
+		return invalid("job", "not in the trash: %s", name)
+	}
+	t.moving.Wait()
+	if _, ok := jobsroot.lookup(name); ok {
+		return invalid("job", "already exists: %s", name)
+	}
+
+	jd, err := mkJobDefinition(t.Name, t.Schedule, t.Cmd)
+	if err != nil {
+		return err
+	}
+	if err := t.unstash(); err != nil {
+		return fmt.Errorf("can't bring the saved runs of %s back from the trash: %v", name, err)
+	}
+	jd.id = t.ID
+	for name, value := range t.Settings {
+		jd.settings[name] = value
+	}
+	owner := p.OsUsers.Uname2User(t.Owner)
+	if err := jobsroot.addJob(*jd, owner); err != nil {
+		return err
+	}
+	j, _ := jobsroot.lookup(name)
+	j.restore(t.History)
+	j.record(fmt.Sprintf("undeleted by %s\n", by))
+	glog.Infof("Brought %s back from the trash for %s", name, by)
+
+	unbinned(name)
+	if err := saveTrash(); err != nil {
+		return err
+	}
+	if err := saveJobs(); err != nil {
+		return err
+	}
+	if owner != nil {
+		if err := saveOwner(name, owner); err != nil {
+			return err
+		}
+	}
+	return jobsroot.saveSettings()
+}
+
+// emptyTrash removes the jobs deleted before the given time from the trash.
+func emptyTrash(before time.Time) error {
+	trash.Lock()
+	defer trash.Unlock()
+
+	emptied := false
+	for name, t := range trash.jobs {
+		if t.Deleted.Before(before) {
+			glog.Infof("Emptying %s from the trash, deleted %v", name, t.Deleted)
+			t.moving.Wait()
+			t.discard()
+			unbinned(name)
+			emptied = true
+		}
+	}
+	if !emptied {
+		return nil
+	}
+	return saveTrash()
+}
+
+// saved returns the directory holding the files saved for the deleted job's
+// runs while it's in the trash.
+func (t *trashed) saved() string {
+	return path.Join(trashdir, t.ID)
+}
+
+// stash moves the files saved for the deleted job's runs, their output, records
+// and summaries, to the trash.
+func (t *trashed) stash() error {
+	if err := os.MkdirAll(trashdir, 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(t.saved()); err != nil {
+		return err
+	}
+	err := os.Rename(path.Join(outdir, t.Name), t.saved())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// unstash moves the files saved for the deleted job's runs back from the trash.
+func (t *trashed) unstash() error {
+	err := os.Rename(t.saved(), path.Join(outdir, t.Name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// discard removes the files saved for the deleted job's runs, and the slots it
+// completed, for good.
+func (t *trashed) discard() {
+	if err := os.RemoveAll(t.saved()); err != nil {
+		glog.Errorf("Can't remove the saved runs of %s [%v]", t.Name, err)
+	}
+	if err := forgetSlots(t.Name); err != nil {
+		glog.Errorf("Can't forget the slots of %s [%v]", t.Name, err)
+	}
+}
+
+// describe renders the deleted job's definition, settings and log, along with
+// who deleted it and when.
+func (t *trashed) describe() []byte {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "deleted: %s by %s\n", formatTime(t.Deleted, timefmt), t.By)
+	fmt.Fprintf(&out, "expires: %s\n", formatTime(t.Deleted.Add(trashfor), timefmt))
+	fmt.Fprintf(&out, "id: %s\n", t.ID)
+	fmt.Fprintf(&out, "owner: %s\n", t.Owner)
+	fmt.Fprintf(&out, "schedule: %s\n", t.Schedule)
+	fmt.Fprintf(&out, "cmd: %s\n", t.Cmd)
+	for _, setting := range render(t.Settings) {
+		fmt.Fprintf(&out, "setting: %s\n", setting)
+	}
+	out.WriteString("log:\n")
+	for _, entry := range t.History {
+		out.WriteString(entry)
+	}
+	return out.Bytes()
+}
+
+// entries returns the entries of the job's log, oldest first.
+func (j *job) entries() []string {
+	j.hlk.Lock()
+	defer j.hlk.Unlock()
+
+	entries := []string{}
+	j.history.Do(func(v interface{}) {
+		if v != nil {
+			entries = append(entries, v.(string))
+		}
+	})
+	return entries
+}
+
+// restore puts back the entries of the job's log, oldest first.
+func (j *job) restore(entries []string) {
+	j.hlk.Lock()
+	defer j.hlk.Unlock()
+
+	for _, entry := range entries {
+		j.history.Value = entry
+		j.history = j.history.Next()
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// TestTrashUndelete checks that a deleted job is kept in the trash and comes
+// back from it, stopped, with its ID, settings and log once undeleted.
+func TestTrashUndelete(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "kept:0 0 0 1 1 ? *:true")
+	h.write("/jobs/kept/settings", "retries=2\n")
+	h.write("/jobs/kept/ctl", START)
+	j, _ := jobsroot.lookup("kept")
+	id, log := j.defn.id, h.read("/jobs/kept/log")
+
+	if err := jobsroot.trashJob("kept", "tester"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := jobsroot.lookup("kept"); ok {
+		t.Fatal("the deleted job is still there")
+	}
+	if trashed := h.read("/trash/kept"); !strings.Contains(trashed, "tester") || !strings.Contains(trashed, id) {
+		t.Errorf("the trash doesn't say who deleted the job and its ID:\n%s", trashed)
+	}
+
+	h.write("/ctl", UNDELETE+" kept")
+	j, ok := jobsroot.lookup("kept")
+	switch {
+	case !ok:
+		t.Fatal("the job isn't back once undeleted")
+	case j.defn.id != id:
+		t.Errorf("got ID %s once undeleted, want %s", j.defn.id, id)
+	case j.defn.state != STOPPED:
+		t.Errorf("got state %s once undeleted, want %s", j.defn.state, STOPPED)
+	case !strings.Contains(h.read("/jobs/kept/settings"), "retries=2"):
+		t.Errorf("the job's settings weren't kept:\n%s", h.read("/jobs/kept/settings"))
+	case !strings.HasPrefix(h.read("/jobs/kept/log"), log):
+		t.Errorf("got log %q once undeleted, want it to start with %q", h.read("/jobs/kept/log"), log)
+	}
+	if _, err := h.c.FOpen("/trash/kept", 0); err == nil {
+		t.Error("the undeleted job is still in the trash")
+	}
+}
+
+// TestDelete checks that removing a job's directory moves the job to the trash
+// and out of the jobs database, and that protected jobs can't be deleted.
+func TestDelete(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "doomed:0 0 0 1 1 ? *:true")
+	h.write("/clone", "kept:0 0 0 1 1 ? *:true")
+	h.write("/ctl", PROTECT+" kept")
+
+	if err := h.try("/jobs/kept/ctl", TRASH); err == nil {
+		t.Error("a protected job was deleted through its ctl file")
+	}
+	if err := h.c.FRemove("/jobs/kept"); err == nil {
+		t.Error("a protected job's directory was removed")
+	}
+	if err := h.c.FRemove("/jobs/doomed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := jobsroot.lookup("doomed"); ok {
+		t.Error("the job is still there once its directory was removed")
+	}
+	if h.read("/trash/doomed") == "" {
+		t.Error("the job isn't in the trash")
+	}
+	if db, err := ioutil.ReadFile(jobsdb); err != nil || strings.Contains(string(db), "doomed") || !strings.Contains(string(db), "kept") {
+		t.Errorf("got jobs database %q (%v), want only kept in it", db, err)
+	}
+}
+
+// TestDeleteThroughCtl checks that once delete written to a job's ctl file
+// returns, the job is in the trash and out of the jobs database, and that its
+// files are then torn down and its saved runs moved to the trash.
+func TestDeleteThroughCtl(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "doomed:0 0 0 1 1 ? *:true")
+	h.write("/clone", "kept:0 0 0 1 1 ? *:true")
+	h.write("/jobs/doomed/ctl", RUN)
+	h.eventually("the run to be recorded", func() bool { return h.read("/jobs/doomed/records") != "" })
+
+	h.write("/jobs/doomed/ctl", TRASH)
+	if _, ok := jobsroot.lookup("doomed"); ok {
+		t.Error("the job is still there once deleted")
+	}
+	if db, err := ioutil.ReadFile(jobsdb); err != nil || strings.Contains(string(db), "doomed") || !strings.Contains(string(db), "kept") {
+		t.Errorf("got jobs database %q (%v), want only kept in it", db, err)
+	}
+	trash.Lock()
+	trashed, ok := trash.jobs["doomed"]
+	trash.Unlock()
+	if !ok {
+		t.Fatal("the job isn't in the trash")
+	}
+
+	trashed.moving.Wait()
+	if _, err := h.c.FOpen("/jobs/doomed", 0); err == nil {
+		t.Error("the job's files are still there")
+	}
+	if _, err := os.Stat(path.Join(trashdir, trashed.ID, "records.jsonl")); err != nil {
+		t.Errorf("the job's saved runs aren't in the trash: %v", err)
+	}
+}
+
+// TestTrashKeepsSavedRuns checks that the runs saved for a deleted job go to the
+// trash with it, come back when it's undeleted and are removed once the trash
+// is emptied.
+func TestTrashKeepsSavedRuns(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "kept:0 0 0 1 1 ? *:true")
+	j, _ := jobsroot.lookup("kept")
+	saved, stashed := path.Join(outdir, "kept"), path.Join(trashdir, j.defn.id)
+
+	h.write("/jobs/kept/ctl", RUN)
+	h.eventually("the run to be recorded", func() bool { return h.read("/jobs/kept/records") != "" })
+	records := h.read("/jobs/kept/records")
+
+	if err := h.confirm(TRASH + " kept"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(saved); !os.IsNotExist(err) {
+		t.Errorf("the deleted job's runs are still in %s", saved)
+	}
+	if _, err := os.Stat(stashed); err != nil {
+		t.Errorf("the deleted job's runs aren't in the trash: %v", err)
+	}
+
+	h.write("/ctl", UNDELETE+" kept")
+	if got := h.read("/jobs/kept/records"); got != records {
+		t.Errorf("got records %q once undeleted, want %q", got, records)
+	}
+
+	if err := h.confirm(TRASH + " kept"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.confirm(EMPTY); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{saved, stashed} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s is still there once the trash was emptied", dir)
+		}
+	}
+}
+
+// TestTrashWaitsForRuns checks that deleting a job with a run in progress moves
+// its saved runs to the trash once the run, interrupted, has finished.
+func TestTrashWaitsForRuns(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "busy:0 0 0 1 1 ? *:true")
+	h.write("/jobs/busy/settings", "fake=duration=1h\n")
+	j, _ := jobsroot.lookup("busy")
+	saved, stashed := path.Join(outdir, "busy"), path.Join(trashdir, j.defn.id)
+
+	h.write("/jobs/busy/ctl", RUN)
+	h.eventually("the run to wait for the clock", func() bool { return h.clock.waiters() == 1 })
+	if err := h.confirm(TRASH + " busy"); err != nil {
+		t.Fatal(err)
+	}
+	if j.running() > 0 {
+		t.Error("the job was deleted while its run was in progress")
+	}
+	if _, err := os.Stat(saved); !os.IsNotExist(err) {
+		t.Errorf("the deleted job's runs are still in %s", saved)
+	}
+	if _, err := os.Stat(path.Join(stashed, "records.jsonl")); err != nil {
+		t.Errorf("the interrupted run's record isn't in the trash: %v", err)
+	}
+}
+
+// TestUndeleteFails checks that a job whose saved runs can't be brought back
+// stays in the trash.
+func TestUndeleteFails(t *testing.T) {
+	h := mkharness(t)
+	h.write("/clone", "kept:0 0 0 1 1 ? *:true")
+	h.write("/jobs/kept/ctl", RUN)
+	h.eventually("the run to be recorded", func() bool { return h.read("/jobs/kept/records") != "" })
+	if err := h.confirm(TRASH + " kept"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(path.Join(outdir, "kept", "1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.try("/ctl", UNDELETE+" kept"); err == nil {
+		t.Fatal("the job was undeleted without its saved runs")
+	}
+	if _, ok := jobsroot.lookup("kept"); ok {
+		t.Error("the job is back without its saved runs")
+	}
+	if h.read("/trash/kept") == "" {
+		t.Error("the job isn't in the trash anymore")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// OVERLAPWAIT scheduled runs wait for the previous one to finish
+	OVERLAPWAIT = "wait"
+
+	// OVERLAPSKIP scheduled runs are skipped while any run of the job is in progress
+	OVERLAPSKIP = "skip"
+
+	// OVERLAPALLOW scheduled runs start on time regardless of runs in progress
+	OVERLAPALLOW = "allow"
+)
+
+// severities are the severities a job may be given
+var severities = []string{"info", "warning", "critical"}
+
+// priorities maps a job's priority to the nice value its commands run with
+var priorities = map[string]int{
+	"low":    10,
+	"normal": 0,
+	"high":   -5,
+}
+
+// validDuration checks that a setting's value is a positive duration.
+func validDuration(value string) error {
+	if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+		return fmt.Errorf("not a positive duration: %s", value)
+	}
+	return nil
+}
+
+// validRetries checks that a setting's value is a non-negative integer.
+func validRetries(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n < 0 {
+		return fmt.Errorf("not a non-negative integer: %s", value)
+	}
+	return nil
+}
+
+// validOverlap checks that a setting's value is an overlap policy.
+func validOverlap(value string) error {
+	switch value {
+	case OVERLAPWAIT, OVERLAPSKIP, OVERLAPALLOW:
+		return nil
+	}
+	return fmt.Errorf("not one of %s, %s or %s: %s", OVERLAPWAIT, OVERLAPSKIP, OVERLAPALLOW, value)
+}
+
+// validPriority checks that a setting's value is a priority.
+func validPriority(value string) error {
+	if _, ok := priorities[value]; !ok {
+		return fmt.Errorf("not one of low, normal or high: %s", value)
+	}
+	return nil
+}
+
+// validTZ checks that a setting's value names a time zone.
+func validTZ(value string) error {
+	if _, err := time.LoadLocation(value); err != nil {
+		return fmt.Errorf("unknown time zone: %s", value)
+	}
+	return nil
+}
+
+// validLabels checks that a setting's value is a comma separated list of
+// label=value pairs.
+func validLabels(value string) error {
+	for _, kv := range strings.Split(value, ",") {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("not a label=value pair: %s", kv)
+		}
+	}
+	return nil
+}
+
+// validSeverity checks that a setting's value is a severity.
+func validSeverity(value string) error {
+	for _, s := range severities {
+		if value == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("not one of %s: %s", strings.Join(severities, ", "), value)
+}
+
+// labels returns the job's labels.
+func (j *job) labels() map[string]string {
+	labels := make(map[string]string)
+	if value := j.setting("labels"); value != "" {
+		for _, kv := range strings.Split(value, ",") {
+			if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+				labels[parts[0]] = parts[1]
+			}
+		}
+	}
+	return labels
+}
+
+// severity returns the severity of the job's failures.
+func (j *job) severity() string {
+	if s := j.setting("severity"); s != "" {
+		return s
+	}
+	return "warning"
+}
+
+// duration returns the value of a job's named duration setting or zero if it
+// isn't set.
+func (j *job) duration(name string) time.Duration {
+	d, err := time.ParseDuration(j.setting(name))
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// overlap returns the job's overlap policy.
+func (j *job) overlap() string {
+	if policy := j.setting("overlap"); policy != "" {
+		return policy
+	}
+	return OVERLAPWAIT
+}
+
+// splay returns a random delay, up to the job's splay, to add to the start of a
+// scheduled run so that jobs sharing a schedule don't all start at once.
+func (j *job) splay() time.Duration {
+	if d := j.duration("splay"); d > 0 {
+		return time.Duration(rand.Int63n(int64(d)))
+	}
+	return 0
+}
+
+// next returns the time of the job's next scheduled slot after t, evaluating
+// its schedule in the job's time zone if it has one.
+func (j *job) next(t time.Time) (time.Time, error) {
+	if tz := j.setting("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return time.Time{}, err
+		}
+		t = t.In(loc)
+	}
+
+	settingslk.RLock()
+	defer settingslk.RUnlock()
+	return j.defn.next(t)
+}
+
+// prioritize sets the nice value of the process group of a run's command
+// according to the job's priority.
+func (j *job) prioritize(pgrp int) {
+	nice, ok := priorities[j.setting("priority")]
+	if !ok || nice == 0 {
+		return
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PGRP, pgrp, nice); err != nil {
+		glog.Errorf("Can't set %s priority to %d [%v]", j.defn.name, nice, err)
+	}
+}
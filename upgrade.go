@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// STARTEDENV names the environment variable in which jobd hands the jobs
+	// that were started to the jobd replacing it
+	STARTEDENV = "JOBD_STARTED"
+
+	// HANDOFFENV names the environment variable in which jobd hands the time
+	// its schedulers stopped to the jobd replacing it
+	HANDOFFENV = "JOBD_HANDOFF"
+)
+
+// upgrading is set once jobd has handed its listener to its replacement
+var upgrading int32
+
+// upgradeOnSignal arranges for jobd to hand its listener and jobs to a new jobd,
+// started from its own executable, when it receives SIGUSR2.
+func upgradeOnSignal(l net.Listener) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+
+	go func() {
+		for range sigs {
+			glog.Infoln("Received SIGUSR2, upgrading")
+			if err := upgrade(l); err != nil {
+				glog.Errorf("can't upgrade (%v)", err)
+			}
+		}
+	}()
+}
+
+// upgrade stops the schedulers of the started jobs and starts a new jobd that
+// inherits the listener and takes over those jobs. The old jobd then stops
+// accepting connections, waits for its runs in progress to finish and exits.
+// Its 9P sessions are served until then but can't move to the new jobd.
+func upgrade(l net.Listener) error {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return invalid("listener", "can't be handed over")
+	}
+	f, err := tl.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	started := []*job{}
+	for _, j := range jobsroot.list() {
+		if j.defn.state == STARTED {
+			started = append(started, j)
+		}
+	}
+
+	var wg sync.WaitGroup
+	names := []string{}
+	for _, j := range started {
+		names = append(names, j.defn.name)
+		wg.Add(1)
+		go func(j *job) {
+			defer wg.Done()
+			j.slk.Lock()
+			j.stop()
+			j.slk.Unlock()
+		}(j)
+	}
+	handoff := time.Now()
+	unmountFUSE()
+
+	env := append(os.Environ(), "LISTEN_FDS=1", STARTEDENV+"="+strings.Join(names, ","), HANDOFFENV+"="+strconv.FormatInt(handoff.UnixNano(), 10))
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr, f}
+	if instance != nil {
+		env = append(env, LOCKENV+"="+strconv.Itoa(LOCKFD))
+		files = append(files, instance)
+	}
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+	if err != nil {
+		wg.Wait()
+		for _, j := range started {
+			j.slk.Lock()
+			j.start()
+			j.slk.Unlock()
+		}
+		return err
+	}
+	glog.Infof("Handed the listener and %d started jobs to jobd %d", len(started), p.Pid)
+
+	atomic.StoreInt32(&upgrading, 1)
+	l.Close()
+
+	wg.Wait()
+	for _, j := range jobsroot.list() {
+		for j.running() > 0 {
+			time.Sleep(time.Second)
+		}
+	}
+
+	glog.Infoln("Runs finished, exiting")
+	glog.Flush()
+	os.Exit(0)
+	return nil
+}
+
+// takeOver starts the jobs handed over by the jobd this one replaces, and runs
+// the slots that fell between that jobd stopping its schedulers and now.
+func takeOver() {
+	names, handoff := os.Getenv(STARTEDENV), os.Getenv(HANDOFFENV)
+	os.Unsetenv(STARTEDENV)
+	os.Unsetenv(HANDOFFENV)
+	if names == "" {
+		return
+	}
+
+	since := time.Now()
+	if ns, err := strconv.ParseInt(handoff, 10, 64); err == nil {
+		since = time.Unix(0, ns)
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		j, ok := jobsroot.lookup(name)
+		if !ok {
+			glog.Errorf("Can't take over %s, no such job", name)
+			continue
+		}
+
+		now := time.Now()
+		j.slk.Lock()
+		j.start()
+		j.slk.Unlock()
+
+		slots, err := j.backfillSlots(since, now)
+		if err != nil || len(slots) == 0 {
+			continue
+		}
+		j.slk.Lock()
+		j.backfilling = true
+		j.slk.Unlock()
+		go j.backfill(slots)
+	}
+}
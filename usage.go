@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// usagelog is the path to the log of the runs charged to each job owner
+var usagelog string
+
+// periods are the windows, shortest first, over which usage is summed
+var periods = []struct {
+	name string
+	span time.Duration
+}{
+	{"hour", time.Hour},
+	{"day", 24 * time.Hour},
+	{"week", 7 * 24 * time.Hour},
+	{"month", 30 * 24 * time.Hour},
+}
+
+// charge is a run charged to the owner of its job, a JSON object per line of
+// the usage log.
+type charge struct {
+	Time  time.Time     `json:"time"`
+	Owner string        `json:"owner"`
+	Job   string        `json:"job"`
+	CPU   time.Duration `json:"cpu"`
+}
+
+// consumption sums the runs charged to an owner and the CPU time they took.
+type consumption struct {
+	runs int
+	cpu  time.Duration
+}
+
+// add charges a run to the consumption.
+func (c *consumption) add(ch charge) {
+	c.runs++
+	c.cpu += ch.CPU
+}
+
+// usage holds the runs charged within the longest period, oldest first, and
+// each owner's consumption since the usage log was started.
+var usage = struct {
+	sync.Mutex
+	dir     *srv.File
+	user    p.User
+	recent  []charge
+	totals  map[string]*consumption
+	tracked map[string]bool
+}{totals: make(map[string]*consumption), tracked: make(map[string]bool)}
+
+// mkUsageDir creates the usage directory at the root of the jobd name space, a
+// file in it for each owner charged in the usage log.
+func mkUsageDir(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkUsageDir(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkUsageDir(%v, %v)", dir, user)
+
+	usage.dir, usage.user = new(srv.File), user
+	if err := usage.dir.Add(dir, "usage", user, nil, p.DMDIR|0555, nil); err != nil {
+		glog.Errorln("Can't create usage directory: ", err)
+		return err
+	}
+
+	usage.Lock()
+	defer usage.Unlock()
+
+	since := time.Now().Add(-periods[len(periods)-1].span)
+	err := scan(usagelog, func(n int, text string) {
+		var ch charge
+		data, err := unsealLine(text)
+		if err == nil {
+			err = json.Unmarshal([]byte(data), &ch)
+		}
+		if err != nil {
+			glog.Warningf("Skipping line %d of the usage log [%v]", n, err)
+			return
+		}
+		if ch.Time.After(since) {
+			usage.recent = append(usage.recent, ch)
+		}
+		account(ch)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// charged records that one of the job's runs finished having used the given
+// CPU time.
+func (j *job) charged(r *run, cpu time.Duration) {
+	r.Lock()
+	ch := charge{Time: r.end, Owner: j.user.Name(), Job: j.defn.name, CPU: cpu}
+	r.Unlock()
+
+	usage.Lock()
+	defer usage.Unlock()
+
+	since := ch.Time.Add(-periods[len(periods)-1].span)
+	for len(usage.recent) > 0 && !usage.recent[0].Time.After(since) {
+		usage.recent = usage.recent[1:]
+	}
+	usage.recent = append(usage.recent, ch)
+	account(ch)
+
+	data, err := json.Marshal(ch)
+	if err != nil {
+		glog.Errorf("Can't charge %v [%v]", ch, err)
+		return
+	}
+	line, err := sealLine(string(data))
+	if err != nil {
+		glog.Errorf("Can't charge %v [%v]", ch, err)
+		return
+	}
+	f, err := os.OpenFile(usagelog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		glog.Errorf("Can't open usage log [%v]", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		glog.Errorf("Can't write usage log [%v]", err)
+	}
+}
+
+// account adds a charge to its owner's consumption, adding a file for the
+// owner to the usage directory the first time it's charged. The caller holds
+// the usage lock.
+func account(ch charge) {
+	c, ok := usage.totals[ch.Owner]
+	if !ok {
+		c = new(consumption)
+		usage.totals[ch.Owner] = c
+	}
+	c.add(ch)
+
+	if usage.tracked[ch.Owner] {
+		return
+	}
+	owner := ch.Owner
+	uf := &jobfile{
+		// usage reader returns the owner's consumption over each period.
+		reader: func() []byte {
+			return ownerUsage(owner, time.Now())
+		},
+		// usage is read only.
+		writer: func(data []byte) (int, error) {
+			return 0, srv.Eperm
+		}}
+	if err := uf.Add(usage.dir, owner, usage.user, nil, 0444, uf); err != nil {
+		glog.Errorf("Can't create usage/%s [%v]", owner, err)
+		return
+	}
+	usage.tracked[owner] = true
+}
+
+// ownerUsage renders the runs charged to the owner, and the CPU time they took,
+// over each period and in total, followed by a line per job for the longest
+// period.
+func ownerUsage(owner string, now time.Time) []byte {
+	usage.Lock()
+	defer usage.Unlock()
+
+	sums := make([]consumption, len(periods))
+	jobs := make(map[string]*consumption)
+	for _, ch := range usage.recent {
+		if ch.Owner != owner {
+			continue
+		}
+		for i, period := range periods {
+			if ch.Time.After(now.Add(-period.span)) {
+				sums[i].add(ch)
+			}
+		}
+		if jobs[ch.Job] == nil {
+			jobs[ch.Job] = new(consumption)
+		}
+		jobs[ch.Job].add(ch)
+	}
+
+	var out bytes.Buffer
+	for i, period := range periods {
+		fmt.Fprintf(&out, "%s: %d runs %.3fs cpu\n", period.name, sums[i].runs, sums[i].cpu.Seconds())
+	}
+	if c := usage.totals[owner]; c != nil {
+		fmt.Fprintf(&out, "total: %d runs %.3fs cpu\n", c.runs, c.cpu.Seconds())
+	}
+	names := []string{}
+	for name := range jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&out, "job: %s %d runs %.3fs cpu\n", name, jobs[name].runs, jobs[name].cpu.Seconds())
+	}
+	return out.Bytes()
+}
+
+// consumers returns the owners charged for runs, ordered by name, with their
+// consumption since the usage log was started.
+func consumers() ([]string, map[string]consumption) {
+	usage.Lock()
+	defer usage.Unlock()
+
+	names := []string{}
+	totals := make(map[string]consumption)
+	for name, c := range usage.totals {
+		names = append(names, name)
+		totals[name] = *c
+	}
+	sort.Strings(names)
+	return names, totals
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	p "github.com/vergult/go9p"
+	"github.com/vergult/go9p/srv"
+)
+
+// mininterval is the shortest time allowed between two runs of a job's
+// schedule
+var mininterval = 10 * time.Second
+
+// allowfast are the jobs exempt from mininterval
+var allowfast = namesFlag{}
+
+// warnfires is the number of runs per hour above which a schedule draws a
+// warning
+var warnfires = 60
+
+// maxcoincident is the most other jobs a schedule may fire together with,
+// unlimited if zero
+var maxcoincident = 0
+
+// validatefile is the file at the root of the jobd name space that checks job
+// definitions without creating jobs.
+type validatefile struct {
+	srv.File
+	results map[string][]byte
+}
+
+// mkValidateFile creates the validate file.
+func mkValidateFile(dir *srv.File, user p.User) error {
+	glog.V(4).Infof("Entering mkValidateFile(%v, %v)", dir, user)
+	defer glog.V(4).Infof("Exiting mkValidateFile(%v, %v)", dir, user)
+
+	v := &validatefile{results: make(map[string][]byte)}
+	if err := v.Add(dir, "validate", user, nil, 0666, v); err != nil {
+		glog.Errorln("Can't create validate file: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// Write checks the job definition written to it as the clone file would, and
+// keeps the outcome for the writing user to read back.
+func (v *validatefile) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	glog.V(4).Infof("Entering validatefile.Write(%v, %v, %v)", fid, data, offset)
+	defer glog.V(4).Infof("Exiting validatefile.Write(%v, %v, %v)", fid, data, offset)
+
+	v.Lock()
+	defer v.Unlock()
+
+	var out bytes.Buffer
+	jd, warnings, err := validate(string(data))
+	for _, w := range warnings {
+		fmt.Fprintf(&out, "warning: %s\n", w)
+	}
+	if err != nil {
+		fmt.Fprintf(&out, "error: %v\n", err)
+	} else {
+		fmt.Fprintf(&out, "ok: %s\n", jd.name)
+	}
+	v.results[fid.Fid.User.Name()] = out.Bytes()
+
+	return len(data), nil
+}
+
+// Read returns the outcome of the reading user's last validation.
+func (v *validatefile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	cont := v.results[fid.Fid.User.Name()]
+	if offset > uint64(len(cont)) {
+		return 0, nil
+	}
+	return copy(buf, cont[offset:]), nil
+}
+
+// validate parses a job definition, <name>:<schedule>:<cmd>[:<timeout>], and
+// checks it against the rules every job must follow and the schedule
+// guardrails. It returns the definition, with the timeout as the job's timeout
+// setting, along with warnings about things that are allowed but probably
+// mistakes, including those found by linting the command.
+func validate(data string) (*jobdef, []string, error) {
+	name, schedule, cmd, timeout, err := parseDefinition(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jd, warnings, err := validateDef(name, schedule, cmd)
+	if err != nil || timeout == "" {
+		return jd, warnings, err
+	}
+	if err := validDuration(timeout); err != nil {
+		return nil, warnings, &fieldError{field: "timeout", err: err}
+	}
+	jd.settings["timeout"] = timeout
+	return jd, warnings, nil
+}
+
+// parseDefinition splits a job definition, <name>:<schedule>:<cmd>[:<timeout>],
+// into its parts, the timeout empty if it isn't given. It has no side effects,
+// whatever is written to the clone file goes through it before a job is
+// created. Commands holding a NUL byte, which can't be passed to the shell,
+// are refused.
+func parseDefinition(data string) (string, string, string, string, error) {
+	parts := strings.Split(data, ":")
+	if len(parts) != 3 && len(parts) != 4 {
+		return "", "", "", "", invalid("definition", "expected <name>:<schedule>:<cmd>[:<timeout>]: %s", data)
+	}
+	if strings.IndexByte(parts[2], 0) >= 0 {
+		return "", "", "", "", invalid("cmd", "contains a NUL byte")
+	}
+	if len(parts) == 4 {
+		return parts[0], parts[1], parts[2], strings.TrimSpace(parts[3]), nil
+	}
+
+	return parts[0], parts[1], parts[2], "", nil
+}
+
+// validateDef checks a job definition given by its parts as validate does.
+func validateDef(name, schedule, cmd string) (*jobdef, []string, error) {
+	if foldnames {
+		name = strings.ToLower(name)
+	}
+
+	jd, err := mkJobDefinition(name, schedule, cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	warnings, err := checkSchedule(*jd)
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	return jd, append(warnings, lint(*jd)...), nil
+}
+
+// checkSchedule looks at when the job's schedule fires over the next hour. It
+// fails when two runs are closer than mininterval, unless the job is exempt,
+// or when they coincide with the runs of more than maxcoincident other jobs.
+// It warns when there are more than warnfires runs.
+func checkSchedule(jd jobdef) ([]string, error) {
+	now := time.Now().Truncate(time.Second)
+	end := now.Add(time.Hour)
+
+	fires := []time.Time{}
+	for t := now; ; {
+		next, err := jd.next(t)
+		if err != nil {
+			return nil, invalid("schedule", "%v", err)
+		}
+		if next.IsZero() || next.After(end) {
+			break
+		}
+		if n := len(fires); n > 0 && next.Sub(fires[n-1]) < mininterval && !allowfast[jd.name] {
+			return nil, invalid("schedule", "fires %v apart, more often than the minimum interval of %v", next.Sub(fires[n-1]), mininterval)
+		}
+		fires = append(fires, next)
+		t = next
+	}
+
+	warnings := []string{}
+	if len(fires) > warnfires {
+		warnings = append(warnings, fmt.Sprintf("schedule fires %d times per hour", len(fires)))
+	}
+
+	if maxcoincident > 0 && len(fires) > 0 {
+		if n, at := coincident(jd.name, fires); n > maxcoincident {
+			return warnings, invalid("schedule", "fires at %s with %d other jobs, more than %d", at.Format(time.RFC3339), n, maxcoincident)
+		}
+	}
+
+	return warnings, nil
+}
+
+// coincident returns the most other jobs firing at one of the given times, and
+// that time.
+func coincident(name string, fires []time.Time) (int, time.Time) {
+	counts := make(map[time.Time]int, len(fires))
+	for _, t := range fires {
+		counts[t] = 0
+	}
+	end := fires[len(fires)-1]
+
+	for _, j := range jobsroot.list() {
+		if j.defn.name == name {
+			continue
+		}
+		for t := fires[0].Add(-time.Nanosecond); ; {
+			next, err := j.next(t)
+			if err != nil || next.IsZero() || next.After(end) {
+				break
+			}
+			if _, ok := counts[next]; ok {
+				counts[next]++
+			}
+			t = next
+		}
+	}
+
+	most, at := 0, time.Time{}
+	for _, t := range fires {
+		if counts[t] > most {
+			most, at = counts[t], t
+		}
+	}
+	return most, at
+}
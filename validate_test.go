@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// FuzzParseDefinition checks that whatever is written to the clone file splits
+// back into the definition it came from, never lets a NUL byte into a command
+// and doesn't upset the checks a job definition goes through next.
+func FuzzParseDefinition(f *testing.F) {
+	for _, seed := range []string{
+		"hello:0 0/5 * * * ? *:echo hello world",
+		"backup:0 0 2 * * ? *:tar czf /backup.tgz /srv:2h",
+		"fast:0/1 * * * * ? *|0 0 * * * ? *:date",
+		"bad",
+		"a:b:c:d:e",
+		"nul:0 0 * * * ? *:echo \x00",
+		":::",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data string) {
+		name, schedule, cmd, timeout, err := parseDefinition(data)
+		if err != nil {
+			return
+		}
+		if strings.IndexByte(cmd, 0) >= 0 {
+			t.Fatalf("command of %q holds a NUL byte", data)
+		}
+		joined := strings.Join([]string{name, schedule, cmd}, ":")
+		if data != joined && (!strings.HasPrefix(data, joined+":") || strings.TrimSpace(data[len(joined)+1:]) != timeout) {
+			t.Fatalf("%q parsed as %q, %q, %q with timeout %q", data, name, schedule, cmd, timeout)
+		}
+		mkJobDefinition(name, schedule, cmd)
+	})
+}